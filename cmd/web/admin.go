@@ -0,0 +1,435 @@
+package web
+
+import (
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// adminPageSize is how many users the admin user list shows at a time.
+const adminPageSize = 25
+
+// userListSorts are the orders users can be listed in; without one, they are listed by relevance when searching,
+// and by name otherwise.
+var userListSorts = []string{data.UserSortRelevance, data.UserSortName, data.UserSortEmail, data.UserSortCreated}
+
+// userListQuery is the search, filters, sort order and page of the admin user list, or of the users listed by the
+// API, as given in its query string.
+type userListQuery struct {
+	Search string
+	// Avatar and Admin are true or false to list only users with or without a profile picture, or administrator
+	// rights, and empty to list either.
+	Avatar string
+	Admin  string
+	// From and To are the dates users were created between, both included, as yyyy-mm-dd; the API also takes
+	// times in RFC 3339 format.
+	From string
+	To   string
+	Sort string
+	Desc bool
+	// After is the cursor of the page to list, or empty for the first.
+	After string
+}
+
+func parseUserListQuery(values url.Values) userListQuery {
+	q := userListQuery{
+		Search: strings.TrimSpace(values.Get("q")),
+		Avatar: values.Get("avatar"),
+		Admin:  values.Get("admin"),
+		From:   values.Get("from"),
+		To:     values.Get("to"),
+		Sort:   values.Get("sort"),
+		Desc:   values.Get("dir") == "desc",
+		After:  values.Get("after"),
+	}
+
+	if !slices.Contains(userListSorts, q.Sort) {
+		q.Sort = ""
+	}
+
+	return q
+}
+
+// search turns the query into a search for a page of at most limit users. Filters that cannot be understood are
+// added to the form's errors.
+func (q userListQuery) search(form *Form, limit int) data.UserSearch {
+	search := data.UserSearch{
+		Query:      q.Search,
+		HasAvatar:  parseFilterBool(form, "avatar", q.Avatar),
+		IsAdmin:    parseFilterBool(form, "admin", q.Admin),
+		Sort:       q.Sort,
+		Descending: q.Desc,
+		Cursor:     q.After,
+		Limit:      limit,
+	}
+
+	search.CreatedFrom = parseFilterTime(form, "from", q.From, false)
+	search.CreatedTo = parseFilterTime(form, "to", q.To, true)
+
+	return search
+}
+
+// parseFilterBool reads a filter that is true, false, or empty to not filter at all.
+func parseFilterBool(form *Form, field, value string) *bool {
+	if value == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(value)
+
+	if err != nil {
+		form.Errors.Add(field, "Must be true or false")
+		return nil
+	}
+
+	return &b
+}
+
+// parseFilterTime reads a filter that is a date, a time in RFC 3339 format, or empty to not filter at all. Dates
+// that end a range include the whole day.
+func parseFilterTime(form *Form, field, value string, end bool) time.Time {
+	if value == "" {
+		return time.Time{}
+	}
+
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		if end {
+			return t.AddDate(0, 0, 1)
+		}
+
+		return t
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+
+	if err != nil {
+		form.Errors.Add(field, "Must be a date, such as 2024-01-31, or a time in RFC 3339 format")
+		return time.Time{}
+	}
+
+	// times are stored in UTC
+	return t.UTC()
+}
+
+func (q userListQuery) url() string {
+	values := url.Values{}
+
+	for param, value := range map[string]string{
+		"q":      q.Search,
+		"avatar": q.Avatar,
+		"admin":  q.Admin,
+		"from":   q.From,
+		"to":     q.To,
+		"sort":   q.Sort,
+		"after":  q.After,
+	} {
+		if value != "" {
+			values.Set(param, value)
+		}
+	}
+
+	if q.Desc {
+		values.Set("dir", "desc")
+	}
+
+	if len(values) == 0 {
+		return "/admin/users"
+	}
+
+	return "/admin/users?" + values.Encode()
+}
+
+// SortURL links to the first page sorted by column, reversing the order if the list is already sorted by it.
+func (q userListQuery) SortURL(column string) string {
+	sorted := q
+	sorted.Sort = column
+	sorted.Desc = q.Sort == column && !q.Desc
+	sorted.After = ""
+
+	return sorted.url()
+}
+
+// PageURL links to the page of the same list after cursor, or to the first page if cursor is empty.
+func (q userListQuery) PageURL(cursor string) string {
+	q.After = cursor
+
+	return q.url()
+}
+
+// Filtered reports whether any filter is set, besides the search.
+func (q userListQuery) Filtered() bool {
+	return q.Avatar != "" || q.Admin != "" || q.From != "" || q.To != ""
+}
+
+// AdminUsers lists users a page at a time, optionally searching their names and email addresses and filtering
+// them by whether they have a profile picture, whether they are administrators and when they joined.
+func (app *Application) AdminUsers(resp http.ResponseWriter, req *http.Request) {
+	q := parseUserListQuery(req.URL.Query())
+	form := NewForm(req.URL.Query())
+
+	result, err := app.DB.SearchUsers(q.search(form, adminPageSize))
+
+	if stderrors.Is(err, data.ErrInvalidCursor) {
+		// the cursor was changed by hand, or the list was sorted differently
+		http.Redirect(resp, req, q.PageURL(""), http.StatusSeeOther)
+		return
+	}
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{
+		"users": result.Users,
+		"query": q,
+		"total": result.Total,
+	}
+
+	if q.After != "" {
+		td["first"] = q.PageURL("")
+	}
+
+	if result.Next != "" {
+		td["next"] = q.PageURL(result.Next)
+	}
+
+	_ = app.Render(resp, req, "admin-users.page.gohtml", &TemplateData{Data: td, Form: form})
+}
+
+// adminSubject returns the user whose id is in the URL, or responds with not found.
+func (app *Application) adminSubject(resp http.ResponseWriter, req *http.Request) (*data.User, bool) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return nil, false
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// AdminUser shows a user's account, with forms to change it.
+func (app *Application) AdminUser(resp http.ResponseWriter, req *http.Request) {
+	user, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	td := map[string]any{
+		"subject":           user,
+		"temporaryPassword": app.Session.PopString(req.Context(), "temporary_password"),
+	}
+
+	_ = app.Render(resp, req, "admin-user.page.gohtml", &TemplateData{Data: td})
+}
+
+// AdminUpdateUser saves changes to a user's name, email address and whether they are active. Administrators cannot
+// deactivate themselves.
+func (app *Application) AdminUpdateUser(resp http.ResponseWriter, req *http.Request) {
+	user, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	redirectTo := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	input := userInput{
+		Email:     strings.TrimSpace(req.PostForm.Get("email")),
+		FirstName: strings.TrimSpace(req.PostForm.Get("first_name")),
+		LastName:  strings.TrimSpace(req.PostForm.Get("last_name")),
+	}
+
+	form := input.form(false, app.Passwords.MaxBytes)
+
+	if !form.Valid() {
+		for _, field := range []string{"first_name", "last_name", "email"} {
+			if message := form.Errors.Get(field); message != "" {
+				app.Session.Put(req.Context(), "error", message)
+				break
+			}
+		}
+
+		http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	if existing, err := app.DB.GetUserByEmail(input.Email); err == nil && existing.ID != user.ID {
+		app.Session.Put(req.Context(), "error", "A user with that email address already exists")
+		http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	active := req.PostForm.Get("active") == "on"
+	self, _ := app.Session.Get(req.Context(), "user").(data.User)
+
+	if !active && user.ID == self.ID {
+		app.Session.Put(req.Context(), "error", "You cannot deactivate yourself")
+		http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	before := *user
+	user.Email = input.Email
+	user.FirstName = input.FirstName
+	user.LastName = input.LastName
+
+	if active {
+		user.DeactivatedAt = nil
+	} else if user.DeactivatedAt == nil {
+		now := time.Now()
+		user.DeactivatedAt = &now
+	}
+
+	err = app.DB.UpdateUser(*user)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserUpdated, user.ID, map[string]any{"changes": auditDiff(before, *user)})
+
+	if user.ID == self.ID {
+		if err := app.refreshSessionUser(req, user.ID); err != nil {
+			log.Println("Could not refresh session:", err)
+		}
+	}
+
+	app.Session.Put(req.Context(), "flash", "User updated")
+	http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+}
+
+// AdminResetPassword gives a user a new random password, which is shown to the administrator once to pass on.
+func (app *Application) AdminResetPassword(resp http.ResponseWriter, req *http.Request) {
+	user, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	password, err := randomHex(8)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = app.DB.ResetPassword(user.ID, password)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditPasswordReset, user.ID, nil)
+
+	app.Session.Put(req.Context(), "temporary_password", password)
+	http.Redirect(resp, req, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// AdminDeleteProfilePicture removes a user's current profile picture, putting the one before it back.
+func (app *Application) AdminDeleteProfilePicture(resp http.ResponseWriter, req *http.Request) {
+	user, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	removed, err := app.removeProfilePicture(user.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if removed {
+		_ = app.audit(req, data.AuditImageRemoved, user.ID, nil)
+		app.Session.Put(req.Context(), "flash", "Profile picture removed")
+	} else {
+		app.Session.Put(req.Context(), "error", "The user has no profile picture")
+	}
+
+	http.Redirect(resp, req, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// AdminConfirmDeleteUser asks an administrator to confirm they want to delete a user.
+func (app *Application) AdminConfirmDeleteUser(resp http.ResponseWriter, req *http.Request) {
+	user, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	_ = app.Render(resp, req, "admin-delete-user.page.gohtml", &TemplateData{Data: map[string]any{
+		"subject":       user,
+		"retentionDays": int(app.DeletedUserRetention.Hours() / 24),
+	}})
+}
+
+// AdminDeleteUser deletes a user, once the administrator has confirmed it by typing the user's email address. The
+// user can be restored, profile pictures and all, until they are purged. Administrators cannot delete themselves.
+func (app *Application) AdminDeleteUser(resp http.ResponseWriter, req *http.Request) {
+	user, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	confirmPage := fmt.Sprintf("/admin/users/%d/delete", user.ID)
+
+	if !strings.EqualFold(strings.TrimSpace(req.PostForm.Get("confirm")), user.Email) {
+		app.Session.Put(req.Context(), "error", "Type the user's email address to confirm")
+		http.Redirect(resp, req, confirmPage, http.StatusSeeOther)
+		return
+	}
+
+	if self, _ := app.Session.Get(req.Context(), "user").(data.User); self.ID == user.ID {
+		app.Session.Put(req.Context(), "error", "You cannot delete yourself")
+		http.Redirect(resp, req, confirmPage, http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.DeleteUser(user.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserDeleted, user.ID, map[string]any{"user": user})
+
+	app.Session.Put(req.Context(), "flash", fmt.Sprintf("Deleted %s; they can be restored from the deleted users page", user.Email))
+	http.Redirect(resp, req, "/admin/users", http.StatusSeeOther)
+}
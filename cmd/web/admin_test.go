@@ -0,0 +1,269 @@
+package web
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_userListQuery(t *testing.T) {
+	yes, no := true, false
+
+	var tests = []struct {
+		name           string
+		query          string
+		expected       data.UserSearch
+		expectedErrors []string
+	}{
+		{"defaults", "", data.UserSearch{Limit: 25}, nil},
+		{"search", "q=+ada+love+", data.UserSearch{Query: "ada love", Limit: 25}, nil},
+		{"by email descending", "sort=email&dir=desc", data.UserSearch{Sort: data.UserSortEmail, Descending: true, Limit: 25}, nil},
+		{"unknown sort", "sort=password", data.UserSearch{Limit: 25}, nil},
+		{"next page", "after=abc", data.UserSearch{Cursor: "abc", Limit: 25}, nil},
+		{"with avatar", "avatar=true", data.UserSearch{HasAvatar: &yes, Limit: 25}, nil},
+		{"not admin", "admin=false", data.UserSearch{IsAdmin: &no, Limit: 25}, nil},
+		{"joined between dates", "from=2024-01-01&to=2024-01-31", data.UserSearch{
+			CreatedFrom: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			CreatedTo:   time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC),
+			Limit:       25,
+		}, nil},
+		{"joined before a time", "to=2024-01-31T12:00:00%2B02:00", data.UserSearch{
+			CreatedTo: time.Date(2024, 1, 31, 10, 0, 0, 0, time.UTC),
+			Limit:     25,
+		}, nil},
+		{"bad filters", "avatar=maybe&admin=2&from=yesterday", data.UserSearch{Limit: 25}, []string{"avatar", "admin", "from"}},
+	}
+
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		form := NewForm(values)
+		actual := parseUserListQuery(values).search(form, 25)
+
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected %+v, got %+v", test.name, test.expected, actual)
+		}
+
+		if len(form.Errors) != len(test.expectedErrors) {
+			t.Errorf("%s: expected errors on %v, got %v", test.name, test.expectedErrors, form.Errors)
+		}
+
+		for _, field := range test.expectedErrors {
+			if form.Errors.Get(field) == "" {
+				t.Errorf("%s: expected an error on %s", test.name, field)
+			}
+		}
+	}
+}
+
+func Test_userListQuery_URLs(t *testing.T) {
+	q := userListQuery{Search: "ada", Admin: "true", Sort: "email", After: "abc"}
+
+	var tests = []struct {
+		name     string
+		actual   string
+		expected string
+	}{
+		{"sort by another column", q.SortURL("name"), "/admin/users?admin=true&q=ada&sort=name"},
+		{"reverse the sort", q.SortURL("email"), "/admin/users?admin=true&dir=desc&q=ada&sort=email"},
+		{"next page", q.PageURL("def"), "/admin/users?admin=true&after=def&q=ada&sort=email"},
+		{"first page", q.PageURL(""), "/admin/users?admin=true&q=ada&sort=email"},
+		{"everything", userListQuery{}.PageURL(""), "/admin/users"},
+	}
+
+	for _, test := range tests {
+		if test.actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, test.actual)
+		}
+	}
+}
+
+// adminRequest sends a request for user id to handler as the logged in user.
+func adminRequest(method, target, id string, form url.Values, user data.User, handler http.HandlerFunc) (*http.Request, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", user)
+
+	routeContext := chi.NewRouteContext()
+	routeContext.URLParams.Add("id", id)
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+
+	return req, resp
+}
+
+func Test_Application_AdminUsers(t *testing.T) {
+	var tests = []struct {
+		name             string
+		target           string
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     []string
+	}{
+		{"no matches", "/admin/users?q=nobody", http.StatusOK, "", []string{"No users found", `value="nobody"`, `href="/admin/users?q=nobody&amp;sort=email"`}},
+		{"first page", "/admin/users?q=ada", http.StatusOK, "", []string{"2 users", "Lovelace", `href="/admin/users?after=after-ada&amp;q=ada"`}},
+		{"next page", "/admin/users?q=ada&after=after-ada", http.StatusOK, "", []string{"Hopper", `href="/admin/users?q=ada">First page`}},
+		{"bad cursor", "/admin/users?q=ada&after=nope", http.StatusSeeOther, "/admin/users?q=ada", nil},
+		{"bad date", "/admin/users?from=soon", http.StatusOK, "", []string{"Must be a date"}},
+	}
+
+	for _, test := range tests {
+		_, resp := adminRequest(http.MethodGet, test.target, "", nil, data.User{ID: 1, IsAdmin: 1}, app.AdminUsers)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+			continue
+		}
+
+		if location := resp.Header().Get("Location"); location != test.expectedLocation {
+			t.Errorf("%s: expected location %q, got %q", test.name, test.expectedLocation, location)
+		}
+
+		for _, expected := range test.expectedBody {
+			if !strings.Contains(resp.Body.String(), expected) {
+				t.Errorf("%s: expected user list to contain %q", test.name, expected)
+			}
+		}
+	}
+}
+
+func Test_Application_AdminUser(t *testing.T) {
+	var tests = []struct {
+		name        string
+		user        data.User
+		expected    []string
+		notExpected []string
+	}{
+		{"admin", data.User{ID: 1, IsAdmin: 1}, []string{`action="/admin/users/1"`, "Reset password", "/admin/users/1/delete", "/admin/users/1/roles"}, nil},
+		{"auditor", data.User{ID: 2, Permissions: []string{data.PermissionReadUsers, data.PermissionReadAudit}}, []string{"All users"}, []string{"Reset password", "/admin/users/1/delete"}},
+	}
+
+	for _, test := range tests {
+		_, resp := adminRequest(http.MethodGet, "/admin/users/1", "1", nil, test.user, app.AdminUser)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", test.name, http.StatusOK, resp.Code)
+		}
+
+		for _, expected := range test.expected {
+			if !strings.Contains(resp.Body.String(), expected) {
+				t.Errorf("%s: expected user page to contain %q", test.name, expected)
+			}
+		}
+
+		for _, notExpected := range test.notExpected {
+			if strings.Contains(resp.Body.String(), notExpected) {
+				t.Errorf("%s: expected user page not to contain %q", test.name, notExpected)
+			}
+		}
+	}
+
+	_, resp := adminRequest(http.MethodGet, "/admin/users/one", "one", nil, data.User{ID: 1, IsAdmin: 1}, app.AdminUser)
+
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected status %d for a bad id, got %d", http.StatusNotFound, resp.Code)
+	}
+}
+
+func Test_Application_AdminUpdateUser(t *testing.T) {
+	admin := data.User{ID: 5, IsAdmin: 1}
+
+	var tests = []struct {
+		name          string
+		user          data.User
+		postedData    url.Values
+		expectedFlash string
+		expectedError string
+	}{
+		{"valid", admin, url.Values{"first_name": {"Jane"}, "last_name": {"Doe"}, "email": {"jane@example.com"}, "active": {"on"}}, "User updated", ""},
+		{"deactivate", admin, url.Values{"first_name": {"Jane"}, "last_name": {"Doe"}, "email": {"jane@example.com"}}, "User updated", ""},
+		{"deactivate yourself", data.User{ID: 1, IsAdmin: 1}, url.Values{"first_name": {"Jane"}, "last_name": {"Doe"}, "email": {"jane@example.com"}}, "", "cannot deactivate yourself"},
+		{"missing name", admin, url.Values{"last_name": {"Doe"}, "email": {"jane@example.com"}, "active": {"on"}}, "", "cannot be blank"},
+		{"invalid email", admin, url.Values{"first_name": {"Jane"}, "last_name": {"Doe"}, "email": {"jane"}, "active": {"on"}}, "", "Invalid email"},
+	}
+
+	for _, test := range tests {
+		req, resp := adminRequest(http.MethodPost, "/admin/users/1", "1", test.postedData, test.user, app.AdminUpdateUser)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/admin/users/1" {
+			t.Errorf("%s: expected a redirect back to the user, got %d %s", test.name, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != test.expectedFlash {
+			t.Errorf("%s: expected flash %q, got %q", test.name, test.expectedFlash, flash)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
+
+func Test_Application_AdminResetPassword(t *testing.T) {
+	req, resp := adminRequest(http.MethodPost, "/admin/users/1/password", "1", nil, data.User{ID: 5, IsAdmin: 1}, app.AdminResetPassword)
+
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("expected status %d, got %d", http.StatusSeeOther, resp.Code)
+	}
+
+	if password := app.Session.GetString(req.Context(), "temporary_password"); len(password) != 16 {
+		t.Errorf("expected a temporary password to show the administrator, got %q", password)
+	}
+}
+
+func Test_Application_AdminDeleteProfilePicture(t *testing.T) {
+	uploadPath = t.TempDir()
+
+	req, resp := adminRequest(http.MethodPost, "/admin/users/1/profile-picture/delete", "1", nil, data.User{ID: 5, IsAdmin: 1}, app.AdminDeleteProfilePicture)
+
+	if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/admin/users/1" {
+		t.Errorf("expected a redirect back to the user, got %d %s", resp.Code, resp.Header().Get("Location"))
+	}
+
+	if flash := app.Session.GetString(req.Context(), "flash"); flash != "Profile picture removed" {
+		t.Errorf("expected the picture to be removed, got %q", flash)
+	}
+}
+
+func Test_Application_AdminDeleteUser(t *testing.T) {
+	uploadPath = t.TempDir()
+
+	var tests = []struct {
+		name             string
+		user             data.User
+		confirm          string
+		expectedLocation string
+		expectedError    string
+	}{
+		{"confirmed", data.User{ID: 5, IsAdmin: 1}, "", "/admin/users", ""},
+		{"wrong email", data.User{ID: 5, IsAdmin: 1}, "someone@example.com", "/admin/users/1/delete", "Type the user's email address"},
+		{"yourself", data.User{ID: 1, IsAdmin: 1}, "", "/admin/users/1/delete", "cannot delete yourself"},
+	}
+
+	for _, test := range tests {
+		req, resp := adminRequest(http.MethodPost, "/admin/users/1/delete", "1", url.Values{"confirm": {test.confirm}}, test.user, app.AdminDeleteUser)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != test.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %d %s", test.name, test.expectedLocation, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+
+	_, resp := adminRequest(http.MethodGet, "/admin/users/1/delete", "1", nil, data.User{ID: 5, IsAdmin: 1}, app.AdminConfirmDeleteUser)
+
+	if !strings.Contains(resp.Body.String(), `name="confirm"`) {
+		t.Error("expected the confirmation page to ask for the email address")
+	}
+}
@@ -0,0 +1,601 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// apiMaxBodyBytes limits the size of JSON request bodies.
+const apiMaxBodyBytes = 1024 * 1024
+
+// apiUserPageSize is how many users the API lists at a time unless asked for fewer, up to apiMaxUserPageSize.
+const (
+	apiUserPageSize    = 50
+	apiMaxUserPageSize = 200
+)
+
+// problem is the body of every API error, as described by RFC 7807.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Errors holds the messages for each invalid field of a validation problem.
+	Errors map[string][]string `json:"errors,omitempty"`
+}
+
+// validationProblemType identifies problems caused by invalid input.
+const validationProblemType = "/api/v1/problems/validation"
+
+// writeJSON sends v as the JSON body of a response with the given status.
+func writeJSON(resp http.ResponseWriter, status int, v any) {
+	out, err := json.Marshal(v)
+
+	if err != nil {
+		log.Println("Error encoding JSON:", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	_, _ = resp.Write(out)
+}
+
+// writeProblem sends an application/problem+json response. The title is the standard text for status.
+func writeProblem(resp http.ResponseWriter, req *http.Request, status int, detail string) {
+	writeProblemBody(resp, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: req.URL.Path,
+	})
+}
+
+// writeValidationProblem reports the errors on a form which failed validation.
+func writeValidationProblem(resp http.ResponseWriter, req *http.Request, form *Form) {
+	writeProblemBody(resp, problem{
+		Type:     validationProblemType,
+		Title:    "Your request parameters didn't validate",
+		Status:   http.StatusUnprocessableEntity,
+		Instance: req.URL.Path,
+		Errors:   form.Errors,
+	})
+}
+
+func writeProblemBody(resp http.ResponseWriter, p problem) {
+	out, err := json.Marshal(p)
+
+	if err != nil {
+		log.Println("Error encoding problem:", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/problem+json")
+	resp.WriteHeader(p.Status)
+	_, _ = resp.Write(out)
+}
+
+// readJSON decodes a request body holding a single JSON object into dst, rejecting unknown fields.
+func readJSON(resp http.ResponseWriter, req *http.Request, dst any) error {
+	req.Body = http.MaxBytesReader(resp, req.Body, apiMaxBodyBytes)
+
+	decoder := json.NewDecoder(req.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(dst)
+
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+
+		if stderrors.As(err, &maxBytesError) {
+			return fmt.Errorf("The body must not be larger than %d bytes", apiMaxBodyBytes)
+		}
+
+		return fmt.Errorf("The body must be a single JSON object: %s", err)
+	}
+
+	if err := decoder.Decode(&struct{}{}); err != io.EOF {
+		return stderrors.New("The body must only contain a single JSON object")
+	}
+
+	return nil
+}
+
+// apiRoutes returns the handler for version 1 of the JSON API, mounted at /api/v1.
+func (app *Application) apiRoutes() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.NotFound(func(resp http.ResponseWriter, req *http.Request) {
+		writeProblem(resp, req, http.StatusNotFound, "")
+	})
+
+	mux.MethodNotAllowed(func(resp http.ResponseWriter, req *http.Request) {
+		writeProblem(resp, req, http.StatusMethodNotAllowed, "")
+	})
+
+	mux.Post("/auth/token", app.APIToken)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.apiAuth)
+
+		mux.Route("/users", func(mux chi.Router) {
+			mux.With(app.apiRequirePermission(data.PermissionReadUsers)).Get("/", app.APIListUsers)
+			mux.With(app.apiRequirePermission(data.PermissionWriteUsers)).Post("/", app.APICreateUser)
+
+			mux.Route("/{id}", func(mux chi.Router) {
+				mux.With(app.apiUserAccess(data.PermissionReadUsers), app.requireScope("profile:read")).Get("/", app.APIGetUser)
+				mux.With(app.apiUserAccess(data.PermissionWriteUsers), app.requireScope("profile:write")).Put("/", app.APIUpdateUser)
+				mux.With(app.apiUserAccess(data.PermissionDeleteUsers), app.apiRequirePermission(data.PermissionDeleteUsers)).Delete("/", app.APIDeleteUser)
+				mux.With(app.apiUserAccess(data.PermissionReadUsers), app.requireScope("avatar:read")).Get("/profile-picture", app.APIGetProfilePicture)
+				mux.With(app.apiUserAccess(data.PermissionWriteUsers), app.requireScope("avatar:write")).Post("/profile-picture", app.APIUploadProfilePicture)
+				mux.With(app.apiUserAccess(data.PermissionModerateImages), app.requireScope("avatar:write")).Delete("/profile-picture", app.APIDeleteProfilePicture)
+			})
+		})
+	})
+
+	return mux
+}
+
+// apiUser returns the user making an API request.
+func (app *Application) apiUser(req *http.Request) data.User {
+	return app.apiCallerFromContext(req.Context()).User
+}
+
+// apiAuth is the API's version of auth: it accepts a personal access token or JWT access token as well as a
+// session, and answers with a problem rather than redirecting to the login page.
+func (app *Application) apiAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		var caller apiCaller
+
+		if header := req.Header.Get("Authorization"); header != "" {
+			scheme, token, _ := strings.Cut(header, " ")
+
+			if !strings.EqualFold(scheme, "Bearer") {
+				resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_request"`)
+				writeProblem(resp, req, http.StatusUnauthorized, "Use a bearer token")
+				return
+			}
+
+			var err error
+			caller, err = app.authenticateBearer(req, token)
+
+			if err != nil {
+				resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeProblem(resp, req, http.StatusUnauthorized, "The token is invalid, expired or revoked")
+				return
+			}
+		} else if user, ok, err := app.sessionUser(req); err != nil {
+			writeProblem(resp, req, http.StatusInternalServerError, err.Error())
+			return
+		} else if ok {
+			caller = apiCaller{User: *user, Unscoped: true}
+		} else {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			writeProblem(resp, req, http.StatusUnauthorized, "Log in first, or use a personal access token")
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), contextAPICallerKey, caller)
+		next.ServeHTTP(resp, req.WithContext(ctx))
+	})
+}
+
+// authenticateBearer checks a bearer token, which is either a personal access token or a JWT access token.
+func (app *Application) authenticateBearer(req *http.Request, token string) (apiCaller, error) {
+	token = strings.TrimSpace(token)
+
+	if strings.HasPrefix(token, tokenPrefix) {
+		return app.authenticateToken(req, token)
+	}
+
+	return app.authenticateJWT(token)
+}
+
+// apiRequirePermission only lets through callers whose roles grant permission, and only when their token has the
+// users:admin scope.
+func (app *Application) apiRequirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			caller := app.apiCallerFromContext(req.Context())
+
+			if !caller.User.Can(permission) {
+				writeProblem(resp, req, http.StatusForbidden, fmt.Sprintf("Only administrators, or users with the %s permission, may do that", permission))
+				return
+			}
+
+			app.requireScope("users:admin")(next).ServeHTTP(resp, req)
+		})
+	}
+}
+
+// apiUserAccess lets users reach their own account, and anyone else's if their roles grant permission.
+func (app *Application) apiUserAccess(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+			if err != nil {
+				writeProblem(resp, req, http.StatusNotFound, "")
+				return
+			}
+
+			if app.apiUser(req).ID != id {
+				app.apiRequirePermission(permission)(next).ServeHTTP(resp, req)
+				return
+			}
+
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
+
+// refreshCallerSession updates the session of a caller who changed their own account through the API. Token callers
+// have no session to update.
+func (app *Application) refreshCallerSession(req *http.Request, userID int) {
+	caller := app.apiCallerFromContext(req.Context())
+
+	if caller.Unscoped && caller.User.ID == userID {
+		if err := app.refreshSessionUser(req, userID); err != nil {
+			log.Println("Could not refresh session:", err)
+		}
+	}
+}
+
+// userID returns the id from the URL, which apiUserAccess has already checked.
+func userID(req *http.Request) int {
+	id, _ := strconv.Atoi(chi.URLParam(req, "id"))
+
+	return id
+}
+
+// userInput is the body of requests which create or update a user.
+type userInput struct {
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Password  string `json:"password"`
+	IsAdmin   *int   `json:"is_admin"`
+}
+
+// form validates the input with the same rules as the HTML forms. Passwords are only required when creating a user,
+// and may be no longer than maxPasswordBytes, if that is set.
+func (input userInput) form(requirePassword bool, maxPasswordBytes int) *Form {
+	form := NewForm(url.Values{
+		"email":      {input.Email},
+		"first_name": {input.FirstName},
+		"last_name":  {input.LastName},
+		"password":   {input.Password},
+	})
+
+	form.Required("email", "first_name", "last_name")
+	form.IsEmail("email")
+
+	for _, field := range []string{"email", "first_name", "last_name"} {
+		form.MaxLength(field, 255)
+	}
+
+	if requirePassword {
+		form.Required("password")
+	}
+
+	if input.Password != "" {
+		form.Check(len(input.Password) >= 8, "password", "Password must be at least 8 characters long")
+		form.Check(maxPasswordBytes <= 0 || len(input.Password) <= maxPasswordBytes, "password",
+			fmt.Sprintf("Password cannot be longer than %d bytes", maxPasswordBytes))
+	}
+
+	if input.IsAdmin != nil {
+		form.Check(*input.IsAdmin == 0 || *input.IsAdmin == 1, "is_admin", "Must be 0 or 1")
+	}
+
+	return form
+}
+
+// APIListUsers lists users a page at a time, taking the same search, filters and sort order as the admin user list,
+// and how many users to list with limit. The next page is listed by passing the next_cursor of one as after.
+func (app *Application) APIListUsers(resp http.ResponseWriter, req *http.Request) {
+	q := parseUserListQuery(req.URL.Query())
+	form := NewForm(req.URL.Query())
+
+	if sort := form.Data.Get("sort"); sort != "" && sort != q.Sort {
+		form.Errors.Add("sort", "Must be one of "+strings.Join(userListSorts, ", "))
+	}
+
+	limit := apiUserPageSize
+
+	if form.Has("limit") {
+		var err error
+		limit, err = strconv.Atoi(form.Data.Get("limit"))
+		form.Check(err == nil && limit >= 1 && limit <= apiMaxUserPageSize, "limit",
+			fmt.Sprintf("Must be a number from 1 to %d", apiMaxUserPageSize))
+	}
+
+	search := q.search(form, limit)
+
+	if !form.Valid() {
+		writeValidationProblem(resp, req, form)
+		return
+	}
+
+	result, err := app.DB.SearchUsers(search)
+
+	if stderrors.Is(err, data.ErrInvalidCursor) {
+		writeProblem(resp, req, http.StatusBadRequest, "after is not a cursor for this sort order")
+		return
+	}
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, result)
+}
+
+func (app *Application) APICreateUser(resp http.ResponseWriter, req *http.Request) {
+	var input userInput
+
+	if err := readJSON(resp, req, &input); err != nil {
+		writeProblem(resp, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := input.form(true, app.Passwords.MaxBytes)
+
+	if !form.Valid() {
+		writeValidationProblem(resp, req, form)
+		return
+	}
+
+	if _, err := app.DB.GetUserByEmail(input.Email); err == nil {
+		writeProblem(resp, req, http.StatusConflict, "A user with that email address already exists")
+		return
+	}
+
+	user := data.User{
+		Email:     input.Email,
+		FirstName: input.FirstName,
+		LastName:  input.LastName,
+		Password:  input.Password,
+	}
+
+	if input.IsAdmin != nil && *input.IsAdmin != 0 {
+		if caller := app.apiCallerFromContext(req.Context()); !caller.User.Can(data.PermissionAssignRoles) {
+			writeProblem(resp, req, http.StatusForbidden, "Only users with the roles:assign permission may set is_admin")
+			return
+		}
+
+		user.IsAdmin = *input.IsAdmin
+	}
+
+	id, err := app.DB.InsertUser(user)
+
+	if err != nil {
+		log.Println("Error creating user:", err)
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	created, err := app.DB.GetUser(id)
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserCreated, id, map[string]any{"user": created})
+
+	resp.Header().Set("Location", fmt.Sprintf("/api/v1/users/%d", id))
+	writeJSON(resp, http.StatusCreated, created)
+}
+
+func (app *Application) APIGetUser(resp http.ResponseWriter, req *http.Request) {
+	user, err := app.DB.GetUser(userID(req))
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusNotFound, "")
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, user)
+}
+
+// APIUpdateUser replaces a user's name and email address. Only administrators may change is_admin, and passwords
+// are changed elsewhere.
+func (app *Application) APIUpdateUser(resp http.ResponseWriter, req *http.Request) {
+	var input userInput
+
+	if err := readJSON(resp, req, &input); err != nil {
+		writeProblem(resp, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	form := input.form(false, app.Passwords.MaxBytes)
+	form.Check(input.Password == "", "password", "Passwords cannot be changed here")
+
+	if !form.Valid() {
+		writeValidationProblem(resp, req, form)
+		return
+	}
+
+	user, err := app.DB.GetUser(userID(req))
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusNotFound, "")
+		return
+	}
+
+	before := *user
+
+	if input.IsAdmin != nil && *input.IsAdmin != user.IsAdmin {
+		if caller := app.apiCallerFromContext(req.Context()); !caller.User.Can(data.PermissionAssignRoles) || !caller.can("users:admin") {
+			writeProblem(resp, req, http.StatusForbidden, "Only administrators may change is_admin")
+			return
+		}
+
+		user.IsAdmin = *input.IsAdmin
+	}
+
+	if existing, err := app.DB.GetUserByEmail(input.Email); err == nil && existing.ID != user.ID {
+		writeProblem(resp, req, http.StatusConflict, "A user with that email address already exists")
+		return
+	}
+
+	user.Email = input.Email
+	user.FirstName = input.FirstName
+	user.LastName = input.LastName
+
+	err = app.DB.UpdateUser(*user)
+
+	if err != nil {
+		log.Println("Error updating user:", err)
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserUpdated, user.ID, map[string]any{"changes": auditDiff(before, *user)})
+	app.refreshCallerSession(req, user.ID)
+
+	writeJSON(resp, http.StatusOK, user)
+}
+
+func (app *Application) APIDeleteUser(resp http.ResponseWriter, req *http.Request) {
+	user, err := app.DB.GetUser(userID(req))
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusNotFound, "")
+		return
+	}
+
+	err = app.DB.DeleteUser(user.ID)
+
+	if err != nil {
+		log.Println("Error deleting user:", err)
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserDeleted, user.ID, map[string]any{"user": user})
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// profilePicture is how the API presents a profile image, with the URL it can be fetched from, and the URL of its
+// static poster for clients which must not show it animated. The URLs are signed if the image is not public, so
+// they must only be given to callers who may see it.
+type profilePicture struct {
+	data.UserImage
+	URL       string `json:"url"`
+	PosterURL string `json:"poster_url"`
+}
+
+func (app *Application) newProfilePicture(image data.UserImage, visibility string) profilePicture {
+	return profilePicture{
+		UserImage: image,
+		URL:       app.avatarURL(image.FileName, visibility, 0, ""),
+		PosterURL: app.avatarURL(image.FileName, visibility, 0, avatarVariantPoster),
+	}
+}
+
+func (app *Application) APIGetProfilePicture(resp http.ResponseWriter, req *http.Request) {
+	user, err := app.DB.GetUser(userID(req))
+
+	if err != nil || user.ProfilePicture.FileName == "" {
+		writeProblem(resp, req, http.StatusNotFound, "No profile picture has been uploaded")
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, app.newProfilePicture(user.ProfilePicture, user.AvatarVisibility))
+}
+
+// APIUploadProfilePicture stores the image in the multipart form field "image" as the user's profile picture.
+func (app *Application) APIUploadProfilePicture(resp http.ResponseWriter, req *http.Request) {
+	quarantine, err := newQuarantine()
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	defer os.RemoveAll(quarantine)
+
+	files, err := UploadFiles(req, quarantine)
+
+	if err != nil {
+		writeProblem(resp, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if len(files) == 0 {
+		form := NewForm(url.Values{})
+		form.Required("image")
+		writeValidationProblem(resp, req, form)
+		return
+	}
+
+	image, err := app.storeProfilePicture(req.Context(), userID(req), filepath.Join(quarantine, files[0].OriginalFileName), files[0].OriginalFileName)
+
+	if err != nil {
+		var rejected imageRejectedError
+
+		if stderrors.As(err, &rejected) {
+			writeProblem(resp, req, http.StatusUnprocessableEntity, rejected.Error())
+			return
+		}
+
+		log.Println("Error storing profile picture:", err)
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	app.auditUpload(req, image)
+	app.refreshCallerSession(req, image.UserID)
+
+	// the visibility decides whether the URL has to be signed; if it cannot be found, sign it to be safe
+	visibility := data.AvatarVisibilityPrivate
+
+	if owner, err := app.DB.GetUser(image.UserID); err == nil {
+		visibility = owner.AvatarVisibility
+	}
+
+	resp.Header().Set("Location", fmt.Sprintf("/api/v1/users/%d/profile-picture", image.UserID))
+	writeJSON(resp, http.StatusCreated, app.newProfilePicture(*image, visibility))
+}
+
+// APIDeleteProfilePicture deletes the user's current profile picture; the one before it, if any, takes its place.
+func (app *Application) APIDeleteProfilePicture(resp http.ResponseWriter, req *http.Request) {
+	removed, err := app.removeProfilePicture(userID(req))
+
+	if err != nil {
+		log.Println("Error deleting profile picture:", err)
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	if !removed {
+		writeProblem(resp, req, http.StatusNotFound, "No profile picture has been uploaded")
+		return
+	}
+
+	_ = app.audit(req, data.AuditImageRemoved, userID(req), nil)
+
+	app.refreshCallerSession(req, userID(req))
+
+	resp.WriteHeader(http.StatusNoContent)
+}
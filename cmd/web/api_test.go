@@ -0,0 +1,207 @@
+package web
+
+import (
+	"encoding/json"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// session users are reloaded from the test repository, which has user 12 as an administrator and user 13 as a
+// moderator
+var apiAdminUser = &data.User{ID: 12}
+var apiRegularUser = &data.User{ID: 3}
+var apiModeratorUser = &data.User{ID: 13}
+
+// apiRequest sends a request to the API as user, who may be nil for an anonymous request.
+func apiRequest(req *http.Request, user *data.User) *httptest.ResponseRecorder {
+	req = addContextAndSessionToRequest(req, app)
+
+	if user != nil {
+		app.Session.Put(req.Context(), "user", *user)
+	}
+
+	resp := httptest.NewRecorder()
+	app.apiRoutes().ServeHTTP(resp, req)
+
+	return resp
+}
+
+func Test_Application_API_Users(t *testing.T) {
+	var tests = []struct {
+		name               string
+		method             string
+		url                string
+		body               string
+		user               *data.User
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"anonymous", "GET", "/users", "", nil, http.StatusUnauthorized, `"title":"Unauthorized"`},
+		{"deactivated", "GET", "/users/14", "", &data.User{ID: 14}, http.StatusUnauthorized, "Log in first"},
+		{"list as user", "GET", "/users", "", apiRegularUser, http.StatusForbidden, `"status":403`},
+		{"list as admin", "GET", "/users", "", apiAdminUser, http.StatusOK, `{"users":[],"total":0}`},
+		{"list as moderator", "GET", "/users", "", apiModeratorUser, http.StatusOK, `{"users":[],"total":0}`},
+		{"search", "GET", "/users?q=ada&limit=1", "", apiAdminUser, http.StatusOK, `"total":2,"next_cursor":"after-ada"`},
+		{"next page", "GET", "/users?q=ada&after=after-ada", "", apiAdminUser, http.StatusOK, `"last_name":"Hopper"`},
+		{"bad cursor", "GET", "/users?q=ada&after=nope", "", apiAdminUser, http.StatusBadRequest, "not a cursor"},
+		{"bad filters", "GET", "/users?sort=password&limit=1000&admin=maybe&to=later", "", apiAdminUser, http.StatusUnprocessableEntity, `"limit":["Must be a number from 1 to 200"]`},
+		{"get as moderator", "GET", "/users/1", "", apiModeratorUser, http.StatusOK, `"id":1`},
+		{"update as moderator", "PUT", "/users/1", `{"email":"me@example.com","first_name":"Me","last_name":"Too"}`, apiModeratorUser, http.StatusForbidden, "users:write permission"},
+		{"delete as moderator", "DELETE", "/users/1", "", apiModeratorUser, http.StatusForbidden, "users:delete permission"},
+		{"get self", "GET", "/users/1", "", &data.User{ID: 1}, http.StatusOK, `"id":1`},
+		{"get someone else", "GET", "/users/1", "", apiRegularUser, http.StatusForbidden, "Only administrators"},
+		{"get as admin", "GET", "/users/1", "", apiAdminUser, http.StatusOK, `"id":1`},
+		{"bad id", "GET", "/users/one", "", apiAdminUser, http.StatusNotFound, `"status":404`},
+		{"unknown route", "GET", "/fish", "", apiAdminUser, http.StatusNotFound, `"instance":"/fish"`},
+		{"wrong method", "PATCH", "/users/1", "", apiAdminUser, http.StatusMethodNotAllowed, `"status":405`},
+		{"create", "POST", "/users", `{"email":"new@example.com","first_name":"New","last_name":"User","password":"secret123"}`, apiAdminUser, http.StatusCreated, `"id":1`},
+		{"create as user", "POST", "/users", `{"email":"new@example.com","first_name":"New","last_name":"User","password":"secret123"}`, apiRegularUser, http.StatusForbidden, ""},
+		{"create invalid", "POST", "/users", `{"email":"nope","first_name":"","last_name":"User","password":"short"}`, apiAdminUser, http.StatusUnprocessableEntity, `"email":["Invalid email address"]`},
+		{"create duplicate", "POST", "/users", `{"email":"admin@example.com","first_name":"A","last_name":"B","password":"secret123"}`, apiAdminUser, http.StatusConflict, "already exists"},
+		{"create unknown field", "POST", "/users", `{"email":"new@example.com","role":"admin"}`, apiAdminUser, http.StatusBadRequest, "unknown field"},
+		{"create two objects", "POST", "/users", `{} {}`, apiAdminUser, http.StatusBadRequest, "single JSON object"},
+		{"update", "PUT", "/users/1", `{"email":"me@example.com","first_name":"Me","last_name":"Too"}`, &data.User{ID: 1}, http.StatusOK, `"first_name":"Me"`},
+		{"update own is_admin", "PUT", "/users/1", `{"email":"me@example.com","first_name":"Me","last_name":"Too","is_admin":1}`, &data.User{ID: 1}, http.StatusForbidden, "is_admin"},
+		{"update password", "PUT", "/users/1", `{"email":"me@example.com","first_name":"Me","last_name":"Too","password":"secret123"}`, &data.User{ID: 1}, http.StatusUnprocessableEntity, "cannot be changed here"},
+		{"delete as user", "DELETE", "/users/3", "", apiRegularUser, http.StatusForbidden, ""},
+		{"delete as admin", "DELETE", "/users/1", "", apiAdminUser, http.StatusNoContent, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.url, strings.NewReader(test.body))
+		resp := apiRequest(req, test.user)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expectedStatusCode, resp.Code, resp.Body.String())
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body containing %s, got %s", test.name, test.expectedBody, resp.Body.String())
+		}
+
+		if resp.Code >= 400 {
+			if contentType := resp.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("%s: expected a problem, got %s", test.name, contentType)
+			}
+
+			var p problem
+
+			if err := json.Unmarshal(resp.Body.Bytes(), &p); err != nil || p.Status != resp.Code || p.Title == "" {
+				t.Errorf("%s: expected a problem matching the status, got %s", test.name, resp.Body.String())
+			}
+		}
+	}
+}
+
+func Test_Application_API_ProfilePicture(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	png, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer removeStoredUploads(t)
+
+	// the test repository never has a current profile picture
+	resp := apiRequest(httptest.NewRequest(http.MethodGet, "/users/1/profile-picture", nil), &data.User{ID: 1})
+
+	if resp.Code != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, resp.Code)
+	}
+
+	upload := uploadRequest(t, "api.png", png)
+	upload.URL.Path = "/users/1/profile-picture"
+	resp = apiRequest(upload, &data.User{ID: 1})
+
+	if resp.Code != http.StatusCreated {
+		t.Fatalf("expected status %d, got %d: %s", http.StatusCreated, resp.Code, resp.Body.String())
+	}
+
+	var picture profilePicture
+
+	if err := json.Unmarshal(resp.Body.Bytes(), &picture); err != nil {
+		t.Fatal(err)
+	}
+
+	if !storedUploadPattern.MatchString(picture.FileName) || picture.OriginalFileName != "api.png" ||
+		picture.URL != "/avatars/"+picture.FileName || picture.PosterURL != "/avatars/"+picture.FileName+"?variant=poster" ||
+		picture.BlurHash == "" || picture.FileSize == 0 {
+		t.Errorf("unexpected profile picture %+v", picture)
+	}
+
+	// not an image at all
+	upload = uploadRequest(t, "api.png", []byte("hello"))
+	upload.URL.Path = "/users/1/profile-picture"
+	resp = apiRequest(upload, &data.User{ID: 1})
+
+	if resp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected status %d, got %d", http.StatusUnprocessableEntity, resp.Code)
+	}
+
+	upload = uploadRequest(t, "api.png", png)
+	upload.URL.Path = "/users/1/profile-picture"
+	resp = apiRequest(upload, apiRegularUser)
+
+	if resp.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, resp.Code)
+	}
+
+	resp = apiRequest(httptest.NewRequest(http.MethodDelete, "/users/1/profile-picture", nil), &data.User{ID: 1})
+
+	if resp.Code != http.StatusNoContent {
+		t.Errorf("expected status %d, got %d", http.StatusNoContent, resp.Code)
+	}
+}
+
+func Test_userInput_form(t *testing.T) {
+	long := userInput{Email: "ada@example.com", FirstName: "Ada", LastName: "Lovelace", Password: strings.Repeat("x", 73)}
+
+	var tests = []struct {
+		name             string
+		maxPasswordBytes int
+		expectValid      bool
+	}{
+		{"bcrypt", 72, false},
+		{"no limit", 0, true},
+	}
+
+	for _, test := range tests {
+		form := long.form(true, test.maxPasswordBytes)
+
+		if form.Valid() != test.expectValid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.expectValid, form.Errors)
+		}
+	}
+}
+
+func Test_readJSON(t *testing.T) {
+	var tests = []struct {
+		name        string
+		body        string
+		expectError bool
+	}{
+		{"valid", `{"email":"me@example.com"}`, false},
+		{"empty", ``, true},
+		{"malformed", `{"email":`, true},
+		{"wrong type", `{"email":1}`, true},
+		{"too big", `{"email":"` + strings.Repeat("a", apiMaxBodyBytes) + `"}`, true},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", io.NopCloser(strings.NewReader(test.body)))
+		var input userInput
+
+		err := readJSON(httptest.NewRecorder(), req, &input)
+
+		if (err != nil) != test.expectError {
+			t.Errorf("%s: expected error to be %t, got %v", test.name, test.expectError, err)
+		}
+	}
+}
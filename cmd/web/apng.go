@@ -0,0 +1,369 @@
+package web
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"time"
+)
+
+// The standard library only understands the default image of an animated PNG, so the animation chunks (acTL, fcTL
+// and fdAT, see https://wiki.mozilla.org/APNG_Specification) are handled here.
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+const (
+	apngDisposeNone       = 0
+	apngDisposeBackground = 1
+	apngDisposePrevious   = 2
+
+	apngBlendSource = 0
+	apngBlendOver   = 1
+)
+
+type pngChunk struct {
+	kind string
+	data []byte
+}
+
+// animationFrame is one fully composited frame of an animation, along with how long it is displayed for.
+type animationFrame struct {
+	image *image.NRGBA
+	delay time.Duration
+}
+
+// readPNGChunks splits a PNG file into its chunks, stopping at IEND.
+func readPNGChunks(b []byte) ([]pngChunk, error) {
+	if !bytes.HasPrefix(b, pngSignature) {
+		return nil, fmt.Errorf("not a PNG file")
+	}
+
+	var chunks []pngChunk
+	b = b[len(pngSignature):]
+
+	for len(b) >= 12 {
+		length := binary.BigEndian.Uint32(b[:4])
+
+		if uint64(length)+12 > uint64(len(b)) {
+			return nil, fmt.Errorf("truncated PNG chunk")
+		}
+
+		chunk := pngChunk{kind: string(b[4:8]), data: b[8 : 8+length]}
+		chunks = append(chunks, chunk)
+		b = b[12+length:]
+
+		if chunk.kind == "IEND" {
+			return chunks, nil
+		}
+	}
+
+	return nil, fmt.Errorf("PNG file has no IEND chunk")
+}
+
+// isAPNG reports whether b is an animated PNG with more than one frame.
+func isAPNG(b []byte) bool {
+	chunks, err := readPNGChunks(b)
+
+	if err != nil {
+		return false
+	}
+
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "acTL":
+			return len(chunk.data) == 8 && binary.BigEndian.Uint32(chunk.data[:4]) > 1
+		case "IDAT":
+			// acTL must come before the image data
+			return false
+		}
+	}
+
+	return false
+}
+
+// apngFrameCount returns the number of frames in an animated PNG, without decoding any of them.
+func apngFrameCount(b []byte) int {
+	chunks, _ := readPNGChunks(b)
+	count := 0
+
+	for _, chunk := range chunks {
+		if chunk.kind == "fcTL" {
+			count++
+		}
+	}
+
+	return count
+}
+
+// decodeAPNG decodes the frames of an animated PNG, up to limit of them unless limit is 0, compositing each onto the
+// canvas as a browser would, and returns the frames along with the number of times the animation loops (0 meaning
+// forever).
+func decodeAPNG(b []byte, limit int) ([]animationFrame, int, error) {
+	chunks, err := readPNGChunks(b)
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(chunks) == 0 || chunks[0].kind != "IHDR" || len(chunks[0].data) != 13 {
+		return nil, 0, fmt.Errorf("PNG file has no IHDR chunk")
+	}
+
+	ihdr := chunks[0].data
+	width := int(binary.BigEndian.Uint32(ihdr[0:4]))
+	height := int(binary.BigEndian.Uint32(ihdr[4:8]))
+
+	type rawFrame struct {
+		control []byte
+		data    [][]byte
+	}
+
+	var plays int
+	var shared []pngChunk
+	var frames []*rawFrame
+	var current *rawFrame
+	seenIDAT := false
+
+	for _, chunk := range chunks[1:] {
+		switch chunk.kind {
+		case "acTL":
+			if len(chunk.data) != 8 {
+				return nil, 0, fmt.Errorf("invalid acTL chunk")
+			}
+
+			plays = int(binary.BigEndian.Uint32(chunk.data[4:8]))
+		case "fcTL":
+			if len(chunk.data) != 26 {
+				return nil, 0, fmt.Errorf("invalid fcTL chunk")
+			}
+
+			current = &rawFrame{control: chunk.data}
+			frames = append(frames, current)
+		case "IDAT":
+			seenIDAT = true
+
+			// image data without a preceding fcTL is a default image that is not part of the animation
+			if current != nil {
+				current.data = append(current.data, chunk.data)
+			}
+		case "fdAT":
+			if current == nil || len(chunk.data) < 4 {
+				return nil, 0, fmt.Errorf("invalid fdAT chunk")
+			}
+
+			current.data = append(current.data, chunk.data[4:])
+		case "IEND":
+		default:
+			// palettes, transparency, gamma and so on apply to every frame
+			if !seenIDAT {
+				shared = append(shared, chunk)
+			}
+		}
+	}
+
+	if len(frames) == 0 {
+		return nil, 0, fmt.Errorf("PNG file has no animation frames")
+	}
+
+	if limit > 0 && len(frames) > limit {
+		frames = frames[:limit]
+	}
+
+	canvas := image.NewNRGBA(image.Rect(0, 0, width, height))
+	var decoded []animationFrame
+
+	for _, frame := range frames {
+		c := frame.control
+		frameWidth := binary.BigEndian.Uint32(c[4:8])
+		frameHeight := binary.BigEndian.Uint32(c[8:12])
+		x := int(binary.BigEndian.Uint32(c[12:16]))
+		y := int(binary.BigEndian.Uint32(c[16:20]))
+		delayNum := binary.BigEndian.Uint16(c[20:22])
+		delayDen := binary.BigEndian.Uint16(c[22:24])
+		dispose := c[24]
+		blend := c[25]
+
+		// frames may not reach outside the canvas, which also bounds how much decoding them takes
+		area := image.Rect(x, y, x+int(frameWidth), y+int(frameHeight))
+
+		if frameWidth > uint32(width) || frameHeight > uint32(height) || !area.In(canvas.Bounds()) {
+			return nil, 0, fmt.Errorf("APNG frame lies outside the image")
+		}
+
+		// each frame is decoded as a standalone PNG sharing the header of the whole image
+		header := make([]byte, 13)
+		copy(header, ihdr)
+		binary.BigEndian.PutUint32(header[0:4], frameWidth)
+		binary.BigEndian.PutUint32(header[4:8], frameHeight)
+
+		var buf bytes.Buffer
+		buf.Write(pngSignature)
+		writePNGChunk(&buf, "IHDR", header)
+
+		for _, chunk := range shared {
+			writePNGChunk(&buf, chunk.kind, chunk.data)
+		}
+
+		writePNGChunk(&buf, "IDAT", bytes.Join(frame.data, nil))
+		writePNGChunk(&buf, "IEND", nil)
+
+		img, err := png.Decode(&buf)
+
+		if err != nil {
+			return nil, 0, err
+		}
+
+		var previous *image.NRGBA
+
+		if dispose == apngDisposePrevious {
+			previous = cloneNRGBA(canvas)
+		}
+
+		op := draw.Over
+
+		if blend == apngBlendSource {
+			op = draw.Src
+		}
+
+		draw.Draw(canvas, area, img, img.Bounds().Min, op)
+
+		if delayDen == 0 {
+			delayDen = 100
+		}
+
+		decoded = append(decoded, animationFrame{
+			image: cloneNRGBA(canvas),
+			delay: time.Duration(delayNum) * time.Second / time.Duration(delayDen),
+		})
+
+		switch dispose {
+		case apngDisposeBackground:
+			draw.Draw(canvas, area, image.Transparent, image.Point{}, draw.Src)
+		case apngDisposePrevious:
+			canvas = previous
+		}
+	}
+
+	return decoded, plays, nil
+}
+
+// encodeAPNG writes frames, which must all be the same size, as an animated PNG. Every frame covers the whole canvas
+// and is stored as 8 bit RGBA.
+func encodeAPNG(w io.Writer, frames []animationFrame, plays int) error {
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames to encode")
+	}
+
+	bounds := frames[0].image.Bounds()
+
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+
+	header := make([]byte, 13)
+	binary.BigEndian.PutUint32(header[0:4], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(header[4:8], uint32(bounds.Dy()))
+	header[8] = 8 // bit depth
+	header[9] = 6 // colour type: truecolour with alpha
+	writePNGChunk(&buf, "IHDR", header)
+
+	actl := make([]byte, 8)
+	binary.BigEndian.PutUint32(actl[0:4], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:8], uint32(plays))
+	writePNGChunk(&buf, "acTL", actl)
+
+	var sequence uint32
+
+	for i, frame := range frames {
+		if frame.image.Bounds() != bounds {
+			return fmt.Errorf("frame %d is not the same size as the first frame", i)
+		}
+
+		fctl := make([]byte, 26)
+		binary.BigEndian.PutUint32(fctl[0:4], sequence)
+		binary.BigEndian.PutUint32(fctl[4:8], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:12], uint32(bounds.Dy()))
+		binary.BigEndian.PutUint16(fctl[20:22], uint16(frame.delay.Milliseconds()))
+		binary.BigEndian.PutUint16(fctl[22:24], 1000)
+		fctl[24] = apngDisposeNone
+		fctl[25] = apngBlendSource
+		writePNGChunk(&buf, "fcTL", fctl)
+		sequence++
+
+		pixels, err := compressNRGBA(frame.image)
+
+		if err != nil {
+			return err
+		}
+
+		if i == 0 {
+			writePNGChunk(&buf, "IDAT", pixels)
+		} else {
+			fdat := make([]byte, 4, 4+len(pixels))
+			binary.BigEndian.PutUint32(fdat, sequence)
+			writePNGChunk(&buf, "fdAT", append(fdat, pixels...))
+			sequence++
+		}
+	}
+
+	writePNGChunk(&buf, "IEND", nil)
+
+	_, err := w.Write(buf.Bytes())
+
+	return err
+}
+
+// compressNRGBA returns the zlib compressed scanlines of img, each using filter type 0 (none).
+func compressNRGBA(img *image.NRGBA) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	bounds := img.Bounds()
+	rowLength := bounds.Dx() * 4
+
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		offset := img.PixOffset(bounds.Min.X, y)
+
+		if _, err := zw.Write([]byte{0}); err != nil {
+			return nil, err
+		}
+
+		if _, err := zw.Write(img.Pix[offset : offset+rowLength]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func writePNGChunk(buf *bytes.Buffer, kind string, data []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(data)))
+	buf.Write(length[:])
+
+	crc := crc32.NewIEEE()
+	crc.Write([]byte(kind))
+	crc.Write(data)
+
+	buf.WriteString(kind)
+	buf.Write(data)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc.Sum32())
+	buf.Write(sum[:])
+}
+
+func cloneNRGBA(src *image.NRGBA) *image.NRGBA {
+	dst := image.NewNRGBA(src.Bounds())
+	copy(dst.Pix, src.Pix)
+
+	return dst
+}
@@ -0,0 +1,172 @@
+package web
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+// testAnimation returns count solid frames of the given size, each a different shade of red.
+func testAnimation(count, width, height int, delay time.Duration) []animationFrame {
+	var frames []animationFrame
+
+	for i := 0; i < count; i++ {
+		img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+		for p := 0; p < len(img.Pix); p += 4 {
+			img.Pix[p] = uint8(255 - i*10)
+			img.Pix[p+3] = 255
+		}
+
+		frames = append(frames, animationFrame{image: img, delay: delay})
+	}
+
+	return frames
+}
+
+func Test_APNG_RoundTrip(t *testing.T) {
+	frames := testAnimation(3, 20, 10, 100*time.Millisecond)
+
+	var buf bytes.Buffer
+
+	if err := encodeAPNG(&buf, frames, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !isAPNG(buf.Bytes()) {
+		t.Fatal("encoded animation is not detected as an APNG")
+	}
+
+	decoded, plays, err := decodeAPNG(buf.Bytes(), 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plays != 2 {
+		t.Errorf("expected 2 plays, got %d", plays)
+	}
+
+	if len(decoded) != len(frames) {
+		t.Fatalf("expected %d frames, got %d", len(frames), len(decoded))
+	}
+
+	for i, frame := range decoded {
+		if frame.delay != 100*time.Millisecond {
+			t.Errorf("frame %d: expected delay of 100ms, got %s", i, frame.delay)
+		}
+
+		if !bytes.Equal(frame.image.Pix, frames[i].image.Pix) {
+			t.Errorf("frame %d: pixels differ after round trip", i)
+		}
+	}
+
+	// browsers without APNG support show the first frame, and so does the standard library
+	img, err := png.Decode(bytes.NewReader(buf.Bytes()))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := color.NRGBAModel.Convert(img.At(0, 0)).(color.NRGBA); c.R != 255 {
+		t.Errorf("expected default image to be the first frame, got %v", c)
+	}
+}
+
+func Test_isAPNG(t *testing.T) {
+	static, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isAPNG(static) {
+		t.Error("static PNG detected as animated")
+	}
+
+	if isAPNG([]byte("GIF89a")) {
+		t.Error("GIF detected as an animated PNG")
+	}
+
+	var single bytes.Buffer
+	_ = encodeAPNG(&single, testAnimation(1, 4, 4, time.Second), 0)
+
+	if isAPNG(single.Bytes()) {
+		t.Error("single frame APNG detected as animated")
+	}
+}
+
+func Test_decodeAPNG_Disposal(t *testing.T) {
+	// a 4x4 red canvas with a 2x2 blue frame drawn over it and then disposed back to the background
+	var buf bytes.Buffer
+	frames := testAnimation(1, 4, 4, time.Second)
+
+	if err := encodeAPNG(&buf, frames, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	chunks, err := readPNGChunks(buf.Bytes())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blue := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+
+	for p := 0; p < len(blue.Pix); p += 4 {
+		blue.Pix[p+2] = 255
+		blue.Pix[p+3] = 255
+	}
+
+	pixels, _ := compressNRGBA(blue)
+
+	var out bytes.Buffer
+	out.Write(pngSignature)
+
+	for _, chunk := range chunks {
+		switch chunk.kind {
+		case "acTL":
+			actl := append([]byte{}, chunk.data...)
+			actl[3] = 3
+			writePNGChunk(&out, "acTL", actl)
+		case "IEND":
+			// second frame: blue square at (1, 1), cleared to transparent afterwards
+			writePNGChunk(&out, "fcTL", []byte{0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 2, 0, 0, 0, 1, 0, 0, 0, 1, 0, 1, 0, 10, apngDisposeBackground, apngBlendOver})
+			writePNGChunk(&out, "fdAT", append([]byte{0, 0, 0, 2}, pixels...))
+			// third frame: nothing new, so it shows what disposal left behind
+			empty := image.NewNRGBA(image.Rect(0, 0, 1, 1))
+			emptyPixels, _ := compressNRGBA(empty)
+			writePNGChunk(&out, "fcTL", []byte{0, 0, 0, 3, 0, 0, 0, 1, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 0, 10, apngDisposeNone, apngBlendOver})
+			writePNGChunk(&out, "fdAT", append([]byte{0, 0, 0, 4}, emptyPixels...))
+			writePNGChunk(&out, "IEND", nil)
+		default:
+			writePNGChunk(&out, chunk.kind, chunk.data)
+		}
+	}
+
+	decoded, _, err := decodeAPNG(out.Bytes(), 0)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(decoded))
+	}
+
+	if c := decoded[1].image.NRGBAAt(1, 1); c.B != 255 || c.R != 0 {
+		t.Errorf("expected blue square in second frame, got %v", c)
+	}
+
+	if c := decoded[2].image.NRGBAAt(1, 1); c.A != 0 {
+		t.Errorf("expected square to be cleared in third frame, got %v", c)
+	}
+
+	if c := decoded[2].image.NRGBAAt(0, 0); c.R != 255 {
+		t.Errorf("expected untouched area to stay red, got %v", c)
+	}
+}
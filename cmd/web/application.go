@@ -2,11 +2,31 @@ package web
 
 import (
 	"github.com/alexedwards/scs/v2"
+	"github.com/spartanhooah/profile-picture-web/data"
 	"github.com/spartanhooah/profile-picture-web/db/repository"
+	"time"
 )
 
 type Application struct {
 	Session    *scs.SessionManager
 	Datasource string
 	DB         repository.DatabaseRepo
+	Images     ImageConfig
+	AvatarURLs AvatarURLConfig
+	Quotas     QuotaConfig
+	JWT        JWTConfig
+	Provider   ProviderConfig
+	// SSO is nil unless signing in with an external OpenID Connect provider is configured.
+	SSO     *SSO
+	Scanner Scanner
+	// ScanFailOpen accepts uploads when the scanner cannot be reached, instead of rejecting them.
+	ScanFailOpen bool
+	// DeletedUserRetention is how long deleted users can be restored for before they are purged.
+	DeletedUserRetention time.Duration
+	Passwords            PasswordPolicy
+	// PasswordHasher hashes new passwords; stored hashes it would not have made are replaced when their users sign in.
+	PasswordHasher data.PasswordHasher
+	Mailer         Mailer
+	// PublicProfiles lets people who are not signed in see the directory and the profiles users have made public.
+	PublicProfiles bool
 }
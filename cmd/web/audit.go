@@ -0,0 +1,255 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+// auditPageSize is how many events the audit log viewer shows at a time.
+const auditPageSize = 50
+
+// auditVerifyBatch is how many events VerifyAuditLog reads from the database at a time.
+const auditVerifyBatch = 500
+
+// audit records in the audit log that the caller did action to the target user, along with where the request came
+// from. An administrator impersonating someone is recorded as themselves, not as the user they are acting as.
+// Failures are logged as well as returned, so callers that cannot undo what they did may ignore them.
+func (app *Application) audit(req *http.Request, action string, targetUserID int, details any) error {
+	event := data.AuditEvent{
+		TargetUserID: targetUserID,
+		Action:       action,
+		IP:           app.ipFromContext(req.Context()),
+		UserAgent:    req.UserAgent(),
+	}
+
+	if impersonator, ok := app.Session.Get(req.Context(), "impersonator").(data.User); ok {
+		event.ActorID = impersonator.ID
+	} else if caller := app.apiCallerFromContext(req.Context()); caller.User.ID != 0 {
+		event.ActorID = caller.User.ID
+	} else if user, ok := app.Session.Get(req.Context(), "user").(data.User); ok {
+		event.ActorID = user.ID
+	}
+
+	if details != nil {
+		var err error
+		event.Details, err = json.Marshal(details)
+
+		if err != nil {
+			log.Println("Could not write audit event:", err)
+			return err
+		}
+	}
+
+	_, err := app.DB.InsertAuditEvent(event)
+
+	if err != nil {
+		log.Println("Could not write audit event:", err)
+	}
+
+	return err
+}
+
+// auditUpload records that a new profile picture was stored.
+func (app *Application) auditUpload(req *http.Request, image *data.UserImage) {
+	_ = app.audit(req, data.AuditImageUploaded, image.UserID, map[string]any{
+		"file_name": image.FileName,
+		"file_size": image.FileSize,
+	})
+}
+
+// auditChange is a field's value before and after a change.
+type auditChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// auditDiff returns the fields whose values differ between before and after, as they appear in JSON; fields
+// which are never shown, such as passwords, are never recorded either.
+func auditDiff(before, after any) map[string]auditChange {
+	from, to := auditFields(before), auditFields(after)
+	changes := make(map[string]auditChange)
+
+	for field, value := range to {
+		if !reflect.DeepEqual(from[field], value) {
+			changes[field] = auditChange{from[field], value}
+		}
+	}
+
+	for field, value := range from {
+		if _, ok := to[field]; !ok {
+			changes[field] = auditChange{value, nil}
+		}
+	}
+
+	return changes
+}
+
+func auditFields(v any) map[string]any {
+	var fields map[string]any
+
+	encoded, err := json.Marshal(v)
+
+	if err == nil {
+		_ = json.Unmarshal(encoded, &fields)
+	}
+
+	return fields
+}
+
+// auditChainError reports the first event in the audit log found to have been tampered with.
+type auditChainError struct {
+	ID     int
+	Reason string
+}
+
+func (e auditChainError) Error() string {
+	return fmt.Sprintf("audit event %d %s", e.ID, e.Reason)
+}
+
+// verifyAuditEvents checks that each event follows on from the one before it, the first from prevHash, and that
+// nothing recorded about it has changed since. Anonymized events must have had all of their personal data removed
+// and nothing else. The hash of a version 1 event covers its personal data, so once anonymized it can only be checked
+// by the events after it following on from it. It returns the hash of the last event.
+func verifyAuditEvents(prevHash string, events []*data.AuditEvent) (string, error) {
+	for _, e := range events {
+		// events written before the log was chained have no hash, and can only come before the chain starts
+		if e.Hash == "" && prevHash == "" {
+			continue
+		}
+
+		if e.PrevHash != prevHash {
+			return "", auditChainError{e.ID, "does not follow on from the event before it"}
+		}
+
+		// anonymized events no longer have the data their hashes were worked out from, but still have the hashes
+		if e.AnonymizedAt == nil {
+			detailsHash, err := e.HashDetails()
+
+			if err != nil || detailsHash != e.DetailsHash {
+				return "", auditChainError{e.ID, "has had its details changed"}
+			}
+
+			if e.HashVersion >= 2 && e.HashPersonal() != e.PersonalHash {
+				return "", auditChainError{e.ID, "has had who, or where from, changed"}
+			}
+		} else if e.ActorID != 0 || e.TargetUserID != 0 || e.IP != "" || e.UserAgent != "" || len(e.Details) != 0 {
+			return "", auditChainError{e.ID, "is marked anonymized but still has personal data"}
+		}
+
+		if (e.AnonymizedAt == nil || e.HashVersion >= 2) && e.ComputeHash() != e.Hash {
+			return "", auditChainError{e.ID, "has been changed"}
+		}
+
+		prevHash = e.Hash
+	}
+
+	return prevHash, nil
+}
+
+// VerifyAuditLog checks the whole audit log, oldest event first, and writes how many events it checked and the
+// hash of the latest. Removing events from the end of the log cannot be detected from the log alone, so keep the
+// latest hash somewhere safe and check it is still there next time.
+func (app *Application) VerifyAuditLog(out io.Writer) error {
+	var checked int
+	var prevHash string
+	filter := data.AuditFilter{Ascending: true, Limit: auditVerifyBatch}
+
+	for {
+		events, err := app.DB.GetAuditEvents(filter)
+
+		if err != nil {
+			return err
+		}
+
+		if len(events) == 0 {
+			break
+		}
+
+		prevHash, err = verifyAuditEvents(prevHash, events)
+
+		if err != nil {
+			return err
+		}
+
+		checked += len(events)
+		filter.Cursor = events[len(events)-1].ID
+	}
+
+	_, err := fmt.Fprintf(out, "Verified %d audit events; the latest hash is %q\n", checked, prevHash)
+
+	return err
+}
+
+// auditUserParam turns the actor or target in the audit log viewer's query string, which may be an id or an email
+// address, into a user id. Unknown email addresses become an id no user has, so they match nothing.
+func (app *Application) auditUserParam(value string) int {
+	if value == "" {
+		return 0
+	}
+
+	if id, err := strconv.Atoi(value); err == nil {
+		return id
+	}
+
+	user, err := app.DB.GetUserByEmail(value)
+
+	if err != nil {
+		return -1
+	}
+
+	return user.ID
+}
+
+// AdminAudit shows the audit log, newest first, filtered by who did what to whom and when.
+func (app *Application) AdminAudit(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	filter := data.AuditFilter{
+		ActorID:      app.auditUserParam(query.Get("actor")),
+		TargetUserID: app.auditUserParam(query.Get("target")),
+		Action:       query.Get("action"),
+		Limit:        auditPageSize + 1,
+	}
+
+	// dates are whole days, and the end date is included
+	if from, err := time.Parse(time.DateOnly, query.Get("from")); err == nil {
+		filter.From = from
+	}
+
+	if to, err := time.Parse(time.DateOnly, query.Get("to")); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+
+	filter.Cursor, _ = strconv.Atoi(query.Get("before"))
+
+	events, err := app.DB.GetAuditEvents(filter)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{
+		"events":  events,
+		"actions": data.AuditActions,
+		"filter":  query,
+	}
+
+	if len(events) > auditPageSize {
+		events = events[:auditPageSize]
+		td["events"] = events
+
+		next := req.URL.Query()
+		next.Set("before", strconv.Itoa(events[len(events)-1].ID))
+		td["next"] = "/admin/audit?" + next.Encode()
+	}
+
+	_ = app.Render(resp, req, "admin-audit.page.gohtml", &TemplateData{Data: td})
+}
@@ -0,0 +1,250 @@
+package web
+
+import (
+	"bytes"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_auditDiff(t *testing.T) {
+	before := data.User{ID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Password: "old"}
+
+	var tests = []struct {
+		name     string
+		after    data.User
+		expected map[string]auditChange
+	}{
+		{"nothing changed", before, map[string]auditChange{}},
+		{"email changed", data.User{ID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane.doe@example.com", Password: "old"},
+			map[string]auditChange{"email": {"jane@example.com", "jane.doe@example.com"}}},
+		{"password is never recorded", data.User{ID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", Password: "new"},
+			map[string]auditChange{}},
+		{"external id removed", data.User{ID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane@example.com", ExternalID: "hr-1"},
+			map[string]auditChange{"external_id": {nil, "hr-1"}}},
+	}
+
+	for _, test := range tests {
+		changes := auditDiff(before, test.after)
+
+		if !reflect.DeepEqual(changes, test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, changes)
+		}
+	}
+
+	changes := auditDiff(data.User{ExternalID: "hr-1"}, data.User{})
+
+	if change := changes["external_id"]; change.From != "hr-1" || change.To != nil {
+		t.Errorf("expected a removed field to change to nil, got %v", changes)
+	}
+}
+
+// auditChain returns events chained together the way the database chains them.
+func auditChain(version int, actions ...string) []*data.AuditEvent {
+	var events []*data.AuditEvent
+	var prevHash string
+
+	for i, action := range actions {
+		e := &data.AuditEvent{
+			ID:           i + 1,
+			ActorID:      1,
+			TargetUserID: 2,
+			Action:       action,
+			IP:           "127.0.0.1",
+			Details:      []byte(`{"b": 2, "a": 1}`),
+			CreatedAt:    time.Date(2024, 1, 1, 9, i, 0, 0, time.UTC),
+			PrevHash:     prevHash,
+			HashVersion:  version,
+		}
+
+		e.DetailsHash, _ = e.HashDetails()
+
+		if version >= 2 {
+			e.PersonalHash = e.HashPersonal()
+		}
+
+		e.Hash = e.ComputeHash()
+		prevHash = e.Hash
+		events = append(events, e)
+	}
+
+	return events
+}
+
+func Test_verifyAuditEvents(t *testing.T) {
+	var tests = []struct {
+		name       string
+		tamper     func(events []*data.AuditEvent) []*data.AuditEvent
+		expectedID int
+	}{
+		{"untouched", func(events []*data.AuditEvent) []*data.AuditEvent { return events }, 0},
+		{"details reformatted", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1].Details = []byte(`{"a":1,"b":2}`)
+			return events
+		}, 0},
+		{"details changed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1].Details = []byte(`{"a":1,"b":3}`)
+			return events
+		}, 2},
+		{"action changed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[0].Action = data.AuditUserUpdated
+			return events
+		}, 1},
+		{"actor changed and rehashed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1].ActorID = 3
+			events[1].Hash = events[1].ComputeHash()
+			return events
+		}, 3},
+		{"event removed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			return append(events[:1], events[2:]...)
+		}, 3},
+		{"events swapped", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1], events[2] = events[2], events[1]
+			return events
+		}, 3},
+		{"written before the chain", func(events []*data.AuditEvent) []*data.AuditEvent {
+			return append([]*data.AuditEvent{{ID: 0, Action: data.AuditImpersonationStarted}}, events...)
+		}, 0},
+		{"hash removed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1].Hash = ""
+			return events
+		}, 2},
+	}
+
+	for _, test := range tests {
+		events := test.tamper(auditChain(1, data.AuditUserCreated, data.AuditPasswordReset, data.AuditUserDeleted))
+
+		_, err := verifyAuditEvents("", events)
+
+		if test.expectedID == 0 {
+			if err != nil {
+				t.Errorf("%s: expected the chain to verify, got %s", test.name, err)
+			}
+
+			continue
+		}
+
+		chainErr, ok := err.(auditChainError)
+
+		if !ok || chainErr.ID != test.expectedID {
+			t.Errorf("%s: expected event %d to fail, got %v", test.name, test.expectedID, err)
+		}
+	}
+}
+
+func Test_verifyAuditEvents_anonymized(t *testing.T) {
+	anonymize := func(e *data.AuditEvent) {
+		anonymizedAt := time.Now()
+		e.ActorID, e.TargetUserID, e.IP, e.UserAgent, e.Details, e.AnonymizedAt = 0, 0, "", "", nil, &anonymizedAt
+	}
+
+	var tests = []struct {
+		name       string
+		tamper     func(events []*data.AuditEvent) []*data.AuditEvent
+		expectedID int
+	}{
+		{"untouched", func(events []*data.AuditEvent) []*data.AuditEvent { return events }, 0},
+		{"anonymized", func(events []*data.AuditEvent) []*data.AuditEvent {
+			anonymize(events[1])
+			return events
+		}, 0},
+		{"anonymized and action changed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			anonymize(events[1])
+			events[1].Action = data.AuditUserUpdated
+			return events
+		}, 2},
+		{"anonymized but the actor kept", func(events []*data.AuditEvent) []*data.AuditEvent {
+			anonymize(events[1])
+			events[1].ActorID = 1
+			return events
+		}, 2},
+		{"anonymized but the user agent kept", func(events []*data.AuditEvent) []*data.AuditEvent {
+			anonymize(events[1])
+			events[1].UserAgent = "Go-http-client/1.1"
+			return events
+		}, 2},
+		{"actor changed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1].ActorID = 3
+			return events
+		}, 2},
+		{"ip changed and rehashed", func(events []*data.AuditEvent) []*data.AuditEvent {
+			events[1].IP = "10.0.0.1"
+			events[1].PersonalHash = events[1].HashPersonal()
+			events[1].Hash = events[1].ComputeHash()
+			return events
+		}, 3},
+		{"following on from version 1", func(events []*data.AuditEvent) []*data.AuditEvent {
+			legacy := auditChain(1, data.AuditUserCreated)[0]
+			events[0].PrevHash = legacy.Hash
+			events[0].Hash = events[0].ComputeHash()
+			events[1].PrevHash = events[0].Hash
+			events[1].Hash = events[1].ComputeHash()
+			events[2].PrevHash = events[1].Hash
+			events[2].Hash = events[2].ComputeHash()
+			return append([]*data.AuditEvent{legacy}, events...)
+		}, 0},
+		{"version 1 anonymized", func(events []*data.AuditEvent) []*data.AuditEvent {
+			legacy := auditChain(1, data.AuditUserCreated)[0]
+			anonymize(legacy)
+			events[0].PrevHash = legacy.Hash
+			events[0].Hash = events[0].ComputeHash()
+			events[1].PrevHash = events[0].Hash
+			events[1].Hash = events[1].ComputeHash()
+			events[2].PrevHash = events[1].Hash
+			events[2].Hash = events[2].ComputeHash()
+			return append([]*data.AuditEvent{legacy}, events...)
+		}, 0},
+	}
+
+	for _, test := range tests {
+		events := test.tamper(auditChain(data.AuditHashVersion, data.AuditUserCreated, data.AuditPasswordReset, data.AuditUserDeleted))
+
+		_, err := verifyAuditEvents("", events)
+
+		if test.expectedID == 0 {
+			if err != nil {
+				t.Errorf("%s: expected the chain to verify, got %s", test.name, err)
+			}
+
+			continue
+		}
+
+		chainErr, ok := err.(auditChainError)
+
+		if !ok || chainErr.ID != test.expectedID {
+			t.Errorf("%s: expected event %d to fail, got %v", test.name, test.expectedID, err)
+		}
+	}
+}
+
+func Test_Application_VerifyAuditLog(t *testing.T) {
+	var out bytes.Buffer
+
+	err := app.VerifyAuditLog(&out)
+
+	if err != nil {
+		t.Fatalf("expected the audit log to verify, got %s", err)
+	}
+
+	if !strings.HasPrefix(out.String(), "Verified 2 audit events") {
+		t.Errorf("expected to be told how many events were checked, got %q", out.String())
+	}
+}
+
+func Test_Application_AdminAudit(t *testing.T) {
+	_, resp := adminRequest(http.MethodGet, "/admin/audit?target=2&action=user.update", "", nil, data.User{ID: 1, IsAdmin: 1}, app.AdminAudit)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+
+	for _, expected := range []string{"user.password_reset", "admin@example.com", `href="/admin/audit?target=2"`,
+		`<option value="user.update" selected>`, "jane.doe@example.com"} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected the audit log to contain %q", expected)
+		}
+	}
+}
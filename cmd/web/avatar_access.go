@@ -0,0 +1,173 @@
+package web
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AvatarURLConfig is how links to avatars that are not public are signed. A signed link works for anyone who has
+// it until it expires, so pages can be cached, and the avatars themselves can be cached by a CDN.
+type AvatarURLConfig struct {
+	// Key is the HMAC-SHA256 key links are signed with.
+	Key []byte
+	// TTL is how long a link works for. Links are issued for windows of half the TTL, so pages rendered in the same
+	// window link to the same URL, and every link works for at least half the TTL.
+	TTL time.Duration
+}
+
+func DefaultAvatarURLConfig() AvatarURLConfig {
+	return AvatarURLConfig{TTL: 24 * time.Hour}
+}
+
+func (cfg AvatarURLConfig) signature(fileName string, expires int64) string {
+	mac := hmac.New(sha256.New, cfg.Key)
+	mac.Write([]byte(fileName + "\n" + strconv.FormatInt(expires, 10)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sign returns the query parameters that let whoever has them see fileName until a while after now.
+func (cfg AvatarURLConfig) sign(fileName string, now time.Time) url.Values {
+	window := max(cfg.TTL/2, time.Second)
+	expires := now.Truncate(window).Add(window * 2).Unix()
+
+	return url.Values{
+		"expires": {strconv.FormatInt(expires, 10)},
+		"sig":     {cfg.signature(fileName, expires)},
+	}
+}
+
+// verify reports whether query holds a signature for fileName, and when it expires. The expiry is only meaningful
+// if the signature is valid.
+func (cfg AvatarURLConfig) verify(fileName string, query url.Values) (bool, time.Time) {
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+
+	if err != nil || len(cfg.Key) == 0 {
+		return false, time.Time{}
+	}
+
+	valid := hmac.Equal([]byte(query.Get("sig")), []byte(cfg.signature(fileName, expires)))
+
+	return valid, time.Unix(expires, 0)
+}
+
+// avatarVisible reports whether viewer, who is the zero User if no one is signed in, may see owner's avatar without
+// a signed link.
+func avatarVisible(viewer, owner data.User) bool {
+	switch owner.AvatarVisibility {
+	case data.AvatarVisibilityMembers:
+		return viewer.ID != 0
+	case data.AvatarVisibilityPrivate:
+		return viewer.ID != 0 && (viewer.ID == owner.ID || viewer.Can(data.PermissionReadUsers))
+	default:
+		return true
+	}
+}
+
+// avatarCacheControl decides whether a request may see owner's avatar, stored as fileName. Anyone may see a public
+// avatar, and anyone with an unexpired signed link one that is not; otherwise it depends on who is signed in. It
+// returns the Cache-Control header to serve the avatar with, or the status to refuse it with: forbidden if the link
+// has expired, and not found otherwise.
+func (app *Application) avatarCacheControl(req *http.Request, fileName string, owner data.User) (string, int) {
+	if owner.AvatarVisibility == "" || owner.AvatarVisibility == data.AvatarVisibilityPublic {
+		return "public, max-age=86400", 0
+	}
+
+	valid, expires := app.AvatarURLs.verify(fileName, req.URL.Query())
+
+	if remaining := int(time.Until(expires).Seconds()); valid && remaining > 0 {
+		// the link is the credential, so shared caches may keep the response for as long as the link works
+		return "public, max-age=" + strconv.Itoa(min(remaining, 86400)), 0
+	}
+
+	viewer, _ := app.Session.Get(req.Context(), "user").(data.User)
+
+	if !avatarVisible(viewer, owner) {
+		if valid {
+			return "", http.StatusForbidden
+		}
+
+		// as if there were no such avatar, so file names cannot be probed
+		return "", http.StatusNotFound
+	}
+
+	return "private, max-age=300", 0
+}
+
+// avatarURL links to the avatar stored as fileName, at size, or as stored if size is 0, and as variant, or as uploaded
+// if variant is empty. Avatars that are not public get a signed link, so it must only be given to someone who may
+// see them.
+func (app *Application) avatarURL(fileName, visibility string, size int, variant string) string {
+	query := url.Values{}
+
+	if visibility != "" && visibility != data.AvatarVisibilityPublic {
+		query = app.AvatarURLs.sign(fileName, time.Now())
+	}
+
+	if size > 0 {
+		query.Set("size", strconv.Itoa(size))
+	}
+
+	if variant != "" {
+		query.Set("variant", variant)
+	}
+
+	link := "/avatars/" + url.PathEscape(fileName)
+
+	if len(query) > 0 {
+		link += "?" + query.Encode()
+	}
+
+	return link
+}
+
+// avatarURLFunc returns the avatarURL template function for viewer, who is the zero User if no one is signed in. It
+// links to a user's current profile picture, or returns nothing if they have none or the viewer may not see it.
+func (app *Application) avatarURLFunc(viewer data.User) func(owner data.User, size int) string {
+	return func(owner data.User, size int) string {
+		if owner.ProfilePicture.FileName == "" || !avatarVisible(viewer, owner) {
+			return ""
+		}
+
+		return app.avatarURL(owner.ProfilePicture.FileName, owner.AvatarVisibility, size, "")
+	}
+}
+
+// staticFileSystem serves static assets, but not the uploads directory if it is among them: uploads are only served
+// by Avatar, which checks who may see them.
+type staticFileSystem struct {
+	http.FileSystem
+	root string
+}
+
+func (fs staticFileSystem) Open(name string) (http.File, error) {
+	upload, err := filepath.Abs(uploadPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	requested, err := filepath.Abs(filepath.Join(fs.root, filepath.FromSlash(path.Clean("/"+name))))
+
+	if err != nil {
+		return nil, err
+	}
+
+	// compare without case, in case the file system does
+	if rel, err := filepath.Rel(strings.ToLower(upload), strings.ToLower(requested)); err == nil &&
+		rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, os.ErrNotExist
+	}
+
+	return fs.FileSystem.Open(name)
+}
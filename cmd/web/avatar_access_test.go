@@ -0,0 +1,226 @@
+package web
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_AvatarURLConfig_sign(t *testing.T) {
+	cfg := AvatarURLConfig{Key: []byte("key"), TTL: 24 * time.Hour}
+	now := time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)
+	signed := cfg.sign("img.png", now)
+
+	tampered := url.Values{"expires": signed["expires"], "sig": {strings.Repeat("0", 64)}}
+	later, _ := strconv.ParseInt(signed.Get("expires"), 10, 64)
+	extended := url.Values{"expires": {strconv.FormatInt(later+3600, 10)}, "sig": signed["sig"]}
+
+	var tests = []struct {
+		name          string
+		cfg           AvatarURLConfig
+		fileName      string
+		query         url.Values
+		expectedValid bool
+	}{
+		{"signed", cfg, "img.png", signed, true},
+		{"another file", cfg, "other.png", signed, false},
+		{"tampered signature", cfg, "img.png", tampered, false},
+		{"extended expiry", cfg, "img.png", extended, false},
+		{"another key", AvatarURLConfig{Key: []byte("other"), TTL: cfg.TTL}, "img.png", signed, false},
+		{"no key", AvatarURLConfig{TTL: cfg.TTL}, "img.png", signed, false},
+		{"unsigned", cfg, "img.png", url.Values{}, false},
+	}
+
+	for _, test := range tests {
+		if valid, _ := test.cfg.verify(test.fileName, test.query); valid != test.expectedValid {
+			t.Errorf("%s: expected valid to be %t, got %t", test.name, test.expectedValid, valid)
+		}
+	}
+
+	_, expires := cfg.verify("img.png", signed)
+
+	if remaining := expires.Sub(now); remaining < cfg.TTL/2 || remaining > cfg.TTL {
+		t.Errorf("expected the link to work for between half the TTL and the TTL, got %s", remaining)
+	}
+
+	if again := cfg.sign("img.png", now.Add(time.Minute)); again.Encode() != signed.Encode() {
+		t.Error("expected links signed in the same window to be the same")
+	}
+}
+
+func Test_avatarVisible(t *testing.T) {
+	owner := data.User{ID: 1}
+	member := data.User{ID: 2}
+	admin := data.User{ID: 3, Permissions: []string{data.PermissionReadUsers}}
+
+	var tests = []struct {
+		name       string
+		visibility string
+		viewer     data.User
+		expected   bool
+	}{
+		{"public", data.AvatarVisibilityPublic, data.User{}, true},
+		{"not chosen", "", data.User{}, true},
+		{"members when not signed in", data.AvatarVisibilityMembers, data.User{}, false},
+		{"members", data.AvatarVisibilityMembers, member, true},
+		{"private to someone else", data.AvatarVisibilityPrivate, member, false},
+		{"private to its owner", data.AvatarVisibilityPrivate, owner, true},
+		{"private to an administrator", data.AvatarVisibilityPrivate, admin, true},
+		{"private when not signed in", data.AvatarVisibilityPrivate, data.User{}, false},
+	}
+
+	for _, test := range tests {
+		owner.AvatarVisibility = test.visibility
+
+		if actual := avatarVisible(test.viewer, owner); actual != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, actual)
+		}
+	}
+}
+
+func Test_Application_avatarURLFunc(t *testing.T) {
+	owner := data.User{ID: 8, AvatarVisibility: data.AvatarVisibilityMembers}
+	owner.ProfilePicture.FileName = "members.png"
+
+	if link := app.avatarURLFunc(data.User{})(owner, 64); link != "" {
+		t.Errorf("expected no link for someone who may not see the avatar, got %s", link)
+	}
+
+	link := app.avatarURLFunc(data.User{ID: 1})(owner, 64)
+	parsed, err := url.Parse(link)
+
+	if err != nil || parsed.Path != "/avatars/members.png" || parsed.Query().Get("size") != "64" {
+		t.Fatalf("expected a link to the avatar at size 64, got %s", link)
+	}
+
+	if valid, _ := app.AvatarURLs.verify("members.png", parsed.Query()); !valid {
+		t.Errorf("expected a signed link, got %s", link)
+	}
+
+	owner.AvatarVisibility = data.AvatarVisibilityPublic
+
+	if link := app.avatarURLFunc(data.User{})(owner, 0); link != "/avatars/members.png" {
+		t.Errorf("expected an unsigned link to a public avatar, got %s", link)
+	}
+
+	if link := app.avatarURLFunc(data.User{ID: 1})(data.User{ID: 2}, 64); link != "" {
+		t.Errorf("expected no link for a user without a picture, got %s", link)
+	}
+}
+
+func Test_Application_Avatar_visibility(t *testing.T) {
+	uploadPath = t.TempDir()
+	cachePath = filepath.Join(uploadPath, "cache")
+
+	img, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, fileName := range []string{"members.png", "private.png", posterFileName("private.png")} {
+		if err := os.WriteFile(filepath.Join(uploadPath, fileName), img, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expired := url.Values{"expires": {"1"}, "sig": {app.AvatarURLs.signature("private.png", 1)}}
+	poster := func(query url.Values) url.Values {
+		query.Set("variant", avatarVariantPoster)
+		return query
+	}
+
+	var tests = []struct {
+		name                 string
+		fileName             string
+		query                url.Values
+		viewer               *data.User
+		expectedStatus       int
+		expectedCacheControl string
+	}{
+		{"members when signed in", "members.png", nil, &data.User{ID: 1}, http.StatusOK, "private, max-age=300"},
+		{"members when not signed in", "members.png", nil, nil, http.StatusNotFound, ""},
+		{"members with a signed link", "members.png", app.AvatarURLs.sign("members.png", time.Now()), nil, http.StatusOK, "public"},
+		{"private to its owner", "private.png", nil, &data.User{ID: 11}, http.StatusOK, "private, max-age=300"},
+		{"private to someone else", "private.png", nil, &data.User{ID: 1}, http.StatusNotFound, ""},
+		{"private with a signed link", "private.png", app.AvatarURLs.sign("private.png", time.Now()), nil, http.StatusOK, "public"},
+		{"link for another avatar", "private.png", app.AvatarURLs.sign("members.png", time.Now()), nil, http.StatusNotFound, ""},
+		{"expired link", "private.png", expired, nil, http.StatusForbidden, ""},
+		{"expired link for its owner", "private.png", expired, &data.User{ID: 11}, http.StatusOK, "private, max-age=300"},
+		{"poster to its owner", "private.png", poster(url.Values{}), &data.User{ID: 11}, http.StatusOK, "private, max-age=300"},
+		{"poster to someone else", "private.png", poster(url.Values{}), &data.User{ID: 1}, http.StatusNotFound, ""},
+		{"poster with a signed link", "private.png", poster(app.AvatarURLs.sign("private.png", time.Now())), nil, http.StatusOK, "public"},
+		{"poster with a link for another avatar", "private.png", poster(app.AvatarURLs.sign("members.png", time.Now())), nil, http.StatusNotFound, ""},
+		{"missing poster", "members.png", poster(url.Values{}), &data.User{ID: 1}, http.StatusNotFound, ""},
+		{"unknown variant", "private.png", url.Values{"variant": {"thumbnail"}}, &data.User{ID: 11}, http.StatusBadRequest, ""},
+	}
+
+	for _, test := range tests {
+		target := "/avatars/" + test.fileName
+
+		if test.query != nil {
+			target += "?" + test.query.Encode()
+		}
+
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		if test.viewer != nil {
+			app.Session.Put(req.Context(), "user", *test.viewer)
+		}
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("fileName", test.fileName)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		app.Avatar(resp, req)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+			continue
+		}
+
+		if cacheControl := resp.Header().Get("Cache-Control"); !strings.HasPrefix(cacheControl, test.expectedCacheControl) {
+			t.Errorf("%s: expected Cache-Control %q, got %q", test.name, test.expectedCacheControl, cacheControl)
+		}
+	}
+}
+
+func Test_staticFileSystem(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+	fs := staticFileSystem{FileSystem: http.Dir("./testdata/"), root: "./testdata/"}
+
+	var tests = []struct {
+		name        string
+		path        string
+		expectFound bool
+	}{
+		{"static file", "/img.png", true},
+		{"upload", "/uploads/.gitkeep", false},
+		{"uploads directory", "/uploads", false},
+		{"upload in capitals", "/UPLOADS/.gitkeep", false},
+		{"upload through parent", "/cache/../uploads/.gitkeep", false},
+	}
+
+	for _, test := range tests {
+		f, err := fs.Open(test.path)
+
+		if err == nil {
+			_ = f.Close()
+		}
+
+		if (err == nil) != test.expectFound {
+			t.Errorf("%s: expected found to be %t, got %v", test.name, test.expectFound, err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cachePath is where transformed avatars are kept so each variant is only encoded once.
+var cachePath = "./cache"
+
+// avatarSizes are the widths, in pixels, an avatar may be requested at; no size serves the stored dimensions.
+var avatarSizes = []int{32, 64, 128, 256, 512}
+
+// avatarVariantPoster is the variant query parameter asking Avatar for the static poster of an avatar instead of the
+// avatar as uploaded.
+const avatarVariantPoster = "poster"
+
+var formatExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// acceptQuality returns the q value the Accept header gives contentType, and whether the type was named explicitly
+// rather than matched by a wildcard.
+func acceptQuality(accept, contentType string) (float64, bool) {
+	best, bestSpecificity := 0.0, -1
+	mainType, _, _ := strings.Cut(contentType, "/")
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		mediaRange = strings.ToLower(strings.TrimSpace(mediaRange))
+
+		var specificity int
+
+		switch mediaRange {
+		case contentType:
+			specificity = 2
+		case mainType + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		default:
+			continue
+		}
+
+		q := 1.0
+
+		for _, param := range strings.Split(params, ";") {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+
+			if strings.EqualFold(name, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if specificity > bestSpecificity {
+			best, bestSpecificity = q, specificity
+		}
+	}
+
+	return best, bestSpecificity == 2
+}
+
+// negotiateFormat picks the content type to serve an avatar in. WebP is only sent to clients that ask for it by
+// name, since plenty of clients send */* without being able to display it; everyone else gets fallback. Builds that
+// only encode lossless WebP only serve it in place of PNG.
+func negotiateFormat(accept, fallback string) string {
+	if webpLossless && fallback != "image/png" {
+		return fallback
+	}
+
+	webpQuality, named := acceptQuality(accept, "image/webp")
+
+	if !named || webpQuality <= 0 {
+		return fallback
+	}
+
+	if fallbackQuality, _ := acceptQuality(accept, fallback); webpQuality >= fallbackQuality {
+		return "image/webp"
+	}
+
+	return fallback
+}
+
+// fallbackFormat is the format served to clients that cannot take WebP: JPEG for photographs, PNG for anything
+// which may have transparency.
+func fallbackFormat(sourceType string) string {
+	if sourceType == "image/jpeg" {
+		return "image/jpeg"
+	}
+
+	return "image/png"
+}
+
+// variantCacheKey identifies one transformation of a source file. The source's size and modification time are part
+// of the key so that a re-upload under the same name is never served stale.
+func (cfg ImageConfig) variantCacheKey(fileName string, info os.FileInfo, size int, contentType string) string {
+	quality := 0
+
+	switch contentType {
+	case "image/jpeg":
+		quality = cfg.JPEGQuality
+	case "image/webp":
+		quality = cfg.WebPQuality
+	}
+
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%s|%d",
+		fileName, info.Size(), info.ModTime().UnixNano(), size, contentType, quality)))
+
+	return hex.EncodeToString(sum[:]) + formatExtensions[contentType]
+}
+
+// removeVariants deletes every cached transformation of a source file. It has to run before the source itself is
+// removed, since the source's size and modification time are part of each variant's key.
+func (cfg ImageConfig) removeVariants(fileName string) {
+	info, err := os.Stat(filepath.Join(uploadPath, fileName))
+
+	if err != nil {
+		return
+	}
+
+	for _, size := range append([]int{0}, avatarSizes...) {
+		for contentType := range formatExtensions {
+			err := os.Remove(filepath.Join(cachePath, cfg.variantCacheKey(fileName, info, size, contentType)))
+
+			if err != nil && !os.IsNotExist(err) {
+				log.Println("Could not remove cached avatar:", err)
+			}
+		}
+	}
+}
+
+// writeVariant converts the source image b to contentType, scales it to size and stores the result at cachedPath.
+func (cfg ImageConfig) writeVariant(cachedPath string, b []byte, size int, contentType string) error {
+	img, err := decodeImage(b)
+
+	if err != nil {
+		return err
+	}
+
+	if size > 0 {
+		img = resizeToFit(img, size)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachedPath), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so a concurrent request never serves a half written variant
+	tmp, err := os.CreateTemp(filepath.Dir(cachedPath), "variant-*")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if err := cfg.encode(tmp, img, contentType); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), cachedPath)
+}
+
+// Avatar serves an uploaded profile picture in the best format the client accepts, optionally scaled down to one
+// of the avatarSizes with the size query parameter. Animations are served as uploaded, unless their static poster is
+// asked for with variant=poster. Pictures that are not public need a signed link, or a viewer who is allowed to see
+// them; see avatarCacheControl. A link to a picture also works for its poster.
+func (app *Application) Avatar(resp http.ResponseWriter, req *http.Request) {
+	fileName := chi.URLParam(req, "fileName")
+
+	if fileName != filepath.Base(fileName) || strings.HasPrefix(fileName, ".") {
+		http.NotFound(resp, req)
+		return
+	}
+
+	size := 0
+
+	if requested := req.URL.Query().Get("size"); requested != "" {
+		size, _ = strconv.Atoi(requested)
+
+		if !isAvatarSize(size) {
+			http.Error(resp, "unsupported size", http.StatusBadRequest)
+			return
+		}
+	}
+
+	variant := req.URL.Query().Get("variant")
+
+	if variant != "" && variant != avatarVariantPoster {
+		http.Error(resp, "unsupported variant", http.StatusBadRequest)
+		return
+	}
+
+	image, err := app.DB.GetUserImageByFileName(fileName)
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	owner, err := app.DB.GetUser(image.UserID)
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	cacheControl, status := app.avatarCacheControl(req, fileName, *owner)
+
+	if status != 0 {
+		http.Error(resp, http.StatusText(status), status)
+		return
+	}
+
+	// the poster is looked up and authorized as the picture it was made from
+	servedName := fileName
+
+	if variant == avatarVariantPoster {
+		servedName = posterFileName(fileName)
+	}
+
+	sourcePath := filepath.Join(uploadPath, servedName)
+	info, err := os.Stat(sourcePath)
+
+	if err != nil || info.IsDir() {
+		http.NotFound(resp, req)
+		return
+	}
+
+	source, err := os.Open(sourcePath)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// the first 512 bytes are all content sniffing looks at
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(source, head)
+	source.Close()
+
+	resp.Header().Add("Vary", "Accept")
+	resp.Header().Set("Cache-Control", cacheControl)
+
+	contentType := negotiateFormat(req.Header.Get("Accept"), fallbackFormat(http.DetectContentType(head[:n])))
+	cachedPath := filepath.Join(cachePath, app.Images.variantCacheKey(servedName, info, size, contentType))
+
+	if _, err := os.Stat(cachedPath); err != nil {
+		b, err := os.ReadFile(sourcePath)
+
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// animations are resized when uploaded, and re-encoding them here would lose every frame but the first; images
+		// stored before this was recorded have to be checked. Posters never animate.
+		if variant != avatarVariantPoster && ((image.Animated != nil && *image.Animated) || (image.Animated == nil && isAnimated(b))) {
+			http.ServeFile(resp, req, sourcePath)
+			return
+		}
+
+		if err := app.Images.writeVariant(cachedPath, b, size, contentType); err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	resp.Header().Set("Content-Type", contentType)
+	http.ServeFile(resp, req, cachedPath)
+}
+
+func isAvatarSize(size int) bool {
+	for _, allowed := range avatarSizes {
+		if size == allowed {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"bytes"
+	"github.com/go-chi/chi/v5"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_negotiateFormat(t *testing.T) {
+	var tests = []struct {
+		name     string
+		accept   string
+		fallback string
+		expected string
+	}{
+		{"no header", "", "image/png", "image/png"},
+		{"wildcard only", "*/*", "image/jpeg", "image/jpeg"},
+		{"browser", "image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "image/jpeg", "image/webp"},
+		{"webp refused", "image/webp;q=0,image/*", "image/png", "image/png"},
+		{"fallback preferred", "image/webp;q=0.5,image/png", "image/png", "image/png"},
+		{"equal preference", "image/webp;q=0.8,image/*;q=0.8", "image/png", "image/webp"},
+		{"case insensitive", "Image/WebP", "image/png", "image/webp"},
+	}
+
+	for _, test := range tests {
+		expected := test.expected
+
+		// builds without the webp tag only offer WebP in place of PNG
+		if webpLossless && test.fallback != "image/png" {
+			expected = test.fallback
+		}
+
+		if actual := negotiateFormat(test.accept, test.fallback); actual != expected {
+			t.Errorf("%s: expected %s, got %s", test.name, expected, actual)
+		}
+	}
+}
+
+func Test_ImageConfig_variantCacheKey(t *testing.T) {
+	info, err := os.Stat("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultImageConfig()
+	keys := map[string]bool{
+		cfg.variantCacheKey("img.png", info, 0, "image/png"):  true,
+		cfg.variantCacheKey("img.png", info, 0, "image/webp"): true,
+		cfg.variantCacheKey("img.png", info, 64, "image/png"): true,
+	}
+
+	cfg.WebPQuality = 50
+	keys[cfg.variantCacheKey("img.png", info, 0, "image/webp")] = true
+
+	if len(keys) != 4 {
+		t.Errorf("expected format, size and quality to give distinct cache keys, got %d keys", len(keys))
+	}
+}
+
+func Test_Application_Avatar(t *testing.T) {
+	uploadPath = "./testdata"
+	cachePath = "./testdata/cache"
+
+	defer func() {
+		_ = os.RemoveAll(cachePath)
+	}()
+
+	var tests = []struct {
+		name                string
+		fileName            string
+		query               string
+		accept              string
+		expectedStatus      int
+		expectedContentType string
+		expectedWidth       int
+	}{
+		{"png", "img.png", "", "", http.StatusOK, "image/png", 0},
+		{"webp", "img.png", "", "image/webp,*/*", http.StatusOK, "image/webp", 0},
+		{"resized", "img.png", "?size=32", "image/webp,*/*", http.StatusOK, "image/webp", 32},
+		{"cached", "img.png", "?size=32", "image/webp,*/*", http.StatusOK, "image/webp", 32},
+		{"bad size", "img.png", "?size=33", "", http.StatusBadRequest, "", 0},
+		{"missing", "nope.png", "", "", http.StatusNotFound, "", 0},
+		{"hidden file", ".gitkeep", "", "", http.StatusNotFound, "", 0},
+	}
+
+	mux := chi.NewRouter()
+	mux.Get("/avatars/{fileName}", app.Avatar)
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/avatars/"+test.fileName+test.query, nil)
+
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+
+		resp := httptest.NewRecorder()
+		mux.ServeHTTP(resp, req)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+			continue
+		}
+
+		if test.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		if resp.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s: expected Vary: Accept, got %q", test.name, resp.Header().Get("Vary"))
+		}
+
+		if resp.Header().Get("Content-Type") != test.expectedContentType {
+			t.Errorf("%s: expected content type %s, got %s", test.name, test.expectedContentType, resp.Header().Get("Content-Type"))
+		}
+
+		img, err := decodeImage(resp.Body.Bytes())
+
+		if err != nil {
+			t.Errorf("%s: response is not an image: %s", test.name, err)
+			continue
+		}
+
+		if test.expectedWidth > 0 && img.Bounds().Dx() != test.expectedWidth {
+			t.Errorf("%s: expected width %d, got %d", test.name, test.expectedWidth, img.Bounds().Dx())
+		}
+	}
+
+	uploadPath = "./testdata/uploads"
+}
+
+func Test_Application_Avatar_RecordedAnimation(t *testing.T) {
+	uploadPath = t.TempDir()
+	cachePath = t.TempDir()
+
+	defer func() {
+		uploadPath = "./testdata/uploads"
+	}()
+
+	b, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the test repository records animated.png as an animation, so it is served as uploaded, however it is asked for
+	if err := os.WriteFile(filepath.Join(uploadPath, "animated.png"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	mux := chi.NewRouter()
+	mux.Get("/avatars/{fileName}", app.Avatar)
+
+	req := httptest.NewRequest(http.MethodGet, "/avatars/animated.png?size=32", nil)
+	req.Header.Set("Accept", "image/webp,*/*")
+	resp := httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+
+	if !bytes.Equal(resp.Body.Bytes(), b) {
+		t.Error("expected the recorded animation to be served as uploaded")
+	}
+
+	// its poster is a still, so it is resized like any other
+	if err := os.WriteFile(filepath.Join(uploadPath, posterFileName("animated.png")), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/avatars/animated.png?size=32&variant=poster", nil)
+	resp = httptest.NewRecorder()
+	mux.ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d for the poster, got %d", http.StatusOK, resp.Code)
+	}
+
+	if img, err := decodeImage(resp.Body.Bytes()); err != nil || img.Bounds().Dx() != 32 {
+		t.Errorf("expected the poster resized to 32 pixels wide, got %v", err)
+	}
+}
+
+func Test_ImageConfig_processImage_WebP(t *testing.T) {
+	b, err := os.ReadFile("./testdata/img.webp")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filePath := "./testdata/uploads/upload.webp"
+	_ = os.WriteFile(filePath, b, 0644)
+
+	defer func() {
+		_ = os.Remove(filePath)
+		_ = os.Remove(posterFileName(filePath))
+	}()
+
+	if _, err := DefaultImageConfig().processImage(filePath); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(posterFileName(filePath)); err != nil {
+		t.Errorf("expected a poster for the WebP upload: %s", err)
+	}
+}
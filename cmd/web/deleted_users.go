@@ -0,0 +1,170 @@
+package web
+
+import (
+	"context"
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// DefaultDeletedUserRetention is how long deleted users can be restored for before they are purged for good.
+const DefaultDeletedUserRetention = 30 * 24 * time.Hour
+
+// deletedUser is a deleted user as the deleted users page lists them, with when they will be purged.
+type deletedUser struct {
+	*data.User
+	PurgeAt time.Time
+}
+
+// AdminDeletedUsers lists the users who have been deleted but not yet purged, so they can be restored.
+func (app *Application) AdminDeletedUsers(resp http.ResponseWriter, req *http.Request) {
+	users, err := app.DB.GetDeletedUsers(time.Now())
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	listed := make([]deletedUser, 0, len(users))
+
+	for _, user := range users {
+		listed = append(listed, deletedUser{user, user.DeletedAt.Add(app.DeletedUserRetention)})
+	}
+
+	_ = app.Render(resp, req, "admin-deleted-users.page.gohtml", &TemplateData{Data: map[string]any{"users": listed}})
+}
+
+// AdminRestoreUser undoes the deletion of a user who has not been purged yet. A user cannot be restored if someone
+// else has taken their email address in the meantime.
+func (app *Application) AdminRestoreUser(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	users, err := app.DB.GetDeletedUsers(time.Now())
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var user *data.User
+
+	for _, deleted := range users {
+		if deleted.ID == id {
+			user = deleted
+		}
+	}
+
+	if user == nil {
+		app.Session.Put(req.Context(), "error", "That user has not been deleted")
+		http.Redirect(resp, req, "/admin/users/deleted", http.StatusSeeOther)
+		return
+	}
+
+	if _, err := app.DB.GetUserByEmail(user.Email); err == nil {
+		app.Session.Put(req.Context(), "error", fmt.Sprintf("Someone else now has the email address %s", user.Email))
+		http.Redirect(resp, req, "/admin/users/deleted", http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.RestoreUser(user.ID, time.Now().Add(-app.DeletedUserRetention))
+
+	if stderrors.Is(err, sql.ErrNoRows) {
+		app.Session.Put(req.Context(), "error", fmt.Sprintf("%s can no longer be restored", user.Email))
+		http.Redirect(resp, req, "/admin/users/deleted", http.StatusSeeOther)
+		return
+	} else if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserRestored, user.ID, nil)
+
+	app.Session.Put(req.Context(), "flash", fmt.Sprintf("Restored %s", user.Email))
+	http.Redirect(resp, req, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// PurgeDeletedUsers deletes users for good once they have been deleted for longer than the retention window, along
+// with their profile pictures and data exports, and returns how many it purged.
+func (app *Application) PurgeDeletedUsers() (int, error) {
+	users, err := app.DB.GetDeletedUsers(time.Now().Add(-app.DeletedUserRetention))
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, user := range users {
+		images, err := app.DB.GetUserImages(user.ID)
+
+		if err != nil {
+			return i, err
+		}
+
+		err = app.pruneImages(images)
+
+		if err != nil {
+			return i, err
+		}
+
+		err = app.removeDataExports(user.ID)
+
+		if err != nil {
+			return i, err
+		}
+
+		err = app.DB.PurgeUser(user.ID)
+
+		if err != nil {
+			return i, err
+		}
+
+		_, err = app.DB.InsertAuditEvent(data.AuditEvent{TargetUserID: user.ID, Action: data.AuditUserPurged})
+
+		if err != nil {
+			log.Println("Could not write audit event:", err)
+		}
+	}
+
+	return len(users), nil
+}
+
+// PurgeDeletedUsersEvery purges deleted users and expired data exports straight away and then once every interval,
+// until ctx is done.
+func (app *Application) PurgeDeletedUsersEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := app.PurgeDeletedUsers()
+
+		if err != nil {
+			log.Println("Could not purge deleted users:", err)
+		} else if purged > 0 {
+			log.Printf("Purged %d deleted users", purged)
+		}
+
+		expired, err := app.PurgeExpiredDataExports()
+
+		if err != nil {
+			log.Println("Could not purge expired data exports:", err)
+		} else if expired > 0 {
+			log.Printf("Purged %d expired data exports", expired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package web
+
+import (
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func Test_Application_AdminDeletedUsers(t *testing.T) {
+	_, resp := adminRequest(http.MethodGet, "/admin/users/deleted", "", nil, data.User{ID: 1, IsAdmin: 1}, app.AdminDeletedUsers)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+
+	for _, expected := range []string{"recent@example.com", "gone@example.com", `action="/admin/users/4/restore"`} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected the deleted users to contain %q", expected)
+		}
+	}
+}
+
+func Test_Application_AdminRestoreUser(t *testing.T) {
+	var tests = []struct {
+		name             string
+		id               string
+		expectedLocation string
+		expectedError    string
+	}{
+		{"recently deleted", "4", "/admin/users/4", ""},
+		{"past the retention window", "5", "/admin/users/deleted", "can no longer be restored"},
+		{"email address taken", "6", "/admin/users/deleted", "Someone else now has the email address"},
+		{"not deleted", "1", "/admin/users/deleted", "has not been deleted"},
+	}
+
+	for _, test := range tests {
+		req, resp := adminRequest(http.MethodPost, "/admin/users/"+test.id+"/restore", test.id, nil, data.User{ID: 1, IsAdmin: 1}, app.AdminRestoreUser)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != test.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %d %s", test.name, test.expectedLocation, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
+
+func Test_Application_PurgeDeletedUsers(t *testing.T) {
+	uploadPath = t.TempDir()
+	exportPath = t.TempDir()
+
+	purged, err := app.PurgeDeletedUsers()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only user 5 was deleted before the retention window
+	if purged != 1 {
+		t.Errorf("expected 1 user to be purged, got %d", purged)
+	}
+}
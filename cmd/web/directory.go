@@ -0,0 +1,167 @@
+package web
+
+import (
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// directoryPageSize is how many users the directory shows at a time.
+const directoryPageSize = 24
+
+// directoryQuery is the search and page of the directory, as given in its query string.
+type directoryQuery struct {
+	Search string
+	Page   int
+}
+
+func parseDirectoryQuery(values url.Values) directoryQuery {
+	q := directoryQuery{Search: strings.TrimSpace(values.Get("q"))}
+
+	q.Page, _ = strconv.Atoi(values.Get("page"))
+	q.Page = max(q.Page, 1)
+
+	return q
+}
+
+// search is the search for the requested page of the directory, by name. Only active users are listed, and only
+// those whose profiles the viewer may see; hidden profiles are never listed, even for the administrators who can see
+// them. Email addresses are only searched for viewers who are signed in, since only they are shown them.
+func (q directoryQuery) search(signedIn bool) data.UserSearch {
+	visibilities := []string{data.ProfileVisibilityPublic}
+
+	if signedIn {
+		visibilities = append(visibilities, data.ProfileVisibilityMembers)
+	}
+
+	return data.UserSearch{
+		Query:               q.Search,
+		Sort:                data.UserSortName,
+		ActiveOnly:          true,
+		ProfileVisibilities: visibilities,
+		SkipEmail:           !signedIn,
+		Offset:              (q.Page - 1) * directoryPageSize,
+		Limit:               directoryPageSize,
+	}
+}
+
+// PageURL links to another page of the same search.
+func (q directoryQuery) PageURL(page int) string {
+	values := url.Values{}
+
+	if q.Search != "" {
+		values.Set("q", q.Search)
+	}
+
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+
+	if len(values) == 0 {
+		return "/directory"
+	}
+
+	return "/directory?" + values.Encode()
+}
+
+// profileListed reports whether a user's profile may be shown to everyone signed in, or to everyone if they are not.
+// Users who have not chosen are treated as having chosen members.
+func profileListed(user *data.User, signedIn bool) bool {
+	switch user.ProfileVisibility {
+	case data.ProfileVisibilityPublic:
+		return true
+	case data.ProfileVisibilityHidden:
+		return false
+	default:
+		return signedIn
+	}
+}
+
+// profileVisible reports whether viewer, who is nil if no one is signed in, may see subject's public profile. Users
+// can always see their own, and administrators who can read users can see anyone's.
+func (app *Application) profileVisible(viewer, subject *data.User) bool {
+	if viewer != nil && (viewer.ID == subject.ID || viewer.Can(data.PermissionReadUsers)) {
+		return true
+	}
+
+	if viewer == nil && !app.PublicProfiles {
+		return false
+	}
+
+	return subject.Active() && profileListed(subject, viewer != nil)
+}
+
+// PublicProfile shows a user's public profile, found by their handle or id. Profiles the viewer may not see are not
+// found, so that whether there is such a user is not given away.
+func (app *Application) PublicProfile(resp http.ResponseWriter, req *http.Request) {
+	key := chi.URLParam(req, "user")
+
+	var subject *data.User
+	var err error
+
+	if id, convErr := strconv.Atoi(key); convErr == nil {
+		subject, err = app.DB.GetUser(id)
+	} else {
+		subject, err = app.DB.GetUserByHandle(strings.ToLower(key))
+	}
+
+	var viewer *data.User
+
+	if user, ok := app.Session.Get(req.Context(), "user").(data.User); ok {
+		viewer = &user
+	}
+
+	if err != nil || !app.profileVisible(viewer, subject) {
+		http.NotFound(resp, req)
+		return
+	}
+
+	// profiles are linked to by handle, where users have one
+	if subject.Handle != "" && key != subject.Handle {
+		http.Redirect(resp, req, "/u/"+subject.Handle, http.StatusMovedPermanently)
+		return
+	}
+
+	td := map[string]any{
+		"subject":   subject,
+		"showEmail": viewer != nil,
+	}
+
+	_ = app.Render(resp, req, "public-profile.page.gohtml", &TemplateData{Data: td})
+}
+
+// Directory lists the users whose profiles the viewer may see a page at a time, optionally searching them.
+func (app *Application) Directory(resp http.ResponseWriter, req *http.Request) {
+	signedIn := app.Session.Exists(req.Context(), "user")
+	q := parseDirectoryQuery(req.URL.Query())
+
+	result, err := app.DB.SearchUsers(q.search(signedIn))
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pages := max((result.Total+directoryPageSize-1)/directoryPageSize, 1)
+
+	td := map[string]any{
+		"users":     result.Users,
+		"query":     q,
+		"total":     result.Total,
+		"pages":     pages,
+		"showEmail": signedIn,
+	}
+
+	if q.Page > 1 {
+		td["previous"] = q.PageURL(q.Page - 1)
+	}
+
+	if q.Page < pages {
+		td["next"] = q.PageURL(q.Page + 1)
+	}
+
+	_ = app.Render(resp, req, "directory.page.gohtml", &TemplateData{Data: td})
+}
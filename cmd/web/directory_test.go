@@ -0,0 +1,184 @@
+package web
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func Test_directoryQuery_search(t *testing.T) {
+	var tests = []struct {
+		name                 string
+		query                string
+		signedIn             bool
+		expectedQuery        string
+		expectedOffset       int
+		expectedVisibilities []string
+	}{
+		{"signed in", "", true, "", 0, []string{data.ProfileVisibilityPublic, data.ProfileVisibilityMembers}},
+		{"second page", "page=2", true, "", 24, []string{data.ProfileVisibilityPublic, data.ProfileVisibilityMembers}},
+		{"bad page", "page=-1", true, "", 0, []string{data.ProfileVisibilityPublic, data.ProfileVisibilityMembers}},
+		{"not signed in", "q=+ada+", false, "ada", 0, []string{data.ProfileVisibilityPublic}},
+	}
+
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.query)
+		search := parseDirectoryQuery(values).search(test.signedIn)
+
+		if search.Query != test.expectedQuery || search.Offset != test.expectedOffset || search.Limit != directoryPageSize {
+			t.Errorf("%s: expected %q from %d, got %+v", test.name, test.expectedQuery, test.expectedOffset, search)
+		}
+
+		if !slices.Equal(search.ProfileVisibilities, test.expectedVisibilities) {
+			t.Errorf("%s: expected visibilities %v, got %v", test.name, test.expectedVisibilities, search.ProfileVisibilities)
+		}
+
+		// hidden profiles and deactivated users are never listed, and email addresses only searched when they are shown
+		if !search.ActiveOnly || search.SkipEmail == test.signedIn || search.Sort != data.UserSortName {
+			t.Errorf("%s: unexpected search %+v", test.name, search)
+		}
+	}
+}
+
+func Test_directoryQuery_PageURL(t *testing.T) {
+	var tests = []struct {
+		query    directoryQuery
+		page     int
+		expected string
+	}{
+		{directoryQuery{}, 1, "/directory"},
+		{directoryQuery{}, 2, "/directory?page=2"},
+		{directoryQuery{Search: "ada love", Page: 2}, 1, "/directory?q=ada+love"},
+		{directoryQuery{Search: "ada"}, 3, "/directory?page=3&q=ada"},
+	}
+
+	for _, test := range tests {
+		if actual := test.query.PageURL(test.page); actual != test.expected {
+			t.Errorf("expected %s, got %s", test.expected, actual)
+		}
+	}
+}
+
+func Test_Application_PublicProfile(t *testing.T) {
+	defer func() { app.PublicProfiles = false }()
+
+	member := &data.User{ID: 9}
+	admin := &data.User{ID: 10, Permissions: []string{data.PermissionReadUsers}}
+
+	var tests = []struct {
+		name             string
+		key              string
+		viewer           *data.User
+		publicProfiles   bool
+		expectedStatus   int
+		expectedLocation string
+		expectedBody     string
+	}{
+		{"public profile", "ada", nil, true, http.StatusOK, "", "Lovelace"},
+		{"public profile when profiles are not public", "ada", nil, false, http.StatusNotFound, "", ""},
+		{"members profile", "colleague", member, false, http.StatusOK, "", "grace@example.com"},
+		{"members profile when not signed in", "colleague", nil, true, http.StatusNotFound, "", ""},
+		{"email not shown when not signed in", "ada", nil, true, http.StatusOK, "", "Analyst"},
+		{"hidden profile", "hermit", member, false, http.StatusNotFound, "", ""},
+		{"hidden profile as administrator", "hermit", admin, false, http.StatusOK, "", "Only Henry Cavendish and administrators"},
+		{"hidden profile as its owner", "hermit", &data.User{ID: 7}, false, http.StatusOK, "", "Cavendish"},
+		{"unknown handle", "nobody", member, false, http.StatusNotFound, "", ""},
+		{"handle in capitals", "Ada", member, false, http.StatusMovedPermanently, "/u/ada", ""},
+		{"by id", "1", member, false, http.StatusOK, "", ""},
+	}
+
+	for _, test := range tests {
+		app.PublicProfiles = test.publicProfiles
+
+		req := httptest.NewRequest(http.MethodGet, "/u/"+test.key, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		if test.viewer != nil {
+			app.Session.Put(req.Context(), "user", *test.viewer)
+		}
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("user", test.key)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		app.PublicProfile(resp, req)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+			continue
+		}
+
+		if location := resp.Header().Get("Location"); location != test.expectedLocation {
+			t.Errorf("%s: expected location %q, got %q", test.name, test.expectedLocation, location)
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected the page to contain %q", test.name, test.expectedBody)
+		}
+
+		if test.viewer == nil && strings.Contains(resp.Body.String(), "@example.com") {
+			t.Errorf("%s: expected email addresses to be hidden from people who are not signed in", test.name)
+		}
+	}
+}
+
+func Test_Application_Directory(t *testing.T) {
+	var tests = []struct {
+		query    string
+		expected []string
+	}{
+		{"nobody", []string{"No one found", `value="nobody"`}},
+		// the test repository finds two users for ada, one a page
+		{"ada", []string{"2 people", "Ada Lovelace"}},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/directory?q="+test.query, nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		resp := httptest.NewRecorder()
+		app.Directory(resp, req)
+
+		if resp.Code != http.StatusOK {
+			t.Fatalf("%s: expected status %d, got %d", test.query, http.StatusOK, resp.Code)
+		}
+
+		for _, expected := range test.expected {
+			if !strings.Contains(resp.Body.String(), expected) {
+				t.Errorf("%s: expected the directory to contain %q", test.query, expected)
+			}
+		}
+	}
+}
+
+func Test_Application_Routes_directory(t *testing.T) {
+	defer func() { app.PublicProfiles = false }()
+
+	var tests = []struct {
+		name           string
+		publicProfiles bool
+		expectedStatus int
+	}{
+		{"sign in needed", false, http.StatusTemporaryRedirect},
+		{"public", true, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		app.PublicProfiles = test.publicProfiles
+
+		resp := httptest.NewRecorder()
+		app.Routes().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/directory", nil))
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+		}
+	}
+}
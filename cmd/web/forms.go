@@ -1,8 +1,14 @@
 package web
 
 import (
+	"fmt"
+	"golang.org/x/text/language"
+	"net/mail"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 type errors map[string][]string
@@ -53,6 +59,65 @@ func (f *Form) Check(ok bool, key, message string) {
 	}
 }
 
+func (f *Form) IsEmail(field string) {
+	value := f.Data.Get(field)
+
+	if value == "" {
+		return
+	}
+
+	address, err := mail.ParseAddress(value)
+
+	if err != nil || address.Address != value {
+		f.Errors.Add(field, "Invalid email address")
+	}
+}
+
+func (f *Form) MaxLength(field string, length int) {
+	if utf8.RuneCountInString(f.Data.Get(field)) > length {
+		f.Errors.Add(field, fmt.Sprintf("This field cannot be longer than %d characters", length))
+	}
+}
+
+func (f *Form) IsTimezone(field string) {
+	value := f.Data.Get(field)
+
+	if value == "" {
+		return
+	}
+
+	if _, err := time.LoadLocation(value); err != nil || value == "Local" {
+		f.Errors.Add(field, "Unknown time zone")
+	}
+}
+
+func (f *Form) IsLocale(field string) {
+	value := f.Data.Get(field)
+
+	if value == "" {
+		return
+	}
+
+	if _, err := language.Parse(value); err != nil {
+		f.Errors.Add(field, "Unknown locale")
+	}
+}
+
+// handles start with a letter, so they can never be mistaken for a user's id
+var handlePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]{2,31}$`)
+
+func (f *Form) IsHandle(field string) {
+	value := f.Data.Get(field)
+
+	if value == "" {
+		return
+	}
+
+	if !handlePattern.MatchString(value) {
+		f.Errors.Add(field, "Use 3 to 32 lower case letters, digits, hyphens and underscores, starting with a letter")
+	}
+}
+
 func (f *Form) Valid() bool {
 	return len(f.Errors) == 0
 }
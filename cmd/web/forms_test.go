@@ -4,6 +4,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -82,3 +83,113 @@ func Test_Form_ErrorGet(t *testing.T) {
 		t.Error("Should not have any error returned from get but got one")
 	}
 }
+
+func Test_Form_IsEmail(t *testing.T) {
+	var tests = []struct {
+		email string
+		valid bool
+	}{
+		{"", true},
+		{"me@example.com", true},
+		{"not an email", false},
+		{"Me <me@example.com>", false},
+	}
+
+	for _, test := range tests {
+		form := NewForm(url.Values{"email": {test.email}})
+		form.IsEmail("email")
+
+		if form.Valid() != test.valid {
+			t.Errorf("%q: expected valid to be %t", test.email, test.valid)
+		}
+	}
+}
+
+func Test_Form_MaxLength(t *testing.T) {
+	form := NewForm(url.Values{"name": {"héllo"}})
+	form.MaxLength("name", 5)
+
+	if !form.Valid() {
+		t.Error("Form shows invalid when the field is exactly the maximum length")
+	}
+
+	form.MaxLength("name", 4)
+
+	if form.Valid() {
+		t.Error("Form shows valid when the field is too long")
+	}
+}
+
+func Test_Form_IsTimezone(t *testing.T) {
+	var tests = []struct {
+		timezone string
+		valid    bool
+	}{
+		{"", true},
+		{"UTC", true},
+		{"Europe/London", true},
+		{"America/Argentina/Buenos_Aires", true},
+		{"Local", false},
+		{"Mars/Olympus_Mons", false},
+		{"../../etc/passwd", false},
+	}
+
+	for _, test := range tests {
+		form := NewForm(url.Values{"timezone": {test.timezone}})
+		form.IsTimezone("timezone")
+
+		if form.Valid() != test.valid {
+			t.Errorf("%q: expected valid to be %t", test.timezone, test.valid)
+		}
+	}
+}
+
+func Test_Form_IsLocale(t *testing.T) {
+	var tests = []struct {
+		locale string
+		valid  bool
+	}{
+		{"", true},
+		{"en", true},
+		{"en-GB", true},
+		{"zh-Hant-TW", true},
+		{"english", false},
+		{"en_GB!", false},
+	}
+
+	for _, test := range tests {
+		form := NewForm(url.Values{"locale": {test.locale}})
+		form.IsLocale("locale")
+
+		if form.Valid() != test.valid {
+			t.Errorf("%q: expected valid to be %t", test.locale, test.valid)
+		}
+	}
+}
+
+func Test_Form_IsHandle(t *testing.T) {
+	var tests = []struct {
+		handle string
+		valid  bool
+	}{
+		{"", true},
+		{"ada", true},
+		{"ada-lovelace_1815", true},
+		{"ad", false},
+		{"Ada", false},
+		{"1815", false},
+		{"-ada", false},
+		{"ada.lovelace", false},
+		{"ada/../admin", false},
+		{strings.Repeat("a", 33), false},
+	}
+
+	for _, test := range tests {
+		form := NewForm(url.Values{"handle": {test.handle}})
+		form.IsHandle("handle")
+
+		if form.Valid() != test.valid {
+			t.Errorf("%q: expected valid to be %t", test.handle, test.valid)
+		}
+	}
+}
@@ -0,0 +1,578 @@
+package web
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// exportPath is where data exports are kept until they expire.
+var exportPath = "./exports"
+
+// exportLifetime is how long a data export can be downloaded for once it has been asked for.
+const exportLifetime = 24 * time.Hour
+
+// runInBackground runs work that should not hold up a response, such as building a data export. Tests replace it so
+// that the work is done before they look at the result.
+var runInBackground = func(task func()) {
+	go task()
+}
+
+// exportedProfile is the profile.json in a data export. Unlike the API, it includes when the account was created and
+// last changed.
+type exportedProfile struct {
+	*data.User
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// exportedImage is an entry in images.json, naming the files in the export that hold the image and its poster.
+type exportedImage struct {
+	*data.UserImage
+	CreatedAt time.Time `json:"created_at"`
+	Files     []string  `json:"files"`
+}
+
+// exportedTokens is the tokens.json in a data export. None of the tokens themselves are included, since only their
+// hashes are stored.
+type exportedTokens struct {
+	PersonalAccessTokens []*data.PersonalAccessToken `json:"personal_access_tokens"`
+	RefreshTokens        []*data.RefreshToken        `json:"refresh_tokens"`
+}
+
+// exportedSession is an entry in sessions.json, a web session the user is signed in to. The session's token is left
+// out, since whoever has it is signed in as the user.
+type exportedSession struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	// Impersonated is set if an administrator is signed in to the session as the user.
+	Impersonated bool `json:"impersonated"`
+}
+
+// RequestDataExport starts building a ZIP file of everything we hold about the logged-in user, replacing any export
+// they asked for before, and takes them to a page that links to it once it is ready. The link contains a token that
+// is only shown to the user, so it cannot be guessed from the export's id.
+func (app *Application) RequestDataExport(resp http.ResponseWriter, req *http.Request) {
+	user, _ := app.Session.Get(req.Context(), "user").(data.User)
+
+	err := app.removeDataExports(user.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := randomHex(32)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	export := data.DataExport{
+		UserID:    user.ID,
+		Status:    data.ExportPending,
+		ExpiresAt: time.Now().Add(exportLifetime),
+	}
+
+	export.ID, err = app.DB.InsertDataExport(export, hashToken(token))
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditDataExported, user.ID, nil)
+
+	runInBackground(func() {
+		app.buildDataExport(export)
+	})
+
+	http.Redirect(resp, req, "/user/exports/"+token, http.StatusSeeOther)
+}
+
+// DataExportStatus shows whether the export the token in the URL refers to is ready, and links to it if it is.
+func (app *Application) DataExportStatus(resp http.ResponseWriter, req *http.Request) {
+	export, ok := app.userDataExport(resp, req)
+
+	if !ok {
+		return
+	}
+
+	_ = app.Render(resp, req, "data-export.page.gohtml", &TemplateData{
+		Data: map[string]any{
+			"export": export,
+			"token":  chi.URLParam(req, "token"),
+		},
+	})
+}
+
+// DownloadDataExport serves a finished data export to the user it belongs to, until it expires.
+func (app *Application) DownloadDataExport(resp http.ResponseWriter, req *http.Request) {
+	export, ok := app.userDataExport(resp, req)
+
+	if !ok {
+		return
+	}
+
+	if export.Status != data.ExportReady {
+		http.Error(resp, "export is not ready", http.StatusConflict)
+		return
+	}
+
+	file, err := os.Open(filepath.Join(exportPath, export.FileName))
+
+	if err != nil {
+		http.Error(resp, "export is no longer available", http.StatusGone)
+		return
+	}
+	defer file.Close()
+
+	resp.Header().Set("Content-Type", "application/zip")
+	resp.Header().Set("Content-Disposition", `attachment; filename="profile-data.zip"`)
+	resp.Header().Set("Cache-Control", "no-store")
+
+	http.ServeContent(resp, req, "", export.CreatedAt, file)
+}
+
+// userDataExport looks up the export the token in the URL refers to. It writes an error and returns false if there is
+// no such export, if it belongs to someone else, or if it has expired.
+func (app *Application) userDataExport(resp http.ResponseWriter, req *http.Request) (*data.DataExport, bool) {
+	user, _ := app.Session.Get(req.Context(), "user").(data.User)
+	export, err := app.DB.GetDataExportByHash(hashToken(chi.URLParam(req, "token")))
+
+	if err != nil || export.UserID != user.ID {
+		http.NotFound(resp, req)
+		return nil, false
+	}
+
+	if export.Expired() {
+		http.Error(resp, "export has expired", http.StatusGone)
+		return nil, false
+	}
+
+	return export, true
+}
+
+// dataExportLocks keep data exports from being built while their user is erased. Builds hold their user's lock for
+// reading, and erasing a user holds it for writing, so that erasure waits for the builds already running.
+var dataExportLocks = struct {
+	sync.Mutex
+	users map[int]*sync.RWMutex
+}{users: map[int]*sync.RWMutex{}}
+
+// dataExportLock returns the lock on building a user's data exports.
+func dataExportLock(userID int) *sync.RWMutex {
+	dataExportLocks.Lock()
+	defer dataExportLocks.Unlock()
+
+	lock, ok := dataExportLocks.users[userID]
+
+	if !ok {
+		lock = &sync.RWMutex{}
+		dataExportLocks.users[userID] = lock
+	}
+
+	return lock
+}
+
+// buildDataExport writes a user's data export and records whether that worked. If the export was deleted while it
+// was being built, because the user asked for another or erased their account, nothing refers to the file any more,
+// so it is removed.
+func (app *Application) buildDataExport(export data.DataExport) {
+	lock := dataExportLock(export.UserID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	status := data.ExportReady
+	fileName, err := app.writeDataExport(export.UserID)
+
+	if err != nil {
+		log.Println("Could not export data:", err)
+		status = data.ExportFailed
+	}
+
+	err = app.DB.FinishDataExport(export.ID, status, fileName)
+
+	if stderrors.Is(err, sql.ErrNoRows) {
+		removeDataExportFile(&data.DataExport{FileName: fileName})
+		return
+	}
+
+	if err != nil {
+		log.Println("Could not finish data export:", err)
+	}
+}
+
+// writeDataExport writes a ZIP file to exportPath of the user's profile, all of their profile pictures, their tokens,
+// the web sessions they are signed in to and the audit log's record of them, returning its name.
+func (app *Application) writeDataExport(userID int) (string, error) {
+	name, err := randomHex(16)
+
+	if err != nil {
+		return "", err
+	}
+
+	fileName := name + ".zip"
+
+	if err := os.MkdirAll(exportPath, 0700); err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(filepath.Join(exportPath, fileName), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return "", err
+	}
+
+	archive := zip.NewWriter(file)
+	err = app.writeDataExportFiles(archive, userID)
+
+	if err == nil {
+		err = archive.Close()
+	}
+
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		_ = os.Remove(filepath.Join(exportPath, fileName))
+		return "", err
+	}
+
+	return fileName, nil
+}
+
+func (app *Application) writeDataExportFiles(archive *zip.Writer, userID int) error {
+	user, err := app.DB.GetUser(userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeZipJSON(archive, "profile.json", exportedProfile{user, user.CreatedAt, user.UpdatedAt})
+
+	if err != nil {
+		return err
+	}
+
+	images, err := app.DB.GetUserImages(userID)
+
+	if err != nil {
+		return err
+	}
+
+	exportedImages := make([]exportedImage, 0, len(images))
+
+	for _, image := range images {
+		exported := exportedImage{UserImage: image, CreatedAt: image.CreatedAt, Files: []string{}}
+
+		for _, fileName := range []string{image.FileName, posterFileName(image.FileName)} {
+			copied, err := copyToZip(archive, "images/"+fileName, filepath.Join(uploadPath, fileName))
+
+			if err != nil {
+				return err
+			}
+
+			if copied {
+				exported.Files = append(exported.Files, "images/"+fileName)
+			}
+		}
+
+		exportedImages = append(exportedImages, exported)
+	}
+
+	err = writeZipJSON(archive, "images.json", exportedImages)
+
+	if err != nil {
+		return err
+	}
+
+	var tokens exportedTokens
+
+	tokens.PersonalAccessTokens, err = app.DB.GetPersonalAccessTokens(userID)
+
+	if err != nil {
+		return err
+	}
+
+	tokens.RefreshTokens, err = app.DB.GetRefreshTokens(userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeZipJSON(archive, "tokens.json", tokens)
+
+	if err != nil {
+		return err
+	}
+
+	sessions, err := app.userSessions(userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = writeZipJSON(archive, "sessions.json", sessions)
+
+	if err != nil {
+		return err
+	}
+
+	events, err := app.userAuditEvents(userID)
+
+	if err != nil {
+		return err
+	}
+
+	return writeZipJSON(archive, "audit.json", events)
+}
+
+// userSessions returns the web sessions a user is signed in to, including any in which an administrator is
+// impersonating them, soonest to expire first.
+func (app *Application) userSessions(userID int) ([]exportedSession, error) {
+	sessions := []exportedSession{}
+
+	err := app.Session.Iterate(context.Background(), func(ctx context.Context) error {
+		if user, ok := app.Session.Get(ctx, "user").(data.User); ok && user.ID == userID {
+			_, impersonated := app.Session.Get(ctx, "impersonator").(data.User)
+			sessions = append(sessions, exportedSession{ExpiresAt: app.Session.Deadline(ctx), Impersonated: impersonated})
+		}
+
+		return nil
+	})
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ExpiresAt.Before(sessions[j].ExpiresAt)
+	})
+
+	return sessions, err
+}
+
+// userAuditEvents returns the audit events about a user, and the ones they were the actor in, oldest first. The
+// details of events they did to other people are left out, since those are about someone else.
+func (app *Application) userAuditEvents(userID int) ([]*data.AuditEvent, error) {
+	about, err := app.DB.GetAuditEvents(data.AuditFilter{TargetUserID: userID, Ascending: true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	by, err := app.DB.GetAuditEvents(data.AuditFilter{ActorID: userID, Ascending: true})
+
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[int]bool)
+	events := make([]*data.AuditEvent, 0, len(about)+len(by))
+
+	for _, event := range about {
+		seen[event.ID] = true
+		events = append(events, event)
+	}
+
+	for _, event := range by {
+		if seen[event.ID] {
+			continue
+		}
+
+		event.Details = nil
+		event.TargetEmail = ""
+		events = append(events, event)
+	}
+
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].ID < events[j].ID
+	})
+
+	return events, nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v any) error {
+	w, err := archive.Create(name)
+
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(v)
+}
+
+// copyToZip copies a file into the archive, returning false if there is no such file.
+func copyToZip(archive *zip.Writer, name, filePath string) (bool, error) {
+	src, err := os.Open(filePath)
+
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	defer src.Close()
+
+	w, err := archive.Create(name)
+
+	if err != nil {
+		return false, err
+	}
+
+	_, err = io.Copy(w, src)
+
+	return err == nil, err
+}
+
+// removeDataExports deletes a user's data exports, files and all.
+func (app *Application) removeDataExports(userID int) error {
+	exports, err := app.DB.GetDataExports(userID)
+
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		removeDataExportFile(export)
+	}
+
+	return app.DB.DeleteDataExports(userID)
+}
+
+// PurgeExpiredDataExports deletes every data export which has expired, files and all, and returns how many it
+// deleted.
+func (app *Application) PurgeExpiredDataExports() (int, error) {
+	exports, err := app.DB.GetExpiredDataExports(time.Now())
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, export := range exports {
+		removeDataExportFile(export)
+
+		err := app.DB.DeleteDataExport(export.ID)
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(exports), nil
+}
+
+// removeDataExportFile deletes the ZIP file of an export, if it has one.
+func removeDataExportFile(export *data.DataExport) {
+	if export.FileName == "" {
+		return
+	}
+
+	err := os.Remove(filepath.Join(exportPath, export.FileName))
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Println("Could not remove data export:", err)
+	}
+}
+
+// ConfirmEraseAccount asks the logged-in user to confirm that they want their account, and everything we hold about
+// them, erased.
+func (app *Application) ConfirmEraseAccount(resp http.ResponseWriter, req *http.Request) {
+	_ = app.Render(resp, req, "erase-account.page.gohtml", &TemplateData{})
+}
+
+// EraseAccount deletes the logged-in user once they have confirmed it by typing their email address, and logs them
+// out.
+func (app *Application) EraseAccount(resp http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, _ := app.Session.Get(req.Context(), "user").(data.User)
+
+	if !strings.EqualFold(strings.TrimSpace(req.PostForm.Get("confirm")), user.Email) {
+		app.Session.Put(req.Context(), "error", "Type your email address to confirm")
+		http.Redirect(resp, req, "/user/erase", http.StatusSeeOther)
+		return
+	}
+
+	err = app.eraseUser(user.ID)
+
+	if err != nil {
+		log.Println("Could not erase user:", err)
+		http.Error(resp, "could not erase your account", http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.Session.Destroy(req.Context())
+
+	app.Session.Put(req.Context(), "flash", "Your account has been erased")
+	http.Redirect(resp, req, "/", http.StatusSeeOther)
+}
+
+// eraseUser deletes a user along with everything we hold about them: their profile pictures, including cached
+// copies, their data exports, and their personal data in the audit log. Deleting the user deletes their tokens,
+// identities and roles with them. The audit log is anonymized first, so that a failure part way through never
+// leaves it naming someone who has gone. Data exports still being built are waited for.
+func (app *Application) eraseUser(userID int) error {
+	// wait for any data export being built, and stop more being started until the user is gone
+	lock := dataExportLock(userID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	images, err := app.DB.GetUserImages(userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = app.pruneImages(images)
+
+	if err != nil {
+		return err
+	}
+
+	err = app.removeDataExports(userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.AnonymizeAuditEvents(userID)
+
+	if err != nil {
+		return err
+	}
+
+	err = app.DB.PurgeUser(userID)
+
+	if err != nil {
+		return err
+	}
+
+	// the erasure itself is recorded, but not who it was
+	_, err = app.DB.InsertAuditEvent(data.AuditEvent{Action: data.AuditUserErased})
+
+	if err != nil {
+		return fmt.Errorf("recording erasure: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,281 @@
+package web
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// exportRequest builds a request for the data export the token refers to, from the user with the given id.
+func exportRequest(target, token string, userID int) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: userID, Email: "admin@example.com"})
+
+	routeContext := chi.NewRouteContext()
+	routeContext.URLParams.Add("token", token)
+
+	return req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+}
+
+func Test_Application_RequestDataExport(t *testing.T) {
+	exportPath = t.TempDir()
+	uploadPath = t.TempDir()
+
+	err := os.WriteFile(filepath.Join(uploadPath, "previous.png"), []byte("image"), 0644)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	background := runInBackground
+	runInBackground = func(task func()) { task() }
+	defer func() { runInBackground = background }()
+
+	// a session in which an administrator is impersonating the user
+	impersonated, _ := app.Session.Load(context.Background(), "")
+	app.Session.Put(impersonated, "user", data.User{ID: 1})
+	app.Session.Put(impersonated, "impersonator", data.User{ID: 12})
+	impersonatedToken, _, _ := app.Session.Commit(impersonated)
+
+	defer func() {
+		_ = app.Session.Store.Delete(impersonatedToken)
+	}()
+
+	req := httptest.NewRequest(http.MethodPost, "/user/export", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	resp := httptest.NewRecorder()
+	app.RequestDataExport(resp, req)
+
+	if location := resp.Header().Get("Location"); !regexp.MustCompile(`^/user/exports/[0-9a-f]{64}$`).MatchString(location) {
+		t.Errorf("expected a redirect to the export, got %d %s", resp.Code, location)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(exportPath, "*.zip"))
+
+	if len(files) != 1 {
+		t.Fatalf("expected one export to have been written, found %d", len(files))
+	}
+
+	archive, err := zip.OpenReader(files[0])
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	var names []string
+	var sessions []exportedSession
+
+	for _, file := range archive.File {
+		names = append(names, file.Name)
+
+		if file.Name == "sessions.json" {
+			f, err := file.Open()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = json.NewDecoder(f).Decode(&sessions)
+			f.Close()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	expected := "profile.json images/previous.png images.json tokens.json sessions.json audit.json"
+
+	if strings.Join(names, " ") != expected {
+		t.Errorf("expected the export to contain %s, got %s", expected, strings.Join(names, " "))
+	}
+
+	if !slices.ContainsFunc(sessions, func(session exportedSession) bool { return session.Impersonated }) {
+		t.Errorf("expected the impersonated session to be exported, got %+v", sessions)
+	}
+}
+
+func Test_Application_buildDataExport_Deleted(t *testing.T) {
+	exportPath = t.TempDir()
+	uploadPath = t.TempDir()
+
+	// the test repository has deleted export 3 while it was being built
+	app.buildDataExport(data.DataExport{ID: 3, UserID: 1})
+
+	if files, _ := filepath.Glob(filepath.Join(exportPath, "*.zip")); len(files) != 0 {
+		t.Errorf("expected the export of a deleted request to be removed, found %v", files)
+	}
+}
+
+func Test_Application_eraseUser_WaitsForDataExports(t *testing.T) {
+	lock := dataExportLock(1)
+	lock.RLock()
+
+	erased := make(chan error)
+
+	go func() {
+		erased <- app.eraseUser(1)
+	}()
+
+	select {
+	case err := <-erased:
+		t.Fatalf("expected erasure to wait for the export being built, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	lock.RUnlock()
+
+	if err := <-erased; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Application_DataExportStatus(t *testing.T) {
+	var tests = []struct {
+		name           string
+		token          string
+		userID         int
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"ready", "ready-export", 1, http.StatusOK, "/user/exports/ready-export/download"},
+		{"pending", "pending-export", 1, http.StatusOK, "being gathered"},
+		{"expired", "expired-export", 1, http.StatusGone, "expired"},
+		{"someone else's", "ready-export", 2, http.StatusNotFound, ""},
+		{"unknown", "no-such-export", 1, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		req := exportRequest("/user/exports/"+test.token, test.token, test.userID)
+
+		resp := httptest.NewRecorder()
+		app.DataExportStatus(resp, req)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected the page to contain %q", test.name, test.expectedBody)
+		}
+	}
+}
+
+func Test_Application_DownloadDataExport(t *testing.T) {
+	exportPath = t.TempDir()
+
+	err := os.WriteFile(filepath.Join(exportPath, "export.zip"), []byte("zip"), 0600)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name           string
+		token          string
+		userID         int
+		expectedStatus int
+	}{
+		{"ready", "ready-export", 1, http.StatusOK},
+		{"pending", "pending-export", 1, http.StatusConflict},
+		{"expired", "expired-export", 1, http.StatusGone},
+		{"someone else's", "ready-export", 2, http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		req := exportRequest("/user/exports/"+test.token+"/download", test.token, test.userID)
+
+		resp := httptest.NewRecorder()
+		app.DownloadDataExport(resp, req)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+		}
+
+		if test.expectedStatus == http.StatusOK && (resp.Body.String() != "zip" || resp.Header().Get("Content-Type") != "application/zip") {
+			t.Errorf("%s: expected the export to be served, got %s %q", test.name, resp.Header().Get("Content-Type"), resp.Body.String())
+		}
+	}
+}
+
+func Test_Application_PurgeExpiredDataExports(t *testing.T) {
+	exportPath = t.TempDir()
+
+	// the test repository has one expired export, whose file is expired.zip
+	for _, fileName := range []string{"expired.zip", "current.zip"} {
+		if err := os.WriteFile(filepath.Join(exportPath, fileName), []byte("zip"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := app.PurgeExpiredDataExports()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if purged != 1 {
+		t.Errorf("expected 1 export to be purged, got %d", purged)
+	}
+
+	if _, err := os.Stat(filepath.Join(exportPath, "expired.zip")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired export's file to be removed, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(exportPath, "current.zip")); err != nil {
+		t.Errorf("expected other files to be kept, got %v", err)
+	}
+}
+
+func Test_Application_EraseAccount(t *testing.T) {
+	uploadPath = t.TempDir()
+	exportPath = t.TempDir()
+
+	var tests = []struct {
+		name             string
+		confirm          string
+		expectedLocation string
+		expectedError    string
+	}{
+		{"confirmed", " Admin@Example.com ", "/", ""},
+		{"wrong email", "someone@example.com", "/user/erase", "Type your email address"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/erase", strings.NewReader(url.Values{"confirm": {test.confirm}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1, Email: "admin@example.com"})
+
+		resp := httptest.NewRecorder()
+		app.EraseAccount(resp, req)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != test.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %d %s", test.name, test.expectedLocation, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+
+		if loggedIn := app.Session.Exists(req.Context(), "user"); loggedIn != (test.expectedError != "") {
+			t.Errorf("%s: expected to be logged in %t, got %t", test.name, test.expectedError != "", loggedIn)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package web
 
 import (
+	"context"
+	stderrors "errors"
 	"fmt"
 	"github.com/spartanhooah/profile-picture-web/data"
 	"html/template"
@@ -10,11 +12,13 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
 )
 
 var pathToTemplates = "./templates/"
 var uploadPath = "./static/img"
+var quarantinePath = "./quarantine"
 
 func (app *Application) Home(resp http.ResponseWriter, req *http.Request) {
 	var td = make(map[string]any)
@@ -26,11 +30,50 @@ func (app *Application) Home(resp http.ResponseWriter, req *http.Request) {
 		app.Session.Put(req.Context(), "test", "Hit this page at "+time.Now().UTC().String())
 	}
 
+	if app.SSO != nil {
+		td["sso"] = app.SSO.Name
+	}
+
 	_ = app.Render(resp, req, "home.page.gohtml", &TemplateData{Data: td})
 }
 
 func (app *Application) Profile(resp http.ResponseWriter, req *http.Request) {
-	_ = app.Render(resp, req, "profile.page.gohtml", &TemplateData{})
+	var td = make(map[string]any)
+
+	if app.Session.Exists(req.Context(), "user") {
+		user := app.Session.Get(req.Context(), "user").(data.User)
+		usage, err := app.quotaUsage(user)
+
+		if err != nil {
+			log.Println("Could not get quota usage:", err)
+		} else {
+			td["usage"] = usage
+		}
+
+		tokens, err := app.DB.GetPersonalAccessTokens(user.ID)
+
+		if err != nil {
+			log.Println("Could not get tokens:", err)
+		} else {
+			td["tokens"] = tokens
+		}
+
+		td["scopes"] = tokenScopes
+		td["lifetimes"] = tokenLifetimes
+		// a new token is only ever shown once
+		td["newToken"] = app.Session.PopString(req.Context(), "new_token")
+	}
+
+	_ = app.Render(resp, req, "profile.page.gohtml", &TemplateData{Data: td})
+}
+
+// templateFuncs are the functions available to every template.
+var templateFuncs = template.FuncMap{
+	"blurHashURI": blurHashURI,
+	"formatBytes": formatBytes,
+	"formatTime":  formatTime,
+	// avatarURL depends on who is looking; Render replaces it with avatarURLFunc
+	"avatarURL": func(owner data.User, size int) string { return "" },
 }
 
 type TemplateData struct {
@@ -39,10 +82,14 @@ type TemplateData struct {
 	Error string
 	Flash string
 	User  data.User
+	// Impersonator is the administrator logged in as User, if any.
+	Impersonator *data.User
+	// Form is the form being filled in, with any errors to show next to its fields.
+	Form *Form
 }
 
 func (app *Application) Render(resp http.ResponseWriter, req *http.Request, t string, td *TemplateData) error {
-	parsedTemplate, err := template.ParseFiles(path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml"))
+	parsedTemplate, err := template.New(t).Funcs(templateFuncs).ParseFiles(path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml"))
 
 	if err != nil {
 		http.Error(resp, "bad request", http.StatusBadRequest)
@@ -58,6 +105,12 @@ func (app *Application) Render(resp http.ResponseWriter, req *http.Request, t st
 		td.User = app.Session.Get(req.Context(), "user").(data.User)
 	}
 
+	if impersonator, ok := app.Session.Get(req.Context(), "impersonator").(data.User); ok {
+		td.Impersonator = &impersonator
+	}
+
+	parsedTemplate.Funcs(template.FuncMap{"avatarURL": app.avatarURLFunc(td.User)})
+
 	// execute the template, passing template data if any
 	err = parsedTemplate.Execute(resp, td)
 
@@ -107,22 +160,49 @@ func (app *Application) Login(resp http.ResponseWriter, req *http.Request) {
 	_ = app.Session.RenewToken(req.Context())
 
 	app.Session.Put(req.Context(), "flash", "Successfully logged in")
-	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+	http.Redirect(resp, req, app.afterLogin(req), http.StatusSeeOther)
+}
+
+// afterLogin returns where to send a user once they have logged in: back to the page that asked them to, if any,
+// or to their profile.
+func (app *Application) afterLogin(req *http.Request) string {
+	returnTo := app.Session.PopString(req.Context(), "return_to")
+
+	// only ever follow paths on this site, so the login form cannot be used as an open redirect
+	if !strings.HasPrefix(returnTo, "/") || strings.HasPrefix(returnTo, "//") || strings.HasPrefix(returnTo, "/\\") {
+		return "/user/profile"
+	}
+
+	return returnTo
 }
 
 func (app *Application) authenticate(req *http.Request, user *data.User, password string) bool {
-	if valid, err := user.PasswordMatches(password); err != nil || !valid {
+	if valid, err := user.PasswordMatches(password); err != nil || !valid || !user.Active() {
 		return false
 	}
 
+	app.upgradePasswordHash(user, password)
+
+	app.Session.Remove(req.Context(), "impersonator")
 	app.Session.Put(req.Context(), "user", user)
 
 	return true
 }
 
 func (app *Application) UploadProfilePicture(resp http.ResponseWriter, req *http.Request) {
+	// uploads are kept out of the upload directory until they have been scanned
+	quarantine, err := newQuarantine()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	defer os.RemoveAll(quarantine)
+
 	// call a function to extract a file from an upload (request)
-	files, err := UploadFiles(req, uploadPath)
+	files, err := UploadFiles(req, quarantine)
 
 	if err != nil {
 		http.Error(resp, err.Error(), http.StatusInternalServerError)
@@ -133,34 +213,250 @@ func (app *Application) UploadProfilePicture(resp http.ResponseWriter, req *http
 	// get the user from the session
 	user := app.Session.Get(req.Context(), "user").(data.User)
 
+	image, err := app.storeProfilePicture(req.Context(), user.ID, filepath.Join(quarantine, files[0].OriginalFileName), files[0].OriginalFileName)
+
+	if err != nil {
+		app.uploadFailed(resp, req, err)
+
+		return
+	}
+
+	app.auditUpload(req, image)
+
+	// refresh user in session
+	err = app.refreshSessionUser(req, user.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+
+		return
+	}
+
+	// redirect back to profile page
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
+
+// storeProfilePicture scans and processes an upload waiting in quarantine, checks it against the user's quotas,
+// moves it into the upload directory under a new, random name, records it as the user's profile picture and prunes
+// their history. originalName is the name it was uploaded under, which is only kept for reference.
+func (app *Application) storeProfilePicture(ctx context.Context, userID int, quarantinedPath, originalName string) (*data.UserImage, error) {
+	// quota overrides may have changed since the user logged in
+	current, err := app.DB.GetUser(userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	quarantinedPath, err = renameUpload(quarantinedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	quota := app.Quotas.forUser(*current)
+
+	info, err := os.Stat(quarantinedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// record the attempt before the slow work, so concurrent uploads cannot all get under the hourly limit
+	err = app.checkUploadRate(quota, userID, info.Size())
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.scanFile(ctx, quarantinedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	poster, err := app.Images.processImage(quarantinedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the animation policy may have kept only the first frame, so look at what was stored rather than what was sent
+	processed, err := os.ReadFile(quarantinedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	animated := isAnimated(processed)
+
+	size, err := storedSize(quarantinedPath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	images, err := app.DB.GetUserImages(userID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	kept, pruned := quota.splitHistory(images)
+
+	err = quota.checkStorage(kept, size)
+
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := filepath.Base(quarantinedPath)
+
+	err = moveFile(quarantinedPath, filepath.Join(uploadPath, fileName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = moveFile(posterFileName(quarantinedPath), filepath.Join(uploadPath, posterFileName(fileName)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	hash, err := blurHash(poster, 4, 3)
+
+	if err != nil {
+		return nil, err
+	}
+
 	// create a var of type data.UserImage
 	var img = data.UserImage{
-		UserID:   user.ID,
-		FileName: files[0].OriginalFileName,
+		UserID:           userID,
+		FileName:         fileName,
+		OriginalFileName: filepath.Base(originalName),
+		FileSize:         size,
+		BlurHash:         hash,
+		DominantColor:    dominantColour(poster),
+		Animated:         &animated,
 	}
 
 	// insert user image into user_images
-	_, err = app.DB.InsertUserImage(img)
+	img.ID, err = app.DB.InsertUserImage(img)
 
 	if err != nil {
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return nil, err
+	}
 
-		return
+	err = app.pruneImages(pruned)
+
+	if err != nil {
+		return nil, err
 	}
 
-	// refresh user in session
-	updatedUser, err := app.DB.GetUser(user.ID)
+	return &img, nil
+}
+
+// uploadExtensions are the extensions images are stored with, by the content type sniffed from them.
+var uploadExtensions = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// renameUpload gives an upload waiting in quarantine a random name, with the extension of the kind of image it
+// really is, so that no two uploads are ever stored under the same name whatever they were called. Files which
+// are not images keep no extension, and are rejected when they are processed.
+func renameUpload(quarantinedPath string) (string, error) {
+	f, err := os.Open(quarantinedPath)
 
 	if err != nil {
-		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return "", err
+	}
 
-		return
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	_ = f.Close()
+
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	name, err := randomHex(16)
+
+	if err != nil {
+		return "", err
+	}
+
+	renamed := filepath.Join(filepath.Dir(quarantinedPath), name+uploadExtensions[http.DetectContentType(head[:n])])
+
+	return renamed, os.Rename(quarantinedPath, renamed)
+}
+
+// RenameSharedUploads gives each image which shares its file with an older image, as ones stored before uploads were
+// given random names can, a copy of the file under a random name of its own, and returns how many it renamed. It
+// must be run before file names are made unique in the database.
+func (app *Application) RenameSharedUploads() (int, error) {
+	images, err := app.DB.GetSharedUserImages()
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, image := range images {
+		name, err := randomHex(16)
+
+		if err != nil {
+			return i, err
+		}
+
+		fileName := name + filepath.Ext(image.FileName)
+
+		for from, to := range map[string]string{image.FileName: fileName, posterFileName(image.FileName): posterFileName(fileName)} {
+			err := copyFile(filepath.Join(uploadPath, from), filepath.Join(uploadPath, to))
+
+			if err != nil && !os.IsNotExist(err) {
+				return i, err
+			}
+		}
+
+		err = app.DB.RenameUserImage(image.ID, fileName)
+
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return len(images), nil
+}
+
+// refreshSessionUser reloads the logged in user from the database, so the session reflects changes such as a new
+// profile picture.
+func (app *Application) refreshSessionUser(req *http.Request, userID int) error {
+	updatedUser, err := app.DB.GetUser(userID)
+
+	if err != nil {
+		return err
 	}
 
 	app.Session.Put(req.Context(), "user", updatedUser)
 
-	// redirect back to profile page
-	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+	return nil
+}
+
+// uploadFailed sends the user back to their profile page when an upload was rejected, and reports any other error
+// as a server error.
+func (app *Application) uploadFailed(resp http.ResponseWriter, req *http.Request, err error) {
+	var rejected imageRejectedError
+
+	if stderrors.As(err, &rejected) {
+		app.Session.Put(req.Context(), "error", rejected.Error())
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+
+		return
+	}
+
+	http.Error(resp, err.Error(), http.StatusInternalServerError)
 }
 
 type UploadedFile struct {
@@ -181,7 +477,6 @@ func UploadFiles(req *http.Request, uploadDirectory string) ([]*UploadedFile, er
 	for _, fHeaders := range req.MultipartForm.File {
 		for _, header := range fHeaders {
 			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
 				infile, err := header.Open()
 
 				if err != nil {
@@ -190,24 +485,13 @@ func UploadFiles(req *http.Request, uploadDirectory string) ([]*UploadedFile, er
 
 				defer infile.Close()
 
-				uploadedFile.OriginalFileName = header.Filename
-
-				var outfile *os.File
-
-				if outfile, err = os.Create(filepath.Join(uploadDirectory, uploadedFile.OriginalFileName)); err != nil {
-					return nil, err
-				}
-
-				defer outfile.Close()
-				fileSize, err := io.Copy(outfile, infile)
+				uploadedFile, err := saveFile(infile, header.Filename, uploadDirectory)
 
 				if err != nil {
 					return nil, err
 				}
 
-				uploadedFile.FileSize = fileSize
-
-				return append(uploadedFiles, &uploadedFile), nil
+				return append(uploadedFiles, uploadedFile), nil
 			}(uploadedFiles)
 
 			if err != nil {
@@ -218,3 +502,73 @@ func UploadFiles(req *http.Request, uploadDirectory string) ([]*UploadedFile, er
 
 	return uploadedFiles, nil
 }
+
+// newQuarantine creates a directory, private to one request, for uploads waiting to be scanned.
+func newQuarantine() (string, error) {
+	if err := os.MkdirAll(quarantinePath, 0700); err != nil {
+		return "", err
+	}
+
+	return os.MkdirTemp(quarantinePath, "upload-*")
+}
+
+// moveFile moves a file, copying it when a rename is not possible because the destination is on another device.
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(from)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	_, err = saveFile(in, filepath.Base(to), filepath.Dir(to))
+
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(from)
+}
+
+// copyFile copies the file at from to the path to.
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+
+	if err != nil {
+		return err
+	}
+
+	defer in.Close()
+
+	_, err = saveFile(in, filepath.Base(to), filepath.Dir(to))
+
+	return err
+}
+
+// saveFile copies src into uploadDirectory under fileName.
+func saveFile(src io.Reader, fileName, uploadDirectory string) (*UploadedFile, error) {
+	var uploadedFile UploadedFile
+	uploadedFile.OriginalFileName = fileName
+
+	outfile, err := os.Create(filepath.Join(uploadDirectory, uploadedFile.OriginalFileName))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer outfile.Close()
+	fileSize, err := io.Copy(outfile, src)
+
+	if err != nil {
+		return nil, err
+	}
+
+	uploadedFile.FileSize = fileSize
+
+	return &uploadedFile, nil
+}
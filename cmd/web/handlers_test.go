@@ -200,12 +200,16 @@ func Test_Application_auth(t *testing.T) {
 
 	})
 
+	// the test repository has user 14 deactivated and user 15 deleted
 	var tests = []struct {
 		name   string
+		user   *data.User
 		isAuth bool
 	}{
-		{"logged in", true},
-		{"not logged in", false},
+		{"logged in", &data.User{ID: 1}, true},
+		{"not logged in", nil, false},
+		{"deactivated", &data.User{ID: 14}, false},
+		{"deleted", &data.User{ID: 15}, false},
 	}
 
 	for _, test := range tests {
@@ -213,8 +217,8 @@ func Test_Application_auth(t *testing.T) {
 		req := httptest.NewRequest(http.MethodGet, "http://testing", nil)
 		req = addContextAndSessionToRequest(req, app)
 
-		if test.isAuth {
-			app.Session.Put(req.Context(), "user", data.User{ID: 1})
+		if test.user != nil {
+			app.Session.Put(req.Context(), "user", *test.user)
 		}
 
 		response := httptest.NewRecorder()
@@ -227,6 +231,10 @@ func Test_Application_auth(t *testing.T) {
 		if !test.isAuth && response.Code != http.StatusTemporaryRedirect {
 			t.Errorf("Test case %s failed: expected status %d, got %d", test.name, http.StatusTemporaryRedirect, response.Code)
 		}
+
+		if !test.isAuth && app.Session.Exists(req.Context(), "user") {
+			t.Errorf("Test case %s failed: expected the session to be ended", test.name)
+		}
 	}
 }
 
@@ -312,7 +320,7 @@ func Test_Application_UploadProfilePicture(t *testing.T) {
 		t.Errorf("Expected status %d, got %d", http.StatusSeeOther, response.Code)
 	}
 
-	_ = os.Remove(uploadPath + "/img.png")
+	removeStoredUploads(t)
 }
 
 func getCtx(req *http.Request) context.Context {
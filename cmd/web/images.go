@@ -0,0 +1,574 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	xdraw "golang.org/x/image/draw"
+	xwebp "golang.org/x/image/webp"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AnimationPolicy decides what happens to animated GIF and PNG uploads.
+type AnimationPolicy string
+
+const (
+	// AnimationReject refuses animated uploads.
+	AnimationReject AnimationPolicy = "reject"
+	// AnimationFirstFrame keeps only the first frame of an animation.
+	AnimationFirstFrame AnimationPolicy = "first-frame"
+	// AnimationKeep keeps the animation, resizing every frame to fit within the maximum dimension.
+	AnimationKeep AnimationPolicy = "keep"
+)
+
+// ImageConfig holds the settings applied to every uploaded image.
+type ImageConfig struct {
+	AnimationPolicy      AnimationPolicy
+	MaxAnimationFrames   int
+	MaxAnimationDuration time.Duration
+	// MaxDimension is the largest width or height an animation is stored at.
+	MaxDimension int
+	// MaxPixels is the most pixels decoded from one upload, counting every frame of an animation, so that a small file
+	// claiming to be huge cannot exhaust memory. Uploads are checked against it before they are decoded.
+	MaxPixels int
+	// JPEGQuality and WebPQuality, from 1 to 100, are used when encoding avatar variants. WebPQuality only matters in
+	// builds with the webp tag, as other builds encode WebP losslessly.
+	JPEGQuality int
+	WebPQuality int
+}
+
+// DefaultImageConfig returns the settings used when none are given on the command line.
+func DefaultImageConfig() ImageConfig {
+	return ImageConfig{
+		AnimationPolicy:      AnimationKeep,
+		MaxAnimationFrames:   100,
+		MaxAnimationDuration: 10 * time.Second,
+		MaxDimension:         512,
+		MaxPixels:            50_000_000,
+		JPEGQuality:          85,
+		WebPQuality:          80,
+	}
+}
+
+// ParseAnimationPolicy validates the name of an animation policy.
+func ParseAnimationPolicy(name string) (AnimationPolicy, error) {
+	switch policy := AnimationPolicy(name); policy {
+	case AnimationReject, AnimationFirstFrame, AnimationKeep:
+		return policy, nil
+	}
+
+	return "", fmt.Errorf("unknown animation policy %q; use %s, %s or %s", name, AnimationReject, AnimationFirstFrame, AnimationKeep)
+}
+
+// imageRejectedError is returned for uploads which are not acceptable; its message is shown to the user.
+type imageRejectedError struct {
+	reason string
+}
+
+func (e imageRejectedError) Error() string {
+	return e.reason
+}
+
+// posterFileName returns the name of the static variant of fileName, used wherever an image must not animate.
+func posterFileName(fileName string) string {
+	ext := filepath.Ext(fileName)
+	posterExt := ".png"
+
+	if strings.EqualFold(ext, ".jpg") || strings.EqualFold(ext, ".jpeg") {
+		posterExt = ".jpg"
+	}
+
+	return strings.TrimSuffix(fileName, ext) + ".poster" + posterExt
+}
+
+// processImage applies the animation policy to the uploaded image at filePath, rewriting it in place when needed,
+// and writes its static poster variant next to it. The poster is returned for computing placeholders from.
+func (cfg ImageConfig) processImage(filePath string) (image.Image, error) {
+	b, err := os.ReadFile(filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var poster image.Image
+
+	switch http.DetectContentType(b) {
+	case "image/gif":
+		poster, err = cfg.processGIF(filePath, b)
+	case "image/png":
+		if isAPNG(b) {
+			poster, err = cfg.processAPNG(filePath, b)
+		} else {
+			poster, err = cfg.decodeStill(b)
+		}
+	case "image/jpeg", "image/webp":
+		poster, err = cfg.decodeStill(b)
+	default:
+		return nil, imageRejectedError{"The uploaded file must be a GIF, JPEG, PNG or WebP image"}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return poster, cfg.writePoster(posterFileName(filePath), poster)
+}
+
+// decodeStill decodes an image which is not animated, once its header shows it is not too large to.
+func (cfg ImageConfig) decodeStill(b []byte) (image.Image, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded image could not be read"}
+	}
+
+	if err := cfg.checkPixels(config.Width, config.Height, 1); err != nil {
+		return nil, err
+	}
+
+	img, err := decodeImage(b)
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded image could not be read"}
+	}
+
+	return img, nil
+}
+
+// checkPixels rejects an image of count frames of width by height pixels, if decoding it would take more than the
+// pixel budget.
+func (cfg ImageConfig) checkPixels(width, height, count int) error {
+	if cfg.MaxPixels <= 0 {
+		return nil
+	}
+
+	if width <= 0 || height <= 0 || width > cfg.MaxPixels/height || count > cfg.MaxPixels/(width*height) {
+		return imageRejectedError{fmt.Sprintf("The uploaded image is too large; it may have at most %d pixels, counting every frame", cfg.MaxPixels)}
+	}
+
+	return nil
+}
+
+// checkFrameCount enforces the frame count limit on an animation we are about to decode and keep.
+func (cfg ImageConfig) checkFrameCount(count int) error {
+	if cfg.MaxAnimationFrames > 0 && count > cfg.MaxAnimationFrames {
+		return imageRejectedError{fmt.Sprintf("Animations may have at most %d frames", cfg.MaxAnimationFrames)}
+	}
+
+	return nil
+}
+
+// processGIF applies the animation policy to a GIF. The size of the image and its number of frames are read, and the
+// policy applied, before any frame is decoded.
+func (cfg ImageConfig) processGIF(filePath string, b []byte) (image.Image, error) {
+	config, err := gif.DecodeConfig(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded GIF could not be read"}
+	}
+
+	count, err := gifFrameCount(b)
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded GIF could not be read"}
+	}
+
+	if count > 1 && cfg.AnimationPolicy == AnimationReject {
+		return nil, imageRejectedError{"Animated images are not allowed"}
+	}
+
+	if count <= 1 || cfg.AnimationPolicy == AnimationFirstFrame {
+		if err := cfg.checkPixels(config.Width, config.Height, 1); err != nil {
+			return nil, err
+		}
+
+		// gif.Decode stops after the first frame
+		img, err := gif.Decode(bytes.NewReader(b))
+
+		if err != nil {
+			return nil, imageRejectedError{"The uploaded GIF could not be read"}
+		}
+
+		first := &gif.GIF{Image: []*image.Paletted{img.(*image.Paletted)}, Delay: []int{0}, Config: config}
+
+		if count > 1 {
+			err = writeGIF(filePath, first)
+		}
+
+		return gifFrames(first)[0].image, err
+	}
+
+	if err := cfg.checkFrameCount(count); err != nil {
+		return nil, err
+	}
+
+	// every frame is composited onto its own copy of the canvas
+	if err := cfg.checkPixels(config.Width, config.Height, count); err != nil {
+		return nil, err
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded GIF could not be read"}
+	}
+
+	frames := gifFrames(g)
+
+	if err := cfg.checkAnimation(frames); err != nil {
+		return nil, err
+	}
+
+	if !cfg.needsResize(g.Config.Width, g.Config.Height) {
+		return frames[0].image, nil
+	}
+
+	resized := &gif.GIF{LoopCount: g.LoopCount}
+
+	for i, frame := range frames {
+		img := resizeToFit(frame.image, cfg.MaxDimension)
+		paletted := image.NewPaletted(img.Bounds(), gifPalette(g.Image[i].Palette))
+		xdraw.FloydSteinberg.Draw(paletted, img.Bounds(), img, image.Point{})
+
+		resized.Image = append(resized.Image, paletted)
+		resized.Delay = append(resized.Delay, g.Delay[i])
+	}
+
+	return frames[0].image, writeGIF(filePath, resized)
+}
+
+// gifFrameCount counts the frames of a GIF by walking its blocks, without decompressing any of them.
+func gifFrameCount(b []byte) (int, error) {
+	errTruncated := fmt.Errorf("truncated GIF")
+
+	if len(b) < 13 {
+		return 0, errTruncated
+	}
+
+	// the header and logical screen descriptor, then the global colour table if there is one
+	pos := 13
+
+	if b[10]&0x80 != 0 {
+		pos += 3 << (b[10]&0x07 + 1)
+	}
+
+	// skipSubBlocks moves pos past a sequence of data sub-blocks, which ends with an empty one
+	skipSubBlocks := func() error {
+		for {
+			if pos >= len(b) {
+				return errTruncated
+			}
+
+			size := int(b[pos])
+			pos += 1 + size
+
+			if size == 0 {
+				return nil
+			}
+		}
+	}
+
+	count := 0
+
+	for {
+		if pos >= len(b) {
+			return 0, errTruncated
+		}
+
+		switch b[pos] {
+		case 0x21: // extension: a label, then sub-blocks
+			pos += 2
+
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2c: // image descriptor, an optional local colour table, the LZW code size, then sub-blocks
+			if pos+10 > len(b) {
+				return 0, errTruncated
+			}
+
+			flags := b[pos+9]
+			pos += 10
+
+			if flags&0x80 != 0 {
+				pos += 3 << (flags&0x07 + 1)
+			}
+
+			pos++
+
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+
+			count++
+		case 0x3b: // trailer
+			return count, nil
+		default:
+			return 0, fmt.Errorf("unknown GIF block %#x", b[pos])
+		}
+	}
+}
+
+// processAPNG applies the animation policy to an animated PNG. The size of the image and its number of frames are read,
+// and the policy applied, before any frame is decoded.
+func (cfg ImageConfig) processAPNG(filePath string, b []byte) (image.Image, error) {
+	if cfg.AnimationPolicy == AnimationReject {
+		return nil, imageRejectedError{"Animated images are not allowed"}
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(b))
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded PNG could not be read"}
+	}
+
+	if cfg.AnimationPolicy == AnimationFirstFrame {
+		if err := cfg.checkPixels(config.Width, config.Height, 1); err != nil {
+			return nil, err
+		}
+
+		frames, _, err := decodeAPNG(b, 1)
+
+		if err != nil {
+			return nil, imageRejectedError{"The uploaded PNG could not be read"}
+		}
+
+		return frames[0].image, writePNG(filePath, frames[0].image)
+	}
+
+	count := apngFrameCount(b)
+
+	if err := cfg.checkFrameCount(count); err != nil {
+		return nil, err
+	}
+
+	// every frame is composited onto its own copy of the canvas
+	if err := cfg.checkPixels(config.Width, config.Height, count); err != nil {
+		return nil, err
+	}
+
+	frames, plays, err := decodeAPNG(b, 0)
+
+	if err != nil {
+		return nil, imageRejectedError{"The uploaded PNG could not be read"}
+	}
+
+	if err := cfg.checkAnimation(frames); err != nil {
+		return nil, err
+	}
+
+	bounds := frames[0].image.Bounds()
+
+	if !cfg.needsResize(bounds.Dx(), bounds.Dy()) {
+		return frames[0].image, nil
+	}
+
+	for i := range frames {
+		frames[i].image = resizeToFit(frames[i].image, cfg.MaxDimension)
+	}
+
+	var buf bytes.Buffer
+
+	if err := encodeAPNG(&buf, frames, plays); err != nil {
+		return nil, err
+	}
+
+	return frames[0].image, os.WriteFile(filePath, buf.Bytes(), 0644)
+}
+
+// decodeImage decodes a GIF, JPEG, PNG or WebP image, returning the first frame of animations.
+func decodeImage(b []byte) (image.Image, error) {
+	// decode WebP explicitly, as the encoder we use registers a decoder of its own for the format
+	if http.DetectContentType(b) == "image/webp" {
+		return xwebp.Decode(bytes.NewReader(b))
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(b))
+
+	return img, err
+}
+
+// isAnimated reports whether b is a GIF or PNG with more than one frame. No frame is decoded to find out.
+func isAnimated(b []byte) bool {
+	switch http.DetectContentType(b) {
+	case "image/gif":
+		count, err := gifFrameCount(b)
+
+		return err == nil && count > 1
+	case "image/png":
+		return isAPNG(b)
+	}
+
+	return false
+}
+
+// checkAnimation enforces the frame count and duration limits on an animation we are about to keep.
+func (cfg ImageConfig) checkAnimation(frames []animationFrame) error {
+	if err := cfg.checkFrameCount(len(frames)); err != nil {
+		return err
+	}
+
+	var total time.Duration
+
+	for _, frame := range frames {
+		total += frame.delay
+	}
+
+	if cfg.MaxAnimationDuration > 0 && total > cfg.MaxAnimationDuration {
+		return imageRejectedError{fmt.Sprintf("Animations may last at most %s", cfg.MaxAnimationDuration)}
+	}
+
+	return nil
+}
+
+func (cfg ImageConfig) needsResize(width, height int) bool {
+	return cfg.MaxDimension > 0 && (width > cfg.MaxDimension || height > cfg.MaxDimension)
+}
+
+// gifFrames composites every frame of g onto the logical screen, honouring each frame's disposal method.
+func gifFrames(g *gif.GIF) []animationFrame {
+	bounds := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+
+	if bounds.Empty() {
+		bounds = g.Image[0].Bounds()
+	}
+
+	canvas := image.NewNRGBA(bounds)
+	var frames []animationFrame
+
+	for i, frame := range g.Image {
+		var disposal byte
+
+		if i < len(g.Disposal) {
+			disposal = g.Disposal[i]
+		}
+
+		var previous *image.NRGBA
+
+		if disposal == gif.DisposalPrevious {
+			previous = cloneNRGBA(canvas)
+		}
+
+		xdraw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, xdraw.Over)
+
+		frames = append(frames, animationFrame{
+			image: cloneNRGBA(canvas),
+			delay: time.Duration(g.Delay[i]) * 10 * time.Millisecond,
+		})
+
+		switch disposal {
+		case gif.DisposalBackground:
+			xdraw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, xdraw.Src)
+		case gif.DisposalPrevious:
+			canvas = previous
+		}
+	}
+
+	return frames
+}
+
+// gifPalette returns p with a transparent entry added, if there is room for one, so that resized frames can keep
+// their transparent areas.
+func gifPalette(p color.Palette) color.Palette {
+	for _, c := range p {
+		if _, _, _, a := c.RGBA(); a == 0 {
+			return p
+		}
+	}
+
+	if len(p) >= 256 {
+		return p
+	}
+
+	return append(append(color.Palette{}, p...), color.Transparent)
+}
+
+// resizeToFit scales img down, keeping its aspect ratio, so that neither side exceeds maxDimension.
+func resizeToFit(img image.Image, maxDimension int) *image.NRGBA {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	if width > maxDimension || height > maxDimension {
+		if width >= height {
+			height = max(1, height*maxDimension/width)
+			width = maxDimension
+		} else {
+			width = max(1, width*maxDimension/height)
+			height = maxDimension
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	xdraw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, xdraw.Src, nil)
+
+	return dst
+}
+
+func (cfg ImageConfig) writePoster(filePath string, img image.Image) error {
+	outfile, err := os.Create(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer outfile.Close()
+
+	if filepath.Ext(filePath) == ".jpg" {
+		return cfg.encode(outfile, img, "image/jpeg")
+	}
+
+	return cfg.encode(outfile, img, "image/png")
+}
+
+// encode writes img in the given format, at the configured quality for that format.
+func (cfg ImageConfig) encode(w io.Writer, img image.Image, contentType string) error {
+	switch contentType {
+	case "image/jpeg":
+		quality := cfg.JPEGQuality
+
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "image/webp":
+		return encodeWebP(w, img, cfg.WebPQuality)
+	case "image/png":
+		return png.Encode(w, img)
+	}
+
+	return fmt.Errorf("cannot encode images as %s", contentType)
+}
+
+func writeGIF(filePath string, g *gif.GIF) error {
+	outfile, err := os.Create(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer outfile.Close()
+
+	return gif.EncodeAll(outfile, g)
+}
+
+func writePNG(filePath string, img image.Image) error {
+	outfile, err := os.Create(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer outfile.Close()
+
+	return png.Encode(outfile, img)
+}
@@ -0,0 +1,295 @@
+package web
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestGIF writes an animated GIF of count frames to the uploads directory and returns its path.
+func writeTestGIF(t *testing.T, count, size int) string {
+	palette := color.Palette{color.Black, color.White, color.NRGBA{R: 255, A: 255}}
+	g := &gif.GIF{}
+
+	for i := 0; i < count; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, size, size), palette)
+
+		for p := range frame.Pix {
+			frame.Pix[p] = uint8(i % len(palette))
+		}
+
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, 10)
+	}
+
+	filePath := filepath.Join("./testdata/uploads", "animated.gif")
+	outfile, err := os.Create(filePath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer outfile.Close()
+
+	if err := gif.EncodeAll(outfile, g); err != nil {
+		t.Fatal(err)
+	}
+
+	return filePath
+}
+
+func Test_ImageConfig_processImage_GIF(t *testing.T) {
+	var tests = []struct {
+		name           string
+		policy         AnimationPolicy
+		frames         int
+		size           int
+		expectRejected bool
+		expectedFrames int
+		expectedSize   int
+	}{
+		{"static", AnimationReject, 1, 40, false, 1, 40},
+		{"reject", AnimationReject, 3, 40, true, 0, 0},
+		{"first frame", AnimationFirstFrame, 3, 40, false, 1, 40},
+		{"keep small", AnimationKeep, 3, 40, false, 3, 40},
+		{"keep and resize", AnimationKeep, 3, 100, false, 3, 50},
+		{"too many frames", AnimationKeep, 6, 40, true, 0, 0},
+	}
+
+	cfg := ImageConfig{
+		MaxAnimationFrames:   5,
+		MaxAnimationDuration: 10 * time.Second,
+		MaxDimension:         50,
+	}
+
+	for _, test := range tests {
+		cfg.AnimationPolicy = test.policy
+		filePath := writeTestGIF(t, test.frames, test.size)
+
+		_, err := cfg.processImage(filePath)
+
+		if _, rejected := err.(imageRejectedError); rejected != test.expectRejected {
+			t.Errorf("%s: expected rejection to be %t, got %v", test.name, test.expectRejected, err)
+		}
+
+		if !test.expectRejected {
+			f, _ := os.Open(filePath)
+			g, err := gif.DecodeAll(f)
+			f.Close()
+
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if len(g.Image) != test.expectedFrames {
+				t.Errorf("%s: expected %d frames, got %d", test.name, test.expectedFrames, len(g.Image))
+			}
+
+			if g.Image[0].Bounds().Dx() != test.expectedSize {
+				t.Errorf("%s: expected width %d, got %d", test.name, test.expectedSize, g.Image[0].Bounds().Dx())
+			}
+
+			if _, err := os.Stat(posterFileName(filePath)); err != nil {
+				t.Errorf("%s: expected a poster: %s", test.name, err)
+			}
+		}
+
+		_ = os.Remove(filePath)
+		_ = os.Remove(posterFileName(filePath))
+	}
+}
+
+func Test_ImageConfig_processImage_APNG(t *testing.T) {
+	var tests = []struct {
+		name           string
+		policy         AnimationPolicy
+		delay          time.Duration
+		expectRejected bool
+		expectAnimated bool
+		expectedSize   int
+	}{
+		{"reject", AnimationReject, 100 * time.Millisecond, true, false, 0},
+		{"first frame", AnimationFirstFrame, 100 * time.Millisecond, false, false, 40},
+		{"keep and resize", AnimationKeep, 100 * time.Millisecond, false, true, 20},
+		{"too long", AnimationKeep, 5 * time.Second, true, false, 0},
+	}
+
+	cfg := ImageConfig{
+		MaxAnimationFrames:   5,
+		MaxAnimationDuration: 10 * time.Second,
+		MaxDimension:         20,
+	}
+
+	filePath := filepath.Join("./testdata/uploads", "animated.png")
+
+	for _, test := range tests {
+		cfg.AnimationPolicy = test.policy
+
+		var buf bytes.Buffer
+		_ = encodeAPNG(&buf, testAnimation(3, 40, 40, test.delay), 0)
+
+		if err := os.WriteFile(filePath, buf.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := cfg.processImage(filePath)
+
+		if _, rejected := err.(imageRejectedError); rejected != test.expectRejected {
+			t.Errorf("%s: expected rejection to be %t, got %v", test.name, test.expectRejected, err)
+		}
+
+		if !test.expectRejected {
+			b, _ := os.ReadFile(filePath)
+
+			if isAPNG(b) != test.expectAnimated {
+				t.Errorf("%s: expected animated to be %t", test.name, test.expectAnimated)
+			}
+
+			img, err := png.Decode(bytes.NewReader(b))
+
+			if err != nil {
+				t.Fatalf("%s: %s", test.name, err)
+			}
+
+			if img.Bounds().Dx() != test.expectedSize {
+				t.Errorf("%s: expected width %d, got %d", test.name, test.expectedSize, img.Bounds().Dx())
+			}
+
+			poster, _ := os.ReadFile(posterFileName(filePath))
+
+			if isAPNG(poster) {
+				t.Errorf("%s: poster must not be animated", test.name)
+			}
+		}
+
+		_ = os.Remove(filePath)
+		_ = os.Remove(posterFileName(filePath))
+	}
+}
+
+func Test_ImageConfig_processImage_MaxPixels(t *testing.T) {
+	var tests = []struct {
+		name           string
+		policy         AnimationPolicy
+		frames         int
+		expectRejected bool
+	}{
+		{"static", AnimationKeep, 1, false},
+		{"first frame of a large animation", AnimationFirstFrame, 3, false},
+		{"large animation", AnimationKeep, 3, true},
+	}
+
+	// one 40 by 40 frame fits, three do not
+	cfg := ImageConfig{MaxPixels: 2000, MaxAnimationFrames: 5}
+
+	for _, test := range tests {
+		cfg.AnimationPolicy = test.policy
+
+		for _, format := range []string{"gif", "png"} {
+			filePath := writeTestGIF(t, test.frames, 40)
+
+			if format == "png" {
+				var buf bytes.Buffer
+				_ = encodeAPNG(&buf, testAnimation(test.frames, 40, 40, 100*time.Millisecond), 0)
+				filePath = filepath.Join("./testdata/uploads", "animated.png")
+
+				if err := os.WriteFile(filePath, buf.Bytes(), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err := cfg.processImage(filePath)
+
+			if _, rejected := err.(imageRejectedError); rejected != test.expectRejected {
+				t.Errorf("%s %s: expected rejection to be %t, got %v", test.name, format, test.expectRejected, err)
+			}
+
+			_ = os.Remove(filePath)
+			_ = os.Remove(posterFileName(filePath))
+		}
+	}
+
+	// a tiny file whose header claims it is enormous is rejected before it is decoded
+	var buf bytes.Buffer
+	buf.Write(pngSignature)
+	writePNGChunk(&buf, "IHDR", []byte{0, 1, 0x86, 0xa0, 0, 1, 0x86, 0xa0, 8, 6, 0, 0, 0})
+	writePNGChunk(&buf, "IEND", nil)
+
+	filePath := filepath.Join("./testdata/uploads", "huge.png")
+	_ = os.WriteFile(filePath, buf.Bytes(), 0644)
+	defer os.Remove(filePath)
+
+	_, err := DefaultImageConfig().processImage(filePath)
+
+	if err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("expected a 100000 by 100000 PNG to be rejected as too large, got %v", err)
+	}
+}
+
+func Test_gifFrameCount(t *testing.T) {
+	for _, frames := range []int{1, 3} {
+		b, _ := os.ReadFile(writeTestGIF(t, frames, 10))
+
+		if count, err := gifFrameCount(b); err != nil || count != frames {
+			t.Errorf("expected %d frames, got %d %v", frames, count, err)
+		}
+
+		if isAnimated(b) != (frames > 1) {
+			t.Errorf("expected a GIF of %d frames to be animated: %t", frames, frames > 1)
+		}
+
+		if _, err := gifFrameCount(b[:len(b)-2]); err == nil {
+			t.Errorf("expected a truncated GIF of %d frames to be an error", frames)
+		}
+	}
+
+	_ = os.Remove(filepath.Join("./testdata/uploads", "animated.gif"))
+}
+
+func Test_ImageConfig_processImage_NotAnImage(t *testing.T) {
+	filePath := filepath.Join("./testdata/uploads", "notes.txt")
+	_ = os.WriteFile(filePath, []byte("hello"), 0644)
+	defer os.Remove(filePath)
+
+	_, err := DefaultImageConfig().processImage(filePath)
+
+	if _, rejected := err.(imageRejectedError); !rejected {
+		t.Errorf("expected a text file to be rejected, got %v", err)
+	}
+}
+
+func Test_posterFileName(t *testing.T) {
+	var tests = []struct {
+		fileName string
+		expected string
+	}{
+		{"me.gif", "me.poster.png"},
+		{"me.png", "me.poster.png"},
+		{"me.jpg", "me.poster.jpg"},
+		{"me.JPEG", "me.poster.jpg"},
+		{"dir/me", "dir/me.poster.png"},
+	}
+
+	for _, test := range tests {
+		if actual := posterFileName(test.fileName); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.fileName, test.expected, actual)
+		}
+	}
+}
+
+func Test_ParseAnimationPolicy(t *testing.T) {
+	if _, err := ParseAnimationPolicy("keep"); err != nil {
+		t.Error(err)
+	}
+
+	if _, err := ParseAnimationPolicy("loop"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
@@ -0,0 +1,118 @@
+package web
+
+import (
+	"database/sql"
+	stderrors "errors"
+	"fmt"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+)
+
+// impersonationDetails is what the audit log records about an impersonation, so that it still reads sensibly after
+// either user has been deleted.
+type impersonationDetails struct {
+	Impersonator string `json:"impersonator"`
+	User         string `json:"user"`
+}
+
+// StartImpersonation logs an administrator in as another user, so they can see the site the way that user does. The
+// administrator is kept in the session so that they can go back to being themselves. Administrators cannot be
+// impersonated, and nobody can impersonate someone while already impersonating.
+func (app *Application) StartImpersonation(resp http.ResponseWriter, req *http.Request) {
+	target, ok := app.adminSubject(resp, req)
+
+	if !ok {
+		return
+	}
+
+	admin, _ := app.Session.Get(req.Context(), "user").(data.User)
+	redirectTo := fmt.Sprintf("/admin/users/%d", target.ID)
+
+	var problem string
+
+	switch {
+	case app.Session.Exists(req.Context(), "impersonator"):
+		problem = "Stop impersonating first"
+	case target.ID == admin.ID:
+		problem = "You cannot impersonate yourself"
+	case target.IsAdmin == 1 || target.HasRole(data.RoleAdmin):
+		problem = "Administrators cannot be impersonated"
+	}
+
+	if problem != "" {
+		app.Session.Put(req.Context(), "error", problem)
+		http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	// nobody gets to impersonate anyone without it being written down
+	err := app.audit(req, data.AuditImpersonationStarted, target.ID, impersonationDetails{admin.Email, target.Email})
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.Session.RenewToken(req.Context())
+
+	app.Session.Put(req.Context(), "impersonator", admin)
+	app.Session.Put(req.Context(), "user", *target)
+	app.Session.Put(req.Context(), "flash", fmt.Sprintf("You are now logged in as %s", target.Email))
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
+
+// StopImpersonation logs an administrator back in as themselves, and takes them back to the user they were
+// impersonating. The administrator is reloaded from the database, as their roles may have changed in the meantime;
+// if they have been deleted, they are logged out.
+func (app *Application) StopImpersonation(resp http.ResponseWriter, req *http.Request) {
+	admin, ok := app.Session.Get(req.Context(), "impersonator").(data.User)
+
+	if !ok {
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	target, _ := app.Session.Get(req.Context(), "user").(data.User)
+
+	err := app.audit(req, data.AuditImpersonationStopped, target.ID, impersonationDetails{admin.Email, target.Email})
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	current, err := app.DB.GetUser(admin.ID)
+
+	if stderrors.Is(err, sql.ErrNoRows) {
+		_ = app.Session.Destroy(req.Context())
+		http.Redirect(resp, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.Session.RenewToken(req.Context())
+
+	app.Session.Remove(req.Context(), "impersonator")
+	app.Session.Put(req.Context(), "user", *current)
+	app.Session.Put(req.Context(), "flash", fmt.Sprintf("You are no longer logged in as %s", target.Email))
+	http.Redirect(resp, req, fmt.Sprintf("/admin/users/%d", target.ID), http.StatusSeeOther)
+}
+
+// blockImpersonation keeps administrators who are impersonating a user away from things only that user should do,
+// such as creating access tokens or signing in to other applications.
+func (app *Application) blockImpersonation(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if app.Session.Exists(req.Context(), "impersonator") {
+			app.Session.Put(req.Context(), "error", "You cannot do that while impersonating another user")
+
+			http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+			return
+		}
+
+		next.ServeHTTP(resp, req)
+	})
+}
@@ -0,0 +1,156 @@
+package web
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Application_StartImpersonation(t *testing.T) {
+	admin := data.User{ID: 3, Email: "admin@example.com", IsAdmin: 1}
+
+	var tests = []struct {
+		name             string
+		user             data.User
+		impersonator     *data.User
+		expectedLocation string
+		expectedError    string
+	}{
+		{"admin", admin, nil, "/user/profile", ""},
+		{"yourself", data.User{ID: 1, IsAdmin: 1}, nil, "/admin/users/1", "cannot impersonate yourself"},
+		{"already impersonating", data.User{ID: 2}, &admin, "/admin/users/1", "Stop impersonating first"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/1/impersonate", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", test.user)
+
+		if test.impersonator != nil {
+			app.Session.Put(req.Context(), "impersonator", *test.impersonator)
+		}
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("id", "1")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		app.StartImpersonation(resp, req)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != test.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %d %s", test.name, test.expectedLocation, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+
+		if test.expectedError != "" {
+			continue
+		}
+
+		user, _ := app.Session.Get(req.Context(), "user").(data.User)
+		impersonator, _ := app.Session.Get(req.Context(), "impersonator").(data.User)
+
+		if user.ID != 1 || impersonator.ID != admin.ID {
+			t.Errorf("%s: expected to be user 1 impersonated by %d, got user %d impersonated by %d", test.name, admin.ID, user.ID, impersonator.ID)
+		}
+	}
+}
+
+func Test_Application_StopImpersonation(t *testing.T) {
+	var tests = []struct {
+		name             string
+		impersonator     *data.User
+		expectedUser     int
+		expectedLocation string
+	}{
+		// the test repository has user 12 as an administrator
+		{"impersonating", &data.User{ID: 12}, 12, "/admin/users/1"},
+		{"not impersonating", nil, 1, "/user/profile"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/stop-impersonating", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		if test.impersonator != nil {
+			app.Session.Put(req.Context(), "impersonator", *test.impersonator)
+		}
+
+		resp := httptest.NewRecorder()
+		app.StopImpersonation(resp, req)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != test.expectedLocation {
+			t.Errorf("%s: expected a redirect to %s, got %d %s", test.name, test.expectedLocation, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if user, _ := app.Session.Get(req.Context(), "user").(data.User); user.ID != test.expectedUser {
+			t.Errorf("%s: expected to be user %d, got %d", test.name, test.expectedUser, user.ID)
+		} else if test.impersonator != nil && !user.HasRole(data.RoleAdmin) {
+			t.Errorf("%s: expected the administrator to be reloaded, got %+v", test.name, user)
+		}
+
+		if app.Session.Exists(req.Context(), "impersonator") {
+			t.Errorf("%s: expected the impersonator to be forgotten", test.name)
+		}
+	}
+}
+
+func Test_Application_blockImpersonation(t *testing.T) {
+	var tests = []struct {
+		name             string
+		impersonating    bool
+		expectedNextCall bool
+	}{
+		{"user", false, true},
+		{"impersonating", true, false},
+	}
+
+	for _, test := range tests {
+		called := false
+		nextHandler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			called = true
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/user/tokens", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		if test.impersonating {
+			app.Session.Put(req.Context(), "impersonator", data.User{ID: 3, IsAdmin: 1})
+		}
+
+		resp := httptest.NewRecorder()
+		app.blockImpersonation(nextHandler).ServeHTTP(resp, req)
+
+		if called != test.expectedNextCall {
+			t.Errorf("%s: expected next handler to be called to be %t", test.name, test.expectedNextCall)
+		}
+
+		if !test.expectedNextCall && resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+	}
+}
+
+func Test_Application_ImpersonationBanner(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1, FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"})
+	app.Session.Put(req.Context(), "impersonator", data.User{ID: 3, Email: "admin@example.com", IsAdmin: 1})
+
+	resp := httptest.NewRecorder()
+	app.Home(resp, req)
+
+	for _, expected := range []string{"logged in as <strong>Jane Doe</strong>", `action="/user/stop-impersonating"`} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected the page to contain %q", expected)
+		}
+	}
+}
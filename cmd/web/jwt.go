@@ -0,0 +1,490 @@
+package web
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// refreshTokenPrefix starts every refresh token, as tokenPrefix does personal access tokens.
+const refreshTokenPrefix = "ppr_"
+
+// SigningKey is a key access tokens are signed and verified with, identified in each token by its key ID.
+type SigningKey struct {
+	ID string
+	// Algorithm is "HS256", for a shared secret, or "EdDSA", for an Ed25519 key pair.
+	Algorithm  string
+	secret     []byte
+	privateKey ed25519.PrivateKey
+}
+
+// NewHS256Key returns a key for signing tokens with HMAC-SHA256. The secret must be at least 32 bytes long.
+func NewHS256Key(id string, secret []byte) (SigningKey, error) {
+	if len(secret) < 32 {
+		return SigningKey{}, fmt.Errorf("HS256 key %q must be at least 32 bytes long", id)
+	}
+
+	return SigningKey{ID: id, Algorithm: "HS256", secret: secret}, nil
+}
+
+// NewEdDSAKey returns a key for signing tokens with Ed25519.
+func NewEdDSAKey(id string, privateKey ed25519.PrivateKey) SigningKey {
+	return SigningKey{ID: id, Algorithm: "EdDSA", privateKey: privateKey}
+}
+
+// GenerateEdDSAKey returns a new random Ed25519 key.
+func GenerateEdDSAKey(id string) (SigningKey, error) {
+	_, privateKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return SigningKey{}, err
+	}
+
+	return NewEdDSAKey(id, privateKey), nil
+}
+
+// LoadSigningKeys reads keys from a JSON file holding a list of objects with "kid", "alg" and "key" members. The key
+// is base64 encoded: a secret for HS256, or a 32 byte seed or 64 byte private key for EdDSA. The first key signs new
+// tokens and the rest only verify them, so a key can be rotated by adding its replacement at the top of the list and
+// removing it once every token it signed has expired.
+func LoadSigningKeys(path string) ([]SigningKey, error) {
+	b, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []struct {
+		ID        string `json:"kid"`
+		Algorithm string `json:"alg"`
+		Key       string `json:"key"`
+	}
+
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("reading signing keys: %w", err)
+	}
+
+	var keys []SigningKey
+	seen := make(map[string]bool)
+
+	for _, entry := range entries {
+		if entry.ID == "" || seen[entry.ID] {
+			return nil, fmt.Errorf("every signing key needs a unique kid")
+		}
+
+		seen[entry.ID] = true
+
+		material, err := base64.StdEncoding.DecodeString(entry.Key)
+
+		if err != nil {
+			return nil, fmt.Errorf("signing key %q is not valid base64", entry.ID)
+		}
+
+		switch entry.Algorithm {
+		case "HS256":
+			key, err := NewHS256Key(entry.ID, material)
+
+			if err != nil {
+				return nil, err
+			}
+
+			keys = append(keys, key)
+		case "EdDSA":
+			switch len(material) {
+			case ed25519.SeedSize:
+				keys = append(keys, NewEdDSAKey(entry.ID, ed25519.NewKeyFromSeed(material)))
+			case ed25519.PrivateKeySize:
+				keys = append(keys, NewEdDSAKey(entry.ID, ed25519.PrivateKey(material)))
+			default:
+				return nil, fmt.Errorf("EdDSA key %q must be a 32 byte seed or 64 byte private key", entry.ID)
+			}
+		default:
+			return nil, fmt.Errorf("signing key %q has unsupported algorithm %q", entry.ID, entry.Algorithm)
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s holds no signing keys", path)
+	}
+
+	return keys, nil
+}
+
+func (k SigningKey) method() jwt.SigningMethod {
+	if k.Algorithm == "EdDSA" {
+		return jwt.SigningMethodEdDSA
+	}
+
+	return jwt.SigningMethodHS256
+}
+
+func (k SigningKey) signingKey() any {
+	if k.Algorithm == "EdDSA" {
+		return k.privateKey
+	}
+
+	return k.secret
+}
+
+func (k SigningKey) verificationKey() any {
+	if k.Algorithm == "EdDSA" {
+		return k.privateKey.Public()
+	}
+
+	return k.secret
+}
+
+// JWTConfig configures the access and refresh tokens issued by the API's token endpoint.
+type JWTConfig struct {
+	Issuer          string
+	Audience        string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	// Keys verify access tokens, and the first of them signs new ones.
+	Keys []SigningKey
+}
+
+// DefaultJWTConfig returns the token settings used when none are configured. It has no keys.
+func DefaultJWTConfig() JWTConfig {
+	return JWTConfig{
+		Issuer:          "profile-picture-web",
+		Audience:        "profile-picture-web-api",
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+	}
+}
+
+// accessTokenClaims are the claims of an API access token. Scope lists the scopes it grants, separated by spaces, as
+// personal access tokens are granted them.
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope"`
+}
+
+// issueAccessToken returns a signed access token for the user, granting scopes.
+func (cfg JWTConfig) issueAccessToken(userID int, scopes []string) (string, error) {
+	if len(cfg.Keys) == 0 {
+		return "", stderrors.New("no key to sign access tokens with")
+	}
+
+	key := cfg.Keys[0]
+	now := time.Now()
+
+	jti, err := randomHex(16)
+
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(key.method(), accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.Issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{cfg.Audience},
+			ExpiresAt: jwt.NewNumericDate(now.Add(cfg.AccessTokenTTL)),
+			NotBefore: jwt.NewNumericDate(now),
+			IssuedAt:  jwt.NewNumericDate(now),
+			ID:        jti,
+		},
+		Scope: strings.Join(scopes, " "),
+	})
+
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.signingKey())
+}
+
+// keyFunc finds the key a token was signed with, by its key ID.
+func (cfg JWTConfig) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	for _, key := range cfg.Keys {
+		// the algorithm must match the key, so an HS256 token cannot be forged with a published public key
+		if key.ID == kid && key.method().Alg() == token.Method.Alg() {
+			return key.verificationKey(), nil
+		}
+	}
+
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// publicKey returns the first key whose signatures anyone can check against the published JWKS, for signing tokens
+// other applications need to verify.
+func (cfg JWTConfig) publicKey() (SigningKey, bool) {
+	for _, key := range cfg.Keys {
+		if key.Algorithm == "EdDSA" {
+			return key, true
+		}
+	}
+
+	return SigningKey{}, false
+}
+
+// parseAccessToken verifies an access token and returns the id of the user it was issued to, and the scopes it
+// grants.
+func (cfg JWTConfig) parseAccessToken(tokenString string) (int, []string, error) {
+	var claims accessTokenClaims
+
+	_, err := jwt.ParseWithClaims(tokenString, &claims, cfg.keyFunc,
+		jwt.WithValidMethods([]string{"HS256", "EdDSA"}),
+		jwt.WithIssuer(cfg.Issuer),
+		jwt.WithAudience(cfg.Audience),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	id, err := strconv.Atoi(claims.Subject)
+
+	return id, strings.Fields(claims.Scope), err
+}
+
+// jwk is a public key in the form RFC 7517 publishes it.
+type jwk struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// jwks returns the public keys access tokens can be verified with. HS256 secrets are never published.
+func (cfg JWTConfig) jwks() map[string][]jwk {
+	keys := []jwk{}
+
+	for _, key := range cfg.Keys {
+		if key.Algorithm != "EdDSA" {
+			continue
+		}
+
+		keys = append(keys, jwk{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         base64.RawURLEncoding.EncodeToString(key.privateKey.Public().(ed25519.PublicKey)),
+			KeyID:     key.ID,
+			Algorithm: "EdDSA",
+			Use:       "sig",
+		})
+	}
+
+	return map[string][]jwk{"keys": keys}
+}
+
+// JWKS publishes the public keys access tokens are signed with.
+func (app *Application) JWKS(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(resp, http.StatusOK, app.JWT.jwks())
+}
+
+// authenticateJWT is the counterpart of the session based auth for clients using access tokens: it verifies the
+// token and returns the caller it was issued to.
+func (app *Application) authenticateJWT(token string) (apiCaller, error) {
+	id, scopes, err := app.JWT.parseAccessToken(token)
+
+	if err != nil {
+		return apiCaller{}, err
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil {
+		return apiCaller{}, err
+	}
+
+	if !user.Active() {
+		return apiCaller{}, errDeactivated
+	}
+
+	return apiCaller{User: *user, Scopes: scopes}, nil
+}
+
+// tokenRequest is the body of a request to the token endpoint.
+type tokenRequest struct {
+	GrantType    string `json:"grant_type"`
+	Email        string `json:"email"`
+	Password     string `json:"password"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+const invalidGrantProblemType = "/api/v1/problems/invalid-grant"
+
+// errInvalidGrant is returned for every bad credential, so callers cannot tell which part was wrong.
+var errInvalidGrant = stderrors.New("The credentials are invalid or have expired")
+
+// APIToken issues access tokens. The password grant exchanges an email address and password for a new access and
+// refresh token; the refresh_token grant exchanges a refresh token for new ones. A refresh token can only be used
+// once: presenting it again revokes every token descended from the same login.
+func (app *Application) APIToken(resp http.ResponseWriter, req *http.Request) {
+	var input tokenRequest
+
+	if err := readJSON(resp, req, &input); err != nil {
+		writeProblem(resp, req, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var tokens tokenResponse
+	var err error
+
+	switch input.GrantType {
+	case "password":
+		tokens, err = app.passwordGrant(input.Email, input.Password)
+	case "refresh_token":
+		tokens, err = app.refreshTokenGrant(input.RefreshToken)
+	default:
+		form := NewForm(nil)
+		form.Errors.Add("grant_type", `Must be "password" or "refresh_token"`)
+		writeValidationProblem(resp, req, form)
+		return
+	}
+
+	if stderrors.Is(err, errInvalidGrant) {
+		writeProblemBody(resp, problem{
+			Type:     invalidGrantProblemType,
+			Title:    "Invalid grant",
+			Status:   http.StatusBadRequest,
+			Detail:   err.Error(),
+			Instance: req.URL.Path,
+		})
+		return
+	}
+
+	if err != nil {
+		log.Println("Error issuing tokens:", err)
+		writeProblem(resp, req, http.StatusInternalServerError, "")
+		return
+	}
+
+	resp.Header().Set("Cache-Control", "no-store")
+	writeJSON(resp, http.StatusOK, tokens)
+}
+
+func (app *Application) passwordGrant(email, password string) (tokenResponse, error) {
+	user, err := app.DB.GetUserByEmail(email)
+
+	if err != nil {
+		return tokenResponse{}, errInvalidGrant
+	}
+
+	if valid, err := user.PasswordMatches(password); err != nil || !valid || !user.Active() {
+		return tokenResponse{}, errInvalidGrant
+	}
+
+	app.upgradePasswordHash(user, password)
+
+	family, err := randomHex(16)
+
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	return app.issueTokens(*user, family)
+}
+
+func (app *Application) refreshTokenGrant(refreshToken string) (tokenResponse, error) {
+	stored, err := app.DB.GetRefreshTokenByHash(hashToken(refreshToken))
+
+	if err != nil {
+		return tokenResponse{}, errInvalidGrant
+	}
+
+	if stored.RevokedAt != nil || !time.Now().Before(stored.ExpiresAt) {
+		return tokenResponse{}, errInvalidGrant
+	}
+
+	fresh := stored.UsedAt == nil
+
+	if fresh {
+		fresh, err = app.DB.UseRefreshToken(stored.ID)
+
+		if err != nil {
+			return tokenResponse{}, err
+		}
+	}
+
+	if !fresh {
+		// whoever presents a used token, it means the family has leaked
+		log.Printf("Refresh token reused for user %d; revoking its family", stored.UserID)
+
+		if err := app.DB.RevokeRefreshTokenFamily(stored.FamilyID); err != nil {
+			return tokenResponse{}, err
+		}
+
+		return tokenResponse{}, errInvalidGrant
+	}
+
+	user, err := app.DB.GetUser(stored.UserID)
+
+	if err != nil || !user.Active() {
+		return tokenResponse{}, errInvalidGrant
+	}
+
+	return app.issueTokens(*user, stored.FamilyID)
+}
+
+// issueTokens creates an access token and a refresh token belonging to family. The access token is granted every
+// scope the user could grant a personal access token, as they are now, so a refresh picks up changes to their roles.
+func (app *Application) issueTokens(user data.User, family string) (tokenResponse, error) {
+	accessToken, err := app.JWT.issueAccessToken(user.ID, grantableScopes(user))
+
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	random, err := randomHex(32)
+
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	refreshToken := refreshTokenPrefix + random
+
+	_, err = app.DB.InsertRefreshToken(data.RefreshToken{
+		UserID:    user.ID,
+		FamilyID:  family,
+		ExpiresAt: time.Now().Add(app.JWT.RefreshTokenTTL),
+	}, hashToken(refreshToken))
+
+	if err != nil {
+		return tokenResponse{}, err
+	}
+
+	return tokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(app.JWT.AccessTokenTTL.Seconds()),
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
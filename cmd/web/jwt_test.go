@@ -0,0 +1,228 @@
+package web
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v5"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_JWTConfig_parseAccessToken(t *testing.T) {
+	current, _ := GenerateEdDSAKey("current")
+	retired, _ := NewHS256Key("retired", []byte(strings.Repeat("s", 32)))
+
+	cfg := DefaultJWTConfig()
+	cfg.Keys = []SigningKey{current, retired}
+
+	signedByCurrent, err := cfg.issueAccessToken(7, []string{"avatar:read", "profile:read"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a token signed before the keys were rotated
+	oldCfg := cfg
+	oldCfg.Keys = []SigningKey{retired}
+	signedByRetired, _ := oldCfg.issueAccessToken(7, nil)
+
+	removedCfg := cfg
+	removedCfg.Keys = []SigningKey{current}
+
+	expiredCfg := cfg
+	expiredCfg.AccessTokenTTL = -time.Minute
+	expired, _ := expiredCfg.issueAccessToken(7, nil)
+
+	otherAudience := cfg
+	otherAudience.Audience = "someone-else"
+	wrongAudience, _ := otherAudience.issueAccessToken(7, nil)
+
+	// an attacker who signs with HS256, using the published public key as the secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    cfg.Issuer,
+		Subject:   "1",
+		Audience:  jwt.ClaimStrings{cfg.Audience},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	forged.Header["kid"] = "current"
+	forgedToken, _ := forged.SignedString([]byte(current.privateKey.Public().(ed25519.PublicKey)))
+
+	unsigned, _ := jwt.NewWithClaims(jwt.SigningMethodNone, jwt.RegisteredClaims{Subject: "1"}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+
+	var tests = []struct {
+		name        string
+		cfg         JWTConfig
+		token       string
+		expectError bool
+	}{
+		{"current key", cfg, signedByCurrent, false},
+		{"retired key", cfg, signedByRetired, false},
+		{"retired key removed", removedCfg, signedByRetired, true},
+		{"expired", cfg, expired, true},
+		{"wrong audience", cfg, wrongAudience, true},
+		{"algorithm confusion", cfg, forgedToken, true},
+		{"unsigned", cfg, unsigned, true},
+		{"garbage", cfg, "not.a.token", true},
+	}
+
+	for _, test := range tests {
+		id, _, err := test.cfg.parseAccessToken(test.token)
+
+		if (err != nil) != test.expectError {
+			t.Errorf("%s: expected error to be %t, got %v", test.name, test.expectError, err)
+		}
+
+		if err == nil && id != 7 {
+			t.Errorf("%s: expected user 7, got %d", test.name, id)
+		}
+	}
+}
+
+func Test_JWTConfig_accessTokenScopes(t *testing.T) {
+	key, _ := GenerateEdDSAKey("current")
+	cfg := DefaultJWTConfig()
+	cfg.Keys = []SigningKey{key}
+
+	for _, scopes := range [][]string{{"avatar:read", "profile:read"}, nil} {
+		token, _ := cfg.issueAccessToken(7, scopes)
+		_, parsed, err := cfg.parseAccessToken(token)
+
+		if err != nil || strings.Join(parsed, " ") != strings.Join(scopes, " ") {
+			t.Errorf("expected scopes %v, got %v %v", scopes, parsed, err)
+		}
+	}
+}
+
+func Test_LoadSigningKeys(t *testing.T) {
+	seed := base64.StdEncoding.EncodeToString(make([]byte, ed25519.SeedSize))
+	secret := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("s", 32)))
+
+	var tests = []struct {
+		name         string
+		contents     string
+		expectedKeys int
+	}{
+		{"valid", `[{"kid":"a","alg":"EdDSA","key":"` + seed + `"},{"kid":"b","alg":"HS256","key":"` + secret + `"}]`, 2},
+		{"empty", `[]`, 0},
+		{"duplicate kid", `[{"kid":"a","alg":"EdDSA","key":"` + seed + `"},{"kid":"a","alg":"HS256","key":"` + secret + `"}]`, 0},
+		{"short secret", `[{"kid":"a","alg":"HS256","key":"c2hvcnQ="}]`, 0},
+		{"unknown algorithm", `[{"kid":"a","alg":"RS256","key":"` + secret + `"}]`, 0},
+		{"bad base64", `[{"kid":"a","alg":"EdDSA","key":"!!"}]`, 0},
+		{"not json", `kid=a`, 0},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "keys.json")
+
+		if err := os.WriteFile(path, []byte(test.contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		keys, err := LoadSigningKeys(path)
+
+		if len(keys) != test.expectedKeys {
+			t.Errorf("%s: expected %d keys, got %d (%v)", test.name, test.expectedKeys, len(keys), err)
+		}
+
+		if test.expectedKeys == 0 && err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+	}
+}
+
+func Test_Application_JWKS(t *testing.T) {
+	secret, _ := NewHS256Key("secret", []byte(strings.Repeat("s", 32)))
+	saved := app.JWT.Keys
+	app.JWT.Keys = append([]SigningKey{secret}, saved...)
+
+	defer func() {
+		app.JWT.Keys = saved
+	}()
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(app.JWKS).ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/.well-known/jwks.json", nil))
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+
+	if err := json.Unmarshal(resp.Body.Bytes(), &set); err != nil {
+		t.Fatal(err)
+	}
+
+	// the HS256 secret must never be published
+	if len(set.Keys) != 1 || set.Keys[0].KeyID != "test" || set.Keys[0].KeyType != "OKP" {
+		t.Fatalf("expected only the test key, got %+v", set.Keys)
+	}
+
+	x, _ := base64.RawURLEncoding.DecodeString(set.Keys[0].X)
+
+	if !ed25519.PublicKey(x).Equal(saved[0].privateKey.Public()) {
+		t.Error("expected the published key to be the public half of the signing key")
+	}
+}
+
+func Test_Application_APIToken(t *testing.T) {
+	var tests = []struct {
+		name               string
+		body               string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"password", `{"grant_type":"password","email":"admin@example.com","password":"secret"}`, http.StatusOK, `"token_type":"Bearer"`},
+		{"wrong password", `{"grant_type":"password","email":"admin@example.com","password":"wrong"}`, http.StatusBadRequest, invalidGrantProblemType},
+		{"unknown user", `{"grant_type":"password","email":"nobody@example.com","password":"secret"}`, http.StatusBadRequest, invalidGrantProblemType},
+		{"refresh", `{"grant_type":"refresh_token","refresh_token":"ppr_valid"}`, http.StatusOK, `"refresh_token":"ppr_`},
+		{"refresh reused", `{"grant_type":"refresh_token","refresh_token":"ppr_reused"}`, http.StatusBadRequest, invalidGrantProblemType},
+		{"refresh expired", `{"grant_type":"refresh_token","refresh_token":"ppr_expired"}`, http.StatusBadRequest, invalidGrantProblemType},
+		{"refresh revoked", `{"grant_type":"refresh_token","refresh_token":"ppr_revoked"}`, http.StatusBadRequest, invalidGrantProblemType},
+		{"refresh unknown", `{"grant_type":"refresh_token","refresh_token":"ppr_nope"}`, http.StatusBadRequest, invalidGrantProblemType},
+		{"unknown grant", `{"grant_type":"client_credentials"}`, http.StatusUnprocessableEntity, "grant_type"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/auth/token", strings.NewReader(test.body))
+		resp := apiRequest(req, nil)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expectedStatusCode, resp.Code, resp.Body.String())
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body containing %s, got %s", test.name, test.expectedBody, resp.Body.String())
+		}
+
+		if resp.Code != http.StatusOK {
+			continue
+		}
+
+		if resp.Header().Get("Cache-Control") != "no-store" {
+			t.Errorf("%s: expected tokens not to be cached", test.name)
+		}
+
+		var tokens tokenResponse
+		_ = json.Unmarshal(resp.Body.Bytes(), &tokens)
+
+		// the access token works against the API
+		req = httptest.NewRequest(http.MethodGet, "/users/1", nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.AccessToken)
+
+		if resp := apiRequest(req, nil); resp.Code != http.StatusOK {
+			t.Errorf("%s: expected the access token to be accepted, got %d: %s", test.name, resp.Code, resp.Body.String())
+		}
+
+		// and carries the scopes the user could grant, which only administrators' include users:admin
+		_, scopes, _ := app.JWT.parseAccessToken(tokens.AccessToken)
+
+		if !slices.Contains(scopes, "profile:write") || slices.Contains(scopes, "users:admin") != (test.name == "password") {
+			t.Errorf("%s: unexpected access token scopes %v", test.name, scopes)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package web
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// Message is a plain text email to one recipient.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends email, such as notifications of changes to a user's account.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// LogMailer writes email to the log instead of sending it; it is meant for development, where there is no mail
+// server.
+type LogMailer struct{}
+
+func (LogMailer) Send(msg Message) error {
+	log.Printf("Email to %s: %s\n%s", msg.To, msg.Subject, msg.Body)
+
+	return nil
+}
+
+// SMTPMailer sends email through an SMTP server, using STARTTLS if the server offers it.
+type SMTPMailer struct {
+	// Address is the host:port of the server.
+	Address string
+	From    string
+	// Username and Password are used to authenticate, if Username is set.
+	Username string
+	Password string
+}
+
+func (m SMTPMailer) Send(msg Message) error {
+	var auth smtp.Auth
+
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Address)
+
+		if err != nil {
+			return err
+		}
+
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Address, auth, m.From, []string{msg.To}, formatMessage(m.From, msg, time.Now()))
+}
+
+// formatMessage writes msg out with its headers, as it is sent over SMTP. Line breaks are stripped from the headers so
+// that nothing can be smuggled into them.
+func formatMessage(from string, msg Message, date time.Time) []byte {
+	header := strings.NewReplacer("\r", "", "\n", "")
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "From: %s\r\n", header.Replace(from))
+	fmt.Fprintf(&b, "To: %s\r\n", header.Replace(msg.To))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", header.Replace(msg.Subject)))
+	fmt.Fprintf(&b, "Date: %s\r\n", date.Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+
+	body := strings.ReplaceAll(msg.Body, "\r\n", "\n")
+	b.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	return b.Bytes()
+}
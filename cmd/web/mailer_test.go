@@ -0,0 +1,44 @@
+package web
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// testMailer keeps the email it is asked to send, so tests can look at it.
+type testMailer struct {
+	sent []Message
+}
+
+func (m *testMailer) Send(msg Message) error {
+	m.sent = append(m.sent, msg)
+
+	return nil
+}
+
+func Test_formatMessage(t *testing.T) {
+	msg := Message{
+		To:      "user@example.com\r\nBcc: everyone@example.com",
+		Subject: "Café opening",
+		Body:    "Line one\nLine two\r\n",
+	}
+
+	formatted := string(formatMessage("from@example.com", msg, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)))
+
+	for _, expected := range []string{
+		"From: from@example.com\r\n",
+		"To: user@example.comBcc: everyone@example.com\r\n",
+		"Subject: =?utf-8?q?Caf=C3=A9_opening?=\r\n",
+		"Date: Tue, 02 Jan 2024 03:04:05 +0000\r\n",
+		"Content-Type: text/plain; charset=utf-8\r\n\r\nLine one\r\nLine two\r\n",
+	} {
+		if !strings.Contains(formatted, expected) {
+			t.Errorf("expected the message to contain %q, got %q", expected, formatted)
+		}
+	}
+
+	if strings.Contains(formatted, "\nBcc:") {
+		t.Error("expected line breaks to be stripped from headers")
+	}
+}
@@ -2,7 +2,10 @@ package web
 
 import (
 	"context"
+	"database/sql"
+	stderrors "errors"
 	"fmt"
+	"github.com/spartanhooah/profile-picture-web/data"
 	"log"
 	"net"
 	"net/http"
@@ -61,9 +64,42 @@ func getIP(req *http.Request) (string, error) {
 	return ip, nil
 }
 
+// sessionUser reloads the logged in user from the database and refreshes the session's copy, so that changes made
+// since they logged in, such as to their roles, take effect at once. If they have since been deleted or deactivated,
+// their session is ended and ok is false.
+func (app *Application) sessionUser(req *http.Request) (user *data.User, ok bool, err error) {
+	loggedIn, ok := app.Session.Get(req.Context(), "user").(data.User)
+
+	if !ok {
+		return nil, false, nil
+	}
+
+	user, err = app.DB.GetUser(loggedIn.ID)
+
+	if err != nil && !stderrors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	if err != nil || !user.Active() {
+		return nil, false, app.Session.Destroy(req.Context())
+	}
+
+	app.Session.Put(req.Context(), "user", *user)
+
+	return user, true, nil
+}
+
+// auth only lets through logged in users whose accounts are still active.
 func (app *Application) auth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
-		if !app.Session.Exists(req.Context(), "user") {
+		_, ok, err := app.sessionUser(req)
+
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if !ok {
 			app.Session.Put(req.Context(), "error", "Log in first!")
 
 			http.Redirect(resp, req, "/", http.StatusTemporaryRedirect)
@@ -73,3 +109,30 @@ func (app *Application) auth(next http.Handler) http.Handler {
 		next.ServeHTTP(resp, req)
 	})
 }
+
+// RequirePermission only lets through users whose roles grant every one of the permissions. Roles are reloaded from
+// the database on every request, so taking one away takes effect at once rather than at the user's next sign in. It
+// belongs after auth in a route group.
+func (app *Application) RequirePermission(permissions ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			user, ok, err := app.sessionUser(req)
+
+			if err != nil {
+				http.Error(resp, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			for _, permission := range permissions {
+				if !ok || !user.Can(permission) {
+					app.Session.Put(req.Context(), "error", "You do not have permission to see that page")
+
+					http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+					return
+				}
+			}
+
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"github.com/spartanhooah/profile-picture-web/data"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -77,3 +78,48 @@ func Test_Application_ipFromContext(t *testing.T) {
 		t.Error("Wrong value from context")
 	}
 }
+
+func Test_Application_RequirePermission(t *testing.T) {
+	// the test repository has user 12 as an administrator and user 13 as a moderator; the session's copies are stale
+	moderator := &data.User{ID: 13}
+
+	var tests = []struct {
+		name             string
+		user             *data.User
+		permissions      []string
+		expectedNextCall bool
+	}{
+		{"not logged in", nil, []string{data.PermissionManageQuotas}, false},
+		{"not an admin", &data.User{ID: 2}, []string{data.PermissionManageQuotas}, false},
+		{"admin", &data.User{ID: 12}, []string{data.PermissionManageQuotas}, true},
+		{"admin role taken away", &data.User{ID: 13, IsAdmin: 1, Roles: []string{data.RoleAdmin}, Permissions: []string{data.PermissionManageQuotas}}, []string{data.PermissionManageQuotas}, false},
+		{"moderator", moderator, []string{data.PermissionModerateImages}, true},
+		{"moderator without permission", moderator, []string{data.PermissionManageQuotas}, false},
+		{"needs every permission", moderator, []string{data.PermissionReadUsers, data.PermissionReadAudit}, false},
+	}
+
+	for _, test := range tests {
+		called := false
+		nextHandler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			called = true
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/admin/users/1/quota", nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		if test.user != nil {
+			app.Session.Put(req.Context(), "user", *test.user)
+		}
+
+		resp := httptest.NewRecorder()
+		app.RequirePermission(test.permissions...)(nextHandler).ServeHTTP(resp, req)
+
+		if called != test.expectedNextCall {
+			t.Errorf("%s: expected next handler to be called to be %t", test.name, test.expectedNextCall)
+		}
+
+		if !test.expectedNextCall && resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+	}
+}
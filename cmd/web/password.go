@@ -0,0 +1,247 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// PasswordPolicy is what a new password has to satisfy.
+type PasswordPolicy struct {
+	// MinLength is the fewest characters a password may have.
+	MinLength int
+	// MaxBytes, if set, is the most bytes a password may have. It is the hasher's MaxPasswordBytes, since bcrypt only
+	// looks at the first 72.
+	MaxBytes int
+	// Denylist holds common and breached passwords, in lower case, which are refused whatever else is true of them.
+	Denylist map[string]bool
+}
+
+func DefaultPasswordPolicy() PasswordPolicy {
+	return PasswordPolicy{MinLength: 8}
+}
+
+// LoadPasswordDenylist reads a file of passwords to refuse, one per line, as published by breach corpora and lists
+// of common passwords. Blank lines and lines starting with # are skipped.
+func LoadPasswordDenylist(path string) (map[string]bool, error) {
+	file, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	denylist := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		denylist[strings.ToLower(line)] = true
+	}
+
+	return denylist, scanner.Err()
+}
+
+// Check adds an error to the form's field for the first rule the password in it breaks. Passwords may not be the
+// user's email address, the part of it before the @, or their name.
+func (p PasswordPolicy) Check(form *Form, field string, user data.User) {
+	password := form.Data.Get(field)
+
+	if password == "" {
+		return
+	}
+
+	normalized := strings.ToLower(strings.Join(strings.Fields(password), ""))
+	localPart, _, _ := strings.Cut(user.Email, "@")
+
+	personal := map[string]bool{}
+
+	for _, s := range []string{user.Email, localPart, user.FirstName, user.LastName, user.FirstName + user.LastName,
+		user.LastName + user.FirstName, user.DisplayName} {
+		if s = strings.ToLower(strings.Join(strings.Fields(s), "")); s != "" {
+			personal[s] = true
+		}
+	}
+
+	switch {
+	case len([]rune(password)) < p.MinLength:
+		form.Errors.Add(field, fmt.Sprintf("Password must be at least %d characters long", p.MinLength))
+	case p.MaxBytes > 0 && len(password) > p.MaxBytes:
+		form.Errors.Add(field, fmt.Sprintf("Password cannot be longer than %d bytes", p.MaxBytes))
+	case personal[normalized]:
+		form.Errors.Add(field, "Password cannot be your name or email address")
+	case p.Denylist[strings.ToLower(password)]:
+		form.Errors.Add(field, "That password is too common, or has appeared in a data breach; choose another")
+	}
+}
+
+// ChangePasswordPage shows the logged-in user a form to change their password.
+func (app *Application) ChangePasswordPage(resp http.ResponseWriter, req *http.Request) {
+	_ = app.Render(resp, req, "password.page.gohtml", &TemplateData{
+		Form: NewForm(nil),
+		Data: map[string]any{"minLength": app.Passwords.MinLength},
+	})
+}
+
+// ChangePassword changes the logged-in user's password once they have given their current one. Every other session
+// they have, including API refresh tokens, is ended, and they are sent an email saying their password changed.
+func (app *Application) ChangePassword(resp http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	sessionUser, _ := app.Session.Get(req.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(sessionUser.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// passwords are never sent back to the browser
+	form := NewForm(url.Values{
+		"current_password": {req.PostForm.Get("current_password")},
+		"new_password":     {req.PostForm.Get("new_password")},
+		"confirm_password": {req.PostForm.Get("confirm_password")},
+	})
+	form.Required("current_password", "new_password", "confirm_password")
+
+	if form.Has("current_password") {
+		matches, err := user.PasswordMatches(form.Data.Get("current_password"))
+		form.Check(err == nil && matches, "current_password", "Your current password is not right")
+	}
+
+	app.Passwords.Check(form, "new_password", *user)
+	form.Check(form.Data.Get("new_password") != form.Data.Get("current_password") || !form.Has("new_password"),
+		"new_password", "Your new password must be different from your current one")
+	form.Check(form.Data.Get("confirm_password") == form.Data.Get("new_password") || !form.Has("confirm_password"),
+		"confirm_password", "The passwords do not match")
+
+	if !form.Valid() {
+		form.Data = url.Values{}
+		app.Session.Put(req.Context(), "error", "Please correct the errors below")
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		_ = app.Render(resp, req, "password.page.gohtml", &TemplateData{
+			Form: form,
+			Data: map[string]any{"minLength": app.Passwords.MinLength},
+		})
+		return
+	}
+
+	err = app.DB.ResetPassword(user.ID, form.Data.Get("new_password"))
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditPasswordChanged, user.ID, nil)
+
+	// a new token for this session, and none for the others, in case the old password was how someone got in
+	_ = app.Session.RenewToken(req.Context())
+
+	if err := app.endOtherSessions(req.Context(), user.ID); err != nil {
+		log.Println("Could not end other sessions:", err)
+	}
+
+	app.notifyPasswordChanged(*user, app.ipFromContext(req.Context()))
+
+	app.Session.Put(req.Context(), "flash", "Password changed")
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
+
+// upgradePasswordHash hashes a user's password again, now that they have signed in with it, if the stored hash was
+// made with another algorithm or a lower cost than PasswordHasher would use. A failure is logged rather than stopping
+// them signing in; it will be tried again next time.
+func (app *Application) upgradePasswordHash(user *data.User, password string) {
+	if !app.PasswordHasher.NeedsRehash(user.Password) {
+		return
+	}
+
+	err := app.DB.ResetPassword(user.ID, password)
+
+	if err != nil {
+		log.Println("Could not rehash password:", err)
+	}
+}
+
+// endOtherSessions logs a user out of every session but the one in ctx, including any in which an administrator is
+// impersonating them, and revokes their API refresh tokens.
+func (app *Application) endOtherSessions(ctx context.Context, userID int) error {
+	current := app.Session.Token(ctx)
+
+	err := app.Session.Iterate(ctx, func(ctx context.Context) error {
+		if app.Session.Token(ctx) == current {
+			return nil
+		}
+
+		if user, ok := app.Session.Get(ctx, "user").(data.User); ok && user.ID == userID {
+			return app.Session.Destroy(ctx)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	tokens, err := app.DB.GetRefreshTokens(userID)
+
+	if err != nil {
+		return err
+	}
+
+	revoked := make(map[string]bool)
+
+	for _, token := range tokens {
+		if token.RevokedAt != nil || revoked[token.FamilyID] {
+			continue
+		}
+
+		err := app.DB.RevokeRefreshTokenFamily(token.FamilyID)
+
+		if err != nil {
+			return err
+		}
+
+		revoked[token.FamilyID] = true
+	}
+
+	return nil
+}
+
+// notifyPasswordChanged emails a user to tell them their password was changed, so they find out if it was not them.
+// The email is sent in the background, so a slow mail server does not hold up the response.
+func (app *Application) notifyPasswordChanged(user data.User, ip string) {
+	msg := Message{
+		To:      user.Email,
+		Subject: "Your password was changed",
+		Body: fmt.Sprintf("Hello %s,\n\n"+
+			"The password for your account was changed at %s, from %s.\n\n"+
+			"If this was you, there is nothing else to do. If it was not, reset your password straight away and "+
+			"contact an administrator.\n",
+			user.Name(), time.Now().UTC().Format("2 Jan 2006 15:04 MST"), ip),
+	}
+
+	runInBackground(func() {
+		if err := app.Mailer.Send(msg); err != nil {
+			log.Println("Could not send password change notification:", err)
+		}
+	})
+}
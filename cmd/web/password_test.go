@@ -0,0 +1,145 @@
+package web
+
+import (
+	"context"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_LoadPasswordDenylist(t *testing.T) {
+	denylist, err := LoadPasswordDenylist("./testdata/password-denylist.txt")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(denylist) != 3 || !denylist["letmein123"] || denylist["# common passwords, for the tests"] {
+		t.Errorf("expected three lower case passwords, got %v", denylist)
+	}
+}
+
+func Test_PasswordPolicy_Check(t *testing.T) {
+	policy := PasswordPolicy{MinLength: 10, MaxBytes: 72, Denylist: map[string]bool{"qwertyuiop": true}}
+	user := data.User{FirstName: "Ada", LastName: "Lovelace", Email: "countess.of.lovelace@example.com"}
+
+	var tests = []struct {
+		name          string
+		password      string
+		expectedError string
+	}{
+		{"good", "correct horse battery staple", ""},
+		{"too short", "tr0ub4dor", "at least 10 characters"},
+		{"short in bytes but not characters", "pässwörd", "at least 10 characters"},
+		{"too long", strings.Repeat("x", 73), "longer than 72 bytes"},
+		{"denylisted", "QwertyUiop", "too common"},
+		{"email address", "Countess.Of.Lovelace@example.com", "name or email address"},
+		{"before the @", "countess.of.lovelace", "name or email address"},
+		{"full name", "Ada Lovelace", "name or email address"},
+		{"surname first", "lovelaceada", "name or email address"},
+	}
+
+	for _, test := range tests {
+		form := NewForm(url.Values{"password": {test.password}})
+		policy.Check(form, "password", user)
+
+		if message := form.Errors.Get("password"); !strings.Contains(message, test.expectedError) || (test.expectedError == "") != form.Valid() {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+
+	// only bcrypt limits how long passwords can be
+	policy.MaxBytes = 0
+	form := NewForm(url.Values{"password": {strings.Repeat("x", 200)}})
+	policy.Check(form, "password", user)
+
+	if !form.Valid() {
+		t.Errorf("expected a long password to be allowed without a limit, got %q", form.Errors.Get("password"))
+	}
+}
+
+func Test_Application_ChangePassword(t *testing.T) {
+	background := runInBackground
+	runInBackground = func(task func()) { task() }
+	defer func() { runInBackground = background }()
+
+	var tests = []struct {
+		name          string
+		current       string
+		new           string
+		confirm       string
+		expectedField string
+		expectedError string
+	}{
+		{"changed", "secret", "a much better password", "a much better password", "", ""},
+		{"wrong current password", "guess", "a much better password", "a much better password", "current_password", "not right"},
+		{"too short", "secret", "short", "short", "new_password", "at least 8 characters"},
+		{"unchanged", "secret", "secret", "secret", "new_password", "at least 8 characters"},
+		{"not confirmed", "secret", "a much better password", "a much worse password", "confirm_password", "do not match"},
+		{"blank", "", "", "", "current_password", "cannot be blank"},
+	}
+
+	for _, test := range tests {
+		mailer := &testMailer{}
+		app.Mailer = mailer
+
+		// another browser the user is logged in on
+		other, _ := app.Session.Load(context.Background(), "")
+		app.Session.Put(other, "user", data.User{ID: 1})
+		otherToken, _, _ := app.Session.Commit(other)
+
+		form := url.Values{"current_password": {test.current}, "new_password": {test.new}, "confirm_password": {test.confirm}}
+		req := httptest.NewRequest(http.MethodPost, "/user/password", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		resp := httptest.NewRecorder()
+		app.ChangePassword(resp, req)
+
+		_, otherStillLoggedIn, _ := app.Session.Store.Find(otherToken)
+
+		if test.expectedError == "" {
+			if resp.Code != http.StatusSeeOther || app.Session.GetString(req.Context(), "flash") != "Password changed" {
+				t.Errorf("%s: expected the password to be changed, got %d", test.name, resp.Code)
+			}
+
+			if otherStillLoggedIn {
+				t.Errorf("%s: expected other sessions to be ended", test.name)
+			}
+
+			if len(mailer.sent) != 1 || mailer.sent[0].Subject != "Your password was changed" {
+				t.Errorf("%s: expected a notification email, got %+v", test.name, mailer.sent)
+			}
+
+			continue
+		}
+
+		if resp.Code != http.StatusUnprocessableEntity {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusUnprocessableEntity, resp.Code)
+		}
+
+		body := resp.Body.String()
+
+		if !strings.Contains(body, test.expectedError) {
+			t.Errorf("%s: expected error containing %q", test.name, test.expectedError)
+		}
+
+		if !strings.Contains(body, `name="`+test.expectedField+`"`) || !strings.Contains(body, "is-invalid") {
+			t.Errorf("%s: expected the error to be shown next to %s", test.name, test.expectedField)
+		}
+
+		if strings.Contains(body, `value="`+test.current+`"`) && test.current != "" {
+			t.Errorf("%s: expected passwords not to be sent back", test.name)
+		}
+
+		if !otherStillLoggedIn || len(mailer.sent) != 0 {
+			t.Errorf("%s: expected nothing to change", test.name)
+		}
+	}
+
+	app.Mailer = LogMailer{}
+}
@@ -0,0 +1,311 @@
+package web
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html/template"
+	"image"
+	"image/png"
+	"math"
+	"strings"
+)
+
+// BlurHash (https://blurha.sh) describes an image as a handful of cosine components packed into a short string,
+// which clients decode into a blurred placeholder while the real image loads.
+
+const base83Characters = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+// placeholderSampleSize is the size images are scaled down to before computing placeholders; any more detail is
+// thrown away by the encoding anyway.
+const placeholderSampleSize = 32
+
+// blurHash encodes img using xComponents by yComponents cosine components, each between 1 and 9.
+func blurHash(img image.Image, xComponents, yComponents int) (string, error) {
+	if xComponents < 1 || xComponents > 9 || yComponents < 1 || yComponents > 9 {
+		return "", fmt.Errorf("blurhash components must be between 1 and 9")
+	}
+
+	sample := resizeToFit(img, placeholderSampleSize)
+	width, height := sample.Bounds().Dx(), sample.Bounds().Dy()
+
+	// convert to linear RGB once rather than once per component
+	linear := make([][3]float64, width*height)
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			c := sample.NRGBAAt(x, y)
+			linear[y*width+x] = [3]float64{sRGBToLinear(c.R), sRGBToLinear(c.G), sRGBToLinear(c.B)}
+		}
+	}
+
+	factors := make([][3]float64, 0, xComponents*yComponents)
+
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+
+			var factor [3]float64
+
+			for y := 0; y < height; y++ {
+				for x := 0; x < width; x++ {
+					basis := normalisation *
+						math.Cos(math.Pi*float64(i)*float64(x)/float64(width)) *
+						math.Cos(math.Pi*float64(j)*float64(y)/float64(height))
+
+					for k := 0; k < 3; k++ {
+						factor[k] += basis * linear[y*width+x][k]
+					}
+				}
+			}
+
+			scale := 1 / float64(width*height)
+			factors = append(factors, [3]float64{factor[0] * scale, factor[1] * scale, factor[2] * scale})
+		}
+	}
+
+	var hash strings.Builder
+	hash.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maximumValue := 1.0
+	ac := factors[1:]
+
+	if len(ac) > 0 {
+		actualMaximum := 0.0
+
+		for _, factor := range ac {
+			for _, v := range factor {
+				actualMaximum = math.Max(actualMaximum, math.Abs(v))
+			}
+		}
+
+		quantisedMaximum := int(math.Max(0, math.Min(82, math.Floor(actualMaximum*166-0.5))))
+		maximumValue = float64(quantisedMaximum+1) / 166
+		hash.WriteString(encodeBase83(quantisedMaximum, 1))
+	} else {
+		hash.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	hash.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+
+	for _, factor := range ac {
+		var quantised [3]int
+
+		for k, v := range factor {
+			quantised[k] = int(math.Max(0, math.Min(18, math.Floor(signPow(v/maximumValue, 0.5)*9+9.5))))
+		}
+
+		hash.WriteString(encodeBase83(quantised[0]*19*19+quantised[1]*19+quantised[2], 2))
+	}
+
+	return hash.String(), nil
+}
+
+// decodeBlurHash renders hash as a width by height image.
+func decodeBlurHash(hash string, width, height int) (image.Image, error) {
+	if len(hash) < 6 {
+		return nil, fmt.Errorf("blurhash is too short")
+	}
+
+	sizeFlag, err := decodeBase83(hash[0:1])
+
+	if err != nil {
+		return nil, err
+	}
+
+	xComponents, yComponents := sizeFlag%9+1, sizeFlag/9+1
+
+	if len(hash) != 4+2*xComponents*yComponents {
+		return nil, fmt.Errorf("blurhash has the wrong length")
+	}
+
+	quantisedMaximum, err := decodeBase83(hash[1:2])
+
+	if err != nil {
+		return nil, err
+	}
+
+	maximumValue := float64(quantisedMaximum+1) / 166
+	colours := make([][3]float64, xComponents*yComponents)
+
+	for i := range colours {
+		if i == 0 {
+			value, err := decodeBase83(hash[2:6])
+
+			if err != nil {
+				return nil, err
+			}
+
+			colours[i] = [3]float64{
+				sRGBToLinear(uint8(value >> 16)),
+				sRGBToLinear(uint8(value >> 8)),
+				sRGBToLinear(uint8(value)),
+			}
+
+			continue
+		}
+
+		value, err := decodeBase83(hash[4+i*2 : 6+i*2])
+
+		if err != nil {
+			return nil, err
+		}
+
+		quantised := [3]int{value / (19 * 19), (value / 19) % 19, value % 19}
+
+		for k, q := range quantised {
+			colours[i][k] = signPow((float64(q)-9)/9, 2) * maximumValue
+		}
+	}
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var pixel [3]float64
+
+			for j := 0; j < yComponents; j++ {
+				for i := 0; i < xComponents; i++ {
+					basis := math.Cos(math.Pi*float64(x)*float64(i)/float64(width)) *
+						math.Cos(math.Pi*float64(y)*float64(j)/float64(height))
+
+					for k := 0; k < 3; k++ {
+						pixel[k] += colours[i+j*xComponents][k] * basis
+					}
+				}
+			}
+
+			offset := img.PixOffset(x, y)
+			img.Pix[offset] = uint8(linearToSRGB(pixel[0]))
+			img.Pix[offset+1] = uint8(linearToSRGB(pixel[1]))
+			img.Pix[offset+2] = uint8(linearToSRGB(pixel[2]))
+			img.Pix[offset+3] = 255
+		}
+	}
+
+	return img, nil
+}
+
+// blurHashURI renders hash as a small PNG data URI, for use as a CSS background in templates. An invalid or empty
+// hash gives an empty URI.
+func blurHashURI(hash string) template.URL {
+	if hash == "" {
+		return ""
+	}
+
+	img, err := decodeBlurHash(hash, placeholderSampleSize, placeholderSampleSize)
+
+	if err != nil {
+		return ""
+	}
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, img); err != nil {
+		return ""
+	}
+
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()))
+}
+
+// dominantColour returns the most common colour in img as a CSS hex colour. Similar colours are grouped together
+// and averaged, and transparent pixels are ignored.
+func dominantColour(img image.Image) string {
+	sample := resizeToFit(img, placeholderSampleSize)
+
+	type bucket struct {
+		count   int
+		r, g, b int
+	}
+
+	buckets := make(map[int]*bucket)
+	var best *bucket
+
+	for i := 0; i < len(sample.Pix); i += 4 {
+		r, g, b, a := sample.Pix[i], sample.Pix[i+1], sample.Pix[i+2], sample.Pix[i+3]
+
+		if a < 128 {
+			continue
+		}
+
+		// group by the top four bits of each channel
+		key := int(r>>4)<<8 | int(g>>4)<<4 | int(b>>4)
+		current, ok := buckets[key]
+
+		if !ok {
+			current = &bucket{}
+			buckets[key] = current
+		}
+
+		current.count++
+		current.r += int(r)
+		current.g += int(g)
+		current.b += int(b)
+
+		if best == nil || current.count > best.count {
+			best = current
+		}
+	}
+
+	if best == nil {
+		return ""
+	}
+
+	return fmt.Sprintf("#%02x%02x%02x", best.r/best.count, best.g/best.count, best.b/best.count)
+}
+
+func encodeBase83(value, length int) string {
+	result := make([]byte, length)
+
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		result[i-1] = base83Characters[digit]
+	}
+
+	return string(result)
+}
+
+func decodeBase83(s string) (int, error) {
+	value := 0
+
+	for _, c := range s {
+		digit := strings.IndexRune(base83Characters, c)
+
+		if digit < 0 {
+			return 0, fmt.Errorf("invalid base83 character %q", c)
+		}
+
+		value = value*83 + digit
+	}
+
+	return value, nil
+}
+
+func sRGBToLinear(value uint8) float64 {
+	v := float64(value) / 255
+
+	if v <= 0.04045 {
+		return v / 12.92
+	}
+
+	return math.Pow((v+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(value float64) int {
+	v := math.Max(0, math.Min(1, value))
+
+	if v <= 0.0031308 {
+		return int(math.Round(v * 12.92 * 255))
+	}
+
+	return int(math.Round((1.055*math.Pow(v, 1/2.4) - 0.055) * 255))
+}
+
+func signPow(value, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(value), exp), value)
+}
@@ -0,0 +1,116 @@
+package web
+
+import (
+	"github.com/spartanhooah/profile-picture-web/data"
+	"image"
+	"image/color"
+	"image/draw"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func solidImage(c color.Color, width, height int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	return img
+}
+
+func Test_blurHash(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+
+	hash, err := blurHash(solidImage(red, 64, 48), 4, 3)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hash) != 4+2*4*3 {
+		t.Errorf("expected a hash of %d characters, got %q", 4+2*4*3, hash)
+	}
+
+	img, err := decodeBlurHash(hash, 8, 8)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c := img.(*image.NRGBA).NRGBAAt(4, 4); c != red {
+		t.Errorf("expected decoded hash to be %v, got %v", red, c)
+	}
+
+	if _, err := blurHash(solidImage(red, 8, 8), 0, 3); err == nil {
+		t.Error("expected an error for too few components")
+	}
+}
+
+func Test_blurHash_RoundTrip(t *testing.T) {
+	// left half black, right half white
+	img := solidImage(color.White, 32, 32)
+	draw.Draw(img, image.Rect(0, 0, 16, 32), image.NewUniform(color.Black), image.Point{}, draw.Src)
+
+	hash, _ := blurHash(img, 4, 3)
+	decoded, err := decodeBlurHash(hash, 32, 32)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	left := decoded.(*image.NRGBA).NRGBAAt(2, 16)
+	right := decoded.(*image.NRGBA).NRGBAAt(29, 16)
+
+	if left.R >= right.R {
+		t.Errorf("expected the left of the placeholder to be darker than the right, got %v and %v", left, right)
+	}
+}
+
+func Test_decodeBlurHash_Invalid(t *testing.T) {
+	for _, hash := range []string{"", "LEHV6n", "LEHV6nWB2yk8pyo0adR*.7kCMdn!"} {
+		if _, err := decodeBlurHash(hash, 4, 4); err == nil {
+			t.Errorf("expected %q to be rejected", hash)
+		}
+	}
+}
+
+func Test_dominantColour(t *testing.T) {
+	img := solidImage(color.NRGBA{R: 0x20, G: 0x40, B: 0xc0, A: 255}, 40, 40)
+	draw.Draw(img, image.Rect(0, 0, 10, 10), image.NewUniform(color.White), image.Point{}, draw.Src)
+
+	if actual := dominantColour(img); actual != "#2040c0" {
+		t.Errorf("expected #2040c0, got %s", actual)
+	}
+
+	if actual := dominantColour(image.NewNRGBA(image.Rect(0, 0, 4, 4))); actual != "" {
+		t.Errorf("expected no colour for a transparent image, got %s", actual)
+	}
+}
+
+func Test_Application_Profile_Placeholder(t *testing.T) {
+	hash, _ := blurHash(solidImage(color.Black, 8, 8), 4, 3)
+
+	req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{
+		ID: 1,
+		ProfilePicture: data.UserImage{
+			FileName:      "me.png",
+			BlurHash:      hash,
+			DominantColor: "#102030",
+		},
+	})
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(app.Profile).ServeHTTP(resp, req)
+
+	body := resp.Body.String()
+
+	if !strings.Contains(body, "background-color: #102030") {
+		t.Error("expected the dominant colour as the image background")
+	}
+
+	if !strings.Contains(body, "url('data:image/png;base64,") {
+		t.Error("expected the blurhash as the image background")
+	}
+}
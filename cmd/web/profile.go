@@ -0,0 +1,157 @@
+package web
+
+import (
+	"cmp"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"golang.org/x/text/language"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// profileFieldLengths are the fields of the edit profile form, and the longest each may be.
+var profileFieldLengths = map[string]int{
+	"first_name":         255,
+	"last_name":          255,
+	"display_name":       255,
+	"pronouns":           64,
+	"job_title":          255,
+	"bio":                1000,
+	"timezone":           64,
+	"locale":             35,
+	"handle":             32,
+	"profile_visibility": 16,
+	"avatar_visibility":  16,
+}
+
+// profileForm validates the edit profile form.
+func profileForm(values url.Values) *Form {
+	form := NewForm(values)
+
+	form.Required("first_name", "last_name")
+
+	for field, length := range profileFieldLengths {
+		form.MaxLength(field, length)
+	}
+
+	form.IsTimezone("timezone")
+	form.IsLocale("locale")
+	form.IsHandle("handle")
+
+	switch form.Data.Get("profile_visibility") {
+	case data.ProfileVisibilityPublic, data.ProfileVisibilityMembers, data.ProfileVisibilityHidden:
+	default:
+		form.Errors.Add("profile_visibility", "Choose who can see your profile")
+	}
+
+	switch form.Data.Get("avatar_visibility") {
+	case data.AvatarVisibilityPublic, data.AvatarVisibilityMembers, data.AvatarVisibilityPrivate:
+	default:
+		form.Errors.Add("avatar_visibility", "Choose who can see your profile picture")
+	}
+
+	return form
+}
+
+// EditProfile shows the logged-in user a form to change their name and the rest of their profile.
+func (app *Application) EditProfile(resp http.ResponseWriter, req *http.Request) {
+	sessionUser, _ := app.Session.Get(req.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(sessionUser.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form := NewForm(url.Values{
+		"first_name":         {user.FirstName},
+		"last_name":          {user.LastName},
+		"display_name":       {user.DisplayName},
+		"pronouns":           {user.Pronouns},
+		"job_title":          {user.JobTitle},
+		"bio":                {user.Bio},
+		"timezone":           {user.Timezone},
+		"locale":             {user.Locale},
+		"handle":             {user.Handle},
+		"profile_visibility": {cmp.Or(user.ProfileVisibility, data.ProfileVisibilityMembers)},
+		"avatar_visibility":  {cmp.Or(user.AvatarVisibility, data.AvatarVisibilityPublic)},
+	})
+
+	_ = app.Render(resp, req, "profile-edit.page.gohtml", &TemplateData{Form: form})
+}
+
+// UpdateProfile saves the logged-in user's changes to their profile, or shows the form again with what is wrong
+// next to each field.
+func (app *Application) UpdateProfile(resp http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	values := url.Values{}
+
+	for field := range profileFieldLengths {
+		values.Set(field, strings.TrimSpace(req.PostForm.Get(field)))
+	}
+
+	values.Set("handle", strings.ToLower(values.Get("handle")))
+
+	sessionUser, _ := app.Session.Get(req.Context(), "user").(data.User)
+	user, err := app.DB.GetUser(sessionUser.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	form := profileForm(values)
+
+	if handle := values.Get("handle"); handle != "" && handle != user.Handle && form.Errors.Get("handle") == "" {
+		other, err := app.DB.GetUserByHandle(handle)
+		form.Check(err != nil || other.ID == user.ID, "handle", "Someone else has that handle")
+	}
+
+	if !form.Valid() {
+		app.Session.Put(req.Context(), "error", "Please correct the errors below")
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		_ = app.Render(resp, req, "profile-edit.page.gohtml", &TemplateData{Form: form})
+		return
+	}
+
+	before := *user
+	user.FirstName = values.Get("first_name")
+	user.LastName = values.Get("last_name")
+	user.DisplayName = values.Get("display_name")
+	user.Pronouns = values.Get("pronouns")
+	user.JobTitle = values.Get("job_title")
+	user.Bio = values.Get("bio")
+	user.Timezone = values.Get("timezone")
+	user.Handle = values.Get("handle")
+	user.ProfileVisibility = values.Get("profile_visibility")
+	user.AvatarVisibility = values.Get("avatar_visibility")
+	user.Locale = ""
+
+	// store locales the way they are usually written, so en-gb becomes en-GB
+	if locale := values.Get("locale"); locale != "" {
+		user.Locale = language.Make(locale).String()
+	}
+
+	err = app.DB.UpdateUser(*user)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserUpdated, user.ID, map[string]any{"changes": auditDiff(before, *user)})
+
+	if err := app.refreshSessionUser(req, user.ID); err != nil {
+		log.Println("Could not refresh session:", err)
+	}
+
+	app.Session.Put(req.Context(), "flash", "Profile updated")
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
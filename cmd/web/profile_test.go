@@ -0,0 +1,107 @@
+package web
+
+import (
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_Application_EditProfile(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/user/profile/edit", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	resp := httptest.NewRecorder()
+	app.EditProfile(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+
+	for _, expected := range []string{`name="display_name"`, `name="pronouns"`, `name="timezone"`, `name="locale"`} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected the form to contain %s", expected)
+		}
+	}
+}
+
+func Test_Application_UpdateProfile(t *testing.T) {
+	valid := url.Values{
+		"first_name":         {"Ada"},
+		"last_name":          {"Lovelace"},
+		"display_name":       {"Countess"},
+		"pronouns":           {"she/her"},
+		"job_title":          {"Analyst"},
+		"bio":                {"Wrote the first program."},
+		"timezone":           {"Europe/London"},
+		"locale":             {"en-gb"},
+		"handle":             {"Countess"},
+		"profile_visibility": {"public"},
+		"avatar_visibility":  {"members"},
+	}
+
+	with := func(field, value string) url.Values {
+		values := url.Values{}
+
+		for k, v := range valid {
+			values[k] = v
+		}
+
+		values.Set(field, value)
+
+		return values
+	}
+
+	var tests = []struct {
+		name           string
+		form           url.Values
+		expectedStatus int
+		expectedError  string
+	}{
+		{"valid", valid, http.StatusSeeOther, ""},
+		{"no first name", with("first_name", " "), http.StatusUnprocessableEntity, "This field cannot be blank"},
+		{"pronouns too long", with("pronouns", strings.Repeat("x", 65)), http.StatusUnprocessableEntity, "cannot be longer than 64"},
+		{"unknown time zone", with("timezone", "Mars/Olympus_Mons"), http.StatusUnprocessableEntity, "Unknown time zone"},
+		{"unknown locale", with("locale", "english"), http.StatusUnprocessableEntity, "Unknown locale"},
+		{"handle with a space", with("handle", "the countess"), http.StatusUnprocessableEntity, "lower case letters"},
+		{"handle taken", with("handle", "ada"), http.StatusUnprocessableEntity, "Someone else has that handle"},
+		{"unknown visibility", with("profile_visibility", "friends"), http.StatusUnprocessableEntity, "Choose who can see your profile"},
+		{"unknown avatar visibility", with("avatar_visibility", ""), http.StatusUnprocessableEntity, "Choose who can see your profile picture"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/profile/edit", strings.NewReader(test.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		resp := httptest.NewRecorder()
+		app.UpdateProfile(resp, req)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+		}
+
+		if test.expectedError == "" {
+			if flash := app.Session.GetString(req.Context(), "flash"); flash != "Profile updated" {
+				t.Errorf("%s: expected the profile to be updated, got %q", test.name, flash)
+			}
+
+			continue
+		}
+
+		body := resp.Body.String()
+
+		if !strings.Contains(body, test.expectedError) || !strings.Contains(body, "is-invalid") {
+			t.Errorf("%s: expected %q next to the field", test.name, test.expectedError)
+		}
+
+		// what was typed is kept, so it can be corrected
+		if !strings.Contains(body, `value="Lovelace"`) {
+			t.Errorf("%s: expected the form to keep what was entered", test.name)
+		}
+	}
+}
@@ -0,0 +1,583 @@
+package web
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProviderConfig configures the OpenID Connect provider other applications sign users in with.
+type ProviderConfig struct {
+	// Issuer is the public base URL of this server. Every endpoint is published under it, and clients check ID tokens
+	// were issued by it.
+	Issuer     string
+	IDTokenTTL time.Duration
+	// CodeTTL is how long a client has to exchange an authorization code for tokens.
+	CodeTTL time.Duration
+}
+
+// DefaultProviderConfig returns the provider settings used when none are configured.
+func DefaultProviderConfig() ProviderConfig {
+	return ProviderConfig{
+		Issuer:     "http://localhost:8080",
+		IDTokenTTL: time.Hour,
+		CodeTTL:    time.Minute,
+	}
+}
+
+// userinfoAudience is the audience of access tokens issued to clients, which only work against the userinfo endpoint.
+func (cfg ProviderConfig) userinfoAudience() string {
+	return cfg.Issuer + "/oauth/userinfo"
+}
+
+// providerScopes are the scopes a client may ask for. openid is required.
+var providerScopes = []string{"openid", "profile", "email"}
+
+// oauthError is an error response, as RFC 6749 describes them.
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e oauthError) Error() string {
+	return e.Description
+}
+
+// userinfoClaims are the claims of an access token issued to a client.
+type userinfoClaims struct {
+	jwt.RegisteredClaims
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+}
+
+// OpenIDConfiguration publishes the provider's discovery document.
+func (app *Application) OpenIDConfiguration(resp http.ResponseWriter, req *http.Request) {
+	issuer := app.Provider.Issuer
+
+	resp.Header().Set("Cache-Control", "public, max-age=300")
+	writeJSON(resp, http.StatusOK, map[string]any{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth/authorize",
+		"token_endpoint":                        issuer + "/oauth/token",
+		"userinfo_endpoint":                     issuer + "/oauth/userinfo",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"scopes_supported":                      providerScopes,
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 []string{"authorization_code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"EdDSA"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"claims_supported":                      []string{"sub", "name", "given_name", "family_name", "email", "picture"},
+	})
+}
+
+// Authorize signs the user in to a client, sending them back to it with an authorization code. Clients are
+// registered by an administrator and trusted, so users are not asked to consent. Users who are not logged in are
+// asked to, and brought back here afterwards.
+func (app *Application) Authorize(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	client, err := app.DB.GetOAuthClientByClientID(query.Get("client_id"))
+
+	if err != nil {
+		http.Error(resp, "Unknown client", http.StatusBadRequest)
+		return
+	}
+
+	// never redirect anywhere the client has not registered, or the code could be sent to an attacker
+	redirectURI := query.Get("redirect_uri")
+
+	if !client.AllowsRedirect(redirectURI) {
+		http.Error(resp, "The redirect_uri is not registered for this client", http.StatusBadRequest)
+		return
+	}
+
+	state := query.Get("state")
+	scopes := strings.Fields(query.Get("scope"))
+
+	if query.Get("response_type") != "code" {
+		redirectWithError(resp, req, redirectURI, state, oauthError{"unsupported_response_type", "Only the code response type is supported"})
+		return
+	}
+
+	if !slices.Contains(scopes, "openid") {
+		redirectWithError(resp, req, redirectURI, state, oauthError{"invalid_scope", "The openid scope is required"})
+		return
+	}
+
+	challenge := query.Get("code_challenge")
+
+	if challenge != "" && query.Get("code_challenge_method") != "S256" {
+		redirectWithError(resp, req, redirectURI, state, oauthError{"invalid_request", "Only the S256 code challenge method is supported"})
+		return
+	}
+
+	// the user is reloaded, so that a deactivated or deleted user's session cannot be used to sign in elsewhere
+	user, ok, err := app.sessionUser(req)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !ok {
+		app.Session.Put(req.Context(), "return_to", req.URL.RequestURI())
+		app.Session.Put(req.Context(), "error", "Log in first!")
+		http.Redirect(resp, req, "/", http.StatusSeeOther)
+		return
+	}
+
+	// drop any scopes we do not know about
+	var granted []string
+
+	for _, scope := range scopes {
+		if slices.Contains(providerScopes, scope) && !slices.Contains(granted, scope) {
+			granted = append(granted, scope)
+		}
+	}
+
+	code, err := randomHex(32)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.DB.InsertAuthorizationCode(data.AuthorizationCode{
+		ClientID:      client.ID,
+		UserID:        user.ID,
+		RedirectURI:   redirectURI,
+		Scope:         strings.Join(granted, " "),
+		Nonce:         query.Get("nonce"),
+		CodeChallenge: challenge,
+		ExpiresAt:     time.Now().Add(app.Provider.CodeTTL),
+	}, hashToken(code))
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(resp, req, withQuery(redirectURI, url.Values{"code": {code}, "state": {state}}), http.StatusFound)
+}
+
+// redirectWithError sends the user back to the client with an error, as RFC 6749 section 4.1.2.1 describes.
+func redirectWithError(resp http.ResponseWriter, req *http.Request, redirectURI, state string, e oauthError) {
+	params := url.Values{"error": {e.Code}, "error_description": {e.Description}}
+
+	if state != "" {
+		params.Set("state", state)
+	}
+
+	http.Redirect(resp, req, withQuery(redirectURI, params), http.StatusFound)
+}
+
+// withQuery adds params to a URL, keeping any query it already has.
+func withQuery(rawURL string, params url.Values) string {
+	u, err := url.Parse(rawURL)
+
+	if err != nil {
+		return rawURL
+	}
+
+	query := u.Query()
+
+	for name, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query[name] = values
+		}
+	}
+
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// providerTokenResponse is what the token endpoint returns to a client.
+type providerTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int    `json:"expires_in"`
+	IDToken     string `json:"id_token"`
+	Scope       string `json:"scope"`
+}
+
+// OAuthToken exchanges an authorization code for an ID token and an access token for the userinfo endpoint. Clients
+// authenticate with their secret, in an Authorization header or in the form.
+func (app *Application) OAuthToken(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Cache-Control", "no-store")
+
+	err := req.ParseForm()
+
+	if err != nil {
+		writeOAuthError(resp, http.StatusBadRequest, oauthError{"invalid_request", "The request body could not be read"})
+		return
+	}
+
+	client, err := app.authenticateClient(req)
+
+	if err != nil {
+		if _, _, basic := req.BasicAuth(); basic {
+			resp.Header().Set("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+
+		writeOAuthError(resp, http.StatusUnauthorized, oauthError{"invalid_client", "Client authentication failed"})
+		return
+	}
+
+	if req.PostForm.Get("grant_type") != "authorization_code" {
+		writeOAuthError(resp, http.StatusBadRequest, oauthError{"unsupported_grant_type", "Only the authorization_code grant is supported"})
+		return
+	}
+
+	tokens, err := app.authorizationCodeGrant(client, req.PostForm)
+
+	var e oauthError
+
+	if stderrors.As(err, &e) {
+		writeOAuthError(resp, http.StatusBadRequest, e)
+		return
+	}
+
+	if err != nil {
+		log.Println("Error issuing tokens to client:", err)
+		writeOAuthError(resp, http.StatusInternalServerError, oauthError{Code: "server_error"})
+		return
+	}
+
+	writeJSON(resp, http.StatusOK, tokens)
+}
+
+// authenticateClient checks the client's id and secret.
+func (app *Application) authenticateClient(req *http.Request) (*data.OAuthClient, error) {
+	clientID, secret, basic := req.BasicAuth()
+
+	if basic {
+		// RFC 6749 has clients form encode their credentials before putting them in the header
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+
+	client, err := app.DB.GetOAuthClientByClientID(clientID)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(client.SecretHash), []byte(hashToken(secret))) != 1 {
+		return nil, stderrors.New("wrong client secret")
+	}
+
+	return client, nil
+}
+
+var errInvalidCode = oauthError{"invalid_grant", "The authorization code is invalid or has expired"}
+
+func (app *Application) authorizationCodeGrant(client *data.OAuthClient, form url.Values) (providerTokenResponse, error) {
+	code, err := app.DB.GetAuthorizationCodeByHash(hashToken(form.Get("code")))
+
+	if err != nil {
+		return providerTokenResponse{}, errInvalidCode
+	}
+
+	if code.ClientID != client.ID || code.UsedAt != nil || !time.Now().Before(code.ExpiresAt) {
+		return providerTokenResponse{}, errInvalidCode
+	}
+
+	if code.RedirectURI != form.Get("redirect_uri") {
+		return providerTokenResponse{}, oauthError{"invalid_grant", "The redirect_uri does not match the authorization request"}
+	}
+
+	if code.CodeChallenge != "" {
+		sum := sha256.Sum256([]byte(form.Get("code_verifier")))
+
+		if subtle.ConstantTimeCompare([]byte(code.CodeChallenge), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) != 1 {
+			return providerTokenResponse{}, oauthError{"invalid_grant", "The code_verifier does not match the code challenge"}
+		}
+	}
+
+	fresh, err := app.DB.UseAuthorizationCode(code.ID)
+
+	if err != nil {
+		return providerTokenResponse{}, err
+	}
+
+	if !fresh {
+		return providerTokenResponse{}, errInvalidCode
+	}
+
+	user, err := app.DB.GetUser(code.UserID)
+
+	if err != nil {
+		return providerTokenResponse{}, errInvalidCode
+	}
+
+	if !user.Active() {
+		return providerTokenResponse{}, oauthError{"invalid_grant", "The user's account is no longer active"}
+	}
+
+	idToken, err := app.issueIDToken(client.ClientID, *user, code.Scope, code.Nonce)
+
+	if err != nil {
+		return providerTokenResponse{}, err
+	}
+
+	accessToken, err := app.issueUserinfoToken(client.ClientID, user.ID, code.Scope)
+
+	if err != nil {
+		return providerTokenResponse{}, err
+	}
+
+	return providerTokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(app.JWT.AccessTokenTTL.Seconds()),
+		IDToken:     idToken,
+		Scope:       code.Scope,
+	}, nil
+}
+
+func writeOAuthError(resp http.ResponseWriter, status int, e oauthError) {
+	writeJSON(resp, status, e)
+}
+
+// issueIDToken returns an ID token for the client. It is signed with a key published in the JWKS, so the client can
+// verify it.
+func (app *Application) issueIDToken(clientID string, user data.User, scope, nonce string) (string, error) {
+	key, ok := app.JWT.publicKey()
+
+	if !ok {
+		return "", stderrors.New("no EdDSA key to sign ID tokens with")
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss": app.Provider.Issuer,
+		"sub": strconv.Itoa(user.ID),
+		"aud": clientID,
+		"exp": now.Add(app.Provider.IDTokenTTL).Unix(),
+		"iat": now.Unix(),
+	}
+
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+
+	for name, value := range app.userClaims(user, scope) {
+		claims[name] = value
+	}
+
+	token := jwt.NewWithClaims(key.method(), claims)
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.signingKey())
+}
+
+// issueUserinfoToken returns an access token the client can use at the userinfo endpoint, and nowhere else.
+func (app *Application) issueUserinfoToken(clientID string, userID int, scope string) (string, error) {
+	if len(app.JWT.Keys) == 0 {
+		return "", stderrors.New("no key to sign access tokens with")
+	}
+
+	key := app.JWT.Keys[0]
+	now := time.Now()
+
+	token := jwt.NewWithClaims(key.method(), userinfoClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    app.Provider.Issuer,
+			Subject:   strconv.Itoa(userID),
+			Audience:  jwt.ClaimStrings{app.Provider.userinfoAudience()},
+			ExpiresAt: jwt.NewNumericDate(now.Add(app.JWT.AccessTokenTTL)),
+			IssuedAt:  jwt.NewNumericDate(now),
+		},
+		Scope:    scope,
+		ClientID: clientID,
+	})
+
+	token.Header["kid"] = key.ID
+
+	return token.SignedString(key.signingKey())
+}
+
+// userClaims returns the claims about a user that the scopes allow a client to see.
+func (app *Application) userClaims(user data.User, scope string) map[string]any {
+	scopes := strings.Fields(scope)
+	claims := map[string]any{"sub": strconv.Itoa(user.ID)}
+
+	if slices.Contains(scopes, "profile") {
+		claims["name"] = strings.TrimSpace(user.FirstName + " " + user.LastName)
+		claims["given_name"] = user.FirstName
+		claims["family_name"] = user.LastName
+
+		if user.ProfilePicture.FileName != "" {
+			claims["picture"] = app.Provider.Issuer + app.newProfilePicture(user.ProfilePicture, user.AvatarVisibility).URL
+		}
+	}
+
+	if slices.Contains(scopes, "email") {
+		claims["email"] = user.Email
+	}
+
+	return claims
+}
+
+// UserInfo returns the claims about the user an access token was issued for.
+func (app *Application) UserInfo(resp http.ResponseWriter, req *http.Request) {
+	token, found := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+
+	var claims userinfoClaims
+
+	if found {
+		_, err := jwt.ParseWithClaims(token, &claims, app.JWT.keyFunc,
+			jwt.WithValidMethods([]string{"HS256", "EdDSA"}),
+			jwt.WithIssuer(app.Provider.Issuer),
+			jwt.WithAudience(app.Provider.userinfoAudience()),
+			jwt.WithExpirationRequired(),
+		)
+
+		found = err == nil
+	}
+
+	if !found {
+		resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(resp, http.StatusUnauthorized, oauthError{"invalid_token", "The access token is invalid or has expired"})
+		return
+	}
+
+	id, _ := strconv.Atoi(claims.Subject)
+	user, err := app.DB.GetUser(id)
+
+	if err != nil || !user.Active() {
+		resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		writeOAuthError(resp, http.StatusUnauthorized, oauthError{"invalid_token", "The user no longer exists or is no longer active"})
+		return
+	}
+
+	resp.Header().Set("Cache-Control", "no-store")
+	writeJSON(resp, http.StatusOK, app.userClaims(*user, claims.Scope))
+}
+
+// AdminClients lists the applications registered with the OpenID Connect provider.
+func (app *Application) AdminClients(resp http.ResponseWriter, req *http.Request) {
+	clients, err := app.DB.GetOAuthClients()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{
+		"clients": clients,
+		"issuer":  app.Provider.Issuer,
+		// a new client's secret is only ever shown once
+		"newClientID":     app.Session.PopString(req.Context(), "new_client_id"),
+		"newClientSecret": app.Session.PopString(req.Context(), "new_client_secret"),
+	}
+
+	_ = app.Render(resp, req, "admin-clients.page.gohtml", &TemplateData{Data: td})
+}
+
+// AdminCreateClient registers an application with the OpenID Connect provider, generating its id and secret.
+func (app *Application) AdminCreateClient(resp http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(req.PostForm)
+	form.Required("name", "redirect_uris")
+	form.MaxLength("name", 255)
+
+	redirectURIs := strings.Fields(form.Data.Get("redirect_uris"))
+
+	for _, uri := range redirectURIs {
+		u, err := url.Parse(uri)
+		form.Check(err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != "" && u.Fragment == "",
+			"redirect_uris", fmt.Sprintf("%s is not a valid redirect URI", uri))
+	}
+
+	if !form.Valid() {
+		for _, field := range []string{"name", "redirect_uris"} {
+			if message := form.Errors.Get(field); message != "" {
+				app.Session.Put(req.Context(), "error", "Could not register client: "+message)
+				break
+			}
+		}
+
+		http.Redirect(resp, req, "/admin/clients", http.StatusSeeOther)
+		return
+	}
+
+	clientID, err := randomHex(16)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := randomHex(32)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_, err = app.DB.InsertOAuthClient(data.OAuthClient{
+		ClientID:     clientID,
+		Name:         strings.TrimSpace(form.Data.Get("name")),
+		RedirectURIs: redirectURIs,
+	}, hashToken(secret))
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(req.Context(), "new_client_id", clientID)
+	app.Session.Put(req.Context(), "new_client_secret", secret)
+	http.Redirect(resp, req, "/admin/clients", http.StatusSeeOther)
+}
+
+// AdminDeleteClient removes a client; it can no longer sign users in, and its outstanding codes stop working.
+func (app *Application) AdminDeleteClient(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	err = app.DB.DeleteOAuthClient(id)
+
+	if stderrors.Is(err, sql.ErrNoRows) {
+		app.Session.Put(req.Context(), "error", "That client does not exist")
+		http.Redirect(resp, req, "/admin/clients", http.StatusSeeOther)
+		return
+	}
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(req.Context(), "flash", "Client deleted")
+	http.Redirect(resp, req, "/admin/clients", http.StatusSeeOther)
+}
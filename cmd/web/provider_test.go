@@ -0,0 +1,428 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"golang.org/x/oauth2"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+func Test_Application_Authorize(t *testing.T) {
+	valid := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {"test-client"},
+		"redirect_uri":          {testRedirectURI},
+		"scope":                 {"openid profile"},
+		"state":                 {"xyz"},
+		"nonce":                 {"abc"},
+		"code_challenge":        {"JBbiqONGWPaAmwXk_8bT6UnlPfrn65D32eZlJS-zGG0"},
+		"code_challenge_method": {"S256"},
+	}
+
+	with := func(name, value string) url.Values {
+		query := url.Values{}
+
+		for k, v := range valid {
+			query[k] = v
+		}
+
+		query.Set(name, value)
+
+		return query
+	}
+
+	// the test repository has user 14 deactivated and user 15 deleted
+	var tests = []struct {
+		name               string
+		query              url.Values
+		loggedIn           int
+		expectedStatusCode int
+		expectedLocation   string
+	}{
+		{"valid", valid, 1, http.StatusFound, testRedirectURI + "?code="},
+		{"not logged in", valid, 0, http.StatusSeeOther, "/"},
+		{"deactivated", valid, 14, http.StatusSeeOther, "/"},
+		{"deleted", valid, 15, http.StatusSeeOther, "/"},
+		{"unknown client", with("client_id", "nobody"), 1, http.StatusBadRequest, ""},
+		{"unregistered redirect", with("redirect_uri", "https://evil.example.com/callback"), 1, http.StatusBadRequest, ""},
+		{"no openid scope", with("scope", "profile"), 1, http.StatusFound, testRedirectURI + "?error=invalid_scope"},
+		{"implicit flow", with("response_type", "token"), 1, http.StatusFound, testRedirectURI + "?error=unsupported_response_type"},
+		{"plain challenge", with("code_challenge_method", "plain"), 1, http.StatusFound, testRedirectURI + "?error=invalid_request"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/authorize?"+test.query.Encode(), nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		if test.loggedIn != 0 {
+			app.Session.Put(req.Context(), "user", data.User{ID: test.loggedIn})
+		}
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.Authorize).ServeHTTP(resp, req)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatusCode, resp.Code)
+		}
+
+		location := resp.Header().Get("Location")
+
+		if !strings.HasPrefix(location, test.expectedLocation) {
+			t.Errorf("%s: expected redirect to %s, got %s", test.name, test.expectedLocation, location)
+		}
+
+		if strings.HasPrefix(location, testRedirectURI) && !strings.Contains(location, "state=xyz") {
+			t.Errorf("%s: expected the state to be sent back, got %s", test.name, location)
+		}
+
+		if test.loggedIn > 1 && app.Session.Exists(req.Context(), "user") {
+			t.Errorf("%s: expected the session to be ended", test.name)
+		}
+
+		// users who have to log in first are brought back afterwards
+		if test.loggedIn != 1 && app.afterLogin(req) != req.URL.RequestURI() {
+			t.Errorf("%s: expected to return to the authorization request after logging in", test.name)
+		}
+	}
+}
+
+func Test_Application_afterLogin(t *testing.T) {
+	var tests = []struct {
+		name     string
+		returnTo string
+		expected string
+	}{
+		{"nothing", "", "/user/profile"},
+		{"local path", "/oauth/authorize?client_id=x", "/oauth/authorize?client_id=x"},
+		{"other site", "https://evil.example.com", "/user/profile"},
+		{"protocol relative", "//evil.example.com", "/user/profile"},
+		{"backslash", "/\\evil.example.com", "/user/profile"},
+	}
+
+	for _, test := range tests {
+		req := addContextAndSessionToRequest(httptest.NewRequest(http.MethodPost, "/login", nil), app)
+
+		if test.returnTo != "" {
+			app.Session.Put(req.Context(), "return_to", test.returnTo)
+		}
+
+		if location := app.afterLogin(req); location != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.name, test.expected, location)
+		}
+	}
+}
+
+func Test_Application_OAuthToken(t *testing.T) {
+	valid := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"test-code"},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {"test-verifier"},
+		"client_id":     {"test-client"},
+		"client_secret": {"test-secret"},
+	}
+
+	with := func(name, value string) url.Values {
+		form := url.Values{}
+
+		for k, v := range valid {
+			form[k] = v
+		}
+
+		form.Set(name, value)
+
+		return form
+	}
+
+	var tests = []struct {
+		name               string
+		form               url.Values
+		basicAuth          bool
+		expectedStatusCode int
+		expectedError      string
+	}{
+		{"valid", valid, false, http.StatusOK, ""},
+		{"basic auth", valid, true, http.StatusOK, ""},
+		{"wrong secret", with("client_secret", "guess"), false, http.StatusUnauthorized, "invalid_client"},
+		{"unknown client", with("client_id", "nobody"), false, http.StatusUnauthorized, "invalid_client"},
+		{"wrong grant", with("grant_type", "password"), false, http.StatusBadRequest, "unsupported_grant_type"},
+		{"unknown code", with("code", "guess"), false, http.StatusBadRequest, "invalid_grant"},
+		{"used code", with("code", "used-code"), false, http.StatusBadRequest, "invalid_grant"},
+		{"expired code", with("code", "expired-code"), false, http.StatusBadRequest, "invalid_grant"},
+		{"wrong redirect", with("redirect_uri", "https://app.example.com/other"), false, http.StatusBadRequest, "invalid_grant"},
+		{"wrong verifier", with("code_verifier", "guess"), false, http.StatusBadRequest, "invalid_grant"},
+		{"deactivated user", with("code", "deactivated-code"), false, http.StatusBadRequest, "invalid_grant"},
+		{"deleted user", with("code", "deleted-code"), false, http.StatusBadRequest, "invalid_grant"},
+	}
+
+	for _, test := range tests {
+		form := test.form
+
+		if test.basicAuth {
+			// the credentials go in the Authorization header instead
+			form = with("client_id", "")
+			form.Del("client_secret")
+		}
+
+		req := httptest.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		if test.basicAuth {
+			req.SetBasicAuth("test-client", "test-secret")
+		}
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.OAuthToken).ServeHTTP(resp, req)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expectedStatusCode, resp.Code, resp.Body.String())
+		}
+
+		var body map[string]any
+		_ = json.Unmarshal(resp.Body.Bytes(), &body)
+
+		if test.expectedError != "" && body["error"] != test.expectedError {
+			t.Errorf("%s: expected error %s, got %v", test.name, test.expectedError, body["error"])
+		}
+
+		if test.expectedError == "" && (body["id_token"] == nil || body["access_token"] == nil) {
+			t.Errorf("%s: expected tokens, got %s", test.name, resp.Body.String())
+		}
+	}
+}
+
+// Test_Application_Provider checks a standard OpenID Connect client can discover the provider, verify the ID tokens
+// it issues, and fetch the user's claims.
+func Test_Application_Provider(t *testing.T) {
+	server := httptest.NewServer(app.Routes())
+	defer server.Close()
+
+	saved := app.Provider.Issuer
+	app.Provider.Issuer = server.URL
+
+	defer func() {
+		app.Provider.Issuer = saved
+	}()
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, server.URL)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {"test-code"},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {"test-verifier"},
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, provider.Endpoint().TokenURL, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth("test-client", "test-secret")
+
+	resp, err := http.DefaultClient.Do(req)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens providerTokenResponse
+	_ = json.NewDecoder(resp.Body).Decode(&tokens)
+	_ = resp.Body.Close()
+
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: "test-client"}).Verify(ctx, tokens.IDToken)
+
+	if err != nil {
+		t.Fatalf("expected the ID token to verify: %v", err)
+	}
+
+	if idToken.Subject != "1" || idToken.Nonce != "test-nonce" {
+		t.Errorf("unexpected ID token subject %s and nonce %s", idToken.Subject, idToken.Nonce)
+	}
+
+	// an ID token meant for another client must be rejected by it
+	if _, err := provider.Verifier(&oidc.Config{ClientID: "other-client"}).Verify(ctx, tokens.IDToken); err == nil {
+		t.Error("expected the ID token to be rejected by another client")
+	}
+
+	_, err = provider.UserInfo(ctx, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: tokens.AccessToken}))
+
+	if err != nil {
+		t.Errorf("expected userinfo to accept the access token: %v", err)
+	}
+}
+
+func Test_Application_UserInfo(t *testing.T) {
+	userinfoToken, _ := app.issueUserinfoToken("test-client", 1, "openid email")
+	deactivatedToken, _ := app.issueUserinfoToken("test-client", 14, "openid email")
+	deletedToken, _ := app.issueUserinfoToken("test-client", 15, "openid email")
+	apiToken, _ := app.JWT.issueAccessToken(1, grantableScopes(data.User{ID: 1}))
+
+	var tests = []struct {
+		name               string
+		token              string
+		expectedStatusCode int
+	}{
+		{"userinfo token", userinfoToken, http.StatusOK},
+		{"deactivated user", deactivatedToken, http.StatusUnauthorized},
+		{"deleted user", deletedToken, http.StatusUnauthorized},
+		{"API access token", apiToken, http.StatusUnauthorized},
+		{"garbage", "not.a.token", http.StatusUnauthorized},
+		{"none", "", http.StatusUnauthorized},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/oauth/userinfo", nil)
+
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.UserInfo).ServeHTTP(resp, req)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatusCode, resp.Code)
+		}
+	}
+
+	// and API endpoints must not accept userinfo tokens
+	req := httptest.NewRequest(http.MethodGet, "/users/1", nil)
+	req.Header.Set("Authorization", "Bearer "+userinfoToken)
+
+	if resp := apiRequest(req, nil); resp.Code != http.StatusUnauthorized {
+		t.Errorf("expected the API to reject a userinfo token, got %d", resp.Code)
+	}
+}
+
+func Test_Application_userClaims(t *testing.T) {
+	user := data.User{
+		ID:             7,
+		FirstName:      "Ada",
+		LastName:       "Lovelace",
+		Email:          "ada@example.com",
+		ProfilePicture: data.UserImage{FileName: "ada.png"},
+	}
+
+	var tests = []struct {
+		name           string
+		scope          string
+		expectedClaims []string
+		hiddenClaims   []string
+	}{
+		{"openid only", "openid", []string{"sub"}, []string{"name", "email", "picture"}},
+		{"profile", "openid profile", []string{"sub", "name", "given_name", "picture"}, []string{"email"}},
+		{"email", "openid email", []string{"sub", "email"}, []string{"name", "picture"}},
+	}
+
+	for _, test := range tests {
+		claims := app.userClaims(user, test.scope)
+
+		for _, name := range test.expectedClaims {
+			if _, ok := claims[name]; !ok {
+				t.Errorf("%s: expected the %s claim", test.name, name)
+			}
+		}
+
+		for _, name := range test.hiddenClaims {
+			if _, ok := claims[name]; ok {
+				t.Errorf("%s: expected no %s claim", test.name, name)
+			}
+		}
+	}
+
+	if picture := app.userClaims(user, "openid profile")["picture"]; picture != app.Provider.Issuer+"/avatars/ada.png" {
+		t.Errorf("expected the picture claim to be the avatar URL, got %v", picture)
+	}
+}
+
+func Test_Application_AdminCreateClient(t *testing.T) {
+	var tests = []struct {
+		name          string
+		postedData    url.Values
+		expectClient  bool
+		expectedError string
+	}{
+		{"valid", url.Values{"name": {"Wiki"}, "redirect_uris": {"https://wiki.example.com/callback\nhttp://localhost:3000/cb"}}, true, ""},
+		{"no name", url.Values{"redirect_uris": {"https://wiki.example.com/callback"}}, false, "cannot be blank"},
+		{"no redirect", url.Values{"name": {"Wiki"}}, false, "cannot be blank"},
+		{"bad redirect", url.Values{"name": {"Wiki"}, "redirect_uris": {"javascript:alert(1)"}}, false, "not a valid redirect URI"},
+		{"fragment", url.Values{"name": {"Wiki"}, "redirect_uris": {"https://wiki.example.com/#callback"}}, false, "not a valid redirect URI"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/admin/clients", strings.NewReader(test.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.AdminCreateClient).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+
+		if secret := app.Session.GetString(req.Context(), "new_client_secret"); (secret != "") != test.expectClient {
+			t.Errorf("%s: expected a client to be %t", test.name, test.expectClient)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+
+		if !test.expectClient {
+			continue
+		}
+
+		// the secret is shown once
+		resp = httptest.NewRecorder()
+		http.HandlerFunc(app.AdminClients).ServeHTTP(resp, req)
+
+		if !strings.Contains(resp.Body.String(), "client_secret: ") || app.Session.Exists(req.Context(), "new_client_secret") {
+			t.Errorf("%s: expected the new secret to be shown once", test.name)
+		}
+	}
+}
+
+func Test_Application_AdminDeleteClient(t *testing.T) {
+	var tests = []struct {
+		name          string
+		id            string
+		expectedFlash string
+		expectedError string
+	}{
+		{"existing", "1", "Client deleted", ""},
+		{"missing", "2", "", "does not exist"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/admin/clients/"+test.id+"/delete", nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("id", test.id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.AdminDeleteClient).ServeHTTP(resp, req)
+
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != test.expectedFlash {
+			t.Errorf("%s: expected flash %q, got %q", test.name, test.expectedFlash, flash)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package web
+
+import (
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// QuotaConfig limits what each user may upload. A limit of zero means no limit, and administrators can override any
+// of them per user.
+type QuotaConfig struct {
+	// MaxBytes is how much space a user's stored images, with their posters, may take up.
+	MaxBytes int64
+	// MaxImages is how many images are kept in a user's history; storing another deletes the oldest.
+	MaxImages int
+	// MaxUploadsPerHour limits how many uploads a user may make in any hour, whether or not they are kept.
+	MaxUploadsPerHour int
+}
+
+// DefaultQuotaConfig returns the quotas used when none are configured.
+func DefaultQuotaConfig() QuotaConfig {
+	return QuotaConfig{
+		MaxBytes:          25 * 1024 * 1024,
+		MaxImages:         5,
+		MaxUploadsPerHour: 10,
+	}
+}
+
+// forUser applies any overrides an administrator has set for user.
+func (q QuotaConfig) forUser(user data.User) QuotaConfig {
+	if user.Quota.MaxBytes != nil {
+		q.MaxBytes = *user.Quota.MaxBytes
+	}
+
+	if user.Quota.MaxImages != nil {
+		q.MaxImages = *user.Quota.MaxImages
+	}
+
+	if user.Quota.MaxUploadsPerHour != nil {
+		q.MaxUploadsPerHour = *user.Quota.MaxUploadsPerHour
+	}
+
+	return q
+}
+
+// splitHistory divides a user's images, newest first, into those kept and those deleted once one more is stored.
+func (q QuotaConfig) splitHistory(images []*data.UserImage) (kept, pruned []*data.UserImage) {
+	if q.MaxImages <= 0 || len(images) < q.MaxImages {
+		return images, nil
+	}
+
+	return images[:q.MaxImages-1], images[q.MaxImages-1:]
+}
+
+// checkStorage rejects an upload of size bytes which would take the kept images over the storage quota.
+func (q QuotaConfig) checkStorage(kept []*data.UserImage, size int64) error {
+	if q.MaxBytes <= 0 {
+		return nil
+	}
+
+	total := size
+
+	for _, image := range kept {
+		total += image.FileSize
+	}
+
+	if total > q.MaxBytes {
+		return imageRejectedError{fmt.Sprintf("This picture would take you over your storage quota of %s", formatBytes(q.MaxBytes))}
+	}
+
+	return nil
+}
+
+// checkUploadRate records an upload of size bytes, or rejects it when the user has already made as many as they may in
+// the last hour. The upload is counted whether or not it goes on to be stored.
+func (app *Application) checkUploadRate(quota QuotaConfig, userID int, size int64) error {
+	recorded, err := app.DB.RecordUpload(userID, size, time.Now().Add(-time.Hour), quota.MaxUploadsPerHour)
+
+	if err != nil {
+		return err
+	}
+
+	if !recorded {
+		return imageRejectedError{fmt.Sprintf("You can upload at most %d pictures an hour; please try again later", quota.MaxUploadsPerHour)}
+	}
+
+	return nil
+}
+
+// pruneImages deletes images which have fallen out of a user's history, along with their files once no image of any
+// user's is stored under the same name; images stored before names were made unique can share a file.
+func (app *Application) pruneImages(pruned []*data.UserImage) error {
+	for _, image := range pruned {
+		if err := app.DB.DeleteUserImage(image.ID); err != nil {
+			return err
+		}
+
+		inUse, err := app.DB.UserImageFileInUse(image.FileName)
+
+		if err != nil {
+			return err
+		}
+
+		if inUse {
+			continue
+		}
+
+		app.Images.removeVariants(image.FileName)
+
+		for _, fileName := range []string{image.FileName, posterFileName(image.FileName)} {
+			err := os.Remove(filepath.Join(uploadPath, fileName))
+
+			if err != nil && !os.IsNotExist(err) {
+				log.Println("Could not remove pruned image:", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// removeProfilePicture deletes a user's current profile picture, so the one before it, if any, takes its place. It
+// returns false if the user has no profile picture.
+func (app *Application) removeProfilePicture(userID int) (bool, error) {
+	images, err := app.DB.GetUserImages(userID)
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(images) == 0 {
+		return false, nil
+	}
+
+	return true, app.pruneImages(images[:1])
+}
+
+// storedSize returns the space an image and its poster take up on disk.
+func storedSize(filePath string) (int64, error) {
+	var size int64
+
+	for _, p := range []string{filePath, posterFileName(filePath)} {
+		info, err := os.Stat(p)
+
+		if err != nil {
+			return 0, err
+		}
+
+		size += info.Size()
+	}
+
+	return size, nil
+}
+
+// quotaUsage is what the profile page shows of a user's quotas.
+type quotaUsage struct {
+	BytesStored       int64
+	MaxBytes          int64
+	Images            int
+	MaxImages         int
+	UploadsThisHour   int
+	MaxUploadsPerHour int
+}
+
+func (app *Application) quotaUsage(user data.User) (quotaUsage, error) {
+	quota := app.Quotas.forUser(user)
+
+	images, err := app.DB.GetUserImages(user.ID)
+
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	uploads, err := app.DB.CountUploadsSince(user.ID, time.Now().Add(-time.Hour))
+
+	if err != nil {
+		return quotaUsage{}, err
+	}
+
+	usage := quotaUsage{
+		MaxBytes:          quota.MaxBytes,
+		Images:            len(images),
+		MaxImages:         quota.MaxImages,
+		UploadsThisHour:   uploads,
+		MaxUploadsPerHour: quota.MaxUploadsPerHour,
+	}
+
+	for _, image := range images {
+		usage.BytesStored += image.FileSize
+	}
+
+	return usage, nil
+}
+
+// formatBytes formats n as a human readable size, such as "2.5 MB".
+func formatBytes(n int64) string {
+	const unit = 1024
+
+	if n < unit {
+		return fmt.Sprintf("%d bytes", n)
+	}
+
+	value, suffix := float64(n)/unit, "KB"
+
+	for _, next := range []string{"MB", "GB", "TB"} {
+		if value < unit {
+			break
+		}
+
+		value, suffix = value/unit, next
+	}
+
+	return strings.Replace(fmt.Sprintf("%.1f %s", value, suffix), ".0 ", " ", 1)
+}
+
+// quotaForm holds the values shown in the quota override form; an empty value means the default applies.
+type quotaForm struct {
+	MaxMegabytes      string
+	MaxImages         string
+	MaxUploadsPerHour string
+}
+
+func newQuotaForm(quota data.UploadQuota) quotaForm {
+	var form quotaForm
+
+	if quota.MaxBytes != nil {
+		form.MaxMegabytes = strconv.FormatInt(*quota.MaxBytes/(1024*1024), 10)
+	}
+
+	if quota.MaxImages != nil {
+		form.MaxImages = strconv.Itoa(*quota.MaxImages)
+	}
+
+	if quota.MaxUploadsPerHour != nil {
+		form.MaxUploadsPerHour = strconv.Itoa(*quota.MaxUploadsPerHour)
+	}
+
+	return form
+}
+
+// optionalLimit reads a limit from the form, returning nil when it was left blank.
+func optionalLimit(form *Form, field string) *int {
+	value := strings.TrimSpace(form.Data.Get(field))
+
+	if value == "" {
+		return nil
+	}
+
+	limit, err := strconv.Atoi(value)
+	form.Check(err == nil && limit >= 0, field, "Enter zero or a positive whole number, or leave blank for the default")
+
+	return &limit
+}
+
+// AdminQuota shows the form administrators use to override a user's quotas.
+func (app *Application) AdminQuota(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	usage, err := app.quotaUsage(*user)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{
+		"subject":  user,
+		"form":     newQuotaForm(user.Quota),
+		"defaults": app.Quotas,
+		"usage":    usage,
+	}
+
+	_ = app.Render(resp, req, "admin-quota.page.gohtml", &TemplateData{Data: td})
+}
+
+// AdminUpdateQuota saves an administrator's overrides of a user's quotas. Blank fields go back to the defaults.
+func (app *Application) AdminUpdateQuota(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	err = req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(req.PostForm)
+	redirectTo := fmt.Sprintf("/admin/users/%d/quota", id)
+
+	var quota data.UploadQuota
+
+	if megabytes := optionalLimit(form, "max_megabytes"); megabytes != nil {
+		maxBytes := int64(*megabytes) * 1024 * 1024
+		quota.MaxBytes = &maxBytes
+	}
+
+	quota.MaxImages = optionalLimit(form, "max_images")
+	quota.MaxUploadsPerHour = optionalLimit(form, "max_uploads_per_hour")
+
+	if !form.Valid() {
+		for _, field := range []string{"max_megabytes", "max_images", "max_uploads_per_hour"} {
+			if message := form.Errors.Get(field); message != "" {
+				app.Session.Put(req.Context(), "error", message)
+				break
+			}
+		}
+
+		http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	var before data.UploadQuota
+
+	if user, err := app.DB.GetUser(id); err == nil {
+		before = user.Quota
+	}
+
+	err = app.DB.UpdateUserQuota(id, quota)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditQuotaChanged, id, map[string]any{"changes": auditDiff(before, quota)})
+
+	app.Session.Put(req.Context(), "flash", "Quota updated")
+	http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+}
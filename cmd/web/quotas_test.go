@@ -0,0 +1,331 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func Test_formatBytes(t *testing.T) {
+	var tests = []struct {
+		bytes    int64
+		expected string
+	}{
+		{0, "0 bytes"},
+		{1023, "1023 bytes"},
+		{1024, "1 KB"},
+		{1536, "1.5 KB"},
+		{25 * 1024 * 1024, "25 MB"},
+		{3 * 1024 * 1024 * 1024, "3 GB"},
+	}
+
+	for _, test := range tests {
+		if actual := formatBytes(test.bytes); actual != test.expected {
+			t.Errorf("formatBytes(%d): expected %q, got %q", test.bytes, test.expected, actual)
+		}
+	}
+}
+
+func Test_QuotaConfig_forUser(t *testing.T) {
+	defaults := QuotaConfig{MaxBytes: 100, MaxImages: 5, MaxUploadsPerHour: 10}
+	maxBytes, maxUploads := int64(0), 2
+
+	quota := defaults.forUser(data.User{Quota: data.UploadQuota{MaxBytes: &maxBytes, MaxUploadsPerHour: &maxUploads}})
+
+	if quota.MaxBytes != 0 || quota.MaxImages != 5 || quota.MaxUploadsPerHour != 2 {
+		t.Errorf("expected overrides to replace only the limits they set, got %+v", quota)
+	}
+}
+
+func Test_QuotaConfig_splitHistory(t *testing.T) {
+	images := []*data.UserImage{{ID: 3}, {ID: 2}, {ID: 1}}
+
+	var tests = []struct {
+		name           string
+		maxImages      int
+		expectedKept   int
+		expectedPruned int
+	}{
+		{"no limit", 0, 3, 0},
+		{"room to spare", 5, 3, 0},
+		{"full", 3, 2, 1},
+		{"over", 1, 0, 3},
+	}
+
+	for _, test := range tests {
+		kept, pruned := QuotaConfig{MaxImages: test.maxImages}.splitHistory(images)
+
+		if len(kept) != test.expectedKept || len(pruned) != test.expectedPruned {
+			t.Errorf("%s: expected %d kept and %d pruned, got %d and %d", test.name, test.expectedKept, test.expectedPruned, len(kept), len(pruned))
+		}
+
+		// the newest images are the ones kept
+		if len(kept) > 0 && kept[0].ID != 3 {
+			t.Errorf("%s: expected the newest image to be kept", test.name)
+		}
+	}
+}
+
+func Test_QuotaConfig_checkStorage(t *testing.T) {
+	kept := []*data.UserImage{{FileSize: 600}, {FileSize: 300}}
+
+	var tests = []struct {
+		name        string
+		maxBytes    int64
+		size        int64
+		expectError bool
+	}{
+		{"no limit", 0, 5000, false},
+		{"fits", 1000, 100, false},
+		{"exactly full", 1000, 100, false},
+		{"too big", 1000, 101, true},
+	}
+
+	for _, test := range tests {
+		err := QuotaConfig{MaxBytes: test.maxBytes}.checkStorage(kept, test.size)
+
+		if _, rejected := err.(imageRejectedError); rejected != test.expectError {
+			t.Errorf("%s: expected rejection to be %t, got %v", test.name, test.expectError, err)
+		}
+	}
+}
+
+func uploadRequest(t *testing.T, fileName string, content []byte) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("image", fileName)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _ = part.Write(content)
+	_ = writer.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/user/upload-profile-picture", body)
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	return req
+}
+
+// storedUploadPattern matches the random names uploads are stored under, but not their posters.
+var storedUploadPattern = regexp.MustCompile(`^[0-9a-f]{32}\.(gif|jpg|png|webp)$`)
+
+// storedUploads returns the names of the images stored in uploadPath by uploads.
+func storedUploads(t *testing.T) []string {
+	entries, err := os.ReadDir(uploadPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var names []string
+
+	for _, entry := range entries {
+		if storedUploadPattern.MatchString(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names
+}
+
+// removeStoredUploads deletes what uploads stored in uploadPath, so the next test starts afresh.
+func removeStoredUploads(t *testing.T) {
+	for _, name := range storedUploads(t) {
+		_ = os.Remove(filepath.Join(uploadPath, name))
+		_ = os.Remove(filepath.Join(uploadPath, posterFileName(name)))
+	}
+}
+
+func Test_Application_UploadProfilePicture_Quotas(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	png, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the test repository reports two earlier images of 1000 bytes each, and three uploads in the last hour
+	var tests = []struct {
+		name          string
+		quota         QuotaConfig
+		expectStored  bool
+		expectPruned  bool
+		expectedError string
+	}{
+		{"within quota", DefaultQuotaConfig(), true, false, ""},
+		{"rate limited", QuotaConfig{MaxUploadsPerHour: 3}, false, false, "at most 3 pictures an hour"},
+		{"over storage quota", QuotaConfig{MaxBytes: 2000}, false, false, "storage quota of 2 KB"},
+		{"history pruned", QuotaConfig{MaxImages: 1}, true, true, ""},
+		// pruning the older images frees enough space for the new one
+		{"pruning makes room", QuotaConfig{MaxImages: 1, MaxBytes: int64(len(png)) * 3}, true, true, ""},
+	}
+
+	defer func() {
+		app.Quotas = DefaultQuotaConfig()
+	}()
+
+	for _, test := range tests {
+		app.Quotas = test.quota
+
+		for _, previous := range []string{"previous.png", "oldest.png"} {
+			if err := os.WriteFile(filepath.Join(uploadPath, previous), png, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		resp := httptest.NewRecorder()
+		req := uploadRequest(t, "quota.png", png)
+		http.HandlerFunc(app.UploadProfilePicture).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+
+		if stored := storedUploads(t); (len(stored) == 1) != test.expectStored {
+			t.Errorf("%s: expected stored to be %t, got %v", test.name, test.expectStored, stored)
+		}
+
+		if _, err := os.Stat(filepath.Join(uploadPath, "quota.png")); err == nil {
+			t.Errorf("%s: expected the upload not to be stored under its own name", test.name)
+		}
+
+		if _, err := os.Stat(filepath.Join(uploadPath, "oldest.png")); os.IsNotExist(err) != test.expectPruned {
+			t.Errorf("%s: expected pruned to be %t", test.name, test.expectPruned)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+
+		removeStoredUploads(t)
+
+		for _, fileName := range []string{"previous.png", "oldest.png"} {
+			_ = os.Remove(filepath.Join(uploadPath, fileName))
+		}
+	}
+}
+
+func Test_Application_pruneImages(t *testing.T) {
+	uploadPath = t.TempDir()
+
+	// the test repository reports that another image is still stored under shared.png
+	for _, fileName := range []string{"shared.png", "shared.poster.png", "own.png", "own.poster.png"} {
+		if err := os.WriteFile(filepath.Join(uploadPath, fileName), []byte("image"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := app.pruneImages([]*data.UserImage{{ID: 1, FileName: "shared.png"}, {ID: 2, FileName: "own.png"}})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for fileName, expectKept := range map[string]bool{"shared.png": true, "shared.poster.png": true, "own.png": false, "own.poster.png": false} {
+		if _, err := os.Stat(filepath.Join(uploadPath, fileName)); (err == nil) != expectKept {
+			t.Errorf("expected %s kept to be %t", fileName, expectKept)
+		}
+	}
+}
+
+func Test_Application_RenameSharedUploads(t *testing.T) {
+	uploadPath = t.TempDir()
+
+	// the test repository reports one image sharing shared.png with an older one
+	for _, fileName := range []string{"shared.png", "shared.poster.png"} {
+		if err := os.WriteFile(filepath.Join(uploadPath, fileName), []byte(fileName), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renamed, err := app.RenameSharedUploads()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if renamed != 1 {
+		t.Errorf("expected 1 image renamed, got %d", renamed)
+	}
+
+	copies := storedUploads(t)
+
+	if len(copies) != 1 {
+		t.Fatalf("expected 1 copy, got %v", copies)
+	}
+
+	for fileName, expected := range map[string]string{copies[0]: "shared.png", posterFileName(copies[0]): "shared.poster.png", "shared.png": "shared.png"} {
+		if content, err := os.ReadFile(filepath.Join(uploadPath, fileName)); err != nil || string(content) != expected {
+			t.Errorf("expected %s to hold %s, got %q %v", fileName, expected, content, err)
+		}
+	}
+}
+
+func Test_Application_Profile_Usage(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(app.Profile).ServeHTTP(resp, req)
+
+	for _, expected := range []string{"Storage: 2 KB of 25 MB used", "Pictures kept: 2 of 5", "Uploads this hour: 3 of 10"} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected profile page to contain %q", expected)
+		}
+	}
+}
+
+func Test_Application_AdminUpdateQuota(t *testing.T) {
+	var tests = []struct {
+		name          string
+		postedData    url.Values
+		expectedFlash string
+		expectedError string
+	}{
+		{"defaults", url.Values{}, "Quota updated", ""},
+		{"overrides", url.Values{"max_megabytes": {"50"}, "max_images": {"0"}, "max_uploads_per_hour": {"2"}}, "Quota updated", ""},
+		{"negative", url.Values{"max_images": {"-1"}}, "", "positive whole number"},
+		{"not a number", url.Values{"max_megabytes": {"lots"}}, "", "positive whole number"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/1/quota", strings.NewReader(test.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("id", "1")
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.AdminUpdateQuota).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/admin/users/1/quota" {
+			t.Errorf("%s: expected a redirect back to the form, got %d %s", test.name, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != test.expectedFlash {
+			t.Errorf("%s: expected flash %q, got %q", test.name, test.expectedFlash, flash)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
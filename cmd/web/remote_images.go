@@ -0,0 +1,303 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	stderrors "errors"
+	"fmt"
+	"github.com/spartanhooah/profile-picture-web/data"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var remoteImageMaxBytes int64 = 1024 * 1024 * 5
+var remoteImageTimeout = 10 * time.Second
+var remoteImageMaxRedirects = 5
+
+// remoteIPAllowed reports whether we may connect to ip when fetching a remote image. Tests replace it so they can
+// reach httptest servers listening on the loopback interface.
+var remoteIPAllowed = isPublicIP
+
+var errDisallowedAddress = stderrors.New("That address points to a private or reserved network")
+var errRemoteImageTooBig = fmt.Errorf("The image is too big; must be less than %d bytes", remoteImageMaxBytes)
+var errNotAnImage = stderrors.New("That URL does not point to a GIF, JPEG, PNG or WebP image")
+var errRemoteImageDownload = stderrors.New("Could not download the image from that URL")
+
+// remoteImageExtensions maps the sniffed content types we accept to the extension used when saving the file.
+var remoteImageExtensions = map[string]string{
+	"image/gif":  ".gif",
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+}
+
+// reservedNetworks are the blocks not covered by the net.IP helpers that must never be reached from the server.
+var reservedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+
+	for _, cidr := range []string{
+		"0.0.0.0/8",       // "this" network
+		"100.64.0.0/10",   // carrier-grade NAT
+		"192.0.0.0/24",    // IETF protocol assignments
+		"192.0.2.0/24",    // TEST-NET-1
+		"198.18.0.0/15",   // benchmarking
+		"198.51.100.0/24", // TEST-NET-2
+		"203.0.113.0/24",  // TEST-NET-3
+		"240.0.0.0/4",     // reserved, including broadcast
+		"64:ff9b::/96",    // NAT64, which can map onto private IPv4 space
+		"2001:db8::/32",   // documentation
+	} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+
+	return networks
+}()
+
+// isPublicIP reports whether ip is a globally routable unicast address.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+
+	for _, network := range reservedNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// remoteImageClient returns an HTTP client which checks every address it connects to, after DNS resolution and on
+// every redirect, so a hostname cannot be used to smuggle a request onto an internal network.
+func remoteImageClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: remoteImageTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+
+			if err != nil {
+				return err
+			}
+
+			ip := net.ParseIP(host)
+
+			if ip == nil || !remoteIPAllowed(ip) {
+				return errDisallowedAddress
+			}
+
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: remoteImageTimeout,
+		Transport: &http.Transport{
+			// never go through a proxy from the environment; it would be the proxy's address that gets checked
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   remoteImageTimeout,
+			ResponseHeaderTimeout: remoteImageTimeout,
+			MaxIdleConns:          1,
+			DisableKeepAlives:     true,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= remoteImageMaxRedirects {
+				return errRemoteImageDownload
+			}
+
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return errRemoteImageDownload
+			}
+
+			return nil
+		},
+	}
+}
+
+// parseRemoteImageURL validates a user supplied image URL.
+func parseRemoteImageURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return nil, stderrors.New("Enter a valid http or https URL")
+	}
+
+	return u, nil
+}
+
+// fetchRemoteImage downloads the image at u, returning its contents and the extension matching its sniffed type.
+// Every error returned is safe to show to the user.
+func fetchRemoteImage(ctx context.Context, u *url.URL) ([]byte, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+
+	if err != nil {
+		return nil, "", errRemoteImageDownload
+	}
+
+	req.Header.Set("Accept", "image/gif,image/jpeg,image/png,image/webp")
+
+	resp, err := remoteImageClient().Do(req)
+
+	if err != nil {
+		log.Println("Error fetching remote image:", err)
+
+		if stderrors.Is(err, errDisallowedAddress) {
+			return nil, "", errDisallowedAddress
+		}
+
+		return nil, "", errRemoteImageDownload
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errRemoteImageDownload
+	}
+
+	if resp.ContentLength > remoteImageMaxBytes {
+		return nil, "", errRemoteImageTooBig
+	}
+
+	// read one byte more than we allow so that we can tell when the body was truncated
+	body, err := io.ReadAll(io.LimitReader(resp.Body, remoteImageMaxBytes+1))
+
+	if err != nil {
+		return nil, "", errRemoteImageDownload
+	}
+
+	if int64(len(body)) > remoteImageMaxBytes {
+		return nil, "", errRemoteImageTooBig
+	}
+
+	// trust the bytes rather than the Content-Type header the remote server sent
+	ext, ok := remoteImageExtensions[http.DetectContentType(body)]
+
+	if !ok {
+		return nil, "", errNotAnImage
+	}
+
+	if _, err := decodeImage(body); err != nil {
+		return nil, "", errNotAnImage
+	}
+
+	return body, ext, nil
+}
+
+// remoteImageFileName returns a random name to save an image downloaded from a URL under, so that nothing about the
+// URL decides where it is written.
+func remoteImageFileName(ext string) (string, error) {
+	name, err := randomHex(16)
+
+	if err != nil {
+		return "", err
+	}
+
+	return name + ext, nil
+}
+
+// remoteImageOriginalName derives the name an image downloaded from u was published under, which is kept only for
+// reference.
+func remoteImageOriginalName(u *url.URL, ext string) string {
+	name := path.Base(u.Path)
+	name = strings.TrimSuffix(name, path.Ext(name))
+
+	if name == "" || name == "." || name == "/" {
+		name = "remote"
+	}
+
+	return name + ext
+}
+
+func (app *Application) UploadProfilePictureFromURL(resp http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+
+	if err != nil {
+		log.Println(err)
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(req.PostForm)
+	form.Required("url")
+
+	if !form.Valid() {
+		app.Session.Put(req.Context(), "error", "Enter the URL of an image")
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	u, err := parseRemoteImageURL(form.Data.Get("url"))
+
+	if err != nil {
+		app.Session.Put(req.Context(), "error", err.Error())
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	body, ext, err := fetchRemoteImage(req.Context(), u)
+
+	if err != nil {
+		app.Session.Put(req.Context(), "error", err.Error())
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	quarantine, err := newQuarantine()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	defer os.RemoveAll(quarantine)
+
+	fileName, err := remoteImageFileName(ext)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	file, err := saveFile(bytes.NewReader(body), fileName, quarantine)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// get the user from the session
+	user := app.Session.Get(req.Context(), "user").(data.User)
+
+	image, err := app.storeProfilePicture(req.Context(), user.ID, filepath.Join(quarantine, file.OriginalFileName), remoteImageOriginalName(u, ext))
+
+	if err != nil {
+		app.uploadFailed(resp, req, err)
+		return
+	}
+
+	app.auditUpload(req, image)
+
+	err = app.refreshSessionUser(req, user.ID)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
@@ -0,0 +1,252 @@
+package web
+
+import (
+	"context"
+	stderrors "errors"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_isPublicIP(t *testing.T) {
+	var tests = []struct {
+		ip       string
+		expected bool
+	}{
+		{"8.8.8.8", true},
+		{"2606:4700:4700::1111", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fc00::1", false},
+		{"0.0.0.0", false},
+		{"100.64.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+	}
+
+	for _, test := range tests {
+		if actual := isPublicIP(net.ParseIP(test.ip)); actual != test.expected {
+			t.Errorf("isPublicIP(%s): expected %t, got %t", test.ip, test.expected, actual)
+		}
+	}
+}
+
+func Test_parseRemoteImageURL(t *testing.T) {
+	var tests = []struct {
+		url   string
+		valid bool
+	}{
+		{"https://example.com/me.png", true},
+		{" http://example.com/me.png ", true},
+		{"ftp://example.com/me.png", false},
+		{"file:///etc/passwd", false},
+		{"https://", false},
+		{"not a url", false},
+	}
+
+	for _, test := range tests {
+		_, err := parseRemoteImageURL(test.url)
+
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error %s", test.url, err)
+		}
+
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.url)
+		}
+	}
+}
+
+func Test_fetchRemoteImage(t *testing.T) {
+	png, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/img.png", func(resp http.ResponseWriter, req *http.Request) {
+		_, _ = resp.Write(png)
+	})
+	mux.HandleFunc("/text", func(resp http.ResponseWriter, req *http.Request) {
+		// claim to be an image; the body is sniffed regardless
+		resp.Header().Set("Content-Type", "image/png")
+		_, _ = resp.Write([]byte("<html>not an image</html>"))
+	})
+	mux.HandleFunc("/missing", func(resp http.ResponseWriter, req *http.Request) {
+		http.NotFound(resp, req)
+	})
+	mux.HandleFunc("/to-metadata", func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+	})
+	mux.HandleFunc("/to-file", func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, "file:///etc/passwd", http.StatusFound)
+	})
+	mux.HandleFunc("/to-img", func(resp http.ResponseWriter, req *http.Request) {
+		http.Redirect(resp, req, "/img.png", http.StatusFound)
+	})
+
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// by default the loopback httptest server must be unreachable
+	u, _ := url.Parse(ts.URL + "/img.png")
+
+	if _, _, err := fetchRemoteImage(context.Background(), u); !stderrors.Is(err, errDisallowedAddress) {
+		t.Errorf("expected loopback address to be rejected, got %v", err)
+	}
+
+	// the same must hold when the loopback address is reached through a hostname
+	u, _ = url.Parse(strings.Replace(ts.URL, "127.0.0.1", "localhost", 1) + "/img.png")
+
+	if _, _, err := fetchRemoteImage(context.Background(), u); !stderrors.Is(err, errDisallowedAddress) {
+		t.Errorf("expected localhost to be rejected, got %v", err)
+	}
+
+	// allow loopback only, so that redirects to anywhere else are still checked
+	remoteIPAllowed = func(ip net.IP) bool {
+		return ip.IsLoopback()
+	}
+
+	defer func() {
+		remoteIPAllowed = isPublicIP
+	}()
+
+	var tests = []struct {
+		name        string
+		path        string
+		maxBytes    int64
+		expectedExt string
+		expectedErr error
+	}{
+		{"png", "/img.png", remoteImageMaxBytes, ".png", nil},
+		{"redirect to image", "/to-img", remoteImageMaxBytes, ".png", nil},
+		{"too big", "/img.png", 10, "", errRemoteImageTooBig},
+		{"not an image", "/text", remoteImageMaxBytes, "", errNotAnImage},
+		{"not found", "/missing", remoteImageMaxBytes, "", errRemoteImageDownload},
+		{"redirect to link-local", "/to-metadata", remoteImageMaxBytes, "", errDisallowedAddress},
+		{"redirect to file", "/to-file", remoteImageMaxBytes, "", errRemoteImageDownload},
+	}
+
+	defaultMaxBytes := remoteImageMaxBytes
+
+	for _, test := range tests {
+		remoteImageMaxBytes = test.maxBytes
+		u, _ := url.Parse(ts.URL + test.path)
+
+		body, ext, err := fetchRemoteImage(context.Background(), u)
+
+		if !stderrors.Is(err, test.expectedErr) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedErr, err)
+		}
+
+		if ext != test.expectedExt {
+			t.Errorf("%s: expected extension %q, got %q", test.name, test.expectedExt, ext)
+		}
+
+		if test.expectedErr == nil && len(body) != len(png) {
+			t.Errorf("%s: expected %d bytes, got %d", test.name, len(png), len(body))
+		}
+	}
+
+	remoteImageMaxBytes = defaultMaxBytes
+}
+
+func Test_remoteImageFileName(t *testing.T) {
+	first, err := remoteImageFileName(".png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := remoteImageFileName(".png")
+
+	if !storedUploadPattern.MatchString(first) || first == second {
+		t.Errorf("expected distinct random names, got %s and %s", first, second)
+	}
+}
+
+func Test_remoteImageOriginalName(t *testing.T) {
+	var tests = []struct {
+		url      string
+		ext      string
+		expected string
+	}{
+		{"https://example.com/pics/me.jpeg", ".jpg", "me.jpg"},
+		{"https://example.com/avatar", ".png", "avatar.png"},
+		{"https://example.com/", ".gif", "remote.gif"},
+		{"https://example.com", ".gif", "remote.gif"},
+		{"https://example.com/a/..%2F..%2Fetc%2Fpasswd", ".png", "passwd.png"},
+	}
+
+	for _, test := range tests {
+		u, _ := url.Parse(test.url)
+
+		if actual := remoteImageOriginalName(u, test.ext); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.url, test.expected, actual)
+		}
+	}
+}
+
+func Test_Application_UploadProfilePictureFromURL(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	ts := httptest.NewServer(http.FileServer(http.Dir("./testdata")))
+	defer ts.Close()
+
+	remoteIPAllowed = func(ip net.IP) bool {
+		return ip.IsLoopback()
+	}
+
+	defer func() {
+		remoteIPAllowed = isPublicIP
+	}()
+
+	var tests = []struct {
+		name          string
+		url           string
+		expectedError bool
+	}{
+		{"valid image", ts.URL + "/img.png", false},
+		{"missing url", "", true},
+		{"bad scheme", "gopher://example.com/img.png", true},
+		{"not an image", ts.URL + "/bad.page.gohtml", true},
+	}
+
+	for _, test := range tests {
+		postedData := url.Values{"url": {test.url}}
+		req := httptest.NewRequest(http.MethodPost, "/user/upload-profile-picture-url", strings.NewReader(postedData.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.UploadProfilePictureFromURL).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+
+		hasError := app.Session.Exists(req.Context(), "error")
+
+		if hasError != test.expectedError {
+			t.Errorf("%s: expected error in session to be %t, got %t", test.name, test.expectedError, hasError)
+		}
+	}
+
+	if stored := storedUploads(t); len(stored) != 1 {
+		t.Errorf("expected downloaded image to be saved, got %v", stored)
+	}
+
+	removeStoredUploads(t)
+}
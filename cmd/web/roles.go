@@ -0,0 +1,120 @@
+package web
+
+import (
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// AdminRoles shows the roles a user has, and lets an administrator change them.
+func (app *Application) AdminRoles(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	roles, err := app.DB.AllRoles()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{
+		"subject": user,
+		"roles":   roles,
+	}
+
+	_ = app.Render(resp, req, "admin-roles.page.gohtml", &TemplateData{Data: td})
+}
+
+// AdminUpdateRoles replaces a user's roles with those ticked. Everyone keeps the user role, and administrators cannot
+// take the admin role away from themselves, so there is always someone left who can assign roles. Users whose roles
+// change pick up their new permissions when they next log in.
+func (app *Application) AdminUpdateRoles(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	err = req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	redirectTo := fmt.Sprintf("/admin/users/%d/roles", id)
+
+	roles, err := app.DB.AllRoles()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	chosen := []string{data.RoleUser}
+
+	for _, name := range req.PostForm["role"] {
+		known := slices.ContainsFunc(roles, func(role *data.Role) bool {
+			return role.Name == name
+		})
+
+		if !known {
+			app.Session.Put(req.Context(), "error", fmt.Sprintf("There is no %s role", name))
+			http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+			return
+		}
+
+		if !slices.Contains(chosen, name) {
+			chosen = append(chosen, name)
+		}
+	}
+
+	self, _ := app.Session.Get(req.Context(), "user").(data.User)
+
+	if id == self.ID && self.HasRole(data.RoleAdmin) && !slices.Contains(chosen, data.RoleAdmin) {
+		app.Session.Put(req.Context(), "error", "You cannot take away your own admin role")
+		http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+		return
+	}
+
+	var before []string
+
+	if user, err := app.DB.GetUser(id); err == nil {
+		before = user.Roles
+	}
+
+	err = app.DB.SetUserRoles(id, chosen)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.audit(req, data.AuditRolesChanged, id, map[string]any{"changes": map[string]auditChange{"roles": {before, chosen}}})
+
+	if id == self.ID {
+		if err := app.refreshSessionUser(req, id); err != nil {
+			log.Println("Could not refresh session:", err)
+		}
+	}
+
+	app.Session.Put(req.Context(), "flash", "Roles updated")
+	http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+}
@@ -0,0 +1,79 @@
+package web
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_Application_AdminRoles(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/admin/users/1/roles", nil)
+	req = addContextAndSessionToRequest(req, app)
+
+	routeContext := chi.NewRouteContext()
+	routeContext.URLParams.Add("id", "1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(app.AdminRoles).ServeHTTP(resp, req)
+
+	if resp.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, resp.Code)
+	}
+
+	for _, expected := range []string{`action="/admin/users/1/roles"`, `value="admin"`, `value="moderator"`, `value="auditor"`, "<code class=\"me-1\">images:moderate</code>"} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected roles page to contain %q", expected)
+		}
+	}
+}
+
+func Test_Application_AdminUpdateRoles(t *testing.T) {
+	admin := data.User{ID: 1, IsAdmin: 1, Roles: []string{data.RoleAdmin, data.RoleUser}}
+
+	var tests = []struct {
+		name          string
+		id            string
+		postedData    url.Values
+		expectedFlash string
+		expectedError string
+	}{
+		{"moderator", "2", url.Values{"role": {"moderator"}}, "Roles updated", ""},
+		{"several", "2", url.Values{"role": {"moderator", "auditor", "user"}}, "Roles updated", ""},
+		{"none", "2", url.Values{}, "Roles updated", ""},
+		{"unknown role", "2", url.Values{"role": {"superuser"}}, "", "There is no superuser role"},
+		{"keep own admin role", "1", url.Values{"role": {"admin", "auditor"}}, "Roles updated", ""},
+		{"remove own admin role", "1", url.Values{"role": {"auditor"}}, "", "your own admin role"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/admin/users/"+test.id+"/roles", strings.NewReader(test.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", admin)
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("id", test.id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.AdminUpdateRoles).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther || resp.Header().Get("Location") != "/admin/users/"+test.id+"/roles" {
+			t.Errorf("%s: expected a redirect back to the form, got %d %s", test.name, resp.Code, resp.Header().Get("Location"))
+		}
+
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != test.expectedFlash {
+			t.Errorf("%s: expected flash %q, got %q", test.name, test.expectedFlash, flash)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package web
 import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
+	"github.com/spartanhooah/profile-picture-web/data"
 	"net/http"
 )
 
@@ -17,17 +18,123 @@ func (app *Application) Routes() http.Handler {
 	// register routes
 	mux.Get("/", app.Home)
 	mux.Post("/login", app.Login)
+	mux.Get("/auth/sso/login", app.SSOLogin)
+	mux.Get("/auth/sso/callback", app.SSOCallback)
 
 	// add custom middleware to a route
 	mux.Route("/user", func(mux chi.Router) {
 		mux.Use(app.auth)
 		// /user is already included
 		mux.Get("/profile", app.Profile)
+		mux.Get("/profile/edit", app.EditProfile)
+		mux.Post("/profile/edit", app.UpdateProfile)
 		mux.Post("/upload-profile-picture", app.UploadProfilePicture)
+		mux.Post("/upload-profile-picture-url", app.UploadProfilePictureFromURL)
+		mux.Post("/stop-impersonating", app.StopImpersonation)
+
+		// things an administrator impersonating the user must not do on their behalf
+		mux.With(app.blockImpersonation).Post("/tokens", app.CreatePersonalAccessToken)
+		mux.With(app.blockImpersonation).Post("/tokens/{id}/revoke", app.RevokePersonalAccessToken)
+		mux.With(app.blockImpersonation).Post("/export", app.RequestDataExport)
+		mux.With(app.blockImpersonation).Get("/exports/{token}", app.DataExportStatus)
+		mux.With(app.blockImpersonation).Get("/exports/{token}/download", app.DownloadDataExport)
+		mux.With(app.blockImpersonation).Get("/erase", app.ConfirmEraseAccount)
+		mux.With(app.blockImpersonation).Post("/erase", app.EraseAccount)
+		mux.With(app.blockImpersonation).Get("/password", app.ChangePasswordPage)
+		mux.With(app.blockImpersonation).Post("/password", app.ChangePassword)
+	})
+
+	// profiles users share with each other, and with everyone if profiles are public
+	mux.Group(func(mux chi.Router) {
+		if !app.PublicProfiles {
+			mux.Use(app.auth)
+		}
+
+		mux.Get("/u/{user}", app.PublicProfile)
+		mux.Get("/directory", app.Directory)
+	})
+
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Use(app.auth)
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionReadUsers))
+			mux.Get("/", http.RedirectHandler("/admin/users", http.StatusSeeOther).ServeHTTP)
+			mux.Get("/users", app.AdminUsers)
+			mux.Get("/users/export", app.AdminExportUsers)
+			mux.Get("/users/{id}", app.AdminUser)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionWriteUsers))
+			mux.Get("/users/import", app.AdminImportUsersPage)
+			mux.Post("/users/import", app.AdminImportUsers)
+			mux.Post("/users/{id}", app.AdminUpdateUser)
+			mux.Post("/users/{id}/password", app.AdminResetPassword)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionDeleteUsers))
+			mux.Get("/users/{id}/delete", app.AdminConfirmDeleteUser)
+			mux.Post("/users/{id}/delete", app.AdminDeleteUser)
+			mux.Get("/users/deleted", app.AdminDeletedUsers)
+			mux.Post("/users/{id}/restore", app.AdminRestoreUser)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionModerateImages))
+			mux.Post("/users/{id}/profile-picture/delete", app.AdminDeleteProfilePicture)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionManageQuotas))
+			mux.Get("/users/{id}/quota", app.AdminQuota)
+			mux.Post("/users/{id}/quota", app.AdminUpdateQuota)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionAssignRoles))
+			mux.Get("/users/{id}/roles", app.AdminRoles)
+			mux.Post("/users/{id}/roles", app.AdminUpdateRoles)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionReadAudit))
+			mux.Get("/audit", app.AdminAudit)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionImpersonate))
+			mux.Post("/users/{id}/impersonate", app.StartImpersonation)
+		})
+
+		mux.Group(func(mux chi.Router) {
+			mux.Use(app.RequirePermission(data.PermissionManageClients))
+			mux.Get("/clients", app.AdminClients)
+			mux.Post("/clients", app.AdminCreateClient)
+			mux.Post("/clients/{id}/delete", app.AdminDeleteClient)
+		})
 	})
 
-	// static assets
-	fileServer := http.FileServer(http.Dir("./static/"))
+	// the JSON API, and the keys its access tokens are signed with
+	mux.Mount("/api/v1", app.apiRoutes())
+	mux.Get("/.well-known/jwks.json", app.JWKS)
+
+	// provisioning from identity management systems
+	mux.Mount("/scim/v2", app.scimRoutes())
+
+	// the OpenID Connect provider other applications sign users in with
+	mux.Get("/.well-known/openid-configuration", app.OpenIDConfiguration)
+	mux.With(app.blockImpersonation).Get("/oauth/authorize", app.Authorize)
+	mux.Post("/oauth/token", app.OAuthToken)
+	mux.Get("/oauth/userinfo", app.UserInfo)
+	mux.Post("/oauth/userinfo", app.UserInfo)
+
+	// uploaded profile pictures, converted and resized on demand
+	mux.Get("/avatars/{fileName}", app.Avatar)
+
+	// static assets, but not the uploads kept among them, which go through Avatar
+	fileServer := http.FileServer(staticFileSystem{FileSystem: http.Dir("./static/"), root: "./static/"})
 	mux.Handle("/static/*", http.StripPrefix("/static/", fileServer))
 
 	return mux
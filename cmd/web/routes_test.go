@@ -14,7 +14,72 @@ func Test_application_routes(t *testing.T) {
 	}{
 		{"/", "GET"},
 		{"/login", "POST"},
+		{"/auth/sso/login", "GET"},
+		{"/auth/sso/callback", "GET"},
 		{"/user/profile", "GET"},
+		{"/user/profile/edit", "GET"},
+		{"/user/profile/edit", "POST"},
+		{"/user/upload-profile-picture", "POST"},
+		{"/user/upload-profile-picture-url", "POST"},
+		{"/user/tokens", "POST"},
+		{"/user/tokens/{id}/revoke", "POST"},
+		{"/user/stop-impersonating", "POST"},
+		{"/user/export", "POST"},
+		{"/user/exports/{token}", "GET"},
+		{"/user/exports/{token}/download", "GET"},
+		{"/user/erase", "GET"},
+		{"/user/erase", "POST"},
+		{"/user/password", "GET"},
+		{"/user/password", "POST"},
+		{"/u/{user}", "GET"},
+		{"/directory", "GET"},
+		{"/admin/", "GET"},
+		{"/admin/users", "GET"},
+		{"/admin/users/export", "GET"},
+		{"/admin/users/import", "GET"},
+		{"/admin/users/import", "POST"},
+		{"/admin/users/{id}", "GET"},
+		{"/admin/users/{id}", "POST"},
+		{"/admin/users/{id}/password", "POST"},
+		{"/admin/users/{id}/delete", "GET"},
+		{"/admin/users/{id}/delete", "POST"},
+		{"/admin/users/deleted", "GET"},
+		{"/admin/users/{id}/restore", "POST"},
+		{"/admin/users/{id}/profile-picture/delete", "POST"},
+		{"/admin/users/{id}/quota", "GET"},
+		{"/admin/users/{id}/quota", "POST"},
+		{"/admin/users/{id}/roles", "GET"},
+		{"/admin/users/{id}/roles", "POST"},
+		{"/admin/users/{id}/impersonate", "POST"},
+		{"/admin/audit", "GET"},
+		{"/admin/clients", "GET"},
+		{"/admin/clients", "POST"},
+		{"/admin/clients/{id}/delete", "POST"},
+		{"/api/v1/auth/token", "POST"},
+		{"/.well-known/jwks.json", "GET"},
+		{"/.well-known/openid-configuration", "GET"},
+		{"/oauth/authorize", "GET"},
+		{"/oauth/token", "POST"},
+		{"/oauth/userinfo", "GET"},
+		{"/oauth/userinfo", "POST"},
+		{"/api/v1/users/", "GET"},
+		{"/api/v1/users/", "POST"},
+		{"/api/v1/users/{id}/", "GET"},
+		{"/api/v1/users/{id}/", "PUT"},
+		{"/api/v1/users/{id}/", "DELETE"},
+		{"/api/v1/users/{id}/profile-picture", "GET"},
+		{"/api/v1/users/{id}/profile-picture", "POST"},
+		{"/api/v1/users/{id}/profile-picture", "DELETE"},
+		{"/scim/v2/Users", "GET"},
+		{"/scim/v2/Users", "POST"},
+		{"/scim/v2/Users/{id}", "GET"},
+		{"/scim/v2/Users/{id}", "PUT"},
+		{"/scim/v2/Users/{id}", "PATCH"},
+		{"/scim/v2/Users/{id}", "DELETE"},
+		{"/scim/v2/ServiceProviderConfig", "GET"},
+		{"/scim/v2/Schemas", "GET"},
+		{"/scim/v2/ResourceTypes", "GET"},
+		{"/avatars/{fileName}", "GET"},
 		{"/static/*", "GET"},
 	}
 
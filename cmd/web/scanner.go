@@ -0,0 +1,191 @@
+package web
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Scanner checks uploaded files for malware before they are stored or served.
+type Scanner interface {
+	// Scan reads r to the end and returns a MalwareFoundError if it is infected, or another error if the file could
+	// not be scanned at all.
+	Scan(ctx context.Context, r io.Reader) error
+}
+
+// MalwareFoundError is returned by a Scanner when a file is infected.
+type MalwareFoundError struct {
+	Signature string
+}
+
+func (e MalwareFoundError) Error() string {
+	return fmt.Sprintf("malware found: %s", e.Signature)
+}
+
+// ScannerUnavailableError is returned by a Scanner when it could not be reached, or did not answer in time. Only
+// these failures are let through when ScanFailOpen is set; any other error is the scanner refusing the file.
+type ScannerUnavailableError struct {
+	Err error
+}
+
+func (e ScannerUnavailableError) Error() string {
+	return fmt.Sprintf("scanner unavailable: %s", e.Err)
+}
+
+func (e ScannerUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// NoopScanner accepts every file; it is meant for development, where no virus scanner is running.
+type NoopScanner struct{}
+
+func (NoopScanner) Scan(ctx context.Context, r io.Reader) error {
+	_, err := io.Copy(io.Discard, r)
+
+	return err
+}
+
+// ClamdScanner scans files by streaming them to a clamd daemon with the INSTREAM command.
+type ClamdScanner struct {
+	// Network is "tcp" or "unix", and Address the host:port or socket path clamd listens on.
+	Network string
+	Address string
+	Timeout time.Duration
+}
+
+// clamdChunkSize is how much of the file is sent to clamd at a time.
+const clamdChunkSize = 64 * 1024
+
+// NewClamdScanner returns a scanner for clamd listening at address, which is either a path to a Unix socket or a
+// TCP host:port.
+func NewClamdScanner(address string, timeout time.Duration) *ClamdScanner {
+	network := "tcp"
+
+	if strings.HasPrefix(address, "/") {
+		network = "unix"
+	}
+
+	return &ClamdScanner{Network: network, Address: address, Timeout: timeout}
+}
+
+func (s *ClamdScanner) Scan(ctx context.Context, r io.Reader) error {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, s.Network, s.Address)
+
+	if err != nil {
+		return ScannerUnavailableError{fmt.Errorf("connecting to clamd: %w", err)}
+	}
+
+	defer conn.Close()
+
+	if s.Timeout > 0 {
+		_ = conn.SetDeadline(time.Now().Add(s.Timeout))
+	}
+
+	// the z prefix means the command, and its reply, are terminated by a null byte rather than a newline
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScannerUnavailableError{fmt.Errorf("sending INSTREAM to clamd: %w", err)}
+	}
+
+	// the file is sent as chunks, each prefixed with its length, followed by a zero length chunk
+	chunk := make([]byte, 4+clamdChunkSize)
+
+	for {
+		n, readErr := io.ReadFull(r, chunk[4:])
+
+		if n > 0 {
+			binary.BigEndian.PutUint32(chunk[:4], uint32(n))
+
+			if _, err := conn.Write(chunk[:4+n]); err != nil {
+				return ScannerUnavailableError{fmt.Errorf("streaming to clamd: %w", err)}
+			}
+		}
+
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScannerUnavailableError{fmt.Errorf("streaming to clamd: %w", err)}
+	}
+
+	reply, err := bufio.NewReader(conn).ReadString(0)
+
+	if err != nil && reply == "" {
+		return ScannerUnavailableError{fmt.Errorf("reading clamd reply: %w", err)}
+	}
+
+	return parseClamdReply(strings.TrimRight(reply, "\x00\n"))
+}
+
+// parseClamdReply interprets a reply such as "stream: OK" or "stream: Eicar-Signature FOUND". Anything else, such as
+// "INSTREAM size limit exceeded. ERROR", means clamd did not clear the file, and is returned as an error.
+func parseClamdReply(reply string) error {
+	result := reply
+
+	if i := strings.Index(reply, ": "); i >= 0 {
+		result = reply[i+2:]
+	}
+
+	switch {
+	case result == "OK":
+		return nil
+	case strings.HasSuffix(result, " FOUND"):
+		return MalwareFoundError{Signature: strings.TrimSuffix(result, " FOUND")}
+	}
+
+	return fmt.Errorf("clamd: %s", reply)
+}
+
+// scanFile runs the application's scanner over the file at filePath. Infected files, and files the scanner reports an
+// error for, are always rejected; when the scanner cannot be reached the upload is accepted or rejected depending on
+// ScanFailOpen.
+func (app *Application) scanFile(ctx context.Context, filePath string) error {
+	f, err := os.Open(filePath)
+
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	err = app.Scanner.Scan(ctx, f)
+
+	if err == nil {
+		return nil
+	}
+
+	if infected, ok := err.(MalwareFoundError); ok {
+		log.Println("Rejected infected upload:", infected.Signature)
+		return imageRejectedError{"The uploaded file did not pass our security checks"}
+	}
+
+	var unavailable ScannerUnavailableError
+
+	if !stderrors.As(err, &unavailable) {
+		log.Println("Scanner refused upload:", err)
+		return imageRejectedError{"The uploaded file could not be checked; please try a different file"}
+	}
+
+	if app.ScanFailOpen {
+		log.Println("Could not scan upload, accepting it anyway:", err)
+		return nil
+	}
+
+	log.Println("Could not scan upload:", err)
+
+	return imageRejectedError{"Uploads cannot be checked right now; please try again later"}
+}
@@ -0,0 +1,227 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	stderrors "errors"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"io"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// clamdTooLarge makes fakeClamd answer with an error, as clamd does for a stream over its size limit.
+const clamdTooLarge = "too large for clamd"
+
+// fakeClamd speaks enough of the clamd protocol to answer INSTREAM, reporting any stream containing the EICAR test
+// string as infected, and any containing clamdTooLarge as an error.
+func fakeClamd(t *testing.T, network, address string) net.Listener {
+	listener, err := net.Listen(network, address)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go func(conn net.Conn) {
+				defer conn.Close()
+
+				reader := bufio.NewReader(conn)
+				command, err := reader.ReadString(0)
+
+				if err != nil || command != "zINSTREAM\x00" {
+					_, _ = conn.Write([]byte("UNKNOWN COMMAND\x00"))
+					return
+				}
+
+				var stream bytes.Buffer
+
+				for {
+					var length uint32
+
+					if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+						return
+					}
+
+					if length == 0 {
+						break
+					}
+
+					if _, err := io.CopyN(&stream, reader, int64(length)); err != nil {
+						return
+					}
+				}
+
+				if strings.Contains(stream.String(), clamdTooLarge) {
+					_, _ = conn.Write([]byte("INSTREAM size limit exceeded. ERROR\x00"))
+					return
+				}
+
+				if strings.Contains(stream.String(), eicar) {
+					_, _ = conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+					return
+				}
+
+				_, _ = conn.Write([]byte("stream: OK\x00"))
+			}(conn)
+		}
+	}()
+
+	return listener
+}
+
+func Test_ClamdScanner_Scan(t *testing.T) {
+	tcp := fakeClamd(t, "tcp", "127.0.0.1:0")
+	defer tcp.Close()
+
+	socketPath := filepath.Join(t.TempDir(), "clamd.sock")
+	unix := fakeClamd(t, "unix", socketPath)
+	defer unix.Close()
+
+	// larger than one chunk, to check that chunks are reassembled
+	large := strings.Repeat("a", clamdChunkSize*2+10) + eicar
+
+	var tests = []struct {
+		name              string
+		address           string
+		content           string
+		expectInfected    bool
+		expectScanError   bool
+		expectUnavailable bool
+	}{
+		{"tcp clean", tcp.Addr().String(), "hello", false, false, false},
+		{"tcp infected", tcp.Addr().String(), eicar, true, false, false},
+		{"tcp infected across chunks", tcp.Addr().String(), large, true, false, false},
+		{"unix clean", socketPath, "hello", false, false, false},
+		{"unix infected", socketPath, eicar, true, false, false},
+		{"error reply", tcp.Addr().String(), clamdTooLarge, false, true, false},
+		{"unreachable", "127.0.0.1:1", "hello", false, true, true},
+	}
+
+	for _, test := range tests {
+		scanner := NewClamdScanner(test.address, time.Second)
+		err := scanner.Scan(context.Background(), strings.NewReader(test.content))
+
+		_, infected := err.(MalwareFoundError)
+
+		if infected != test.expectInfected {
+			t.Errorf("%s: expected infected to be %t, got %v", test.name, test.expectInfected, err)
+		}
+
+		if scanError := err != nil && !infected; scanError != test.expectScanError {
+			t.Errorf("%s: expected scan error to be %t, got %v", test.name, test.expectScanError, err)
+		}
+
+		var unavailable ScannerUnavailableError
+
+		if isUnavailable := stderrors.As(err, &unavailable); isUnavailable != test.expectUnavailable {
+			t.Errorf("%s: expected unavailable to be %t, got %v", test.name, test.expectUnavailable, err)
+		}
+	}
+}
+
+func Test_parseClamdReply(t *testing.T) {
+	if err := parseClamdReply("stream: OK"); err != nil {
+		t.Errorf("expected OK to be clean, got %v", err)
+	}
+
+	if err, ok := parseClamdReply("stream: Win.Test.EICAR_HDB-1 FOUND").(MalwareFoundError); !ok || err.Signature != "Win.Test.EICAR_HDB-1" {
+		t.Errorf("expected signature to be reported, got %v", err)
+	}
+
+	if err := parseClamdReply("INSTREAM size limit exceeded. ERROR"); err == nil {
+		t.Error("expected an error reply to be an error")
+	} else if _, unavailable := err.(ScannerUnavailableError); unavailable {
+		t.Errorf("expected an error reply to be a refusal, not the scanner being unavailable: %v", err)
+	}
+}
+
+func Test_Application_UploadProfilePicture_Scanning(t *testing.T) {
+	uploadPath = "./testdata/uploads"
+
+	tcp := fakeClamd(t, "tcp", "127.0.0.1:0")
+	defer tcp.Close()
+
+	png, err := os.ReadFile("./testdata/img.png")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name          string
+		scanner       Scanner
+		failOpen      bool
+		content       []byte
+		expectStored  bool
+		expectedError string
+	}{
+		{"clean", NewClamdScanner(tcp.Addr().String(), time.Second), false, png, true, ""},
+		// a polyglot: a valid PNG with the test signature appended
+		{"infected", NewClamdScanner(tcp.Addr().String(), time.Second), false, append(append([]byte{}, png...), eicar...), false, "security checks"},
+		{"unreachable, fail closed", NewClamdScanner("127.0.0.1:1", time.Second), false, png, false, "cannot be checked"},
+		{"unreachable, fail open", NewClamdScanner("127.0.0.1:1", time.Second), true, png, true, ""},
+		{"error reply, fail open", NewClamdScanner(tcp.Addr().String(), time.Second), true, append(append([]byte{}, png...), clamdTooLarge...), false, "could not be checked"},
+	}
+
+	defer func() {
+		app.Scanner = NoopScanner{}
+		app.ScanFailOpen = false
+	}()
+
+	for _, test := range tests {
+		app.Scanner = test.scanner
+		app.ScanFailOpen = test.failOpen
+
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("image", "scanned.png")
+		_, _ = part.Write(test.content)
+		_ = writer.Close()
+
+		req := httptest.NewRequest(http.MethodPost, "/user/upload-profile-picture", body)
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.UploadProfilePicture).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+
+		if stored := len(storedUploads(t)) == 1; stored != test.expectStored {
+			t.Errorf("%s: expected stored to be %t", test.name, test.expectStored)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+
+		removeStoredUploads(t)
+	}
+
+	// nothing may be left behind in quarantine
+	if entries, _ := os.ReadDir(quarantinePath); len(entries) != 0 {
+		t.Errorf("expected quarantine to be empty, found %d entries", len(entries))
+	}
+}
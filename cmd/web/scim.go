@@ -0,0 +1,1076 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	scimUserSchema          = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimListResponseSchema  = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimErrorSchema         = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimPatchOpSchema       = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	scimServiceConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	scimResourceTypeSchema  = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	scimSchemaSchema        = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+// scimMaxResults is the most users a single list request returns.
+const scimMaxResults = 200
+
+// scimError is an error response, as RFC 7644 section 3.12 describes them.
+type scimError struct {
+	Status   int
+	ScimType string
+	Detail   string
+}
+
+func (e scimError) Error() string {
+	return e.Detail
+}
+
+func writeSCIM(resp http.ResponseWriter, status int, v any) {
+	out, err := json.Marshal(v)
+
+	if err != nil {
+		log.Println("Error encoding SCIM response:", err)
+		resp.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	resp.Header().Set("Content-Type", "application/scim+json")
+	resp.WriteHeader(status)
+	_, _ = resp.Write(out)
+}
+
+func writeSCIMError(resp http.ResponseWriter, e scimError) {
+	body := map[string]any{
+		"schemas": []string{scimErrorSchema},
+		// SCIM sends the status as a string
+		"status": strconv.Itoa(e.Status),
+	}
+
+	if e.ScimType != "" {
+		body["scimType"] = e.ScimType
+	}
+
+	if e.Detail != "" {
+		body["detail"] = e.Detail
+	}
+
+	writeSCIM(resp, e.Status, body)
+}
+
+// readSCIM decodes a request body into dst. Unlike readJSON it ignores unknown attributes, because provisioning
+// systems send extensions we have no use for.
+func readSCIM(resp http.ResponseWriter, req *http.Request, dst any) error {
+	req.Body = http.MaxBytesReader(resp, req.Body, apiMaxBodyBytes)
+
+	if err := json.NewDecoder(req.Body).Decode(dst); err != nil {
+		return scimError{http.StatusBadRequest, "invalidSyntax", "The body must be a JSON object: " + err.Error()}
+	}
+
+	return nil
+}
+
+// scimBool is a SCIM boolean. Some provisioning systems send booleans as the strings "True" and "False".
+type scimBool bool
+
+func (b *scimBool) UnmarshalJSON(raw []byte) error {
+	var value bool
+
+	if err := json.Unmarshal(raw, &value); err == nil {
+		*b = scimBool(value)
+		return nil
+	}
+
+	var s string
+
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return err
+	}
+
+	value, err := strconv.ParseBool(strings.ToLower(s))
+
+	if err != nil {
+		return fmt.Errorf("%q is not a boolean", s)
+	}
+
+	*b = scimBool(value)
+
+	return nil
+}
+
+type scimName struct {
+	GivenName  string `json:"givenName"`
+	FamilyName string `json:"familyName"`
+	Formatted  string `json:"formatted,omitempty"`
+}
+
+type scimMultiValue struct {
+	Value   string   `json:"value"`
+	Type    string   `json:"type,omitempty"`
+	Primary scimBool `json:"primary,omitempty"`
+}
+
+type scimMeta struct {
+	ResourceType string `json:"resourceType"`
+	Created      string `json:"created"`
+	LastModified string `json:"lastModified"`
+	Location     string `json:"location"`
+}
+
+// scimUser is a user as SCIM represents them. userName is the user's email address, and photos holds their current
+// profile picture.
+type scimUser struct {
+	Schemas     []string         `json:"schemas"`
+	ID          string           `json:"id,omitempty"`
+	ExternalID  string           `json:"externalId,omitempty"`
+	UserName    string           `json:"userName"`
+	Name        scimName         `json:"name"`
+	DisplayName string           `json:"displayName,omitempty"`
+	Emails      []scimMultiValue `json:"emails,omitempty"`
+	Active      *scimBool        `json:"active,omitempty"`
+	// Password can be set but is never returned.
+	Password string           `json:"password,omitempty"`
+	Photos   []scimMultiValue `json:"photos,omitempty"`
+	Meta     *scimMeta        `json:"meta,omitempty"`
+}
+
+// email returns the address the user should have: their primary email, or else their first, or else their userName.
+func (u scimUser) email() string {
+	for _, email := range u.Emails {
+		if email.Primary {
+			return strings.TrimSpace(email.Value)
+		}
+	}
+
+	if len(u.Emails) > 0 {
+		return strings.TrimSpace(u.Emails[0].Value)
+	}
+
+	return strings.TrimSpace(u.UserName)
+}
+
+// toSCIM represents a user for SCIM.
+func (app *Application) toSCIM(user data.User) scimUser {
+	active := scimBool(user.Active())
+	location := fmt.Sprintf("%s/scim/v2/Users/%d", app.Provider.Issuer, user.ID)
+
+	u := scimUser{
+		Schemas:    []string{scimUserSchema},
+		ID:         strconv.Itoa(user.ID),
+		ExternalID: user.ExternalID,
+		UserName:   user.Email,
+		Name: scimName{
+			GivenName:  user.FirstName,
+			FamilyName: user.LastName,
+			Formatted:  strings.TrimSpace(user.FirstName + " " + user.LastName),
+		},
+		DisplayName: strings.TrimSpace(user.FirstName + " " + user.LastName),
+		Emails:      []scimMultiValue{{Value: user.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &scimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt.UTC().Format(time.RFC3339),
+			LastModified: user.UpdatedAt.UTC().Format(time.RFC3339),
+			Location:     location,
+		},
+	}
+
+	if user.ProfilePicture.FileName != "" {
+		u.Photos = []scimMultiValue{{
+			Value:   app.Provider.Issuer + app.newProfilePicture(user.ProfilePicture, user.AvatarVisibility).URL,
+			Type:    "photo",
+			Primary: true,
+		}}
+	}
+
+	return u
+}
+
+// applySCIM validates a SCIM representation of a user and copies it onto user. Photos are read only; profile
+// pictures are uploaded through the API.
+func (app *Application) applySCIM(user *data.User, u scimUser) error {
+	input := userInput{
+		Email:     u.email(),
+		FirstName: strings.TrimSpace(u.Name.GivenName),
+		LastName:  strings.TrimSpace(u.Name.FamilyName),
+		Password:  u.Password,
+	}
+
+	form := input.form(false, app.Passwords.MaxBytes)
+
+	if !form.Valid() {
+		for _, field := range []string{"email", "first_name", "last_name", "password"} {
+			if message := form.Errors.Get(field); message != "" {
+				return scimError{http.StatusBadRequest, "invalidValue", fmt.Sprintf("%s: %s", field, message)}
+			}
+		}
+	}
+
+	if len(u.ExternalID) > 255 {
+		return scimError{http.StatusBadRequest, "invalidValue", "externalId cannot be longer than 255 characters"}
+	}
+
+	user.Email = input.Email
+	user.FirstName = input.FirstName
+	user.LastName = input.LastName
+	user.ExternalID = u.ExternalID
+
+	if u.Active != nil {
+		if *u.Active {
+			user.DeactivatedAt = nil
+		} else if user.DeactivatedAt == nil {
+			now := time.Now()
+			user.DeactivatedAt = &now
+		}
+	}
+
+	return nil
+}
+
+// scimPatchOperation is one change in a PATCH request.
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+type scimPatchRequest struct {
+	Schemas    []string             `json:"schemas"`
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+// patch applies one PATCH operation. Operations without a path hold an object of attributes to set.
+func (u *scimUser) patch(op scimPatchOperation) error {
+	switch strings.ToLower(op.Op) {
+	case "add", "replace":
+		if op.Path != "" {
+			return u.set(op.Path, op.Value)
+		}
+
+		var attributes map[string]json.RawMessage
+
+		if err := json.Unmarshal(op.Value, &attributes); err != nil {
+			return scimError{http.StatusBadRequest, "invalidValue", "An operation without a path needs an object value"}
+		}
+
+		paths := make([]string, 0, len(attributes))
+
+		for path := range attributes {
+			paths = append(paths, path)
+		}
+
+		// set userName before emails, so that an address in emails wins when both are given
+		slices.SortFunc(paths, func(a, b string) int {
+			return strings.Compare(strings.ToLower(b), strings.ToLower(a))
+		})
+
+		for _, path := range paths {
+			if err := u.set(path, attributes[path]); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case "remove":
+		if op.Path == "" {
+			return scimError{http.StatusBadRequest, "noTarget", "A remove operation needs a path"}
+		}
+
+		return u.set(op.Path, nil)
+	default:
+		return scimError{http.StatusBadRequest, "invalidSyntax", fmt.Sprintf("Unknown operation %q", op.Op)}
+	}
+}
+
+// set sets the attribute at path to raw, or clears it when raw is nil.
+func (u *scimUser) set(path string, raw json.RawMessage) error {
+	decode := func(dst any) error {
+		if raw == nil {
+			return nil
+		}
+
+		if err := json.Unmarshal(raw, dst); err != nil {
+			return scimError{http.StatusBadRequest, "invalidValue", fmt.Sprintf("Invalid value for %s: %s", path, err)}
+		}
+
+		return nil
+	}
+
+	attribute := strings.ToLower(strings.TrimPrefix(path, scimUserSchema+":"))
+
+	switch {
+	case attribute == "username":
+		u.UserName = ""
+		// the email address is the user name, so changing one changes the other
+		u.Emails = nil
+		return decode(&u.UserName)
+	case attribute == "externalid":
+		u.ExternalID = ""
+		return decode(&u.ExternalID)
+	case attribute == "active":
+		if raw == nil {
+			return scimError{http.StatusBadRequest, "mutability", "active cannot be removed"}
+		}
+
+		u.Active = new(scimBool)
+		return decode(u.Active)
+	case attribute == "name":
+		u.Name = scimName{}
+		return decode(&u.Name)
+	case attribute == "name.givenname":
+		u.Name.GivenName = ""
+		return decode(&u.Name.GivenName)
+	case attribute == "name.familyname":
+		u.Name.FamilyName = ""
+		return decode(&u.Name.FamilyName)
+	case attribute == "password":
+		u.Password = ""
+		return decode(&u.Password)
+	case attribute == "emails":
+		u.Emails = nil
+		return decode(&u.Emails)
+	case attribute == "emails.value" || strings.HasPrefix(attribute, "emails[") && strings.HasSuffix(attribute, "].value"):
+		// we only keep one address, so whichever email is addressed, it replaces it
+		var value string
+
+		if err := decode(&value); err != nil {
+			return err
+		}
+
+		u.UserName = value
+		u.Emails = []scimMultiValue{{Value: value, Type: "work", Primary: true}}
+		return nil
+	case attribute == "displayname" || attribute == "name.formatted":
+		// derived from the given and family names
+		return nil
+	case attribute == "photos" || strings.HasPrefix(attribute, "photos"):
+		return scimError{http.StatusBadRequest, "mutability", "photos are read only; upload a profile picture through the API"}
+	default:
+		return scimError{http.StatusBadRequest, "invalidPath", fmt.Sprintf("Unknown attribute %s", path)}
+	}
+}
+
+// scimComparison is one comparison in a filter, such as userName eq "jane@example.com".
+type scimComparison struct {
+	attribute string
+	operator  string
+	value     string
+}
+
+// scimFilter is a list of comparisons which must all be true. It is the subset of RFC 7644 section 3.4.2.2 that
+// provisioning systems use to look users up: no "or", "not" or grouping, and no ordering operators.
+type scimFilter []scimComparison
+
+var scimFilterAttributes = []string{"id", "externalid", "username", "emails", "emails.value", "name.givenname",
+	"name.familyname", "displayname", "active"}
+
+var scimFilterOperators = []string{"eq", "ne", "co", "sw", "ew", "pr"}
+
+var errInvalidFilter = scimError{http.StatusBadRequest, "invalidFilter", "The filter is not supported"}
+
+// parseSCIMFilter parses a filter; an empty filter matches everyone.
+func parseSCIMFilter(filter string) (scimFilter, error) {
+	tokens, err := scimFilterTokens(filter)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var parsed scimFilter
+
+	for len(tokens) > 0 {
+		if len(parsed) > 0 {
+			if !strings.EqualFold(tokens[0], "and") {
+				return nil, errInvalidFilter
+			}
+
+			tokens = tokens[1:]
+		}
+
+		if len(tokens) < 2 {
+			return nil, errInvalidFilter
+		}
+
+		comparison := scimComparison{
+			attribute: strings.ToLower(strings.TrimPrefix(tokens[0], scimUserSchema+":")),
+			operator:  strings.ToLower(tokens[1]),
+		}
+
+		if !slices.Contains(scimFilterAttributes, comparison.attribute) || !slices.Contains(scimFilterOperators, comparison.operator) {
+			return nil, scimError{http.StatusBadRequest, "invalidFilter", fmt.Sprintf("Cannot filter on %s %s", tokens[0], tokens[1])}
+		}
+
+		tokens = tokens[2:]
+
+		if comparison.operator != "pr" {
+			if len(tokens) == 0 {
+				return nil, errInvalidFilter
+			}
+
+			comparison.value = tokens[0]
+			tokens = tokens[1:]
+		}
+
+		parsed = append(parsed, comparison)
+	}
+
+	return parsed, nil
+}
+
+// scimFilterTokens splits a filter into words and the contents of quoted strings.
+func scimFilterTokens(filter string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+
+	for i := 0; i < len(filter); i++ {
+		c := filter[i]
+
+		switch {
+		case c == '"':
+			// let the JSON decoder deal with escapes in quoted values
+			end := i + 1
+
+			for end < len(filter) && filter[end] != '"' {
+				if filter[end] == '\\' {
+					end++
+				}
+
+				end++
+			}
+
+			if end >= len(filter) {
+				return nil, errInvalidFilter
+			}
+
+			var value string
+
+			if err := json.NewDecoder(bytes.NewReader([]byte(filter[i : end+1]))).Decode(&value); err != nil {
+				return nil, errInvalidFilter
+			}
+
+			tokens = append(tokens, value)
+			i = end
+		case unicode.IsSpace(rune(c)):
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			return nil, errInvalidFilter
+		default:
+			current.WriteByte(c)
+		}
+	}
+
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+
+	return tokens, nil
+}
+
+// search translates the filter into a search for the database to run, in order of id so that paging through the list
+// sees everyone once. Identity providers look users up with an eq comparison on userName, emails or externalId, and
+// check active eq true, which are all translated. The comparisons that are not are returned, to be applied to what
+// is found.
+func (f scimFilter) search() (data.UserSearch, scimFilter) {
+	search := data.UserSearch{Sort: data.UserSortID}
+	var rest scimFilter
+
+	for _, comparison := range f {
+		switch {
+		case comparison.operator == "eq" && search.Email == "" &&
+			slices.Contains([]string{"username", "emails", "emails.value"}, comparison.attribute):
+			search.Email = comparison.value
+		case comparison.operator == "eq" && search.ExternalID == "" && comparison.attribute == "externalid":
+			search.ExternalID = comparison.value
+		case comparison.operator == "eq" && comparison.attribute == "active" && strings.EqualFold(comparison.value, "true"):
+			search.ActiveOnly = true
+		default:
+			rest = append(rest, comparison)
+		}
+	}
+
+	return search, rest
+}
+
+// matches reports whether user passes every comparison in the filter.
+func (f scimFilter) matches(user data.User) bool {
+	for _, comparison := range f {
+		if !comparison.matches(user) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c scimComparison) matches(user data.User) bool {
+	var actual string
+	caseExact := false
+
+	switch c.attribute {
+	case "id":
+		actual, caseExact = strconv.Itoa(user.ID), true
+	case "externalid":
+		actual, caseExact = user.ExternalID, true
+	case "username", "emails", "emails.value":
+		actual = user.Email
+	case "name.givenname":
+		actual = user.FirstName
+	case "name.familyname":
+		actual = user.LastName
+	case "displayname":
+		actual = strings.TrimSpace(user.FirstName + " " + user.LastName)
+	case "active":
+		actual = strconv.FormatBool(user.Active())
+	}
+
+	expected := c.value
+
+	if !caseExact {
+		actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+	}
+
+	switch c.operator {
+	case "eq":
+		return actual == expected
+	case "ne":
+		return actual != expected
+	case "co":
+		return strings.Contains(actual, expected)
+	case "sw":
+		return strings.HasPrefix(actual, expected)
+	case "ew":
+		return strings.HasSuffix(actual, expected)
+	case "pr":
+		return actual != ""
+	}
+
+	return false
+}
+
+// scimRoutes returns the handler for the SCIM 2.0 provisioning API, mounted at /scim/v2.
+func (app *Application) scimRoutes() http.Handler {
+	mux := chi.NewRouter()
+
+	mux.NotFound(func(resp http.ResponseWriter, req *http.Request) {
+		writeSCIMError(resp, scimError{Status: http.StatusNotFound, Detail: "Not found"})
+	})
+
+	mux.MethodNotAllowed(func(resp http.ResponseWriter, req *http.Request) {
+		writeSCIMError(resp, scimError{Status: http.StatusMethodNotAllowed, Detail: "Method not allowed"})
+	})
+
+	// the discovery endpoints describe the service, and do not need authentication
+	mux.Get("/ServiceProviderConfig", app.SCIMServiceProviderConfig)
+	mux.Get("/Schemas", app.SCIMSchemas)
+	mux.Get("/Schemas/{id}", app.SCIMSchemas)
+	mux.Get("/ResourceTypes", app.SCIMResourceTypes)
+	mux.Get("/ResourceTypes/{id}", app.SCIMResourceTypes)
+
+	mux.Group(func(mux chi.Router) {
+		mux.Use(app.scimAuth)
+
+		mux.Get("/Users", app.SCIMListUsers)
+		mux.Post("/Users", app.SCIMCreateUser)
+		mux.Get("/Users/{id}", app.SCIMGetUser)
+		mux.Put("/Users/{id}", app.SCIMReplaceUser)
+		mux.Patch("/Users/{id}", app.SCIMPatchUser)
+		mux.Delete("/Users/{id}", app.SCIMDeleteUser)
+	})
+
+	return mux
+}
+
+// scimAuth only lets through users with the users:write permission presenting a bearer token with the users:admin
+// scope.
+func (app *Application) scimAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		scheme, token, _ := strings.Cut(req.Header.Get("Authorization"), " ")
+
+		if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+			resp.Header().Set("WWW-Authenticate", "Bearer")
+			writeSCIMError(resp, scimError{Status: http.StatusUnauthorized, Detail: "Use a bearer token"})
+			return
+		}
+
+		caller, err := app.authenticateBearer(req, token)
+
+		if err != nil {
+			resp.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeSCIMError(resp, scimError{Status: http.StatusUnauthorized, Detail: "The token is invalid, expired or revoked"})
+			return
+		}
+
+		if !caller.User.Can(data.PermissionWriteUsers) || !caller.can("users:admin") {
+			writeSCIMError(resp, scimError{Status: http.StatusForbidden, Detail: "Provisioning needs a token with the users:admin scope, belonging to a user with the users:write permission"})
+			return
+		}
+
+		ctx := context.WithValue(req.Context(), contextAPICallerKey, caller)
+		next.ServeHTTP(resp, req.WithContext(ctx))
+	})
+}
+
+// scimFailed reports err, which is a scimError if the client is to blame.
+func scimFailed(resp http.ResponseWriter, err error) {
+	var e scimError
+
+	if stderrors.As(err, &e) {
+		writeSCIMError(resp, e)
+		return
+	}
+
+	log.Println("SCIM error:", err)
+	writeSCIMError(resp, scimError{Status: http.StatusInternalServerError})
+}
+
+// scimUserFromURL returns the user whose id is in the URL.
+func (app *Application) scimUserFromURL(req *http.Request) (*data.User, error) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		return nil, scimError{Status: http.StatusNotFound, Detail: "User not found"}
+	}
+
+	user, err := app.DB.GetUser(id)
+
+	if err != nil {
+		return nil, scimError{Status: http.StatusNotFound, Detail: "User not found"}
+	}
+
+	return user, nil
+}
+
+// checkEmailAvailable makes sure no other user has the address.
+func (app *Application) checkEmailAvailable(user data.User) error {
+	if existing, err := app.DB.GetUserByEmail(user.Email); err == nil && existing.ID != user.ID {
+		return scimError{http.StatusConflict, "uniqueness", "A user with that userName already exists"}
+	}
+
+	return nil
+}
+
+// SCIMListUsers lists users, optionally filtered, a page at a time. startIndex counts from 1.
+func (app *Application) SCIMListUsers(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	filter, err := parseSCIMFilter(query.Get("filter"))
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	startIndex, err := strconv.Atoi(query.Get("startIndex"))
+
+	if err != nil || startIndex < 1 {
+		startIndex = 1
+	}
+
+	count, err := strconv.Atoi(query.Get("count"))
+
+	if err != nil || count > scimMaxResults {
+		count = scimMaxResults
+	}
+
+	count = max(count, 0)
+
+	search, rest := filter.search()
+	var total int
+	var users []*data.User
+
+	if len(rest) == 0 {
+		// a limit of zero would be no limit at all
+		search.Offset, search.Limit = startIndex-1, max(count, 1)
+
+		var result *data.UserSearchResult
+		result, err = app.DB.SearchUsers(search)
+
+		if result != nil {
+			total, users = result.Total, result.Users[:min(count, len(result.Users))]
+		}
+	} else {
+		total, users, err = app.scimFilterUsers(search, rest, startIndex, count)
+	}
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	resources := []scimUser{}
+
+	for _, user := range users {
+		resources = append(resources, app.toSCIM(*user))
+	}
+
+	writeSCIM(resp, http.StatusOK, map[string]any{
+		"schemas":      []string{scimListResponseSchema},
+		"totalResults": total,
+		"startIndex":   startIndex,
+		"itemsPerPage": len(resources),
+		"Resources":    resources,
+	})
+}
+
+// scimFilterUsers pages through the users search finds, keeping those that also pass rest, which the database cannot
+// check. It returns how many pass, and count of them from startIndex on.
+func (app *Application) scimFilterUsers(search data.UserSearch, rest scimFilter, startIndex, count int) (int, []*data.User, error) {
+	search.Limit = scimMaxResults
+	total := 0
+	var users []*data.User
+
+	for {
+		result, err := app.DB.SearchUsers(search)
+
+		if err != nil {
+			return 0, nil, err
+		}
+
+		for _, user := range result.Users {
+			if !rest.matches(*user) {
+				continue
+			}
+
+			total++
+
+			if total >= startIndex && len(users) < count {
+				users = append(users, user)
+			}
+		}
+
+		if result.Next == "" {
+			return total, users, nil
+		}
+
+		search.Cursor = result.Next
+	}
+}
+
+// SCIMCreateUser provisions a user. Users created without a password can only sign in through SSO until they reset
+// it.
+func (app *Application) SCIMCreateUser(resp http.ResponseWriter, req *http.Request) {
+	var input scimUser
+
+	if err := readSCIM(resp, req, &input); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	var user data.User
+
+	if err := app.applySCIM(&user, input); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	if err := app.checkEmailAvailable(user); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	user.Password = input.Password
+
+	if user.Password == "" {
+		password, err := randomHex(32)
+
+		if err != nil {
+			scimFailed(resp, err)
+			return
+		}
+
+		user.Password = password
+	}
+
+	id, err := app.DB.InsertUser(user)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	created, err := app.DB.GetUser(id)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserCreated, id, map[string]any{"user": created})
+
+	u := app.toSCIM(*created)
+
+	resp.Header().Set("Location", u.Meta.Location)
+	writeSCIM(resp, http.StatusCreated, u)
+}
+
+func (app *Application) SCIMGetUser(resp http.ResponseWriter, req *http.Request) {
+	user, err := app.scimUserFromURL(req)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	writeSCIM(resp, http.StatusOK, app.toSCIM(*user))
+}
+
+// SCIMReplaceUser replaces a user's attributes with those in the request.
+func (app *Application) SCIMReplaceUser(resp http.ResponseWriter, req *http.Request) {
+	var input scimUser
+
+	if err := readSCIM(resp, req, &input); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	user, err := app.scimUserFromURL(req)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	app.saveSCIMUser(resp, req, user, input)
+}
+
+// SCIMPatchUser changes some of a user's attributes.
+func (app *Application) SCIMPatchUser(resp http.ResponseWriter, req *http.Request) {
+	var patch scimPatchRequest
+
+	if err := readSCIM(resp, req, &patch); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	if !slices.Contains(patch.Schemas, scimPatchOpSchema) || len(patch.Operations) == 0 {
+		scimFailed(resp, scimError{http.StatusBadRequest, "invalidSyntax", "The body must be a PatchOp with at least one operation"})
+		return
+	}
+
+	user, err := app.scimUserFromURL(req)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	u := app.toSCIM(*user)
+
+	for _, op := range patch.Operations {
+		if err := u.patch(op); err != nil {
+			scimFailed(resp, err)
+			return
+		}
+	}
+
+	app.saveSCIMUser(resp, req, user, u)
+}
+
+// saveSCIMUser applies the SCIM representation u to user, saves them, and responds with the result.
+func (app *Application) saveSCIMUser(resp http.ResponseWriter, req *http.Request, user *data.User, u scimUser) {
+	before := *user
+
+	if err := app.applySCIM(user, u); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	if err := app.checkEmailAvailable(*user); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	if err := app.DB.UpdateUser(*user); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserUpdated, user.ID, map[string]any{"changes": auditDiff(before, *user)})
+
+	if u.Password != "" {
+		if err := app.DB.ResetPassword(user.ID, u.Password); err != nil {
+			scimFailed(resp, err)
+			return
+		}
+
+		_ = app.audit(req, data.AuditPasswordReset, user.ID, nil)
+	}
+
+	updated, err := app.DB.GetUser(user.ID)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	writeSCIM(resp, http.StatusOK, app.toSCIM(*updated))
+}
+
+func (app *Application) SCIMDeleteUser(resp http.ResponseWriter, req *http.Request) {
+	user, err := app.scimUserFromURL(req)
+
+	if err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	if err := app.DB.DeleteUser(user.ID); err != nil {
+		scimFailed(resp, err)
+		return
+	}
+
+	_ = app.audit(req, data.AuditUserDeleted, user.ID, map[string]any{"user": user})
+
+	resp.WriteHeader(http.StatusNoContent)
+}
+
+// SCIMServiceProviderConfig describes which parts of SCIM we support.
+func (app *Application) SCIMServiceProviderConfig(resp http.ResponseWriter, req *http.Request) {
+	writeSCIM(resp, http.StatusOK, map[string]any{
+		"schemas":          []string{scimServiceConfigSchema},
+		"documentationUri": app.Provider.Issuer + "/scim/v2/Schemas",
+		"patch":            map[string]bool{"supported": true},
+		"bulk":             map[string]any{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":           map[string]any{"supported": true, "maxResults": scimMaxResults},
+		"changePassword":   map[string]bool{"supported": true},
+		"sort":             map[string]bool{"supported": false},
+		"etag":             map[string]bool{"supported": false},
+		"authenticationSchemes": []map[string]any{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "A personal access token or API access token with the users:admin scope, belonging to a user with the users:write permission",
+			"primary":     true,
+		}},
+		"meta": map[string]string{
+			"resourceType": "ServiceProviderConfig",
+			"location":     app.Provider.Issuer + "/scim/v2/ServiceProviderConfig",
+		},
+	})
+}
+
+// SCIMResourceTypes lists the kinds of resource we provision, which is only users, or describes one of them.
+func (app *Application) SCIMResourceTypes(resp http.ResponseWriter, req *http.Request) {
+	userType := map[string]any{
+		"schemas":     []string{scimResourceTypeSchema},
+		"id":          "User",
+		"name":        "User",
+		"endpoint":    "/Users",
+		"description": "User Account",
+		"schema":      scimUserSchema,
+		"meta": map[string]string{
+			"resourceType": "ResourceType",
+			"location":     app.Provider.Issuer + "/scim/v2/ResourceTypes/User",
+		},
+	}
+
+	app.scimDiscovery(resp, req, "User", userType)
+}
+
+// scimAttribute describes an attribute of a schema.
+type scimAttribute struct {
+	Name          string          `json:"name"`
+	Type          string          `json:"type"`
+	MultiValued   bool            `json:"multiValued"`
+	Description   string          `json:"description"`
+	Required      bool            `json:"required"`
+	CaseExact     bool            `json:"caseExact"`
+	Mutability    string          `json:"mutability"`
+	Returned      string          `json:"returned"`
+	Uniqueness    string          `json:"uniqueness"`
+	SubAttributes []scimAttribute `json:"subAttributes,omitempty"`
+}
+
+func scimString(name, description string, required bool) scimAttribute {
+	return scimAttribute{Name: name, Type: "string", Description: description, Required: required,
+		Mutability: "readWrite", Returned: "default", Uniqueness: "none"}
+}
+
+// SCIMSchemas describes the attributes of the User schema we support.
+func (app *Application) SCIMSchemas(resp http.ResponseWriter, req *http.Request) {
+	userName := scimString("userName", "The user's email address, which they sign in with", true)
+	userName.Uniqueness = "server"
+
+	externalID := scimString("externalId", "The identifier the provisioning system knows the user by", false)
+	externalID.CaseExact = true
+
+	emailValue := scimString("value", "The email address", true)
+	emailType := scimString("type", "Always work", false)
+	primary := scimAttribute{Name: "primary", Type: "boolean", Description: "Whether this is the user's main address",
+		Mutability: "readWrite", Returned: "default", Uniqueness: "none"}
+
+	password := scimString("password", "Sets the user's password; it is never returned", false)
+	password.Mutability, password.Returned = "writeOnly", "never"
+
+	photoValue := scimString("value", "The URL of the user's current profile picture", false)
+	photoValue.Type, photoValue.Mutability = "reference", "readOnly"
+
+	schema := map[string]any{
+		"schemas":     []string{scimSchemaSchema},
+		"id":          scimUserSchema,
+		"name":        "User",
+		"description": "User Account",
+		"attributes": []scimAttribute{
+			userName,
+			externalID,
+			{Name: "name", Type: "complex", Description: "The user's name", Required: true, Mutability: "readWrite",
+				Returned: "default", Uniqueness: "none", SubAttributes: []scimAttribute{
+					scimString("givenName", "First name", true),
+					scimString("familyName", "Last name", true),
+				}},
+			{Name: "emails", Type: "complex", MultiValued: true, Description: "The user's email address; only one is kept",
+				Mutability: "readWrite", Returned: "default", Uniqueness: "none",
+				SubAttributes: []scimAttribute{emailValue, emailType, primary}},
+			{Name: "active", Type: "boolean", Description: "Whether the user may sign in", Mutability: "readWrite",
+				Returned: "default", Uniqueness: "none"},
+			password,
+			{Name: "photos", Type: "complex", MultiValued: true, Description: "The user's current profile picture",
+				Mutability: "readOnly", Returned: "default", Uniqueness: "none",
+				SubAttributes: []scimAttribute{photoValue}},
+		},
+		"meta": map[string]string{
+			"resourceType": "Schema",
+			"location":     app.Provider.Issuer + "/scim/v2/Schemas/" + scimUserSchema,
+		},
+	}
+
+	app.scimDiscovery(resp, req, scimUserSchema, schema)
+}
+
+// scimDiscovery answers a discovery request for our one resource: as a list, or on its own when asked for by id.
+func (app *Application) scimDiscovery(resp http.ResponseWriter, req *http.Request, id string, resource any) {
+	if requested := chi.URLParam(req, "id"); requested != "" {
+		if requested != id {
+			writeSCIMError(resp, scimError{Status: http.StatusNotFound, Detail: "Not found"})
+			return
+		}
+
+		writeSCIM(resp, http.StatusOK, resource)
+		return
+	}
+
+	writeSCIM(resp, http.StatusOK, map[string]any{
+		"schemas":      []string{scimListResponseSchema},
+		"totalResults": 1,
+		"startIndex":   1,
+		"itemsPerPage": 1,
+		"Resources":    []any{resource},
+	})
+}
@@ -0,0 +1,374 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_parseSCIMFilter(t *testing.T) {
+	var tests = []struct {
+		name          string
+		filter        string
+		expected      scimFilter
+		expectedError bool
+	}{
+		{"empty", "", nil, false},
+		{"user name", `userName eq "jane@example.com"`, scimFilter{{"username", "eq", "jane@example.com"}}, false},
+		{"operators are case insensitive", `userName EQ "jane@example.com"`, scimFilter{{"username", "eq", "jane@example.com"}}, false},
+		{"schema prefix", `urn:ietf:params:scim:schemas:core:2.0:User:externalId eq "abc"`, scimFilter{{"externalid", "eq", "abc"}}, false},
+		{"present", "externalId pr", scimFilter{{"externalid", "pr", ""}}, false},
+		{"and", `emails.value co "example" and active eq true`, scimFilter{{"emails.value", "co", "example"}, {"active", "eq", "true"}}, false},
+		{"escaped quote", `name.familyName eq "O\"Brien"`, scimFilter{{"name.familyname", "eq", `O"Brien`}}, false},
+		{"or", `userName eq "a" or userName eq "b"`, nil, true},
+		{"grouping", `(userName eq "a")`, nil, true},
+		{"value path", `emails[type eq "work"]`, nil, true},
+		{"unknown attribute", `password eq "secret"`, nil, true},
+		{"unknown operator", `userName gt "a"`, nil, true},
+		{"missing value", "userName eq", nil, true},
+		{"unterminated string", `userName eq "jane`, nil, true},
+	}
+
+	for _, test := range tests {
+		filter, err := parseSCIMFilter(test.filter)
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("%s: expected error to be %t, got %v", test.name, test.expectedError, err)
+			continue
+		}
+
+		if len(filter) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, filter)
+			continue
+		}
+
+		for i := range filter {
+			if filter[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, filter)
+			}
+		}
+	}
+}
+
+func Test_scimFilter_search(t *testing.T) {
+	var tests = []struct {
+		name         string
+		filter       string
+		expected     data.UserSearch
+		expectedRest int
+	}{
+		{"everyone", "", data.UserSearch{}, 0},
+		{"user name", `userName eq "jane@example.com"`, data.UserSearch{Email: "jane@example.com"}, 0},
+		{"email", `emails.value eq "jane@example.com" and active eq true`, data.UserSearch{Email: "jane@example.com", ActiveOnly: true}, 0},
+		{"external id", `externalId eq "abc"`, data.UserSearch{ExternalID: "abc"}, 0},
+		{"two user names", `userName eq "jane@example.com" and emails eq "john@example.com"`, data.UserSearch{Email: "jane@example.com"}, 1},
+		{"inactive", "active eq false", data.UserSearch{}, 1},
+		{"not a lookup", `userName co "jane"`, data.UserSearch{}, 1},
+	}
+
+	for _, test := range tests {
+		filter, err := parseSCIMFilter(test.filter)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		search, rest := filter.search()
+
+		if search.Sort != data.UserSortID || search.Email != test.expected.Email || search.ExternalID != test.expected.ExternalID ||
+			search.ActiveOnly != test.expected.ActiveOnly || len(rest) != test.expectedRest {
+			t.Errorf("%s: expected %+v and %d left, got %+v and %v", test.name, test.expected, test.expectedRest, search, rest)
+		}
+	}
+}
+
+func Test_scimFilter_matches(t *testing.T) {
+	deactivated := time.Now()
+
+	users := []data.User{
+		{ID: 1, Email: "Jane@Example.com", FirstName: "Jane", LastName: "Doe", ExternalID: "abc"},
+		{ID: 2, Email: "john@example.org", FirstName: "John", LastName: "Smith", DeactivatedAt: &deactivated},
+	}
+
+	var tests = []struct {
+		name     string
+		filter   string
+		expected []int
+	}{
+		{"everyone", "", []int{1, 2}},
+		{"user name ignores case", `userName eq "jane@example.com"`, []int{1}},
+		{"external id is case exact", `externalId eq "ABC"`, nil},
+		{"external id", `externalId eq "abc"`, []int{1}},
+		{"present", "externalId pr", []int{1}},
+		{"not equal", `id ne "1"`, []int{2}},
+		{"starts with", `name.givenName sw "j"`, []int{1, 2}},
+		{"ends with", `emails ew ".org"`, []int{2}},
+		{"display name", `displayName co "e d"`, []int{1}},
+		{"active", "active eq false", []int{2}},
+		{"and", `name.givenName sw "j" and active eq true`, []int{1}},
+	}
+
+	for _, test := range tests {
+		filter, err := parseSCIMFilter(test.filter)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var matched []int
+
+		for _, user := range users {
+			if filter.matches(user) {
+				matched = append(matched, user.ID)
+			}
+		}
+
+		if len(matched) != len(test.expected) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, matched)
+			continue
+		}
+
+		for i := range matched {
+			if matched[i] != test.expected[i] {
+				t.Errorf("%s: expected %v, got %v", test.name, test.expected, matched)
+			}
+		}
+	}
+}
+
+func Test_scimUser_patch(t *testing.T) {
+	var tests = []struct {
+		name              string
+		op                scimPatchOperation
+		expectedEmail     string
+		expectedFirstName string
+		expectedActive    bool
+		expectedError     bool
+	}{
+		{"replace given name", scimPatchOperation{"replace", "name.givenName", json.RawMessage(`"Janet"`)}, "jane@example.com", "Janet", true, false},
+		{"deactivate", scimPatchOperation{"Replace", "active", json.RawMessage(`false`)}, "jane@example.com", "Jane", false, false},
+		{"deactivate with a string", scimPatchOperation{"replace", "active", json.RawMessage(`"False"`)}, "jane@example.com", "Jane", false, false},
+		{"no path", scimPatchOperation{"replace", "", json.RawMessage(`{"active":false,"name.givenName":"Janet"}`)}, "jane@example.com", "Janet", false, false},
+		{"user name", scimPatchOperation{"replace", "userName", json.RawMessage(`"janet@example.com"`)}, "janet@example.com", "Jane", true, false},
+		{"email value path", scimPatchOperation{"replace", `emails[type eq "work"].value`, json.RawMessage(`"janet@example.com"`)}, "janet@example.com", "Jane", true, false},
+		{"emails win over user name", scimPatchOperation{"replace", "", json.RawMessage(`{"emails":[{"value":"work@example.com","primary":true}],"userName":"janet@example.com"}`)}, "work@example.com", "Jane", true, false},
+		{"remove given name", scimPatchOperation{"remove", "name.givenName", nil}, "jane@example.com", "", true, false},
+		{"remove without path", scimPatchOperation{"remove", "", nil}, "", "", false, true},
+		{"remove active", scimPatchOperation{"remove", "active", nil}, "", "", false, true},
+		{"photos", scimPatchOperation{"add", "photos", json.RawMessage(`[{"value":"https://example.com/me.png"}]`)}, "", "", false, true},
+		{"unknown attribute", scimPatchOperation{"replace", "nickName", json.RawMessage(`"JJ"`)}, "", "", false, true},
+		{"unknown operation", scimPatchOperation{"move", "name.givenName", json.RawMessage(`"Janet"`)}, "", "", false, true},
+		{"wrong type", scimPatchOperation{"replace", "active", json.RawMessage(`"maybe"`)}, "", "", false, true},
+	}
+
+	for _, test := range tests {
+		u := app.toSCIM(data.User{ID: 1, Email: "jane@example.com", FirstName: "Jane", LastName: "Doe"})
+
+		err := u.patch(test.op)
+
+		if (err != nil) != test.expectedError {
+			t.Errorf("%s: expected error to be %t, got %v", test.name, test.expectedError, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if u.email() != test.expectedEmail || u.Name.GivenName != test.expectedFirstName || bool(*u.Active) != test.expectedActive {
+			t.Errorf("%s: expected %s %q active %t, got %s %q active %t", test.name, test.expectedEmail, test.expectedFirstName,
+				test.expectedActive, u.email(), u.Name.GivenName, *u.Active)
+		}
+	}
+}
+
+func Test_applySCIM(t *testing.T) {
+	active, inactive := scimBool(true), scimBool(false)
+	deactivated := time.Now().Add(-time.Hour)
+
+	var tests = []struct {
+		name             string
+		user             data.User
+		input            scimUser
+		expectedEmail    string
+		expectedActive   bool
+		expectedScimType string
+	}{
+		{"user name", data.User{}, scimUser{UserName: "jane@example.com", Name: scimName{"Jane", "Doe", ""}}, "jane@example.com", true, ""},
+		{"primary email", data.User{}, scimUser{UserName: "jdoe", Emails: []scimMultiValue{{Value: "home@example.com"}, {Value: "work@example.com", Primary: true}}, Name: scimName{"Jane", "Doe", ""}}, "work@example.com", true, ""},
+		{"first email", data.User{}, scimUser{UserName: "jdoe", Emails: []scimMultiValue{{Value: "home@example.com"}}, Name: scimName{"Jane", "Doe", ""}}, "home@example.com", true, ""},
+		{"deactivate", data.User{}, scimUser{UserName: "jane@example.com", Name: scimName{"Jane", "Doe", ""}, Active: &inactive}, "jane@example.com", false, ""},
+		{"reactivate", data.User{DeactivatedAt: &deactivated}, scimUser{UserName: "jane@example.com", Name: scimName{"Jane", "Doe", ""}, Active: &active}, "jane@example.com", true, ""},
+		{"active left alone", data.User{DeactivatedAt: &deactivated}, scimUser{UserName: "jane@example.com", Name: scimName{"Jane", "Doe", ""}}, "jane@example.com", false, ""},
+		{"invalid email", data.User{}, scimUser{UserName: "jdoe", Name: scimName{"Jane", "Doe", ""}}, "", false, "invalidValue"},
+		{"missing name", data.User{}, scimUser{UserName: "jane@example.com"}, "", false, "invalidValue"},
+		{"long external id", data.User{}, scimUser{UserName: "jane@example.com", Name: scimName{"Jane", "Doe", ""}, ExternalID: strings.Repeat("a", 256)}, "", false, "invalidValue"},
+	}
+
+	for _, test := range tests {
+		user := test.user
+		err := app.applySCIM(&user, test.input)
+
+		if test.expectedScimType != "" {
+			if e, ok := err.(scimError); !ok || e.ScimType != test.expectedScimType {
+				t.Errorf("%s: expected a %s error, got %v", test.name, test.expectedScimType, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+
+		if user.Email != test.expectedEmail || user.Active() != test.expectedActive {
+			t.Errorf("%s: expected %s active %t, got %s active %t", test.name, test.expectedEmail, test.expectedActive, user.Email, user.Active())
+		}
+	}
+}
+
+func Test_Application_SCIMUsers(t *testing.T) {
+	patch := func(operations string) string {
+		return `{"schemas":["` + scimPatchOpSchema + `"],"Operations":` + operations + `}`
+	}
+
+	var tests = []struct {
+		name               string
+		method             string
+		id                 string
+		query              string
+		body               string
+		handler            http.HandlerFunc
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"list", "GET", "", "", "", app.SCIMListUsers, http.StatusOK, `"totalResults":2`},
+		{"list a page", "GET", "", "?startIndex=2&count=1", "", app.SCIMListUsers, http.StatusOK, `/scim/v2/Users/3"}}],"itemsPerPage":1,"schemas":["` + scimListResponseSchema + `"],"startIndex":2,"totalResults":2`},
+		{"list past the end", "GET", "", "?startIndex=3", "", app.SCIMListUsers, http.StatusOK, `"Resources":[],"itemsPerPage":0`},
+		{"list only the total", "GET", "", "?count=0", "", app.SCIMListUsers, http.StatusOK, `"Resources":[],"itemsPerPage":0,"schemas":["` + scimListResponseSchema + `"],"startIndex":1,"totalResults":2`},
+		{"list filtered in the application", "GET", "", `?filter=name.familyName+eq+"Hopper"`, "", app.SCIMListUsers, http.StatusOK, `"totalResults":1`},
+		{"list filtered", "GET", "", `?filter=userName+eq+"jane@example.com"&startIndex=1&count=10`, "", app.SCIMListUsers, http.StatusOK, scimListResponseSchema},
+		{"list looked up by userName", "GET", "", `?filter=userName+eq+"ADA@example.com"`, "", app.SCIMListUsers, http.StatusOK, `"totalResults":1`},
+		{"list looked up and filtered", "GET", "", `?filter=userName+eq+"ada@example.com"+and+name.familyName+eq+"Hopper"`, "", app.SCIMListUsers, http.StatusOK, `"totalResults":0`},
+		{"list bad filter", "GET", "", `?filter=userName+eq+"a"+or+userName+eq+"b"`, "", app.SCIMListUsers, http.StatusBadRequest, `"scimType":"invalidFilter"`},
+		{"get", "GET", "1", "", "", app.SCIMGetUser, http.StatusOK, `"location":"http://localhost:8080/scim/v2/Users/1"`},
+		{"get bad id", "GET", "one", "", "", app.SCIMGetUser, http.StatusNotFound, `"status":"404"`},
+		{"create", "POST", "", "", `{"schemas":["` + scimUserSchema + `"],"userName":"new@example.com","name":{"givenName":"New","familyName":"User"},"urn:example:extension":{}}`, app.SCIMCreateUser, http.StatusCreated, `"schemas":["` + scimUserSchema + `"]`},
+		{"create duplicate", "POST", "", "", `{"userName":"admin@example.com","name":{"givenName":"A","familyName":"B"}}`, app.SCIMCreateUser, http.StatusConflict, `"scimType":"uniqueness"`},
+		{"create invalid", "POST", "", "", `{"userName":"jdoe","name":{"givenName":"J","familyName":"Doe"}}`, app.SCIMCreateUser, http.StatusBadRequest, `"scimType":"invalidValue"`},
+		{"create not json", "POST", "", "", `userName=jdoe`, app.SCIMCreateUser, http.StatusBadRequest, `"scimType":"invalidSyntax"`},
+		{"replace", "PUT", "1", "", `{"userName":"admin@example.com","name":{"givenName":"Admin","familyName":"User"},"active":true,"password":"secret123"}`, app.SCIMReplaceUser, http.StatusOK, `"givenName":"`},
+		{"replace taken email", "PUT", "2", "", `{"userName":"admin@example.com","name":{"givenName":"A","familyName":"B"}}`, app.SCIMReplaceUser, http.StatusOK, ""},
+		{"patch", "PATCH", "1", "", patch(`[{"op":"replace","path":"userName","value":"me@example.com"},{"op":"replace","path":"name","value":{"givenName":"Me","familyName":"Too"}}]`), app.SCIMPatchUser, http.StatusOK, `"id":"1"`},
+		{"patch no operations", "PATCH", "1", "", patch(`[]`), app.SCIMPatchUser, http.StatusBadRequest, `"scimType":"invalidSyntax"`},
+		{"patch photos", "PATCH", "1", "", patch(`[{"op":"add","path":"photos","value":[]}]`), app.SCIMPatchUser, http.StatusBadRequest, `"scimType":"mutability"`},
+		{"delete", "DELETE", "1", "", "", app.SCIMDeleteUser, http.StatusNoContent, ""},
+		{"delete bad id", "DELETE", "one", "", "", app.SCIMDeleteUser, http.StatusNotFound, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/scim/v2/Users"+test.query, strings.NewReader(test.body))
+		req = addContextAndSessionToRequest(req, app)
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("id", test.id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		test.handler.ServeHTTP(resp, req)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expectedStatusCode, resp.Code, resp.Body.String())
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body containing %s, got %s", test.name, test.expectedBody, resp.Body.String())
+		}
+
+		if resp.Code != http.StatusNoContent && resp.Header().Get("Content-Type") != "application/scim+json" {
+			t.Errorf("%s: expected a SCIM response, got %s", test.name, resp.Header().Get("Content-Type"))
+		}
+
+		if strings.Contains(resp.Body.String(), "password") {
+			t.Errorf("%s: expected the password never to be returned", test.name)
+		}
+	}
+}
+
+func Test_Application_scimAuth(t *testing.T) {
+	accessToken, err := app.JWT.issueAccessToken(1, []string{"users:admin"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name               string
+		authorization      string
+		expectedStatusCode int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"session is not enough", "Basic YWRtaW46c2VjcmV0", http.StatusUnauthorized},
+		{"unknown token", "Bearer ppw_nope", http.StatusUnauthorized},
+		{"expired token", "Bearer ppw_expired-token", http.StatusUnauthorized},
+		{"token without the admin scope", "Bearer ppw_test-token", http.StatusForbidden},
+		{"access token of a user who is not an administrator", "Bearer " + accessToken, http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		req := addContextAndSessionToRequest(httptest.NewRequest(http.MethodGet, "/Users", nil), app)
+		app.Session.Put(req.Context(), "user", *apiAdminUser)
+
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+
+		resp := httptest.NewRecorder()
+		app.scimRoutes().ServeHTTP(resp, req)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expectedStatusCode, resp.Code, resp.Body.String())
+		}
+
+		if !strings.Contains(resp.Body.String(), scimErrorSchema) {
+			t.Errorf("%s: expected a SCIM error, got %s", test.name, resp.Body.String())
+		}
+	}
+}
+
+func Test_Application_SCIMDiscovery(t *testing.T) {
+	var tests = []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+		expectedBody       string
+	}{
+		{"service provider config", "/ServiceProviderConfig", http.StatusOK, `"patch":{"supported":true}`},
+		{"schemas", "/Schemas", http.StatusOK, `"totalResults":1`},
+		{"user schema", "/Schemas/" + scimUserSchema, http.StatusOK, `"name":"userName"`},
+		{"unknown schema", "/Schemas/urn:ietf:params:scim:schemas:core:2.0:Group", http.StatusNotFound, `"status":"404"`},
+		{"resource types", "/ResourceTypes", http.StatusOK, `"endpoint":"/Users"`},
+		{"user resource type", "/ResourceTypes/User", http.StatusOK, `"schema":"` + scimUserSchema + `"`},
+		{"groups are not supported", "/Groups", http.StatusNotFound, scimErrorSchema},
+	}
+
+	for _, test := range tests {
+		resp := httptest.NewRecorder()
+		app.scimRoutes().ServeHTTP(resp, httptest.NewRequest(http.MethodGet, test.url, nil))
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatusCode, resp.Code)
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBody) {
+			t.Errorf("%s: expected body containing %s, got %s", test.name, test.expectedBody, resp.Body.String())
+		}
+	}
+}
@@ -1,7 +1,10 @@
 package web
 
 import (
+	"encoding/gob"
+	"github.com/spartanhooah/profile-picture-web/data"
 	"github.com/spartanhooah/profile-picture-web/db/repository/dbrepo"
+	"log"
 	"os"
 	"testing"
 )
@@ -11,9 +14,45 @@ var app Application
 func TestMain(m *testing.M) {
 	pathToTemplates = "./../../templates"
 
+	gob.Register(data.User{})
+
 	app.Session = GetSession()
 
 	app.DB = &dbrepo.TestDBRepo{}
 
-	os.Exit(m.Run())
+	app.Images = DefaultImageConfig()
+
+	app.Quotas = DefaultQuotaConfig()
+
+	app.JWT = DefaultJWTConfig()
+	key, err := GenerateEdDSAKey("test")
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.JWT.Keys = []SigningKey{key}
+
+	app.Provider = DefaultProviderConfig()
+
+	app.Scanner = NoopScanner{}
+
+	app.DeletedUserRetention = DefaultDeletedUserRetention
+
+	app.Passwords = DefaultPasswordPolicy()
+
+	app.PasswordHasher = data.DefaultPasswordHasher()
+
+	app.AvatarURLs = DefaultAvatarURLConfig()
+	app.AvatarURLs.Key = []byte("avatar test key")
+
+	app.Mailer = LogMailer{}
+
+	quarantinePath = "./testdata/quarantine"
+
+	code := m.Run()
+
+	_ = os.RemoveAll(quarantinePath)
+
+	os.Exit(code)
 }
@@ -0,0 +1,286 @@
+package web
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	stderrors "errors"
+	"github.com/coreos/go-oidc/v3/oidc"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"golang.org/x/oauth2"
+	"log"
+	"net/http"
+	"strings"
+)
+
+var errSSOUnverifiedEmail = stderrors.New("Your identity provider has not verified your email address, so it cannot be used to sign in")
+
+var errSSODeleted = stderrors.New("This account has been deleted")
+
+// OIDCConfig configures signing in with an external OpenID Connect provider.
+type OIDCConfig struct {
+	// Name is shown on the sign in button.
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	// RedirectURL is the address of the callback handler, as registered with the provider.
+	RedirectURL string
+}
+
+// SSO signs users in with an external OpenID Connect provider.
+type SSO struct {
+	Name     string
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+// ssoClaims are the claims we use from an ID token.
+type ssoClaims struct {
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+// names returns the first and last names to give a new user, falling back to their email address.
+func (c ssoClaims) names() (string, string) {
+	firstName, lastName := c.GivenName, c.FamilyName
+
+	if firstName == "" && lastName == "" {
+		firstName, lastName, _ = strings.Cut(strings.TrimSpace(c.Name), " ")
+	}
+
+	if firstName == "" {
+		firstName, _, _ = strings.Cut(c.Email, "@")
+	}
+
+	return firstName, lastName
+}
+
+// NewSSO fetches the provider's discovery document, which tells us its endpoints and where its signing keys are.
+func NewSSO(ctx context.Context, cfg OIDCConfig) (*SSO, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+
+	if err != nil {
+		return nil, err
+	}
+
+	name := cfg.Name
+
+	if name == "" {
+		name = "SSO"
+	}
+
+	return &SSO{
+		Name: name,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+// SSOLogin sends the user to the identity provider. The state, nonce and PKCE verifier are kept in the session so
+// the callback can check the response belongs to this login.
+func (app *Application) SSOLogin(resp http.ResponseWriter, req *http.Request) {
+	if app.SSO == nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	state, err := randomHex(16)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	nonce, err := randomHex(16)
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	verifier := oauth2.GenerateVerifier()
+
+	app.Session.Put(req.Context(), "sso_state", state)
+	app.Session.Put(req.Context(), "sso_nonce", nonce)
+	app.Session.Put(req.Context(), "sso_verifier", verifier)
+
+	authURL := app.SSO.oauth2.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier))
+
+	http.Redirect(resp, req, authURL, http.StatusFound)
+}
+
+// SSOCallback finishes signing in once the identity provider sends the user back.
+func (app *Application) SSOCallback(resp http.ResponseWriter, req *http.Request) {
+	if app.SSO == nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	// each login attempt may only be completed once
+	state := app.Session.PopString(req.Context(), "sso_state")
+	nonce := app.Session.PopString(req.Context(), "sso_nonce")
+	verifier := app.Session.PopString(req.Context(), "sso_verifier")
+
+	query := req.URL.Query()
+
+	if query.Get("error") != "" {
+		log.Println("Identity provider refused sign in:", query.Get("error"), query.Get("error_description"))
+		app.ssoFailed(resp, req, "Your identity provider did not sign you in")
+		return
+	}
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(query.Get("state"))) != 1 {
+		app.ssoFailed(resp, req, "Your sign in has expired; please try again")
+		return
+	}
+
+	token, err := app.SSO.oauth2.Exchange(req.Context(), query.Get("code"), oauth2.VerifierOption(verifier))
+
+	if err != nil {
+		log.Println("Error exchanging authorization code:", err)
+		app.ssoFailed(resp, req, "Could not sign you in with your identity provider")
+		return
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+
+	if !ok {
+		log.Println("Identity provider did not return an ID token")
+		app.ssoFailed(resp, req, "Could not sign you in with your identity provider")
+		return
+	}
+
+	// checks the signature against the provider's published keys, and the issuer, audience and expiry
+	idToken, err := app.SSO.verifier.Verify(req.Context(), rawIDToken)
+
+	if err != nil {
+		log.Println("Invalid ID token:", err)
+		app.ssoFailed(resp, req, "Could not sign you in with your identity provider")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(nonce), []byte(idToken.Nonce)) != 1 {
+		log.Println("ID token nonce does not match")
+		app.ssoFailed(resp, req, "Could not sign you in with your identity provider")
+		return
+	}
+
+	var claims ssoClaims
+
+	if err := idToken.Claims(&claims); err != nil {
+		log.Println("Invalid ID token claims:", err)
+		app.ssoFailed(resp, req, "Could not sign you in with your identity provider")
+		return
+	}
+
+	user, err := app.ssoUser(idToken.Issuer, idToken.Subject, claims)
+
+	if stderrors.Is(err, errSSOUnverifiedEmail) || stderrors.Is(err, errDeactivated) || stderrors.Is(err, errSSODeleted) {
+		app.ssoFailed(resp, req, err.Error())
+		return
+	}
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// prevent fixation attack
+	_ = app.Session.RenewToken(req.Context())
+
+	app.Session.Remove(req.Context(), "impersonator")
+	app.Session.Put(req.Context(), "user", user)
+	app.Session.Put(req.Context(), "flash", "Successfully logged in")
+	http.Redirect(resp, req, app.afterLogin(req), http.StatusSeeOther)
+}
+
+// ssoUser finds the user an identity provider account belongs to. Accounts seen for the first time are linked to
+// the user with the same, verified, email address, or to a new user if there is none.
+func (app *Application) ssoUser(issuer, subject string, claims ssoClaims) (*data.User, error) {
+	identity, err := app.DB.GetUserIdentity(issuer, subject)
+
+	if err == nil {
+		return activeUser(app.DB.GetUser(identity.UserID))
+	}
+
+	if !stderrors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// anyone can claim any address at some providers, so only a verified one may take over an existing account
+	if !claims.EmailVerified || claims.Email == "" {
+		return nil, errSSOUnverifiedEmail
+	}
+
+	userID := 0
+	user, err := app.DB.GetUserByEmail(claims.Email)
+
+	switch {
+	case err == nil:
+		userID = user.ID
+	case stderrors.Is(err, sql.ErrNoRows):
+		userID, err = app.createSSOUser(claims)
+
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	_, err = app.DB.InsertUserIdentity(data.UserIdentity{UserID: userID, Issuer: issuer, Subject: subject})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return activeUser(app.DB.GetUser(userID))
+}
+
+// activeUser passes on the result of looking up a user, turning deactivated users into errDeactivated, and users who
+// have been deleted, whose identity provider accounts are still linked to them, into errSSODeleted.
+func activeUser(user *data.User, err error) (*data.User, error) {
+	if stderrors.Is(err, sql.ErrNoRows) {
+		return nil, errSSODeleted
+	}
+
+	if err == nil && !user.Active() {
+		return nil, errDeactivated
+	}
+
+	return user, err
+}
+
+// createSSOUser creates a user the first time they sign in with an identity provider. They are given a random
+// password nobody knows, so they can only sign in through the provider.
+func (app *Application) createSSOUser(claims ssoClaims) (int, error) {
+	password, err := randomHex(32)
+
+	if err != nil {
+		return 0, err
+	}
+
+	firstName, lastName := claims.names()
+
+	return app.DB.InsertUser(data.User{
+		FirstName: firstName,
+		LastName:  lastName,
+		Email:     claims.Email,
+		Password:  password,
+	})
+}
+
+func (app *Application) ssoFailed(resp http.ResponseWriter, req *http.Request, message string) {
+	app.Session.Put(req.Context(), "error", message)
+	http.Redirect(resp, req, "/", http.StatusSeeOther)
+}
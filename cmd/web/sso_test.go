@@ -0,0 +1,307 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	stderrors "errors"
+	"github.com/golang-jwt/jwt/v5"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const mockClientID = "profile-picture-web"
+
+// mockOIDCProvider is just enough of an OpenID Connect provider to sign users in: discovery, signing keys and a
+// token endpoint which checks the PKCE verifier.
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu sync.Mutex
+	// authorizations maps the codes we have issued to the code challenge and ID token claims they were issued for
+	authorizations map[string]mockAuthorization
+}
+
+type mockAuthorization struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newMockOIDCProvider(t *testing.T) *mockOIDCProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider := &mockOIDCProvider{key: key, authorizations: make(map[string]mockAuthorization)}
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/.well-known/openid-configuration", func(resp http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(resp).Encode(map[string]any{
+			"issuer":                                provider.URL,
+			"authorization_endpoint":                provider.URL + "/authorize",
+			"token_endpoint":                        provider.URL + "/token",
+			"jwks_uri":                              provider.URL + "/keys",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+
+	mux.HandleFunc("/keys", func(resp http.ResponseWriter, req *http.Request) {
+		_ = json.NewEncoder(resp).Encode(map[string]any{
+			"keys": []map[string]string{{
+				"kty": "RSA",
+				"kid": "mock",
+				"alg": "RS256",
+				"use": "sig",
+				"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			}},
+		})
+	})
+
+	mux.HandleFunc("/token", func(resp http.ResponseWriter, req *http.Request) {
+		_ = req.ParseForm()
+
+		provider.mu.Lock()
+		authorization, ok := provider.authorizations[req.PostForm.Get("code")]
+		delete(provider.authorizations, req.PostForm.Get("code"))
+		provider.mu.Unlock()
+
+		sum := sha256.Sum256([]byte(req.PostForm.Get("code_verifier")))
+
+		if !ok || base64.RawURLEncoding.EncodeToString(sum[:]) != authorization.challenge {
+			resp.Header().Set("Content-Type", "application/json")
+			resp.WriteHeader(http.StatusBadRequest)
+			_, _ = resp.Write([]byte(`{"error":"invalid_grant"}`))
+			return
+		}
+
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, authorization.claims)
+		token.Header["kid"] = "mock"
+		idToken, _ := token.SignedString(key)
+
+		resp.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(resp).Encode(map[string]any{
+			"access_token": "mock-access-token",
+			"token_type":   "Bearer",
+			"expires_in":   3600,
+			"id_token":     idToken,
+		})
+	})
+
+	provider.Server = httptest.NewServer(mux)
+	t.Cleanup(provider.Close)
+
+	return provider
+}
+
+// authorize plays the part of the user signing in at the provider: it takes the URL we redirected them to, and
+// returns the code the provider would send them back with. claims are added to, or replace, the ID token's defaults.
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL string, claims jwt.MapClaims) (code, state string) {
+	u, err := url.Parse(authURL)
+
+	if err != nil || !strings.HasPrefix(authURL, p.URL+"/authorize") {
+		t.Fatalf("unexpected authorization URL %s", authURL)
+	}
+
+	query := u.Query()
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("client_id") != mockClientID {
+		t.Fatalf("unexpected authorization request %s", authURL)
+	}
+
+	idClaims := jwt.MapClaims{
+		"iss":   p.URL,
+		"aud":   mockClientID,
+		"sub":   "new-subject",
+		"iat":   time.Now().Unix(),
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"nonce": query.Get("nonce"),
+	}
+
+	for name, value := range claims {
+		idClaims[name] = value
+	}
+
+	code, _ = randomHex(8)
+
+	p.mu.Lock()
+	p.authorizations[code] = mockAuthorization{challenge: query.Get("code_challenge"), claims: idClaims}
+	p.mu.Unlock()
+
+	return code, query.Get("state")
+}
+
+func Test_Application_SSO(t *testing.T) {
+	provider := newMockOIDCProvider(t)
+
+	sso, err := NewSSO(context.Background(), OIDCConfig{
+		Issuer:      provider.URL,
+		ClientID:    mockClientID,
+		RedirectURL: "http://localhost:8080/auth/sso/callback",
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.SSO = sso
+
+	defer func() {
+		app.SSO = nil
+	}()
+
+	verified := jwt.MapClaims{"email": "new@example.com", "email_verified": true, "name": "New User"}
+
+	var tests = []struct {
+		name             string
+		claims           jwt.MapClaims
+		state            string
+		code             string
+		expectedLocation string
+	}{
+		{"linked identity", jwt.MapClaims{"sub": "linked-subject"}, "", "", "/user/profile"},
+		{"linked to a deactivated user", jwt.MapClaims{"sub": "deactivated-subject"}, "", "", "/"},
+		{"linked to a deleted user", jwt.MapClaims{"sub": "deleted-subject"}, "", "", "/"},
+		{"link by verified email", jwt.MapClaims{"email": "admin@example.com", "email_verified": true}, "", "", "/user/profile"},
+		{"just in time", verified, "", "", "/user/profile"},
+		{"unverified email", jwt.MapClaims{"email": "admin@example.com", "email_verified": false}, "", "", "/"},
+		{"wrong state", verified, "forged", "", "/"},
+		{"unknown code", verified, "", "forged", "/"},
+		{"wrong nonce", jwt.MapClaims{"nonce": "replayed", "email": "new@example.com", "email_verified": true}, "", "", "/"},
+		{"wrong audience", jwt.MapClaims{"aud": "another-app", "email": "new@example.com", "email_verified": true}, "", "", "/"},
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com", "email": "new@example.com", "email_verified": true}, "", "", "/"},
+		{"expired", jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix(), "email": "new@example.com", "email_verified": true}, "", "", "/"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/auth/sso/login", nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.SSOLogin).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusFound {
+			t.Fatalf("%s: expected a redirect to the provider, got %d", test.name, resp.Code)
+		}
+
+		code, state := provider.authorize(t, resp.Header().Get("Location"), test.claims)
+
+		if test.state != "" {
+			state = test.state
+		}
+
+		if test.code != "" {
+			code = test.code
+		}
+
+		// the provider sends the user back with the same session
+		callback := httptest.NewRequest(http.MethodGet, "/auth/sso/callback?"+url.Values{"code": {code}, "state": {state}}.Encode(), nil)
+		callback = callback.WithContext(req.Context())
+
+		resp = httptest.NewRecorder()
+		http.HandlerFunc(app.SSOCallback).ServeHTTP(resp, callback)
+
+		if resp.Header().Get("Location") != test.expectedLocation {
+			t.Errorf("%s: expected redirect to %s, got %d to %s", test.name, test.expectedLocation, resp.Code, resp.Header().Get("Location"))
+		}
+
+		signedIn := app.Session.Exists(callback.Context(), "user")
+
+		if signedIn != (test.expectedLocation == "/user/profile") {
+			t.Errorf("%s: expected signed in to be %t", test.name, !signedIn)
+		}
+
+		if app.Session.Exists(callback.Context(), "sso_state") {
+			t.Errorf("%s: expected the login attempt to be used up", test.name)
+		}
+	}
+}
+
+func Test_Application_ssoUser(t *testing.T) {
+	var tests = []struct {
+		name          string
+		subject       string
+		claims        ssoClaims
+		expectedError error
+	}{
+		{"linked", "linked-subject", ssoClaims{}, nil},
+		{"existing email", "new-subject", ssoClaims{Email: "admin@example.com", EmailVerified: true}, nil},
+		{"new user", "new-subject", ssoClaims{Email: "new@example.com", EmailVerified: true, GivenName: "New"}, nil},
+		{"unverified existing email", "new-subject", ssoClaims{Email: "admin@example.com"}, errSSOUnverifiedEmail},
+		{"no email", "new-subject", ssoClaims{EmailVerified: true}, errSSOUnverifiedEmail},
+		{"linked to a deactivated user", "deactivated-subject", ssoClaims{}, errDeactivated},
+		{"linked to a deleted user", "deleted-subject", ssoClaims{}, errSSODeleted},
+	}
+
+	for _, test := range tests {
+		user, err := app.ssoUser("https://idp.example.com", test.subject, test.claims)
+
+		if !stderrors.Is(err, test.expectedError) {
+			t.Errorf("%s: expected error %v, got %v", test.name, test.expectedError, err)
+		}
+
+		if err == nil && user == nil {
+			t.Errorf("%s: expected a user", test.name)
+		}
+	}
+}
+
+func Test_Application_SSO_disabled(t *testing.T) {
+	for _, handler := range []http.HandlerFunc{app.SSOLogin, app.SSOCallback} {
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, httptest.NewRequest(http.MethodGet, "/auth/sso/login", nil))
+
+		if resp.Code != http.StatusNotFound {
+			t.Errorf("expected %d when SSO is not configured, got %d", http.StatusNotFound, resp.Code)
+		}
+	}
+}
+
+func Test_Application_Home_SSO(t *testing.T) {
+	app.SSO = &SSO{Name: "SSO"}
+
+	defer func() {
+		app.SSO = nil
+	}()
+
+	req := addContextAndSessionToRequest(httptest.NewRequest(http.MethodGet, "/", nil), app)
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(app.Home).ServeHTTP(resp, req)
+
+	if !strings.Contains(resp.Body.String(), "Sign in with SSO") {
+		t.Error("expected the home page to offer signing in with SSO")
+	}
+}
+
+func Test_ssoClaims_names(t *testing.T) {
+	var tests = []struct {
+		name              string
+		claims            ssoClaims
+		expectedFirstName string
+		expectedLastName  string
+	}{
+		{"given and family names", ssoClaims{Email: "ada@example.com", GivenName: "Ada", FamilyName: "Lovelace", Name: "Countess"}, "Ada", "Lovelace"},
+		{"full name", ssoClaims{Email: "ada@example.com", Name: " Ada King Lovelace"}, "Ada", "King Lovelace"},
+		{"email only", ssoClaims{Email: "ada@example.com"}, "ada", ""},
+	}
+
+	for _, test := range tests {
+		firstName, lastName := test.claims.names()
+
+		if firstName != test.expectedFirstName || lastName != test.expectedLastName {
+			t.Errorf("%s: expected %q %q, got %q %q", test.name, test.expectedFirstName, test.expectedLastName, firstName, lastName)
+		}
+	}
+}
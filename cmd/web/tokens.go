@@ -0,0 +1,287 @@
+package web
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	stderrors "errors"
+	"fmt"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenPrefix starts every personal access token, so leaked tokens are easy to recognise and search for.
+const tokenPrefix = "ppw_"
+
+// tokenTouchInterval is how often a token's last used time is written to the database while it is in use.
+const tokenTouchInterval = time.Minute
+
+const contextAPICallerKey contextKey = "api_caller"
+
+var errDeactivated = stderrors.New("This account has been deactivated")
+
+type tokenScope struct {
+	Name        string
+	Description string
+	// Permission, if set, is the permission a user needs to grant the scope to a token.
+	Permission string
+}
+
+// tokenScopes are the scopes a personal access token may be granted.
+var tokenScopes = []tokenScope{
+	{"avatar:read", "See profile pictures", ""},
+	{"avatar:write", "Upload and delete profile pictures", ""},
+	{"profile:read", "See your profile", ""},
+	{"profile:write", "Change your name and email address", ""},
+	{"users:admin", "Use your permissions over other users", data.PermissionReadUsers},
+}
+
+type tokenLifetime struct {
+	Label string
+	Days  int
+}
+
+// tokenLifetimes are the expiry periods offered when creating a token; zero days means the token never expires.
+var tokenLifetimes = []tokenLifetime{
+	{"30 days", 30},
+	{"90 days", 90},
+	{"1 year", 365},
+	{"Never", 0},
+}
+
+// newToken returns a new random personal access token.
+func newToken() (string, error) {
+	b := make([]byte, 32)
+
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return tokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashToken returns the hash a token is stored and looked up by. Tokens are long and random, so unlike passwords
+// they do not need a slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// apiCaller is who is making an API request, and the token they are using, if any.
+type apiCaller struct {
+	User data.User
+	// Token is the personal access token the caller used, if they used one.
+	Token *data.PersonalAccessToken
+	// Scopes are those granted to the caller's personal access token or JWT access token.
+	Scopes []string
+	// Unscoped is set for requests made with a session cookie, which are not limited by scopes.
+	Unscoped bool
+}
+
+// can reports whether the caller may do what scope allows.
+func (c apiCaller) can(scope string) bool {
+	return c.Unscoped || slices.Contains(c.Scopes, scope)
+}
+
+func (app *Application) apiCallerFromContext(ctx context.Context) apiCaller {
+	caller, _ := ctx.Value(contextAPICallerKey).(apiCaller)
+
+	return caller
+}
+
+// authenticateToken checks a bearer token, recording its use, and returns the caller it belongs to.
+func (app *Application) authenticateToken(req *http.Request, token string) (apiCaller, error) {
+	if !strings.HasPrefix(token, tokenPrefix) {
+		return apiCaller{}, stderrors.New("not a personal access token")
+	}
+
+	pat, err := app.DB.GetPersonalAccessTokenByHash(hashToken(token))
+
+	if err != nil {
+		return apiCaller{}, err
+	}
+
+	if pat.Expired() {
+		return apiCaller{}, stderrors.New("token has expired")
+	}
+
+	user, err := app.DB.GetUser(pat.UserID)
+
+	if err != nil {
+		return apiCaller{}, err
+	}
+
+	if !user.Active() {
+		return apiCaller{}, errDeactivated
+	}
+
+	if pat.LastUsedAt == nil || time.Since(*pat.LastUsedAt) > tokenTouchInterval {
+		if err := app.DB.TouchPersonalAccessToken(pat.ID, app.ipFromContext(req.Context())); err != nil {
+			log.Println("Could not record token use:", err)
+		}
+	}
+
+	return apiCaller{User: *user, Token: pat, Scopes: pat.Scopes}, nil
+}
+
+// requireScope rejects API requests made with a token which lacks scope.
+func (app *Application) requireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+			if !app.apiCallerFromContext(req.Context()).can(scope) {
+				resp.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+				writeProblem(resp, req, http.StatusForbidden, fmt.Sprintf("This token does not have the %s scope", scope))
+				return
+			}
+
+			next.ServeHTTP(resp, req)
+		})
+	}
+}
+
+// formatTime formats an optional time for display, in templates.
+func formatTime(t *time.Time) string {
+	if t == nil {
+		return "Never"
+	}
+
+	return t.Format("2 Jan 2006 15:04 MST")
+}
+
+// CreatePersonalAccessToken creates a token for the logged in user. The token is shown once, on the profile page,
+// and cannot be recovered afterwards.
+func (app *Application) CreatePersonalAccessToken(resp http.ResponseWriter, req *http.Request) {
+	err := req.ParseForm()
+
+	if err != nil {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user := app.Session.Get(req.Context(), "user").(data.User)
+
+	form := NewForm(req.PostForm)
+	form.Required("name")
+	form.MaxLength("name", 255)
+
+	scopes := form.Data["scope"]
+	form.Check(len(scopes) > 0, "scope", "Choose at least one scope")
+
+	for _, scope := range scopes {
+		form.Check(allowedScope(scope, user), "scope", fmt.Sprintf("You cannot grant the %s scope", scope))
+	}
+
+	days, err := strconv.Atoi(form.Data.Get("lifetime"))
+	form.Check(err == nil && allowedLifetime(days), "lifetime", "Choose when the token expires")
+
+	if !form.Valid() {
+		for _, field := range []string{"name", "scope", "lifetime"} {
+			if message := form.Errors.Get(field); message != "" {
+				app.Session.Put(req.Context(), "error", "Could not create token: "+message)
+				break
+			}
+		}
+
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	token, err := newToken()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	pat := data.PersonalAccessToken{
+		UserID: user.ID,
+		Name:   strings.TrimSpace(form.Data.Get("name")),
+		Scopes: scopes,
+	}
+
+	if days > 0 {
+		expires := time.Now().AddDate(0, 0, days)
+		pat.ExpiresAt = &expires
+	}
+
+	_, err = app.DB.InsertPersonalAccessToken(pat, hashToken(token))
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(req.Context(), "new_token", token)
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
+
+// RevokePersonalAccessToken deletes one of the logged in user's tokens.
+func (app *Application) RevokePersonalAccessToken(resp http.ResponseWriter, req *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(req, "id"))
+
+	if err != nil {
+		http.NotFound(resp, req)
+		return
+	}
+
+	user := app.Session.Get(req.Context(), "user").(data.User)
+
+	err = app.DB.DeletePersonalAccessToken(user.ID, id)
+
+	if stderrors.Is(err, sql.ErrNoRows) {
+		app.Session.Put(req.Context(), "error", "That token does not exist")
+		http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(req.Context(), "flash", "Token revoked")
+	http.Redirect(resp, req, "/user/profile", http.StatusSeeOther)
+}
+
+// grantableScopes returns every scope user could grant a token.
+func grantableScopes(user data.User) []string {
+	var scopes []string
+
+	for _, scope := range tokenScopes {
+		if allowedScope(scope.Name, user) {
+			scopes = append(scopes, scope.Name)
+		}
+	}
+
+	return scopes
+}
+
+func allowedScope(scope string, user data.User) bool {
+	for _, s := range tokenScopes {
+		if s.Name == scope {
+			return s.Permission == "" || user.Can(s.Permission)
+		}
+	}
+
+	return false
+}
+
+func allowedLifetime(days int) bool {
+	for _, lifetime := range tokenLifetimes {
+		if lifetime.Days == days {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,188 @@
+package web
+
+import (
+	"context"
+	"github.com/go-chi/chi/v5"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_newToken(t *testing.T) {
+	first, err := newToken()
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, _ := newToken()
+
+	if !strings.HasPrefix(first, tokenPrefix) || len(first) != len(tokenPrefix)+43 {
+		t.Errorf("unexpected token format %q", first)
+	}
+
+	if first == second {
+		t.Error("expected tokens to be random")
+	}
+
+	if hashToken(first) != hashToken(first) || hashToken(first) == hashToken(second) || len(hashToken(first)) != 64 {
+		t.Error("expected a stable hex encoded SHA-256 hash")
+	}
+}
+
+func Test_Application_API_BearerTokens(t *testing.T) {
+	accessToken, err := app.JWT.issueAccessToken(1, []string{"avatar:read"})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name                 string
+		authorization        string
+		url                  string
+		expectedStatusCode   int
+		expectedAuthenticate string
+		expectedBodyFragment string
+	}{
+		{"scope granted", "Bearer ppw_test-token", "/users/1/profile-picture", http.StatusNotFound, "", "No profile picture"},
+		{"scheme is case insensitive", "bearer ppw_test-token", "/users/1/profile-picture", http.StatusNotFound, "", ""},
+		{"scope missing", "Bearer ppw_test-token", "/users/1", http.StatusForbidden, `error="insufficient_scope", scope="profile:read"`, "profile:read scope"},
+		{"access token scope granted", "Bearer " + accessToken, "/users/1/profile-picture", http.StatusNotFound, "", "No profile picture"},
+		{"access token scope missing", "Bearer " + accessToken, "/users/1", http.StatusForbidden, `error="insufficient_scope", scope="profile:read"`, "profile:read scope"},
+		{"another user", "Bearer ppw_test-token", "/users/2/profile-picture", http.StatusForbidden, "", "Only administrators"},
+		{"expired", "Bearer ppw_expired-token", "/users/1/profile-picture", http.StatusUnauthorized, `error="invalid_token"`, ""},
+		{"unknown", "Bearer ppw_nope", "/users/1/profile-picture", http.StatusUnauthorized, `error="invalid_token"`, ""},
+		{"not a token", "Bearer hello", "/users/1/profile-picture", http.StatusUnauthorized, `error="invalid_token"`, ""},
+		{"basic auth", "Basic YWRtaW46c2VjcmV0", "/users/1/profile-picture", http.StatusUnauthorized, `error="invalid_request"`, ""},
+		{"nothing", "", "/users/1/profile-picture", http.StatusUnauthorized, "Bearer", ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, test.url, nil)
+
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+
+		resp := apiRequest(req, nil)
+
+		if resp.Code != test.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", test.name, test.expectedStatusCode, resp.Code, resp.Body.String())
+		}
+
+		if authenticate := resp.Header().Get("WWW-Authenticate"); !strings.Contains(authenticate, test.expectedAuthenticate) {
+			t.Errorf("%s: expected WWW-Authenticate containing %s, got %s", test.name, test.expectedAuthenticate, authenticate)
+		}
+
+		if !strings.Contains(resp.Body.String(), test.expectedBodyFragment) {
+			t.Errorf("%s: expected body containing %q, got %s", test.name, test.expectedBodyFragment, resp.Body.String())
+		}
+	}
+}
+
+func Test_Application_CreatePersonalAccessToken(t *testing.T) {
+	var tests = []struct {
+		name          string
+		user          data.User
+		postedData    url.Values
+		expectToken   bool
+		expectedError string
+	}{
+		{"valid", data.User{ID: 3}, url.Values{"name": {"backup"}, "scope": {"avatar:read", "avatar:write"}, "lifetime": {"30"}}, true, ""},
+		{"never expires", data.User{ID: 3}, url.Values{"name": {"backup"}, "scope": {"avatar:read"}, "lifetime": {"0"}}, true, ""},
+		{"no name", data.User{ID: 3}, url.Values{"scope": {"avatar:read"}, "lifetime": {"30"}}, false, "cannot be blank"},
+		{"no scopes", data.User{ID: 3}, url.Values{"name": {"backup"}, "lifetime": {"30"}}, false, "at least one scope"},
+		{"unknown scope", data.User{ID: 3}, url.Values{"name": {"backup"}, "scope": {"everything"}, "lifetime": {"30"}}, false, "everything scope"},
+		{"admin scope", data.User{ID: 3}, url.Values{"name": {"backup"}, "scope": {"users:admin"}, "lifetime": {"30"}}, false, "users:admin scope"},
+		{"admin scope as admin", data.User{ID: 1, IsAdmin: 1}, url.Values{"name": {"backup"}, "scope": {"users:admin"}, "lifetime": {"30"}}, true, ""},
+		{"admin scope as auditor", data.User{ID: 3, Roles: []string{"auditor"}, Permissions: []string{"audit:read", "users:read"}}, url.Values{"name": {"backup"}, "scope": {"users:admin"}, "lifetime": {"30"}}, true, ""},
+		{"odd lifetime", data.User{ID: 3}, url.Values{"name": {"backup"}, "scope": {"avatar:read"}, "lifetime": {"7"}}, false, "expires"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/tokens", strings.NewReader(test.postedData.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", test.user)
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.CreatePersonalAccessToken).ServeHTTP(resp, req)
+
+		if resp.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected status %d, got %d", test.name, http.StatusSeeOther, resp.Code)
+		}
+
+		if token := app.Session.GetString(req.Context(), "new_token"); strings.HasPrefix(token, tokenPrefix) != test.expectToken {
+			t.Errorf("%s: expected a token to be %t, got %q", test.name, test.expectToken, token)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
+
+func Test_Application_RevokePersonalAccessToken(t *testing.T) {
+	var tests = []struct {
+		name          string
+		id            string
+		expectedFlash string
+		expectedError string
+	}{
+		{"own token", "1", "Token revoked", ""},
+		{"someone else's token", "2", "", "does not exist"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/user/tokens/"+test.id+"/revoke", nil)
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", data.User{ID: 1})
+
+		routeContext := chi.NewRouteContext()
+		routeContext.URLParams.Add("id", test.id)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, routeContext))
+
+		resp := httptest.NewRecorder()
+		http.HandlerFunc(app.RevokePersonalAccessToken).ServeHTTP(resp, req)
+
+		if flash := app.Session.GetString(req.Context(), "flash"); flash != test.expectedFlash {
+			t.Errorf("%s: expected flash %q, got %q", test.name, test.expectedFlash, flash)
+		}
+
+		if message := app.Session.GetString(req.Context(), "error"); !strings.Contains(message, test.expectedError) {
+			t.Errorf("%s: expected error containing %q, got %q", test.name, test.expectedError, message)
+		}
+	}
+}
+
+func Test_Application_Profile_Tokens(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+	app.Session.Put(req.Context(), "new_token", "ppw_shown-once")
+
+	resp := httptest.NewRecorder()
+	http.HandlerFunc(app.Profile).ServeHTTP(resp, req)
+
+	for _, expected := range []string{"ppw_shown-once", "backup script", "/user/tokens/1/revoke", `value="avatar:write"`} {
+		if !strings.Contains(resp.Body.String(), expected) {
+			t.Errorf("expected profile page to contain %q", expected)
+		}
+	}
+
+	// only administrators are offered the admin scope
+	if strings.Contains(resp.Body.String(), `value="users:admin"`) {
+		t.Error("expected the users:admin scope to be hidden")
+	}
+
+	resp = httptest.NewRecorder()
+	http.HandlerFunc(app.Profile).ServeHTTP(resp, req)
+
+	if strings.Contains(resp.Body.String(), "ppw_shown-once") {
+		t.Error("expected the new token to be shown only once")
+	}
+}
@@ -0,0 +1,793 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"golang.org/x/text/language"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// userExportColumns are the columns of a user export, in order. Imports take the same columns, in any order and
+// leaving out any but email, so an export can be edited and imported again. Users are matched by email address;
+// id, roles and created_at cannot be imported, and are ignored.
+var userExportColumns = []string{
+	"id", "email", "first_name", "last_name", "display_name", "pronouns", "job_title", "bio", "timezone", "locale",
+	"handle", "profile_visibility", "avatar_visibility", "is_admin", "roles", "external_id", "deactivated_at",
+	"created_at",
+}
+
+var userImportIgnoredColumns = []string{"id", "roles", "created_at"}
+
+// The formats users are imported and exported in: CSV with a header row, or JSON Lines, one object per user.
+const (
+	userFormatCSV   = "csv"
+	userFormatJSONL = "jsonl"
+)
+
+// userImportMaxBytes is the largest file that can be imported, and userImportMaxRows the most users in it.
+const (
+	userImportMaxBytes = 5 << 20
+	userImportMaxRows  = 5000
+)
+
+// userFileFormat works out the format of a file from its name, defaulting to CSV.
+func userFileFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".jsonl", ".ndjson", ".json":
+		return userFormatJSONL
+	default:
+		return userFormatCSV
+	}
+}
+
+// UserImportOptions say what an import does besides writing users.
+type UserImportOptions struct {
+	// DryRun checks every user and reports what would happen, without writing anything.
+	DryRun bool
+	// Welcome emails new users a temporary password, and Reset gives existing users a new one and emails it.
+	Welcome bool
+	Reset   bool
+	// ActorID is the administrator importing the file, who cannot deactivate themselves, or zero on the command line.
+	ActorID int
+	// AssignRoles is whether the file may make users administrators, or stop them being.
+	AssignRoles bool
+}
+
+// userImportRow is one user in an imported file.
+type userImportRow struct {
+	// Line is where the user is in the file, counting a CSV file's header.
+	Line int
+	// Form holds the values of the columns the file has, and whatever is wrong with them.
+	Form *Form
+	// Before is the user as they are now, or nil for a new user.
+	Before *data.User
+	// User is the user as the import leaves them. Their Password is set only if they are given a new one.
+	User data.User
+}
+
+// Created reports whether the row is for a new user.
+func (r *userImportRow) Created() bool {
+	return r.Before == nil
+}
+
+// UserImportReport is what an import did, or would do on a dry run.
+type UserImportReport struct {
+	Rows    []*userImportRow
+	Options UserImportOptions
+	// Imported is whether the users were written; nothing is if any row has a problem.
+	Imported bool
+	Created  int
+	Updated  int
+	Failed   int
+}
+
+// readUserImport reads the users in a file of the given format. Problems with the file as a whole are returned as
+// an error; problems with a single user are left for prepareUserImport to find.
+func readUserImport(r io.Reader, format string) ([]*userImportRow, error) {
+	switch format {
+	case userFormatCSV:
+		return readUserImportCSV(r)
+	case userFormatJSONL:
+		return readUserImportJSONL(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q; use csv or jsonl", format)
+	}
+}
+
+func readUserImportCSV(r io.Reader) ([]*userImportRow, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+
+	if err == io.EOF {
+		return nil, stderrors.New("the file is empty")
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// spreadsheets often start CSV files with a byte order mark
+	header[0] = strings.TrimPrefix(header[0], "\ufeff")
+
+	for i, column := range header {
+		column = strings.ToLower(strings.TrimSpace(column))
+
+		if !slices.Contains(userExportColumns, column) {
+			return nil, fmt.Errorf("unknown column %q", column)
+		}
+
+		if slices.Contains(header[:i], column) {
+			return nil, fmt.Errorf("column %q appears twice", column)
+		}
+
+		header[i] = column
+	}
+
+	if !slices.Contains(header, "email") {
+		return nil, stderrors.New("there is no email column")
+	}
+
+	var rows []*userImportRow
+
+	for {
+		record, err := reader.Read()
+
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(rows) == userImportMaxRows {
+			return nil, fmt.Errorf("a file can import at most %d users", userImportMaxRows)
+		}
+
+		values := url.Values{}
+
+		for i, column := range header {
+			if !slices.Contains(userImportIgnoredColumns, column) {
+				values.Set(column, strings.TrimSpace(csvUnescape(record[i])))
+			}
+		}
+
+		line, _ := reader.FieldPos(0)
+		rows = append(rows, &userImportRow{Line: line, Form: NewForm(values)})
+	}
+
+	return rows, nil
+}
+
+func readUserImportJSONL(r io.Reader) ([]*userImportRow, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, userImportMaxBytes)
+
+	var rows []*userImportRow
+
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+
+		if text == "" {
+			continue
+		}
+
+		if len(rows) == userImportMaxRows {
+			return nil, fmt.Errorf("a file can import at most %d users", userImportMaxRows)
+		}
+
+		decoder := json.NewDecoder(strings.NewReader(text))
+		decoder.UseNumber()
+
+		var object map[string]any
+
+		if err := decoder.Decode(&object); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if _, err := decoder.Token(); err != io.EOF {
+			return nil, fmt.Errorf("line %d: expected one JSON object", line)
+		}
+
+		values := url.Values{}
+
+		for key, value := range object {
+			if !slices.Contains(userExportColumns, key) {
+				return nil, fmt.Errorf("line %d: unknown field %q", line, key)
+			}
+
+			if slices.Contains(userImportIgnoredColumns, key) {
+				continue
+			}
+
+			switch v := value.(type) {
+			case nil:
+				values.Set(key, "")
+			case string:
+				values.Set(key, strings.TrimSpace(v))
+			case json.Number:
+				values.Set(key, v.String())
+			case bool:
+				values.Set(key, strconv.FormatBool(v))
+			default:
+				return nil, fmt.Errorf("line %d: %s must be a string, number, boolean or null", line, key)
+			}
+		}
+
+		if _, ok := values["email"]; !ok {
+			values.Set("email", "")
+		}
+
+		rows = append(rows, &userImportRow{Line: line, Form: NewForm(values)})
+	}
+
+	return rows, scanner.Err()
+}
+
+// prepareUserImport checks every row, and works out what the user it creates or updates will look like. Only the
+// columns a row has are changed for existing users; new users get a random password whether or not it is emailed
+// to them, so that no one can sign in as them until they are told it.
+func (app *Application) prepareUserImport(rows []*userImportRow, opts UserImportOptions) error {
+	seen := map[string]int{}
+
+	for _, row := range rows {
+		form := row.Form
+		values := form.Data
+
+		if _, ok := values["handle"]; ok {
+			values.Set("handle", strings.ToLower(values.Get("handle")))
+		}
+
+		form.Required("email")
+		form.IsEmail("email")
+		form.MaxLength("email", 255)
+		form.MaxLength("external_id", 255)
+
+		for field, length := range profileFieldLengths {
+			form.MaxLength(field, length)
+		}
+
+		form.IsTimezone("timezone")
+		form.IsLocale("locale")
+		form.IsHandle("handle")
+
+		switch values.Get("profile_visibility") {
+		case "", data.ProfileVisibilityPublic, data.ProfileVisibilityMembers, data.ProfileVisibilityHidden:
+		default:
+			form.Errors.Add("profile_visibility", "Must be public, members or hidden")
+		}
+
+		switch values.Get("avatar_visibility") {
+		case "", data.AvatarVisibilityPublic, data.AvatarVisibilityMembers, data.AvatarVisibilityPrivate:
+		default:
+			form.Errors.Add("avatar_visibility", "Must be public, members or private")
+		}
+
+		isAdmin := parseFilterBool(form, "is_admin", values.Get("is_admin"))
+		deactivatedAt := parseFilterTime(form, "deactivated_at", values.Get("deactivated_at"), false)
+
+		email := strings.ToLower(values.Get("email"))
+
+		if line, ok := seen[email]; ok && email != "" {
+			form.Errors.Add("email", fmt.Sprintf("This email address is already on line %d", line))
+		} else {
+			seen[email] = row.Line
+		}
+
+		existing, err := app.DB.GetUserByEmail(values.Get("email"))
+
+		switch {
+		case err == nil:
+			row.Before = existing
+			row.User = *existing
+			// the stored hash must not be taken for a new password
+			row.User.Password = ""
+
+			for _, field := range []string{"first_name", "last_name"} {
+				if _, ok := values[field]; ok {
+					form.Required(field)
+				}
+			}
+		case stderrors.Is(err, sql.ErrNoRows):
+			row.User = data.User{ProfileVisibility: data.ProfileVisibilityMembers, AvatarVisibility: data.AvatarVisibilityPublic}
+			form.Required("first_name", "last_name")
+		default:
+			return err
+		}
+
+		if !form.Valid() {
+			continue
+		}
+
+		user := &row.User
+
+		for field, set := range map[string]*string{
+			"email":        &user.Email,
+			"first_name":   &user.FirstName,
+			"last_name":    &user.LastName,
+			"display_name": &user.DisplayName,
+			"pronouns":     &user.Pronouns,
+			"job_title":    &user.JobTitle,
+			"bio":          &user.Bio,
+			"timezone":     &user.Timezone,
+			"handle":       &user.Handle,
+			"external_id":  &user.ExternalID,
+		} {
+			if _, ok := values[field]; ok {
+				*set = values.Get(field)
+			}
+		}
+
+		// store locales the way they are usually written, so en-gb becomes en-GB
+		if _, ok := values["locale"]; ok {
+			user.Locale = ""
+
+			if locale := values.Get("locale"); locale != "" {
+				user.Locale = language.Make(locale).String()
+			}
+		}
+
+		if visibility := values.Get("profile_visibility"); visibility != "" {
+			user.ProfileVisibility = visibility
+		}
+
+		if visibility := values.Get("avatar_visibility"); visibility != "" {
+			user.AvatarVisibility = visibility
+		}
+
+		if isAdmin != nil {
+			user.IsAdmin = 0
+
+			if *isAdmin {
+				user.IsAdmin = 1
+			}
+
+			wasAdmin := row.Before != nil && row.Before.IsAdmin == 1
+			form.Check(opts.AssignRoles || *isAdmin == wasAdmin, "is_admin", "You cannot change who is an administrator")
+		}
+
+		if _, ok := values["deactivated_at"]; ok {
+			switch {
+			case deactivatedAt.IsZero():
+				user.DeactivatedAt = nil
+			case user.DeactivatedAt == nil || !user.DeactivatedAt.Equal(deactivatedAt):
+				user.DeactivatedAt = &deactivatedAt
+			}
+
+			form.Check(user.DeactivatedAt == nil || opts.ActorID == 0 || user.ID != opts.ActorID, "deactivated_at",
+				"You cannot deactivate yourself")
+		}
+
+		if row.Created() || opts.Reset {
+			user.Password, err = randomHex(8)
+
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// importUsers checks the rows and, unless it is a dry run or any row has a problem, creates and updates all of
+// their users at once. Every user written is passed to audit, with the details of its audit event.
+func (app *Application) importUsers(rows []*userImportRow, opts UserImportOptions, audit func(action string, userID int, details any)) (*UserImportReport, error) {
+	err := app.prepareUserImport(rows, opts)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var valid []*userImportRow
+	var users []data.User
+
+	for _, row := range rows {
+		if row.Form.Valid() {
+			valid = append(valid, row)
+			users = append(users, row.User)
+		}
+	}
+
+	// the database is asked even when some rows are invalid, so that its problems, like taken handles, are
+	// reported alongside them
+	dryRun := opts.DryRun || len(valid) < len(rows)
+
+	if len(users) > 0 {
+		results, err := app.DB.ImportUsers(users, dryRun)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, result := range results {
+			if result.Error != "" {
+				valid[i].Form.Errors.Add("", result.Error)
+			}
+		}
+
+		if !dryRun {
+			for i, result := range results {
+				valid[i].User.ID = result.ID
+			}
+		}
+	}
+
+	report := &UserImportReport{Rows: rows, Options: opts}
+
+	for _, row := range rows {
+		switch {
+		case !row.Form.Valid():
+			report.Failed++
+		case row.Created():
+			report.Created++
+		default:
+			report.Updated++
+		}
+	}
+
+	report.Imported = !dryRun && report.Failed == 0
+
+	if !report.Imported {
+		return report, nil
+	}
+
+	for _, row := range rows {
+		if row.Created() {
+			audit(data.AuditUserCreated, row.User.ID, map[string]any{"user": row.User, "source": "import"})
+		} else {
+			audit(data.AuditUserUpdated, row.User.ID, map[string]any{
+				"changes": auditDiff(*row.Before, row.User),
+				"source":  "import",
+			})
+		}
+	}
+
+	return report, nil
+}
+
+// sendUserImportEmails emails the temporary passwords an import gave out, if it was asked to. Emails that cannot
+// be sent are logged, and do not stop the rest.
+func (app *Application) sendUserImportEmails(report *UserImportReport) {
+	signIn := app.Provider.Issuer + "/"
+
+	for _, row := range report.Rows {
+		var msg Message
+
+		switch {
+		case row.Created() && report.Options.Welcome:
+			msg = Message{
+				To:      row.User.Email,
+				Subject: "Your new account",
+				Body: fmt.Sprintf("Hello %s,\n\n"+
+					"An account has been made for you. Sign in at %s with this email address and the temporary "+
+					"password\n\n    %s\n\nthen choose a password of your own.\n",
+					row.User.Name(), signIn, row.User.Password),
+			}
+		case !row.Created() && report.Options.Reset:
+			msg = Message{
+				To:      row.User.Email,
+				Subject: "Your password was reset",
+				Body: fmt.Sprintf("Hello %s,\n\n"+
+					"An administrator reset the password for your account. Sign in at %s with the temporary "+
+					"password\n\n    %s\n\nthen choose a password of your own.\n",
+					row.User.Name(), signIn, row.User.Password),
+			}
+		default:
+			continue
+		}
+
+		if err := app.Mailer.Send(msg); err != nil {
+			log.Println("Could not send import email:", err)
+		}
+	}
+}
+
+// ImportUsersFromFile imports the users in a file from the command line, printing each problem to w. The format is
+// worked out from the file name if it is empty. Imports there are not made by any one user, so their audit events
+// have no actor, and they can change administrators.
+func (app *Application) ImportUsersFromFile(w io.Writer, path, format string, opts UserImportOptions) (*UserImportReport, error) {
+	f, err := os.Open(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = f.Close()
+	}()
+
+	rows, err := readUserImport(io.LimitReader(f, userImportMaxBytes), cmp.Or(format, userFileFormat(path)))
+
+	if err != nil {
+		return nil, err
+	}
+
+	opts.AssignRoles = true
+
+	report, err := app.importUsers(rows, opts, func(action string, userID int, details any) {
+		event := data.AuditEvent{TargetUserID: userID, Action: action}
+		event.Details, _ = json.Marshal(details)
+
+		if _, err := app.DB.InsertAuditEvent(event); err != nil {
+			log.Println("Could not write audit event:", err)
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range report.Rows {
+		for field, messages := range row.Form.Errors {
+			for _, message := range messages {
+				if field == "" {
+					_, _ = fmt.Fprintf(w, "line %d: %s\n", row.Line, message)
+				} else {
+					_, _ = fmt.Fprintf(w, "line %d: %s: %s\n", row.Line, field, message)
+				}
+			}
+		}
+	}
+
+	if report.Imported {
+		app.sendUserImportEmails(report)
+	}
+
+	return report, nil
+}
+
+// AdminImportUsersPage shows the form to import users from a file.
+func (app *Application) AdminImportUsersPage(resp http.ResponseWriter, req *http.Request) {
+	_ = app.Render(resp, req, "admin-import-users.page.gohtml", &TemplateData{
+		Form: NewForm(url.Values{}),
+		Data: map[string]any{},
+	})
+}
+
+// AdminImportUsers imports users from an uploaded file. The file is checked first, and every problem shown against
+// the line it is on; a dry run, or a file with problems, shows what would happen, and a clean dry run can then be
+// confirmed without uploading the file again.
+func (app *Application) AdminImportUsers(resp http.ResponseWriter, req *http.Request) {
+	req.Body = http.MaxBytesReader(resp, req.Body, userImportMaxBytes+1<<20)
+	err := req.ParseMultipartForm(userImportMaxBytes)
+
+	if err != nil && !stderrors.Is(err, http.ErrNotMultipart) {
+		http.Error(resp, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	self, _ := app.Session.Get(req.Context(), "user").(data.User)
+	opts := UserImportOptions{
+		DryRun:      req.PostForm.Get("dry_run") == "on",
+		Welcome:     req.PostForm.Get("welcome") == "on",
+		Reset:       req.PostForm.Get("reset") == "on",
+		ActorID:     self.ID,
+		AssignRoles: self.Can(data.PermissionAssignRoles),
+	}
+
+	form := NewForm(req.PostForm)
+	content := []byte(req.PostForm.Get("content"))
+	format := req.PostForm.Get("format")
+
+	if file, header, err := req.FormFile("file"); err == nil {
+		content, err = io.ReadAll(io.LimitReader(file, userImportMaxBytes+1))
+		_ = file.Close()
+
+		if err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if format == "" {
+			format = userFileFormat(header.Filename)
+		}
+	}
+
+	form.Check(len(content) > 0, "file", "Choose a file to import")
+	form.Check(len(content) <= userImportMaxBytes, "file", fmt.Sprintf("The file cannot be larger than %s", formatBytes(userImportMaxBytes)))
+
+	var rows []*userImportRow
+
+	if form.Valid() {
+		rows, err = readUserImport(bytes.NewReader(content), cmp.Or(format, userFormatCSV))
+
+		if err != nil {
+			form.Errors.Add("file", "The file cannot be read: "+err.Error())
+		}
+	}
+
+	if !form.Valid() {
+		app.Session.Put(req.Context(), "error", "Please correct the errors below")
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+		_ = app.Render(resp, req, "admin-import-users.page.gohtml", &TemplateData{Form: form, Data: map[string]any{}})
+		return
+	}
+
+	report, err := app.importUsers(rows, opts, func(action string, userID int, details any) {
+		_ = app.audit(req, action, userID, details)
+	})
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if report.Imported {
+		runInBackground(func() {
+			app.sendUserImportEmails(report)
+		})
+
+		app.Session.Put(req.Context(), "flash", fmt.Sprintf("Created %d users and updated %d", report.Created, report.Updated))
+		http.Redirect(resp, req, "/admin/users", http.StatusSeeOther)
+		return
+	}
+
+	if report.Failed > 0 {
+		app.Session.Put(req.Context(), "error", fmt.Sprintf("Nothing was imported: %d users have problems", report.Failed))
+		resp.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	_ = app.Render(resp, req, "admin-import-users.page.gohtml", &TemplateData{
+		Form: form,
+		Data: map[string]any{
+			"report":  report,
+			"content": string(content),
+			"format":  cmp.Or(format, userFormatCSV),
+		},
+	})
+}
+
+// csvFormulaPrefixes start values spreadsheets would run as formulas when opening a CSV file.
+const csvFormulaPrefixes = "=+-@\t\r"
+
+// csvEscape stops a value being run as a formula by putting a quote in front, which spreadsheets hide, and
+// csvUnescape takes it off again so that exports can be imported unchanged.
+func csvEscape(value string) string {
+	if value != "" && strings.ContainsRune(csvFormulaPrefixes, rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+func csvUnescape(value string) string {
+	if len(value) > 1 && value[0] == '\'' && strings.ContainsRune(csvFormulaPrefixes, rune(value[1])) {
+		return value[1:]
+	}
+
+	return value
+}
+
+// userExportRecord returns a user's values for each of userExportColumns.
+func userExportRecord(u *data.User) []string {
+	deactivatedAt := ""
+
+	if u.DeactivatedAt != nil {
+		deactivatedAt = u.DeactivatedAt.UTC().Format(time.RFC3339)
+	}
+
+	return []string{
+		strconv.Itoa(u.ID), u.Email, u.FirstName, u.LastName, u.DisplayName, u.Pronouns, u.JobTitle, u.Bio,
+		u.Timezone, u.Locale, u.Handle, u.ProfileVisibility, u.AvatarVisibility, strconv.Itoa(u.IsAdmin),
+		strings.Join(u.Roles, " "), u.ExternalID, deactivatedAt, u.CreatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// writeUserExport writes users as CSV or JSON Lines. In JSON Lines, ids and is_admin are numbers, roles a list,
+// and deactivated_at null for active users.
+func writeUserExport(w io.Writer, format string, users []*data.User) error {
+	switch format {
+	case userFormatCSV:
+		writer := csv.NewWriter(w)
+
+		if err := writer.Write(userExportColumns); err != nil {
+			return err
+		}
+
+		for _, user := range users {
+			record := userExportRecord(user)
+
+			for i := range record {
+				record[i] = csvEscape(record[i])
+			}
+
+			if err := writer.Write(record); err != nil {
+				return err
+			}
+		}
+
+		writer.Flush()
+
+		return writer.Error()
+	case userFormatJSONL:
+		encoder := json.NewEncoder(w)
+
+		for _, user := range users {
+			object := map[string]any{}
+
+			for i, value := range userExportRecord(user) {
+				object[userExportColumns[i]] = value
+			}
+
+			object["id"] = user.ID
+			object["is_admin"] = user.IsAdmin
+			object["roles"] = user.Roles
+
+			if user.Roles == nil {
+				object["roles"] = []string{}
+			}
+
+			if user.DeactivatedAt == nil {
+				object["deactivated_at"] = nil
+			}
+
+			if err := encoder.Encode(object); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	default:
+		return fmt.Errorf("unknown format %q; use csv or jsonl", format)
+	}
+}
+
+// ExportUsers writes every user who has not been deleted, as CSV or JSON Lines.
+func (app *Application) ExportUsers(w io.Writer, format string) error {
+	users, err := app.DB.AllUsers()
+
+	if err != nil {
+		return err
+	}
+
+	return writeUserExport(w, format, users)
+}
+
+// AdminExportUsers downloads every user who has not been deleted, as CSV or, with format=jsonl, JSON Lines. Exports
+// can be edited and imported again.
+func (app *Application) AdminExportUsers(resp http.ResponseWriter, req *http.Request) {
+	format := cmp.Or(req.URL.Query().Get("format"), userFormatCSV)
+
+	if format != userFormatCSV && format != userFormatJSONL {
+		http.Error(resp, "format must be csv or jsonl", http.StatusBadRequest)
+		return
+	}
+
+	users, err := app.DB.AllUsers()
+
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	contentType := "text/csv; charset=utf-8"
+
+	if format == userFormatJSONL {
+		contentType = "application/jsonl; charset=utf-8"
+	}
+
+	resp.Header().Set("Content-Type", contentType)
+	resp.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+
+	if err := writeUserExport(resp, format, users); err != nil {
+		log.Println("Could not export users:", err)
+	}
+}
@@ -0,0 +1,397 @@
+package web
+
+import (
+	"bytes"
+	"github.com/spartanhooah/profile-picture-web/data"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_readUserImport(t *testing.T) {
+	var tests = []struct {
+		name           string
+		format         string
+		content        string
+		expectedError  string
+		expectedRows   int
+		expectedLine   int
+		expectedValues url.Values
+	}{
+		{"csv", userFormatCSV, "\ufeffEmail,First_Name,last_name,id\r\n\"new@example.com\", \"Ada, Countess\",'=Lovelace,7\r\n",
+			"", 1, 2, url.Values{"email": {"new@example.com"}, "first_name": {"Ada, Countess"}, "last_name": {"=Lovelace"}}},
+		{"csv record over two lines", userFormatCSV, "email,bio\na@example.com,x\nb@example.com,\"one\ntwo\"\nc@example.com,y\n",
+			"", 3, 2, url.Values{"email": {"a@example.com"}, "bio": {"x"}}},
+		{"csv unknown column", userFormatCSV, "email,password\na@example.com,secret\n", `unknown column "password"`, 0, 0, nil},
+		{"csv column twice", userFormatCSV, "email,Email\n", `column "email" appears twice`, 0, 0, nil},
+		{"csv without email", userFormatCSV, "first_name\nAda\n", "no email column", 0, 0, nil},
+		{"csv empty", userFormatCSV, "", "empty", 0, 0, nil},
+		{"csv short record", userFormatCSV, "email,first_name\na@example.com\n", "wrong number of fields", 0, 0, nil},
+		{"jsonl", userFormatJSONL, "\n{\"first_name\":\" Ada \",\"is_admin\":1,\"deactivated_at\":null,\"roles\":[\"user\"],\"id\":3}\n",
+			"", 1, 2, url.Values{"email": {""}, "first_name": {"Ada"}, "is_admin": {"1"}, "deactivated_at": {""}}},
+		{"jsonl boolean", userFormatJSONL, `{"email":"a@example.com","is_admin":true}`,
+			"", 1, 1, url.Values{"email": {"a@example.com"}, "is_admin": {"true"}}},
+		{"jsonl unknown field", userFormatJSONL, `{"email":"a@example.com","password":"x"}`, `line 1: unknown field "password"`, 0, 0, nil},
+		{"jsonl list", userFormatJSONL, `{"email":["a@example.com"]}`, "line 1: email must be", 0, 0, nil},
+		{"jsonl two objects on a line", userFormatJSONL, `{"email":"a@example.com"} {}`, "line 1: expected one JSON object", 0, 0, nil},
+		{"jsonl not json", userFormatJSONL, "{}\nemail,first_name\n", "line 2:", 0, 0, nil},
+		{"unknown format", "xlsx", "", `unknown format "xlsx"`, 0, 0, nil},
+	}
+
+	for _, test := range tests {
+		rows, err := readUserImport(strings.NewReader(test.content), test.format)
+
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+				t.Errorf("%s: expected an error containing %q, got %v", test.name, test.expectedError, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		if len(rows) != test.expectedRows {
+			t.Errorf("%s: expected %d rows, got %d", test.name, test.expectedRows, len(rows))
+			continue
+		}
+
+		if rows[0].Line != test.expectedLine {
+			t.Errorf("%s: expected the first row to be on line %d, got %d", test.name, test.expectedLine, rows[0].Line)
+		}
+
+		if got, expected := rows[0].Form.Data.Encode(), test.expectedValues.Encode(); got != expected {
+			t.Errorf("%s: expected values %s, got %s", test.name, expected, got)
+		}
+	}
+}
+
+func Test_readUserImport_lines(t *testing.T) {
+	rows, _ := readUserImport(strings.NewReader("email,bio\na@example.com,x\nb@example.com,\"one\ntwo\"\nc@example.com,y\n"), userFormatCSV)
+
+	for i, expected := range []int{2, 3, 5} {
+		if rows[i].Line != expected {
+			t.Errorf("expected row %d to be on line %d, got %d", i, expected, rows[i].Line)
+		}
+	}
+}
+
+func Test_Application_importUsers(t *testing.T) {
+	header := "email,first_name,last_name,handle,is_admin,deactivated_at,locale\n"
+
+	var tests = []struct {
+		name            string
+		rows            string
+		opts            UserImportOptions
+		expectedErrors  map[int]string
+		expectImported  bool
+		expectedCreated int
+		expectedUpdated int
+		expectedAudit   []string
+	}{
+		{"creates and updates", "new@example.com,Ada,Lovelace,ada-l,,,en-gb\nadmin@example.com,Admin,Person,,1,,\n",
+			UserImportOptions{ActorID: 1}, nil, true, 1, 1, []string{data.AuditUserCreated, data.AuditUserUpdated}},
+		{"dry run", "new@example.com,Ada,Lovelace,,,,\n",
+			UserImportOptions{DryRun: true, ActorID: 1}, nil, false, 1, 0, nil},
+		{"invalid values", "not an email,Ada,Lovelace,A!,maybe,soon,xx-notalocale-!\n",
+			UserImportOptions{ActorID: 1}, map[int]string{2: "Invalid email address"}, false, 0, 0, nil},
+		{"new user without a name", "new@example.com,,,,,,\n",
+			UserImportOptions{ActorID: 1}, map[int]string{2: "cannot be blank"}, false, 0, 0, nil},
+		{"one bad row stops the rest", "new@example.com,Ada,Lovelace,,,,\nother@example.com,Grace,,,,,\n",
+			UserImportOptions{ActorID: 1}, map[int]string{3: "cannot be blank"}, false, 1, 0, nil},
+		{"same email twice", "new@example.com,Ada,Lovelace,,,,\nNEW@example.com,Ada,Lovelace,,,,\n",
+			UserImportOptions{ActorID: 1}, map[int]string{3: "already on line 2"}, false, 1, 0, nil},
+		{"handle taken", "new@example.com,Ada,Lovelace,taken,,,\n",
+			UserImportOptions{ActorID: 1}, map[int]string{2: "Someone else has that handle"}, false, 0, 0, nil},
+		{"making an administrator without roles:assign", "new@example.com,Ada,Lovelace,,true,,\n",
+			UserImportOptions{ActorID: 1}, map[int]string{2: "cannot change who is an administrator"}, false, 0, 0, nil},
+		{"making an administrator", "new@example.com,Ada,Lovelace,,true,,\n",
+			UserImportOptions{ActorID: 1, AssignRoles: true}, nil, true, 1, 0, []string{data.AuditUserCreated}},
+		{"deactivating yourself", "admin@example.com,Admin,User,,,2024-05-01,\n",
+			UserImportOptions{ActorID: 1}, map[int]string{2: "cannot deactivate yourself"}, false, 0, 0, nil},
+		{"deactivating from the command line", "admin@example.com,Admin,User,,,2024-05-01T10:00:00+02:00,\n",
+			UserImportOptions{}, nil, true, 0, 1, []string{data.AuditUserUpdated}},
+	}
+
+	for _, test := range tests {
+		rows, err := readUserImport(strings.NewReader(header+test.rows), userFormatCSV)
+
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		var audited []string
+
+		report, err := app.importUsers(rows, test.opts, func(action string, userID int, details any) {
+			audited = append(audited, action)
+		})
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+
+		for _, row := range report.Rows {
+			var problems []string
+
+			for _, messages := range row.Form.Errors {
+				problems = append(problems, messages...)
+			}
+
+			expected := test.expectedErrors[row.Line]
+
+			if expected == "" && len(problems) > 0 {
+				t.Errorf("%s: expected line %d to be fine, got %v", test.name, row.Line, problems)
+			}
+
+			if expected != "" && !strings.Contains(strings.Join(problems, "; "), expected) {
+				t.Errorf("%s: expected line %d to have a problem containing %q, got %v", test.name, row.Line, expected, problems)
+			}
+		}
+
+		if report.Imported != test.expectImported || report.Created != test.expectedCreated || report.Updated != test.expectedUpdated {
+			t.Errorf("%s: expected imported %t with %d created and %d updated, got %t with %d and %d", test.name,
+				test.expectImported, test.expectedCreated, test.expectedUpdated, report.Imported, report.Created, report.Updated)
+		}
+
+		if strings.Join(audited, ",") != strings.Join(test.expectedAudit, ",") {
+			t.Errorf("%s: expected audit events %v, got %v", test.name, test.expectedAudit, audited)
+		}
+	}
+}
+
+func Test_Application_importUsers_changes(t *testing.T) {
+	rows, _ := readUserImport(strings.NewReader("email,job_title,locale,handle,deactivated_at\n"+
+		"admin@example.com,Analyst,en-gb,Admin,2024-05-01T10:00:00+02:00\n"+
+		"new@example.com,,,,\n"), userFormatCSV)
+	rows[1].Form.Data.Set("first_name", "Ada")
+	rows[1].Form.Data.Set("last_name", "Lovelace")
+
+	report, err := app.importUsers(rows, UserImportOptions{}, func(string, int, any) {})
+
+	if err != nil || !report.Imported {
+		t.Fatalf("expected the users to be imported, got %v", err)
+	}
+
+	updated := report.Rows[0].User
+
+	if updated.FirstName != "Admin" || updated.JobTitle != "Analyst" || updated.Locale != "en-GB" || updated.Handle != "admin" {
+		t.Errorf("expected only the columns in the file to change, got %+v", updated)
+	}
+
+	if updated.DeactivatedAt == nil || !updated.DeactivatedAt.Equal(time.Date(2024, 5, 1, 8, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the user to be deactivated at 08:00 UTC, got %v", updated.DeactivatedAt)
+	}
+
+	if updated.Password != "" {
+		t.Error("expected an existing user to keep their password")
+	}
+
+	created := report.Rows[1].User
+
+	if created.ID != 101 || created.Password == "" || created.ProfileVisibility != data.ProfileVisibilityMembers {
+		t.Errorf("expected a new user with an id, a random password and the default visibility, got %+v", created)
+	}
+}
+
+func Test_Application_AdminImportUsers(t *testing.T) {
+	background := runInBackground
+	runInBackground = func(task func()) { task() }
+	defer func() { runInBackground = background }()
+
+	admin := data.User{ID: 1, IsAdmin: 1}
+
+	var tests = []struct {
+		name             string
+		form             url.Values
+		expectedStatus   int
+		expectedBody     []string
+		expectedEmails   []string
+		expectedLocation string
+	}{
+		{"nothing uploaded", url.Values{"dry_run": {"on"}}, http.StatusUnprocessableEntity,
+			[]string{"Choose a file to import"}, nil, ""},
+		{"unreadable", url.Values{"content": {"email,password\n"}}, http.StatusUnprocessableEntity,
+			[]string{"The file cannot be read", "unknown column"}, nil, ""},
+		{"dry run", url.Values{"content": {"email,first_name,last_name\nnew@example.com,Ada,Lovelace\n"}, "dry_run": {"on"}, "welcome": {"on"}},
+			http.StatusOK, []string{"Dry run: 1 to create, 0 to update", "new@example.com", "Import these users", `name="welcome" value="on"`}, nil, ""},
+		{"problems", url.Values{"content": {"email,first_name,last_name\nnew@example.com,Ada,\n"}, "dry_run": {"on"}},
+			http.StatusUnprocessableEntity, []string{"1 with problems", "last_name: This field cannot be blank"}, nil, ""},
+		{"import", url.Values{"content": {"email,first_name,last_name\nnew@example.com,Ada,Lovelace\nadmin@example.com,Admin,User\n"}, "welcome": {"on"}, "reset": {"on"}},
+			http.StatusSeeOther, nil, []string{"Your new account", "Your password was reset"}, "/admin/users"},
+		{"import without emails", url.Values{"content": {`{"email":"new@example.com","first_name":"Ada","last_name":"Lovelace"}`}, "format": {"jsonl"}},
+			http.StatusSeeOther, nil, nil, "/admin/users"},
+	}
+
+	for _, test := range tests {
+		mailer := &testMailer{}
+		app.Mailer = mailer
+
+		_, resp := adminRequest(http.MethodPost, "/admin/users/import", "", test.form, admin, app.AdminImportUsers)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+			continue
+		}
+
+		if location := resp.Header().Get("Location"); location != test.expectedLocation {
+			t.Errorf("%s: expected to be sent to %q, got %q", test.name, test.expectedLocation, location)
+		}
+
+		for _, expected := range test.expectedBody {
+			if !strings.Contains(resp.Body.String(), expected) {
+				t.Errorf("%s: expected the page to contain %q", test.name, expected)
+			}
+		}
+
+		var subjects []string
+
+		for _, msg := range mailer.sent {
+			subjects = append(subjects, msg.Subject)
+
+			if !strings.Contains(msg.Body, "temporary password") {
+				t.Errorf("%s: expected the email to give a temporary password, got %q", test.name, msg.Body)
+			}
+		}
+
+		if strings.Join(subjects, ",") != strings.Join(test.expectedEmails, ",") {
+			t.Errorf("%s: expected emails %v, got %v", test.name, test.expectedEmails, subjects)
+		}
+	}
+
+	app.Mailer = LogMailer{}
+}
+
+func Test_Application_ImportUsersFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.jsonl")
+	content := `{"email":"admin@example.com","is_admin":0}` + "\n" + `{"email":"new@example.com","first_name":"Ada"}` + "\n"
+
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var problems bytes.Buffer
+	report, err := app.ImportUsersFromFile(&problems, path, "", UserImportOptions{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Imported || report.Failed != 1 {
+		t.Errorf("expected one user with problems and nothing imported, got %+v", report)
+	}
+
+	if problems.String() != "line 2: last_name: This field cannot be blank\n" {
+		t.Errorf("expected the problem to be printed, got %q", problems.String())
+	}
+
+	if _, err := app.ImportUsersFromFile(&problems, filepath.Join(t.TempDir(), "missing.csv"), "", UserImportOptions{}); err == nil {
+		t.Error("expected an error for a file that does not exist")
+	}
+}
+
+func Test_writeUserExport(t *testing.T) {
+	deactivatedAt := time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	users := []*data.User{
+		{ID: 1, Email: "admin@example.com", FirstName: "Admin", LastName: "User", IsAdmin: 1,
+			Roles: []string{data.RoleUser, data.RoleAdmin}, CreatedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{ID: 2, Email: "ada@example.com", FirstName: "Ada", LastName: "=HYPERLINK(\"x\")", Bio: "Line one\nline two",
+			Handle: "ada", DeactivatedAt: &deactivatedAt},
+	}
+
+	var csvOut bytes.Buffer
+
+	if err := writeUserExport(&csvOut, userFormatCSV, users); err != nil {
+		t.Fatal(err)
+	}
+
+	exported := csvOut.String()
+
+	for _, expected := range []string{
+		strings.Join(userExportColumns, ",") + "\n",
+		"1,admin@example.com,Admin,User,,,,,,,,,,1,user admin,,,2024-01-02T03:04:05Z\n",
+		`"'=HYPERLINK(""x"")"`,
+	} {
+		if !strings.Contains(exported, expected) {
+			t.Errorf("expected the CSV export to contain %q, got %q", expected, exported)
+		}
+	}
+
+	rows, err := readUserImport(&csvOut, userFormatCSV)
+
+	if err != nil || len(rows) != 2 {
+		t.Fatalf("expected the CSV export to import again, got %v", err)
+	}
+
+	if values := rows[1].Form.Data; values.Get("last_name") != users[1].LastName || values.Get("bio") != users[1].Bio ||
+		values.Get("deactivated_at") != "2024-05-01T10:00:00Z" || values.Has("id") {
+		t.Errorf("expected the exported values back, got %v", values)
+	}
+
+	var jsonOut bytes.Buffer
+
+	if err := writeUserExport(&jsonOut, userFormatJSONL, users); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(jsonOut.String()), "\n")
+
+	if len(lines) != 2 {
+		t.Fatalf("expected a line per user, got %q", jsonOut.String())
+	}
+
+	for _, expected := range []string{`"id":1,`, `"is_admin":1,`, `"roles":["user","admin"]`, `"deactivated_at":null`} {
+		if !strings.Contains(lines[0], expected) {
+			t.Errorf("expected %s in %s", expected, lines[0])
+		}
+	}
+
+	if !strings.Contains(lines[1], `"roles":[]`) || !strings.Contains(lines[1], `"deactivated_at":"2024-05-01T10:00:00Z"`) {
+		t.Errorf("expected no roles and the time the user was deactivated, got %s", lines[1])
+	}
+
+	if _, err := readUserImport(strings.NewReader(jsonOut.String()), userFormatJSONL); err != nil {
+		t.Errorf("expected the JSON Lines export to import again, got %v", err)
+	}
+
+	if err := writeUserExport(&jsonOut, "xlsx", users); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func Test_Application_AdminExportUsers(t *testing.T) {
+	var tests = []struct {
+		name                string
+		target              string
+		expectedStatus      int
+		expectedType        string
+		expectedDisposition string
+	}{
+		{"csv", "/admin/users/export", http.StatusOK, "text/csv; charset=utf-8", `attachment; filename="users.csv"`},
+		{"jsonl", "/admin/users/export?format=jsonl", http.StatusOK, "application/jsonl; charset=utf-8", `attachment; filename="users.jsonl"`},
+		{"unknown format", "/admin/users/export?format=xlsx", http.StatusBadRequest, "text/plain; charset=utf-8", ""},
+	}
+
+	for _, test := range tests {
+		_, resp := adminRequest(http.MethodGet, test.target, "", nil, data.User{ID: 1, IsAdmin: 1}, app.AdminExportUsers)
+
+		if resp.Code != test.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", test.name, test.expectedStatus, resp.Code)
+		}
+
+		if contentType := resp.Header().Get("Content-Type"); contentType != test.expectedType {
+			t.Errorf("%s: expected Content-Type %q, got %q", test.name, test.expectedType, contentType)
+		}
+
+		if disposition := resp.Header().Get("Content-Disposition"); disposition != test.expectedDisposition {
+			t.Errorf("%s: expected Content-Disposition %q, got %q", test.name, test.expectedDisposition, disposition)
+		}
+	}
+}
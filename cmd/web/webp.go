@@ -0,0 +1,22 @@
+//go:build webp
+
+package web
+
+import (
+	chaiwebp "github.com/chai2010/webp"
+	"image"
+	"io"
+)
+
+// webpLossless reports whether avatar variants are encoded as lossless WebP. With the webp build tag they are lossy,
+// which needs cgo and libwebp, so WebP can be served in place of JPEG too.
+const webpLossless = false
+
+// encodeWebP writes img as a lossy WebP at the given quality.
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	if quality <= 0 {
+		quality = chaiwebp.DefaulQuality
+	}
+
+	return chaiwebp.Encode(w, img, &chaiwebp.Options{Quality: float32(quality)})
+}
@@ -0,0 +1,19 @@
+//go:build !webp
+
+package web
+
+import (
+	"github.com/HugoSmits86/nativewebp"
+	"image"
+	"io"
+)
+
+// webpLossless reports whether avatar variants are encoded as lossless WebP. Without the webp build tag they are,
+// by an encoder that needs no cgo, so WebP is only served in place of PNG: lossless WebP is smaller than PNG, but not
+// than a lossy JPEG. With the tag, libwebp encodes lossy WebP for every source.
+const webpLossless = true
+
+// encodeWebP writes img as a lossless WebP. quality does not apply to lossless encoding.
+func encodeWebP(w io.Writer, img image.Image, quality int) error {
+	return nativewebp.Encode(w, img, nil)
+}
@@ -0,0 +1,155 @@
+package data
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditImpersonationStarted = "impersonation.start"
+	AuditImpersonationStopped = "impersonation.stop"
+	AuditUserCreated          = "user.create"
+	AuditUserUpdated          = "user.update"
+	AuditUserDeleted          = "user.delete"
+	AuditUserRestored         = "user.restore"
+	AuditUserPurged           = "user.purge"
+	AuditPasswordReset        = "user.password_reset"
+	AuditPasswordChanged      = "user.password_change"
+	AuditRolesChanged         = "user.roles"
+	AuditQuotaChanged         = "user.quota"
+	AuditImageUploaded        = "image.upload"
+	AuditImageRemoved         = "image.remove"
+	AuditDataExported         = "user.export"
+	AuditUserErased           = "user.erase"
+)
+
+// AuditActions lists every action, in the order the audit log viewer offers them.
+var AuditActions = []string{
+	AuditUserCreated,
+	AuditUserUpdated,
+	AuditUserDeleted,
+	AuditUserRestored,
+	AuditUserPurged,
+	AuditUserErased,
+	AuditDataExported,
+	AuditPasswordReset,
+	AuditPasswordChanged,
+	AuditRolesChanged,
+	AuditQuotaChanged,
+	AuditImageUploaded,
+	AuditImageRemoved,
+	AuditImpersonationStarted,
+	AuditImpersonationStopped,
+}
+
+// AuditEvent records that one user, the actor, did something to another, the target. Either may be zero: for
+// example when a user is acted on by the system, or when the target has since been deleted.
+//
+// Events are chained together: each holds the hash of the one before it, and its own hash covers that along with
+// everything recorded about the event, so changing or removing an event breaks the chain from there on. Since
+// version 2, the personal data in an event is hashed separately, so that it can be anonymized when a user is erased
+// without breaking the chain.
+type AuditEvent struct {
+	ID           int             `json:"id"`
+	ActorID      int             `json:"actor_id,omitempty"`
+	TargetUserID int             `json:"target_user_id,omitempty"`
+	Action       string          `json:"action"`
+	IP           string          `json:"ip"`
+	UserAgent    string          `json:"user_agent"`
+	Details      json.RawMessage `json:"details,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+	// DetailsHash is the hash of Details in canonical form; the chain covers it rather than Details themselves.
+	DetailsHash string `json:"details_hash"`
+	// PersonalHash covers the actor, target, IP address, user agent and DetailsHash, for version 2 events.
+	PersonalHash string     `json:"personal_hash,omitempty"`
+	HashVersion  int        `json:"hash_version"`
+	PrevHash     string     `json:"prev_hash"`
+	Hash         string     `json:"hash"`
+	AnonymizedAt *time.Time `json:"anonymized_at,omitempty"`
+	// ActorEmail and TargetEmail are the users' current email addresses, if they still exist. They are not hashed.
+	ActorEmail  string `json:"actor_email,omitempty"`
+	TargetEmail string `json:"target_email,omitempty"`
+}
+
+// AuditFilter narrows down the audit events to list. Zero values match everything.
+type AuditFilter struct {
+	ActorID      int
+	TargetUserID int
+	Action       string
+	From         time.Time
+	To           time.Time
+	// Ascending lists the oldest events first, rather than the newest. Cursor is the id of the last event on the
+	// previous page, or zero for the first page.
+	Ascending bool
+	Cursor    int
+	Limit     int
+}
+
+// CanonicalJSON rewrites a JSON document with its object keys sorted and no insignificant whitespace, so that it
+// hashes the same however it was formatted, including after a round trip through a jsonb column.
+func CanonicalJSON(raw []byte) ([]byte, error) {
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return []byte("{}"), nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var v any
+
+	err := decoder.Decode(&v)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(v)
+}
+
+// HashDetails returns the hash of the canonical form of the event's details.
+func (e *AuditEvent) HashDetails() (string, error) {
+	canonical, err := CanonicalJSON(e.Details)
+
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// AuditHashVersion is the way new events are hashed.
+const AuditHashVersion = 2
+
+// HashPersonal returns the hash of the personal data in the event: who did it, to whom, from where, and the hash
+// of its details.
+func (e *AuditEvent) HashPersonal() string {
+	return hashFields(e.ActorID, e.TargetUserID, e.IP, e.UserAgent, e.DetailsHash)
+}
+
+// ComputeHash returns what the event's hash should be, given the hash of the event before it in PrevHash, of its
+// details in DetailsHash and, from version 2, of its personal data in PersonalHash. The id is left out, as it is
+// not known until the event has been saved.
+func (e *AuditEvent) ComputeHash() string {
+	createdAt := e.CreatedAt.UTC().Format(time.RFC3339Nano)
+
+	if e.HashVersion < 2 {
+		return hashFields(e.PrevHash, e.ActorID, e.TargetUserID, e.Action, e.IP, e.UserAgent, e.DetailsHash, createdAt)
+	}
+
+	return hashFields(e.PrevHash, e.HashVersion, e.Action, createdAt, e.PersonalHash)
+}
+
+// hashFields returns the SHA-256 of the fields encoded as a JSON array, so that no two lists of fields can run
+// together into the same input.
+func hashFields(fields ...any) string {
+	encoded, _ := json.Marshal(fields)
+	sum := sha256.Sum256(encoded)
+
+	return hex.EncodeToString(sum[:])
+}
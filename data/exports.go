@@ -0,0 +1,27 @@
+package data
+
+import "time"
+
+// The states a data export goes through.
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+)
+
+// DataExport is a ZIP file of everything we hold about a user, built in the background when they ask for it and
+// downloadable until it expires. Only a hash of the token in its download link is stored.
+type DataExport struct {
+	ID          int        `json:"id"`
+	UserID      int        `json:"user_id"`
+	FileName    string     `json:"-"`
+	Status      string     `json:"status"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+}
+
+// Expired reports whether the export may no longer be downloaded.
+func (e DataExport) Expired() bool {
+	return !time.Now().Before(e.ExpiresAt)
+}
@@ -0,0 +1,40 @@
+package data
+
+import "time"
+
+// OAuthClient is an application allowed to sign users in through our OpenID Connect provider.
+type OAuthClient struct {
+	ID           int      `json:"id"`
+	ClientID     string   `json:"client_id"`
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	// SecretHash is a hash of the client secret, which is only shown once, when the client is registered.
+	SecretHash string    `json:"-"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// AllowsRedirect reports whether uri is exactly one of the client's registered redirect URIs.
+func (c OAuthClient) AllowsRedirect(uri string) bool {
+	for _, allowed := range c.RedirectURIs {
+		if allowed == uri {
+			return true
+		}
+	}
+
+	return false
+}
+
+// AuthorizationCode is handed to a client when a user signs in, for the client to exchange for tokens. ClientID is
+// the id of the OAuthClient it was issued to. Only a hash of the code itself is ever stored.
+type AuthorizationCode struct {
+	ID            int
+	ClientID      int
+	UserID        int
+	RedirectURI   string
+	Scope         string
+	Nonce         string
+	CodeChallenge string
+	ExpiresAt     time.Time
+	UsedAt        *time.Time
+	CreatedAt     time.Time
+}
@@ -0,0 +1,227 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+// The algorithms passwords can be hashed with.
+const (
+	PasswordHashArgon2id = "argon2id"
+	PasswordHashBcrypt   = "bcrypt"
+)
+
+// ErrUnknownPasswordHash is returned for a stored hash that was made by none of the supported algorithms.
+var ErrUnknownPasswordHash = errors.New("unknown password hash format")
+
+// Argon2Params are the cost parameters of Argon2id. Memory is in KiB.
+type Argon2Params struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordHasher hashes new passwords with the preferred algorithm and cost. Argon2id hashes are stored in the PHC
+// string format, $argon2id$v=19$m=65536,t=3,p=4$salt$hash, and bcrypt hashes in their usual $2a$ form, so a stored
+// hash carries everything needed to check a password against it whatever the current settings are.
+type PasswordHasher struct {
+	// Algorithm is PasswordHashArgon2id or PasswordHashBcrypt.
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+}
+
+// DefaultPasswordHasher uses Argon2id with the parameters RFC 9106 recommends when memory is constrained.
+func DefaultPasswordHasher() PasswordHasher {
+	return PasswordHasher{
+		Algorithm:  PasswordHashArgon2id,
+		BcryptCost: 12,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 4,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+	}
+}
+
+// withDefaults lets the zero PasswordHasher be used.
+func (h PasswordHasher) withDefaults() PasswordHasher {
+	if h.Algorithm == "" {
+		return DefaultPasswordHasher()
+	}
+
+	return h
+}
+
+// MaxPasswordBytes is the longest password, in bytes, that can be hashed: bcrypt looks at no more than the first 72.
+// It is zero when there is no limit.
+func (h PasswordHasher) MaxPasswordBytes() int {
+	if h.withDefaults().Algorithm == PasswordHashBcrypt {
+		return 72
+	}
+
+	return 0
+}
+
+// Validate reports settings that passwords cannot be hashed with.
+func (h PasswordHasher) Validate() error {
+	switch h.Algorithm {
+	case PasswordHashArgon2id:
+		if h.Argon2.Memory < 8*uint32(h.Argon2.Parallelism) || h.Argon2.Iterations < 1 || h.Argon2.Parallelism < 1 {
+			return errors.New("argon2id needs at least one iteration and thread, and 8 KiB of memory for each thread")
+		}
+
+		if h.Argon2.SaltLength < 8 || h.Argon2.KeyLength < 16 {
+			return errors.New("argon2id needs a salt of at least 8 bytes and a key of at least 16")
+		}
+	case PasswordHashBcrypt:
+		if h.BcryptCost < bcrypt.MinCost || h.BcryptCost > bcrypt.MaxCost {
+			return fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+	default:
+		return fmt.Errorf("unknown password hash algorithm %q; use %s or %s", h.Algorithm, PasswordHashArgon2id,
+			PasswordHashBcrypt)
+	}
+
+	return nil
+}
+
+// Hash hashes a password with the preferred algorithm, returning the encoded hash to store.
+func (h PasswordHasher) Hash(password string) (string, error) {
+	h = h.withDefaults()
+
+	if err := h.Validate(); err != nil {
+		return "", err
+	}
+
+	if h.Algorithm == PasswordHashBcrypt {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), h.BcryptCost)
+
+		return string(hash), err
+	}
+
+	salt := make([]byte, h.Argon2.SaltLength)
+
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := h.Argon2
+	key := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+// NeedsRehash reports whether a stored hash was made with another algorithm, or at a lower cost, than the preferred
+// one, so it should be replaced the next time the password is known.
+func (h PasswordHasher) NeedsRehash(encoded string) bool {
+	h = h.withDefaults()
+
+	switch {
+	case isBcryptHash(encoded):
+		if h.Algorithm != PasswordHashBcrypt {
+			return true
+		}
+
+		cost, err := bcrypt.Cost([]byte(encoded))
+
+		return err == nil && cost < h.BcryptCost
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		if h.Algorithm != PasswordHashArgon2id {
+			return true
+		}
+
+		version, p, _, key, err := decodeArgon2id(encoded)
+
+		if err != nil {
+			return false
+		}
+
+		return version != argon2.Version || p.Memory < h.Argon2.Memory || p.Iterations < h.Argon2.Iterations ||
+			uint32(len(key)) < h.Argon2.KeyLength
+	}
+
+	// there is nothing a password could be checked against
+	return false
+}
+
+// VerifyPassword checks a password against a stored hash made by either algorithm, with whatever cost it was made.
+func VerifyPassword(encoded, password string) (bool, error) {
+	switch {
+	case isBcryptHash(encoded):
+		err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+
+		return err == nil, err
+	case strings.HasPrefix(encoded, "$argon2id$"):
+		version, p, salt, key, err := decodeArgon2id(encoded)
+
+		if err != nil {
+			return false, err
+		}
+
+		if version != argon2.Version {
+			return false, fmt.Errorf("unsupported argon2id version %d", version)
+		}
+
+		other := argon2.IDKey([]byte(password), salt, p.Iterations, p.Memory, p.Parallelism, uint32(len(key)))
+
+		return subtle.ConstantTimeCompare(key, other) == 1, nil
+	}
+
+	return false, ErrUnknownPasswordHash
+}
+
+func isBcryptHash(encoded string) bool {
+	return strings.HasPrefix(encoded, "$2a$") || strings.HasPrefix(encoded, "$2b$") || strings.HasPrefix(encoded, "$2y$")
+}
+
+// decodeArgon2id splits an Argon2id hash in the PHC string format into its parts.
+func decodeArgon2id(encoded string) (version int, p Argon2Params, salt, key []byte, err error) {
+	parts := strings.Split(encoded, "$")
+
+	if len(parts) != 6 {
+		return 0, p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	if _, err = fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return 0, p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism)
+
+	if err != nil || p.Iterations < 1 || p.Parallelism < 1 {
+		return 0, p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+
+	if err != nil {
+		return 0, p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	key, err = base64.RawStdEncoding.DecodeString(parts[5])
+
+	if err != nil || len(key) == 0 {
+		return 0, p, nil, nil, ErrUnknownPasswordHash
+	}
+
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+
+	return version, p, salt, key, nil
+}
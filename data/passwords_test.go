@@ -0,0 +1,139 @@
+package data
+
+import (
+	"strings"
+	"testing"
+)
+
+// cheap parameters keep the tests quick
+var testArgon2 = Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32}
+
+func Test_PasswordHasher_Hash(t *testing.T) {
+	var tests = []struct {
+		name           string
+		hasher         PasswordHasher
+		expectedPrefix string
+	}{
+		{"argon2id", PasswordHasher{Algorithm: PasswordHashArgon2id, Argon2: testArgon2}, "$argon2id$v=19$m=64,t=1,p=1$"},
+		{"bcrypt", PasswordHasher{Algorithm: PasswordHashBcrypt, BcryptCost: 4}, "$2a$04$"},
+	}
+
+	for _, test := range tests {
+		hash, err := test.hasher.Hash("secret")
+
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+
+		if !strings.HasPrefix(hash, test.expectedPrefix) {
+			t.Errorf("%s: expected a hash starting %s, got %s", test.name, test.expectedPrefix, hash)
+		}
+
+		if len(hash) > 255 {
+			t.Errorf("%s: hash is longer than the password column", test.name)
+		}
+
+		if matches, err := VerifyPassword(hash, "secret"); err != nil || !matches {
+			t.Errorf("%s: expected the password to match, got %t %v", test.name, matches, err)
+		}
+
+		if matches, err := VerifyPassword(hash, "Secret"); err != nil || matches {
+			t.Errorf("%s: expected another password not to match, got %t %v", test.name, matches, err)
+		}
+
+		if again, _ := test.hasher.Hash("secret"); again == hash {
+			t.Errorf("%s: expected each hash to have its own salt", test.name)
+		}
+	}
+}
+
+func Test_PasswordHasher_MaxPasswordBytes(t *testing.T) {
+	for hasher, expected := range map[PasswordHasher]int{
+		{}:                                0,
+		{Algorithm: PasswordHashArgon2id}: 0,
+		{Algorithm: PasswordHashBcrypt}:   72,
+	} {
+		if actual := hasher.MaxPasswordBytes(); actual != expected {
+			t.Errorf("%s: expected %d, got %d", hasher.Algorithm, expected, actual)
+		}
+	}
+}
+
+func Test_PasswordHasher_Validate(t *testing.T) {
+	var tests = []struct {
+		name        string
+		hasher      PasswordHasher
+		expectValid bool
+	}{
+		{"default", DefaultPasswordHasher(), true},
+		{"unknown algorithm", PasswordHasher{Algorithm: "md5"}, false},
+		{"bcrypt cost too low", PasswordHasher{Algorithm: PasswordHashBcrypt, BcryptCost: 3}, false},
+		{"no argon2id iterations", PasswordHasher{Algorithm: PasswordHashArgon2id, Argon2: Argon2Params{Memory: 64, Parallelism: 1, SaltLength: 16, KeyLength: 32}}, false},
+		{"argon2id salt too short", PasswordHasher{Algorithm: PasswordHashArgon2id, Argon2: Argon2Params{Memory: 64, Iterations: 1, Parallelism: 1, SaltLength: 4, KeyLength: 32}}, false},
+	}
+
+	for _, test := range tests {
+		if err := test.hasher.Validate(); (err == nil) != test.expectValid {
+			t.Errorf("%s: expected valid to be %t, got %v", test.name, test.expectValid, err)
+		}
+	}
+}
+
+func Test_PasswordHasher_NeedsRehash(t *testing.T) {
+	argon2id := PasswordHasher{Algorithm: PasswordHashArgon2id, Argon2: testArgon2}
+	stronger := argon2id
+	stronger.Argon2.Iterations = 2
+	bcrypt := PasswordHasher{Algorithm: PasswordHashBcrypt, BcryptCost: 4}
+	costlier := PasswordHasher{Algorithm: PasswordHashBcrypt, BcryptCost: 5}
+
+	argon2idHash, _ := argon2id.Hash("secret")
+	bcryptHash, _ := bcrypt.Hash("secret")
+
+	var tests = []struct {
+		name     string
+		hasher   PasswordHasher
+		hash     string
+		expected bool
+	}{
+		{"same argon2id parameters", argon2id, argon2idHash, false},
+		{"more argon2id iterations", stronger, argon2idHash, true},
+		{"fewer argon2id iterations", argon2id, strings.Replace(argon2idHash, "t=1", "t=2", 1), false},
+		{"same bcrypt cost", bcrypt, bcryptHash, false},
+		{"higher bcrypt cost", costlier, bcryptHash, true},
+		{"bcrypt to argon2id", argon2id, bcryptHash, true},
+		{"argon2id to bcrypt", bcrypt, argon2idHash, true},
+		{"zero hasher uses the default", PasswordHasher{}, bcryptHash, true},
+		{"unknown hash", argon2id, "plain text", false},
+	}
+
+	for _, test := range tests {
+		if actual := test.hasher.NeedsRehash(test.hash); actual != test.expected {
+			t.Errorf("%s: expected %t, got %t", test.name, test.expected, actual)
+		}
+	}
+}
+
+func Test_VerifyPassword(t *testing.T) {
+	var tests = []struct {
+		name          string
+		hash          string
+		expectedMatch bool
+		expectError   bool
+	}{
+		// made with the password "password"
+		{"bcrypt", "$2a$04$7QYo1sYpx8rq.mTUTZpUrO9HZDwkeLuom35oqaxJrvFW7BM.swU4m", true, false},
+		{"argon2id", "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$55PWTvddWPUD1GMbKxSff4ASfF85k9ibHJt4HlHQtBM", true, false},
+		{"unknown argon2 version", "$argon2id$v=16$m=64,t=1,p=1$c29tZXNhbHRzb21lc2FsdA$55PWTvddWPUD1GMbKxSff4ASfF85k9ibHJt4HlHQtBM", false, true},
+		{"malformed argon2id", "$argon2id$v=19$m=64$c29tZXNhbHQ", false, true},
+		{"unknown algorithm", "$1$saltsalt$qjXMvbEw8oaL.CzflDugX/", false, true},
+		{"empty", "", false, true},
+	}
+
+	for _, test := range tests {
+		matches, err := VerifyPassword(test.hash, "password")
+
+		if matches != test.expectedMatch || (err != nil) != test.expectError {
+			t.Errorf("%s: expected %t with error %t, got %t %v", test.name, test.expectedMatch, test.expectError, matches, err)
+		}
+	}
+}
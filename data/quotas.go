@@ -0,0 +1,9 @@
+package data
+
+// UploadQuota holds an administrator's overrides of the default upload limits for one user. A nil field means the
+// default applies, and a limit of zero means no limit.
+type UploadQuota struct {
+	MaxBytes          *int64 `json:"max_bytes"`
+	MaxImages         *int   `json:"max_images"`
+	MaxUploadsPerHour *int   `json:"max_uploads_per_hour"`
+}
@@ -0,0 +1,15 @@
+package data
+
+import "time"
+
+// RefreshToken is exchanged for a new access token, and is replaced by a new refresh token each time it is used.
+// Tokens descended from the same login share a FamilyID. Only a hash of the token itself is ever stored.
+type RefreshToken struct {
+	ID        int        `json:"id"`
+	UserID    int        `json:"user_id"`
+	FamilyID  string     `json:"family_id"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
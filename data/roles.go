@@ -0,0 +1,51 @@
+package data
+
+import (
+	"slices"
+	"time"
+)
+
+// The roles every installation starts with. Administrators can assign any number of them to a user.
+const (
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleUser      = "user"
+	RoleAuditor   = "auditor"
+)
+
+// Permissions are granted to users through their roles.
+const (
+	PermissionReadUsers      = "users:read"
+	PermissionWriteUsers     = "users:write"
+	PermissionDeleteUsers    = "users:delete"
+	PermissionAssignRoles    = "roles:assign"
+	PermissionManageQuotas   = "quotas:manage"
+	PermissionManageClients  = "clients:manage"
+	PermissionModerateImages = "images:moderate"
+	PermissionReadAudit      = "audit:read"
+	PermissionImpersonate    = "users:impersonate"
+)
+
+// Role is a named set of permissions.
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// HasRole reports whether the user has been given the named role.
+func (u *User) HasRole(name string) bool {
+	return slices.Contains(u.Roles, name)
+}
+
+// Can reports whether any of the user's roles grants permission. Users loaded before roles existed, such as those
+// kept in old sessions, have no permissions recorded, so administrators among them may do anything.
+func (u *User) Can(permission string) bool {
+	if u.Permissions == nil {
+		return u.IsAdmin == 1
+	}
+
+	return slices.Contains(u.Permissions, permission)
+}
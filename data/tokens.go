@@ -0,0 +1,32 @@
+package data
+
+import "time"
+
+// PersonalAccessToken lets a script use the API on behalf of a user, limited to its scopes. Only a hash of the token
+// itself is ever stored.
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+// Expired reports whether the token has passed its expiry time; tokens without one never expire.
+func (t PersonalAccessToken) Expired() bool {
+	return t.ExpiresAt != nil && !time.Now().Before(*t.ExpiresAt)
+}
+
+// HasScope reports whether the token was granted scope.
+func (t PersonalAccessToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
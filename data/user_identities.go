@@ -0,0 +1,12 @@
+package data
+
+import "time"
+
+// UserIdentity links a user to their account at an external OpenID Connect provider.
+type UserIdentity struct {
+	ID        int       `json:"id"`
+	UserID    int       `json:"user_id"`
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	CreatedAt time.Time `json:"created_at"`
+}
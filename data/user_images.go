@@ -2,11 +2,21 @@ package data
 
 import "time"
 
-// UserImage is the type for user profile images.
+// UserImage is the type for user profile images. FileSize counts the image and its poster together, and BlurHash and
+// DominantColor describe a placeholder clients can show while the image itself loads.
 type UserImage struct {
-	ID        int       `json:"id"`
-	UserID    int       `json:"user_id"`
-	FileName  string    `json:"file_name"`
+	ID       int    `json:"id"`
+	UserID   int    `json:"user_id"`
+	FileName string `json:"file_name"`
+	// OriginalFileName is the name the image was uploaded under. Images are stored under a random FileName instead,
+	// so that uploads never collide.
+	OriginalFileName string `json:"original_file_name,omitempty"`
+	FileSize         int64  `json:"file_size"`
+	BlurHash         string `json:"blur_hash"`
+	DominantColor    string `json:"dominant_color"`
+	// Animated records whether the stored file is an animation, so that it can be served without being re-encoded.
+	// It is nil for images stored before this was recorded.
+	Animated  *bool     `json:"animated,omitempty"`
 	CreatedAt time.Time `json:"-"`
 	UpdatedAt time.Time `json:"-"`
 }
@@ -0,0 +1,8 @@
+package data
+
+// UserImportResult is what importing one user did, or would have done on a dry run: the id of the user written,
+// or why they could not be.
+type UserImportResult struct {
+	ID    int
+	Error string
+}
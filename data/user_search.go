@@ -0,0 +1,59 @@
+package data
+
+import (
+	"errors"
+	"time"
+)
+
+// The orders users can be searched in. Relevance puts the best matches for the search first, and id keeps an order
+// that does not change as users are edited, for clients that page through everyone.
+const (
+	UserSortRelevance = "relevance"
+	UserSortName      = "name"
+	UserSortEmail     = "email"
+	UserSortCreated   = "created"
+	UserSortID        = "id"
+)
+
+// ErrInvalidCursor is returned for a page cursor that was not handed out for the same search order.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// UserSearch narrows down the users to list, and orders them. Zero values match everything.
+type UserSearch struct {
+	// Query is looked for in users' names and email addresses, allowing for typos and partial words.
+	Query string
+	// HasAvatar and IsAdmin, if set, match users with or without a profile picture, or administrator rights.
+	HasAvatar *bool
+	IsAdmin   *bool
+	// CreatedFrom and CreatedTo match users created at or after From, and before To.
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// ActiveOnly leaves out users who have been deactivated.
+	ActiveOnly bool
+	// ProfileVisibilities, if any, match only users whose profiles have one of these visibilities.
+	ProfileVisibilities []string
+	// SkipEmail looks for Query in names and handles only, for viewers who are not shown email addresses.
+	SkipEmail bool
+	// Email and ExternalID, if set, match only the users with exactly that email address, ignoring case, or external
+	// id.
+	Email      string
+	ExternalID string
+	// Sort is one of the UserSort constants. Without one, users are sorted by relevance if there is a Query, and by
+	// name if there is not.
+	Sort       string
+	Descending bool
+	// Cursor is the Next cursor of the previous page, or empty for the first page. Limit is the most users on a
+	// page, or zero for all of them. Offset skips that many users first, for lists paged by number instead.
+	Cursor string
+	Limit  int
+	Offset int
+}
+
+// UserSearchResult is a page of the users a search found.
+type UserSearchResult struct {
+	Users []*User `json:"users"`
+	// Total is how many users the search found, on every page.
+	Total int `json:"total"`
+	// Next is the cursor of the page after this one, or empty if this is the last.
+	Next string `json:"next_cursor,omitempty"`
+}
@@ -1,38 +1,77 @@
 package data
 
-import (
-	"errors"
-	"golang.org/x/crypto/bcrypt"
-	"time"
+import "time"
+
+// Who can see a user's public profile. Hidden profiles can still be seen by the user themselves and by
+// administrators who can read users.
+const (
+	ProfileVisibilityPublic  = "public"
+	ProfileVisibilityMembers = "members"
+	ProfileVisibilityHidden  = "hidden"
+)
+
+// Who can see a user's profile pictures. Private pictures can still be seen by the user themselves and by
+// administrators who can read users; anyone else needs a signed link.
+const (
+	AvatarVisibilityPublic  = "public"
+	AvatarVisibilityMembers = "members"
+	AvatarVisibilityPrivate = "private"
 )
 
 // User describes the data for the User type.
 type User struct {
-	ID             int       `json:"id"`
-	FirstName      string    `json:"first_name"`
-	LastName       string    `json:"last_name"`
-	Email          string    `json:"email"`
-	Password       string    `json:"-"`
-	IsAdmin        int       `json:"is_admin"`
-	CreatedAt      time.Time `json:"-"`
-	UpdatedAt      time.Time `json:"-"`
-	ProfilePicture UserImage `json:"-"`
+	ID             int         `json:"id"`
+	FirstName      string      `json:"first_name"`
+	LastName       string      `json:"last_name"`
+	Email          string      `json:"email"`
+	Password       string      `json:"-"`
+	IsAdmin        int         `json:"is_admin"`
+	CreatedAt      time.Time   `json:"-"`
+	UpdatedAt      time.Time   `json:"-"`
+	ProfilePicture UserImage   `json:"profile_picture"`
+	Quota          UploadQuota `json:"quota"`
+	// ExternalID is the identifier a provisioning system, such as an HR system speaking SCIM, knows the user by.
+	ExternalID    string     `json:"external_id,omitempty"`
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
+	// DeletedAt is set for users who have been deleted but not yet purged, and so can still be restored.
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// DisplayName is what the user would like to be called, if not their first and last names.
+	DisplayName string `json:"display_name"`
+	Pronouns    string `json:"pronouns"`
+	JobTitle    string `json:"job_title"`
+	Bio         string `json:"bio"`
+	// Timezone is an IANA time zone name, such as Europe/London, and Locale a BCP 47 language tag, such as en-GB.
+	Timezone string `json:"timezone"`
+	Locale   string `json:"locale"`
+	// Handle is a unique, URL-safe name for the user's public profile, which is at /u/{handle}.
+	Handle string `json:"handle,omitempty"`
+	// ProfileVisibility is who can see the user's public profile and find them in the directory.
+	ProfileVisibility string `json:"profile_visibility"`
+	// AvatarVisibility is who can see the user's profile pictures.
+	AvatarVisibility string `json:"avatar_visibility"`
+	// Roles replace IsAdmin, which is still 1 for users with the admin role so older clients keep working.
+	Roles []string `json:"roles"`
+	// Permissions are those granted by all of the user's roles.
+	Permissions []string `json:"-"`
 }
 
-// PasswordMatches uses Go's bcrypt package to compare a user supplied password
-// with the hash we have stored for a given user in the database. If the password
-// and hash match, we return true; otherwise, we return false.
-func (u *User) PasswordMatches(plainText string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(plainText))
-	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			// invalid password
-			return false, nil
-		default:
-			return false, err
-		}
+// Name returns the user's display name, or their first and last names if they have not chosen one.
+func (u *User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
 	}
 
-	return true, nil
+	return u.FirstName + " " + u.LastName
+}
+
+// Active reports whether the user may sign in. Deactivated and deleted users are kept, but cannot.
+func (u *User) Active() bool {
+	return u.DeactivatedAt == nil && u.DeletedAt == nil
+}
+
+// PasswordMatches compares a user supplied password with the hash we have stored
+// for a given user in the database, whichever algorithm made it. If the password
+// and hash match, we return true; otherwise, we return false.
+func (u *User) PasswordMatches(plainText string) (bool, error) {
+	return VerifyPassword(u.Password, plainText)
 }
@@ -1,9 +1,354 @@
+--
+-- Name: pg_trgm; Type: EXTENSION; Schema: -; Owner: -
+--
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA public;
+
+
+--
+-- Name: EXTENSION pg_trgm; Type: COMMENT; Schema: -; Owner: -
+--
+
+COMMENT ON EXTENSION pg_trgm IS 'text similarity measurement and index searching based on trigrams';
+
+
+
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    -- the only change allowed is anonymizing an event: personal data may be removed, but not changed, and everything
+    -- else is left alone
+    IF TG_OP = 'UPDATE' AND OLD.anonymized_at IS NULL AND NEW.anonymized_at IS NOT NULL
+        AND NEW.id = OLD.id AND NEW.action = OLD.action AND NEW.created_at IS NOT DISTINCT FROM OLD.created_at
+        AND NEW.details_hash = OLD.details_hash AND NEW.personal_hash = OLD.personal_hash
+        AND NEW.hash_version = OLD.hash_version AND NEW.prev_hash = OLD.prev_hash AND NEW.hash = OLD.hash
+        AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+        AND (NEW.target_user_id IS NULL OR NEW.target_user_id = OLD.target_user_id)
+        AND (NEW.ip IS NULL OR NEW.ip = OLD.ip)
+        AND (NEW.user_agent IS NULL OR NEW.user_agent = OLD.user_agent)
+        AND (NEW.details IS NULL OR NEW.details = OLD.details) THEN
+        RETURN NEW;
+    END IF;
+
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
+
+
+CREATE TABLE public.audit_events (
+    id integer NOT NULL,
+    actor_id integer,
+    target_user_id integer,
+    action character varying(64) NOT NULL,
+    ip character varying(64),
+    user_agent text,
+    details jsonb,
+    created_at timestamp without time zone,
+    anonymized_at timestamp without time zone,
+    details_hash character varying(64) DEFAULT ''::character varying NOT NULL,
+    personal_hash character varying(64) DEFAULT ''::character varying NOT NULL,
+    hash_version smallint DEFAULT 1 NOT NULL,
+    prev_hash character varying(64) DEFAULT ''::character varying NOT NULL,
+    hash character varying(64) DEFAULT ''::character varying NOT NULL
+);
+
+
+--
+-- Name: audit_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.audit_events ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.audit_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: data_exports; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.data_exports (
+    id integer NOT NULL,
+    user_id integer NOT NULL,
+    token_hash character varying(64) NOT NULL,
+    file_name character varying(255) DEFAULT ''::character varying NOT NULL,
+    status character varying(16) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    completed_at timestamp without time zone
+);
+
+
+--
+-- Name: data_exports_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.data_exports ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.data_exports_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: oauth_authorization_codes; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.oauth_authorization_codes (
+    id integer NOT NULL,
+    client_id integer,
+    user_id integer,
+    code_hash character(64),
+    redirect_uri text,
+    scope character varying(255),
+    nonce character varying(255),
+    code_challenge character varying(128),
+    expires_at timestamp without time zone,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: oauth_authorization_codes_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.oauth_authorization_codes ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.oauth_authorization_codes_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: oauth_clients; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.oauth_clients (
+    id integer NOT NULL,
+    client_id character varying(64),
+    client_secret_hash character(64),
+    name character varying(255),
+    redirect_uris text,
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: oauth_clients_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.oauth_clients ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.oauth_clients_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: permissions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.permissions (
+    id integer NOT NULL,
+    name character varying(64) NOT NULL,
+    description character varying(255)
+);
+
+
+--
+-- Name: permissions_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.permissions ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.permissions_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: personal_access_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.personal_access_tokens (
+    id integer NOT NULL,
+    user_id integer,
+    name character varying(255),
+    token_hash character(64),
+    scopes character varying(255),
+    expires_at timestamp without time zone,
+    last_used_at timestamp without time zone,
+    last_used_ip character varying(45),
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: personal_access_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.personal_access_tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.personal_access_tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: refresh_tokens; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.refresh_tokens (
+    id integer NOT NULL,
+    user_id integer,
+    family_id character varying(64),
+    token_hash character(64),
+    expires_at timestamp without time zone,
+    used_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: refresh_tokens_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.refresh_tokens ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.refresh_tokens_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: role_permissions; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.role_permissions (
+    role_id integer NOT NULL,
+    permission_id integer NOT NULL
+);
+
+
+--
+-- Name: roles; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.roles (
+    id integer NOT NULL,
+    name character varying(64) NOT NULL,
+    description character varying(255),
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: roles_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.roles ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.roles_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: upload_events; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.upload_events (
+    id integer NOT NULL,
+    user_id integer,
+    file_size bigint,
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: upload_events_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.upload_events ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.upload_events_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: user_identities; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_identities (
+    id integer NOT NULL,
+    user_id integer,
+    issuer character varying(255),
+    subject character varying(255),
+    created_at timestamp without time zone
+);
+
+
+--
+-- Name: user_identities_id_seq; Type: SEQUENCE; Schema: public; Owner: -
+--
+
+ALTER TABLE public.user_identities ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
+    SEQUENCE NAME public.user_identities_id_seq
+    START WITH 1
+    INCREMENT BY 1
+    NO MINVALUE
+    NO MAXVALUE
+    CACHE 1
+);
+
+
+--
+-- Name: user_images; Type: TABLE; Schema: public; Owner: -
+--
+
 CREATE TABLE public.user_images (
     id integer NOT NULL,
     user_id integer,
     file_name character varying(255),
+    file_size bigint,
+    blur_hash character varying(64),
+    dominant_color character varying(7),
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    original_file_name character varying(255),
+    animated boolean
 );
 
 
@@ -21,6 +366,16 @@ ALTER TABLE public.user_images ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY
 );
 
 
+--
+-- Name: user_roles; Type: TABLE; Schema: public; Owner: -
+--
+
+CREATE TABLE public.user_roles (
+    user_id integer NOT NULL,
+    role_id integer NOT NULL
+);
+
+
 --
 -- Name: users; Type: TABLE; Schema: public; Owner: -
 --
@@ -29,11 +384,28 @@ CREATE TABLE public.users (
     id integer NOT NULL,
     first_name character varying(255),
     last_name character varying(255),
+    display_name character varying(255),
+    pronouns character varying(64),
+    job_title character varying(255),
+    bio text,
+    timezone character varying(64),
+    locale character varying(35),
+    handle character varying(32),
+    profile_visibility character varying(16) DEFAULT 'members'::character varying NOT NULL,
+    avatar_visibility character varying(16) DEFAULT 'public'::character varying NOT NULL,
     email character varying(255),
-    password character varying(60),
+    password character varying(255),
     is_admin integer,
+    quota_bytes bigint,
+    quota_images integer,
+    quota_uploads_per_hour integer,
+    external_id character varying(255),
+    deactivated_at timestamp without time zone,
+    deleted_at timestamp without time zone,
     created_at timestamp without time zone,
-    updated_at timestamp without time zone
+    updated_at timestamp without time zone,
+    search_vector tsvector GENERATED ALWAYS AS ((setweight(to_tsvector('simple'::regconfig, (((((COALESCE(first_name, ''::character varying))::text || ' '::text) || (COALESCE(last_name, ''::character varying))::text) || ' '::text) || (COALESCE(display_name, ''::character varying))::text)), 'A'::"char") || setweight(to_tsvector('simple'::regconfig, translate((COALESCE(email, ''::character varying))::text, '@.'::text, '  '::text)), 'B'::"char"))) STORED,
+    search_text text GENERATED ALWAYS AS (lower((((((((COALESCE(first_name, ''::character varying))::text || ' '::text) || (COALESCE(last_name, ''::character varying))::text) || ' '::text) || (COALESCE(display_name, ''::character varying))::text) || ' '::text) || (COALESCE(email, ''::character varying))::text))) STORED
 );
 
 
@@ -50,6 +422,224 @@ ALTER TABLE public.users ALTER COLUMN id ADD GENERATED ALWAYS AS IDENTITY (
     CACHE 1
 );
 
+--
+-- Data for Name: permissions; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (1, 'users:read', 'View every user''s account');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (2, 'users:write', 'Create, change and deactivate users');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (3, 'users:delete', 'Delete users');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (4, 'roles:assign', 'Assign roles to users');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (5, 'quotas:manage', 'Change users'' upload quotas');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (6, 'clients:manage', 'Register applications that sign users in');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (7, 'images:moderate', 'Remove other users'' profile pictures');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (8, 'audit:read', 'Read the audit log');
+INSERT INTO public.permissions OVERRIDING SYSTEM VALUE VALUES (9, 'users:impersonate', 'Sign in as another user to see what they see');
+
+
+--
+-- Data for Name: role_permissions; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+INSERT INTO public.role_permissions VALUES (1, 1);
+INSERT INTO public.role_permissions VALUES (1, 2);
+INSERT INTO public.role_permissions VALUES (1, 3);
+INSERT INTO public.role_permissions VALUES (1, 4);
+INSERT INTO public.role_permissions VALUES (1, 5);
+INSERT INTO public.role_permissions VALUES (1, 6);
+INSERT INTO public.role_permissions VALUES (1, 7);
+INSERT INTO public.role_permissions VALUES (1, 8);
+INSERT INTO public.role_permissions VALUES (1, 9);
+INSERT INTO public.role_permissions VALUES (2, 1);
+INSERT INTO public.role_permissions VALUES (2, 7);
+INSERT INTO public.role_permissions VALUES (4, 1);
+INSERT INTO public.role_permissions VALUES (4, 8);
+
+
+--
+-- Data for Name: roles; Type: TABLE DATA; Schema: public; Owner: -
+--
+
+INSERT INTO public.roles OVERRIDING SYSTEM VALUE VALUES (1, 'admin', 'Can do everything', '2022-08-19 00:00:00');
+INSERT INTO public.roles OVERRIDING SYSTEM VALUE VALUES (2, 'moderator', 'Looks after the profile pictures people upload', '2022-08-19 00:00:00');
+INSERT INTO public.roles OVERRIDING SYSTEM VALUE VALUES (3, 'user', 'Manages their own account', '2022-08-19 00:00:00');
+INSERT INTO public.roles OVERRIDING SYSTEM VALUE VALUES (4, 'auditor', 'Reviews accounts and the audit log', '2022-08-19 00:00:00');
+
+
+--
+-- Name: permissions_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.permissions_id_seq', 9, true);
+
+
+--
+-- Name: roles_id_seq; Type: SEQUENCE SET; Schema: public; Owner: -
+--
+
+SELECT pg_catalog.setval('public.roles_id_seq', 4, true);
+
+
+--
+-- Name: audit_events audit_events_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.audit_events
+    ADD CONSTRAINT audit_events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: data_exports data_exports_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.data_exports
+    ADD CONSTRAINT data_exports_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: data_exports data_exports_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.data_exports
+    ADD CONSTRAINT data_exports_token_hash_key UNIQUE (token_hash);
+
+
+--
+-- Name: oauth_authorization_codes oauth_authorization_codes_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_authorization_codes
+    ADD CONSTRAINT oauth_authorization_codes_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: oauth_authorization_codes oauth_authorization_codes_code_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_authorization_codes
+    ADD CONSTRAINT oauth_authorization_codes_code_hash_key UNIQUE (code_hash);
+
+
+--
+-- Name: oauth_clients oauth_clients_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_clients
+    ADD CONSTRAINT oauth_clients_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: oauth_clients oauth_clients_client_id_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_clients
+    ADD CONSTRAINT oauth_clients_client_id_key UNIQUE (client_id);
+
+
+--
+-- Name: permissions permissions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.permissions
+    ADD CONSTRAINT permissions_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: permissions permissions_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.permissions
+    ADD CONSTRAINT permissions_name_key UNIQUE (name);
+
+
+--
+-- Name: personal_access_tokens personal_access_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.personal_access_tokens
+    ADD CONSTRAINT personal_access_tokens_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: personal_access_tokens personal_access_tokens_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.personal_access_tokens
+    ADD CONSTRAINT personal_access_tokens_token_hash_key UNIQUE (token_hash);
+
+
+--
+-- Name: refresh_tokens refresh_tokens_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.refresh_tokens
+    ADD CONSTRAINT refresh_tokens_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: refresh_tokens refresh_tokens_token_hash_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.refresh_tokens
+    ADD CONSTRAINT refresh_tokens_token_hash_key UNIQUE (token_hash);
+
+
+--
+-- Name: role_permissions role_permissions_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_permissions
+    ADD CONSTRAINT role_permissions_pkey PRIMARY KEY (role_id, permission_id);
+
+
+--
+-- Name: roles roles_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.roles
+    ADD CONSTRAINT roles_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: roles roles_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.roles
+    ADD CONSTRAINT roles_name_key UNIQUE (name);
+
+
+--
+-- Name: upload_events upload_events_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.upload_events
+    ADD CONSTRAINT upload_events_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: user_identities user_identities_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_pkey PRIMARY KEY (id);
+
+
+--
+-- Name: user_identities user_identities_issuer_subject_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_issuer_subject_key UNIQUE (issuer, subject);
+
+
+--
+-- Name: user_images user_images_file_name_key; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_images
+    ADD CONSTRAINT user_images_file_name_key UNIQUE (file_name);
+
+
 --
 -- Name: user_images user_images_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -58,6 +648,14 @@ ALTER TABLE ONLY public.user_images
     ADD CONSTRAINT user_images_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: user_roles user_roles_pkey; Type: CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_roles
+    ADD CONSTRAINT user_roles_pkey PRIMARY KEY (user_id, role_id);
+
+
 --
 -- Name: users users_pkey; Type: CONSTRAINT; Schema: public; Owner: -
 --
@@ -66,6 +664,192 @@ ALTER TABLE ONLY public.users
     ADD CONSTRAINT users_pkey PRIMARY KEY (id);
 
 
+--
+-- Name: upload_events_user_id_created_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX upload_events_user_id_created_at_idx ON public.upload_events USING btree (user_id, created_at);
+
+
+--
+-- Name: user_images_user_id_created_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX user_images_user_id_created_at_idx ON public.user_images USING btree (user_id, created_at);
+
+
+--
+-- Name: personal_access_tokens_user_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX personal_access_tokens_user_id_idx ON public.personal_access_tokens USING btree (user_id);
+
+
+--
+-- Name: refresh_tokens_family_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX refresh_tokens_family_id_idx ON public.refresh_tokens USING btree (family_id);
+
+
+--
+-- Name: user_roles_role_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX user_roles_role_id_idx ON public.user_roles USING btree (role_id);
+
+
+--
+-- Name: audit_events_actor_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_actor_id_idx ON public.audit_events USING btree (actor_id);
+
+
+--
+-- Name: audit_events_target_user_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX audit_events_target_user_id_idx ON public.audit_events USING btree (target_user_id);
+
+
+--
+-- Name: audit_events audit_events_append_only; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER audit_events_append_only BEFORE DELETE OR UPDATE ON public.audit_events FOR EACH ROW EXECUTE FUNCTION public.audit_events_append_only();
+
+
+--
+-- Name: audit_events audit_events_no_truncate; Type: TRIGGER; Schema: public; Owner: -
+--
+
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON public.audit_events FOR EACH STATEMENT EXECUTE FUNCTION public.audit_events_append_only();
+
+
+--
+-- Name: data_exports_user_id_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX data_exports_user_id_idx ON public.data_exports USING btree (user_id);
+
+
+--
+-- Name: users_deleted_at_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX users_deleted_at_idx ON public.users USING btree (deleted_at) WHERE (deleted_at IS NOT NULL);
+
+
+--
+-- Name: users_handle_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE UNIQUE INDEX users_handle_idx ON public.users USING btree (handle) WHERE (deleted_at IS NULL);
+
+
+--
+-- Name: users_search_text_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX users_search_text_idx ON public.users USING gin (search_text public.gin_trgm_ops);
+
+
+--
+-- Name: users_search_vector_idx; Type: INDEX; Schema: public; Owner: -
+--
+
+CREATE INDEX users_search_vector_idx ON public.users USING gin (search_vector);
+
+
+--
+-- Name: data_exports data_exports_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.data_exports
+    ADD CONSTRAINT data_exports_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: user_roles user_roles_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_roles
+    ADD CONSTRAINT user_roles_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: user_roles user_roles_role_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_roles
+    ADD CONSTRAINT user_roles_role_id_fkey FOREIGN KEY (role_id) REFERENCES public.roles(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: role_permissions role_permissions_role_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_permissions
+    ADD CONSTRAINT role_permissions_role_id_fkey FOREIGN KEY (role_id) REFERENCES public.roles(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: role_permissions role_permissions_permission_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.role_permissions
+    ADD CONSTRAINT role_permissions_permission_id_fkey FOREIGN KEY (permission_id) REFERENCES public.permissions(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: oauth_authorization_codes oauth_authorization_codes_client_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_authorization_codes
+    ADD CONSTRAINT oauth_authorization_codes_client_id_fkey FOREIGN KEY (client_id) REFERENCES public.oauth_clients(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: oauth_authorization_codes oauth_authorization_codes_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.oauth_authorization_codes
+    ADD CONSTRAINT oauth_authorization_codes_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: user_identities user_identities_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.user_identities
+    ADD CONSTRAINT user_identities_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: refresh_tokens refresh_tokens_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.refresh_tokens
+    ADD CONSTRAINT refresh_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: personal_access_tokens personal_access_tokens_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.personal_access_tokens
+    ADD CONSTRAINT personal_access_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
+--
+-- Name: upload_events upload_events_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
+--
+
+ALTER TABLE ONLY public.upload_events
+    ADD CONSTRAINT upload_events_user_id_fkey FOREIGN KEY (user_id) REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE;
+
+
 --
 -- Name: user_images user_images_user_id_fkey; Type: FK CONSTRAINT; Schema: public; Owner: -
 --
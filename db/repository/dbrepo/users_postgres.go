@@ -3,9 +3,17 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/spartanhooah/profile-picture-web/data"
-	"golang.org/x/crypto/bcrypt"
 	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -13,19 +21,70 @@ const dbTimeout = time.Second * 3
 
 type PostgresDBRepo struct {
 	DB *sql.DB
+	// Hasher hashes new passwords; the zero value uses data.DefaultPasswordHasher.
+	Hasher data.PasswordHasher
 }
 
 func (m *PostgresDBRepo) Connection() *sql.DB {
 	return m.DB
 }
 
+// querier runs statements against either the database or a transaction.
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+// userRoleColumns selects the names of a user's roles, and of the permissions those roles grant, space separated.
+const userRoleColumns = `
+			coalesce((
+				select string_agg(r.name, ' ' order by r.name)
+				from user_roles ur join roles r on r.id = ur.role_id
+				where ur.user_id = u.id
+			), ''),
+			coalesce((
+				select string_agg(distinct p.name, ' ' order by p.name)
+				from user_roles ur
+					join role_permissions rp on rp.role_id = ur.role_id
+					join permissions p on p.id = rp.permission_id
+				where ur.user_id = u.id
+			), '')`
+
+// userProfileColumns selects the optional parts of a user's profile, which they can fill in themselves.
+const userProfileColumns = `coalesce(u.display_name, ''), coalesce(u.pronouns, ''), coalesce(u.job_title, ''),
+			coalesce(u.bio, ''), coalesce(u.timezone, ''), coalesce(u.locale, ''), coalesce(u.handle, ''),
+			u.profile_visibility, u.avatar_visibility`
+
+// setRoles fills in the roles and permissions selected by userRoleColumns.
+func setRoles(user *data.User, roles, permissions string) {
+	user.Roles = strings.Fields(roles)
+	user.Permissions = strings.Fields(permissions)
+}
+
 // AllUsers returns all users as a slice of *data.User
 func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at
-	from users order by last_name`
+	query := `
+		select
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
+			coalesce(u.external_id, ''), u.deactivated_at,
+			` + userProfileColumns + `,
+			` + userRoleColumns + `,
+			coalesce(ui.id, 0), coalesce(ui.file_name, '')
+		from
+			users u
+			left join lateral (
+				select id, file_name
+				from user_images
+				where user_id = u.id
+				order by created_at desc, id desc
+				limit 1
+			) ui on true
+		where
+			u.deleted_at is null
+		order by u.last_name`
 
 	rows, err := m.DB.QueryContext(ctx, query)
 	if err != nil {
@@ -37,6 +96,7 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 
 	for rows.Next() {
 		var user data.User
+		var roles, permissions string
 		err := rows.Scan(
 			&user.ID,
 			&user.Email,
@@ -46,72 +106,346 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 			&user.IsAdmin,
 			&user.CreatedAt,
 			&user.UpdatedAt,
+			&user.ExternalID,
+			&user.DeactivatedAt,
+			&user.DisplayName,
+			&user.Pronouns,
+			&user.JobTitle,
+			&user.Bio,
+			&user.Timezone,
+			&user.Locale,
+			&user.Handle,
+			&user.ProfileVisibility,
+			&user.AvatarVisibility,
+			&roles,
+			&permissions,
+			&user.ProfilePicture.ID,
+			&user.ProfilePicture.FileName,
 		)
 		if err != nil {
 			log.Println("Error scanning", err)
 			return nil, err
 		}
 
+		setRoles(&user, roles, permissions)
 		users = append(users, &user)
 	}
 
 	return users, nil
 }
 
-// GetUser returns one user by id
-func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
+// userSearchKey is an expression users are ordered by, and the type it is compared as when it is read back from a
+// cursor, where it is kept as text.
+type userSearchKey struct {
+	expr string
+	typ  string
+}
+
+// userSearchRank scores how well a user matches the search in $1: full-text matches count for more in names than
+// in email addresses, and trigram similarity ranks typos and partial words by how close they come.
+const userSearchRank = `(ts_rank(u.search_vector, websearch_to_tsquery('simple', $1)) + word_similarity($1, u.search_text))::float8`
+
+// userSearchKeys are what each sort orders users by, before their id, which breaks ties. Relevance is negated so
+// that the best matches come first in ascending order, like the other sorts.
+var userSearchKeys = map[string][]userSearchKey{
+	data.UserSortRelevance: {{"-" + userSearchRank, "float8"}},
+	data.UserSortName:      {{"lower(coalesce(u.last_name, ''))", "text"}, {"lower(coalesce(u.first_name, ''))", "text"}},
+	data.UserSortEmail:     {{"lower(coalesce(u.email, ''))", "text"}},
+	data.UserSortCreated:   {{"extract(epoch from coalesce(u.created_at, 'epoch'))", "numeric"}},
+	data.UserSortID:        {{"u.id", "integer"}},
+}
+
+// userSearchCursor is the position of a user in a search order: the sort, the user's keys in that order, as text,
+// and their id. Cursors are handed out base64 encoded JSON.
+type userSearchCursor struct {
+	Sort string   `json:"s"`
+	Keys []string `json:"k"`
+	ID   int      `json:"id"`
+}
+
+func (c userSearchCursor) encode() string {
+	out, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(out)
+}
+
+// decodeUserSearchCursor reads a cursor handed out for sort, checking its keys can be compared as they need to be.
+func decodeUserSearchCursor(encoded, sort string) (userSearchCursor, error) {
+	var c userSearchCursor
+
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+
+	if err != nil || json.Unmarshal(raw, &c) != nil || c.Sort != sort || len(c.Keys) != len(userSearchKeys[sort]) {
+		return c, data.ErrInvalidCursor
+	}
+
+	for i, key := range userSearchKeys[sort] {
+		if key.typ == "text" {
+			continue
+		}
+
+		f, err := strconv.ParseFloat(c.Keys[i], 64)
+
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return c, data.ErrInvalidCursor
+		}
+	}
+
+	return c, nil
+}
+
+// escapeLike makes s match only itself in a like pattern.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// SearchUsers returns a page of the users who have not been deleted that match the search, along with how many
+// match. Full-text search finds whole words in names and email addresses, trigram similarity finds words with
+// typos in, and anything else containing the search is found too. Pages follow on from the cursor of the one
+// before rather than skipping an offset, so users added or removed while paging neither repeat nor go missing; an
+// offset can still be given for lists paged by number, such as the directory.
+func (m *PostgresDBRepo) SearchUsers(search data.UserSearch) (*data.UserSearchResult, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	query := `
+	query := strings.TrimSpace(search.Query)
+	sort := search.Sort
+
+	if sort == "" || (sort == data.UserSortRelevance && query == "") {
+		sort = data.UserSortName
+
+		if query != "" {
+			sort = data.UserSortRelevance
+		}
+	}
+
+	keys, ok := userSearchKeys[sort]
+
+	if !ok {
+		return nil, fmt.Errorf("unknown sort %q", search.Sort)
+	}
+
+	// handles, and names without email addresses, are only ever matched as they are written
+	where := `
+			u.deleted_at is null
+			and ($1 = '' or (not $9 and (u.search_vector @@ websearch_to_tsquery('simple', $1)
+				or $1 <% u.search_text or u.search_text like $2))
+				or lower(concat_ws(' ', u.first_name, u.last_name, u.display_name, u.handle)) like $2)
+			and ($3::boolean is null or exists (select 1 from user_images i where i.user_id = u.id) = $3)
+			and ($4::boolean is null or (coalesce(u.is_admin, 0) = 1) = $4)
+			and ($5::timestamp is null or u.created_at >= $5)
+			and ($6::timestamp is null or u.created_at < $6)
+			and (not $7 or u.deactivated_at is null)
+			and (cardinality($8::text[]) = 0 or u.profile_visibility = any($8))
+			and ($10 = '' or lower(u.email) = lower($10))
+			and ($11 = '' or u.external_id = $11)`
+
+	args := []any{
+		query,
+		"%" + escapeLike(strings.ToLower(query)) + "%",
+		nullBool(search.HasAvatar),
+		nullBool(search.IsAdmin),
+		sql.NullTime{Time: search.CreatedFrom, Valid: !search.CreatedFrom.IsZero()},
+		sql.NullTime{Time: search.CreatedTo, Valid: !search.CreatedTo.IsZero()},
+		search.ActiveOnly,
+		append([]string{}, search.ProfileVisibilities...),
+		search.SkipEmail,
+		search.Email,
+		search.ExternalID,
+	}
+
+	result := data.UserSearchResult{Users: []*data.User{}}
+
+	err := m.DB.QueryRowContext(ctx, `select count(*) from users u where `+where, args...).Scan(&result.Total)
+
+	if err != nil {
+		return nil, err
+	}
+
+	order := "asc"
+	cursorOp := ">"
+
+	if search.Descending {
+		order, cursorOp = "desc", "<"
+	}
+
+	var keyColumns, orderBy, cursorKeys, cursorArgs []string
+
+	for _, key := range keys {
+		keyColumns = append(keyColumns, "("+key.expr+")::text")
+		orderBy = append(orderBy, key.expr+" "+order)
+		cursorKeys = append(cursorKeys, key.expr)
+	}
+
+	orderBy = append(orderBy, "u.id "+order)
+	cursorKeys = append(cursorKeys, "u.id")
+
+	if search.Cursor != "" {
+		cursor, err := decodeUserSearchCursor(search.Cursor, sort)
+
+		if err != nil {
+			return nil, err
+		}
+
+		for i, key := range keys {
+			args = append(args, cursor.Keys[i])
+			cursorArgs = append(cursorArgs, fmt.Sprintf("$%d::%s", len(args), key.typ))
+		}
+
+		args = append(args, cursor.ID)
+		cursorArgs = append(cursorArgs, fmt.Sprintf("$%d::integer", len(args)))
+
+		where += `
+			and (` + strings.Join(cursorKeys, ", ") + `) ` + cursorOp + ` (` + strings.Join(cursorArgs, ", ") + `)`
+	}
+
+	// one more than a page shows whether there is a next page
+	args = append(args, search.Limit+1)
+	limit := fmt.Sprintf("$%d", len(args))
+
+	if search.Limit <= 0 {
+		limit = "null"
+		args = args[:len(args)-1]
+	}
+
+	args = append(args, max(search.Offset, 0))
+	offset := fmt.Sprintf("$%d", len(args))
+
+	stmt := `
 		select
 			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
-			coalesce(ui.file_name, '')
+			coalesce(u.external_id, ''), u.deactivated_at,
+			` + userProfileColumns + `,
+			` + userRoleColumns + `,
+			coalesce(ui.id, 0), coalesce(ui.file_name, ''),
+			` + strings.Join(keyColumns, ", ") + `
 		from
 			users u
-			left join user_images ui on u.id = ui.user_id
-		where
-		    u.id = $1`
-
-	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, id)
-
-	err := row.Scan(
-		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
-		&user.Password,
-		&user.IsAdmin,
-		&user.CreatedAt,
-		&user.UpdatedAt,
-		&user.ProfilePicture.FileName,
-	)
+			left join lateral (
+				select id, file_name
+				from user_images
+				where user_id = u.id
+				order by created_at desc, id desc
+				limit 1
+			) ui on true
+		where` + where + `
+		order by ` + strings.Join(orderBy, ", ") + `
+		limit ` + limit + ` offset ` + offset
 
+	rows, err := m.DB.QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return &user, nil
+	var last []string
+
+	for rows.Next() {
+		if search.Limit > 0 && len(result.Users) == search.Limit {
+			result.Next = userSearchCursor{Sort: sort, Keys: last, ID: result.Users[len(result.Users)-1].ID}.encode()
+			break
+		}
+
+		var user data.User
+		var roles, permissions string
+		keyValues := make([]string, len(keys))
+
+		dest := []any{
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.IsAdmin,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.ExternalID,
+			&user.DeactivatedAt,
+			&user.DisplayName,
+			&user.Pronouns,
+			&user.JobTitle,
+			&user.Bio,
+			&user.Timezone,
+			&user.Locale,
+			&user.Handle,
+			&user.ProfileVisibility,
+			&user.AvatarVisibility,
+			&roles,
+			&permissions,
+			&user.ProfilePicture.ID,
+			&user.ProfilePicture.FileName,
+		}
+
+		for i := range keyValues {
+			dest = append(dest, &keyValues[i])
+		}
+
+		err := rows.Scan(dest...)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		setRoles(&user, roles, permissions)
+		result.Users = append(result.Users, &user)
+		last = keyValues
+	}
+
+	return &result, rows.Err()
+}
+
+// nullBool is null for a nil *bool, so a query can tell no filter from false.
+func nullBool(b *bool) sql.NullBool {
+	if b == nil {
+		return sql.NullBool{}
+	}
+
+	return sql.NullBool{Bool: *b, Valid: true}
+}
+
+// GetUser returns one user by id, with their most recent profile image
+func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
+	return m.getUser("u.id = $1", id)
 }
 
-// GetUserByEmail returns one user by email address
+// GetUserByEmail returns one user by email address, with their most recent profile image
 func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
+	return m.getUser("u.email = $1", email)
+}
+
+// GetUserByHandle returns one user by the handle of their public profile, with their most recent profile image
+func (m *PostgresDBRepo) GetUserByHandle(handle string) (*data.User, error) {
+	return m.getUser("u.handle = $1", handle)
+}
+
+// getUser returns the one user who has not been deleted that matches condition, which refers to arg as $1.
+func (m *PostgresDBRepo) getUser(condition string, arg any) (*data.User, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
 	query := `
 		select
 			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at,
-			coalesce(ui.file_name, '')
+			u.quota_bytes, u.quota_images, u.quota_uploads_per_hour, coalesce(u.external_id, ''), u.deactivated_at,
+			` + userProfileColumns + `,
+			` + userRoleColumns + `,
+			coalesce(ui.id, 0), coalesce(ui.file_name, ''), coalesce(ui.file_size, 0), coalesce(ui.blur_hash, ''),
+			coalesce(ui.dominant_color, '')
 		from
 			users u
-			left join user_images ui on u.id = ui.user_id
+			left join lateral (
+				select id, file_name, file_size, blur_hash, dominant_color
+				from user_images
+				where user_id = u.id
+				order by created_at desc, id desc
+				limit 1
+			) ui on true
 		where
-		    u.email = $1`
+		    ` + condition + ` and u.deleted_at is null`
 
 	var user data.User
-	row := m.DB.QueryRowContext(ctx, query, email)
+	var roles, permissions string
+	row := m.DB.QueryRowContext(ctx, query, arg)
 
 	err := row.Scan(
 		&user.ID,
@@ -122,13 +456,35 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 		&user.IsAdmin,
 		&user.CreatedAt,
 		&user.UpdatedAt,
+		&user.Quota.MaxBytes,
+		&user.Quota.MaxImages,
+		&user.Quota.MaxUploadsPerHour,
+		&user.ExternalID,
+		&user.DeactivatedAt,
+		&user.DisplayName,
+		&user.Pronouns,
+		&user.JobTitle,
+		&user.Bio,
+		&user.Timezone,
+		&user.Locale,
+		&user.Handle,
+		&user.ProfileVisibility,
+		&user.AvatarVisibility,
+		&roles,
+		&permissions,
+		&user.ProfilePicture.ID,
 		&user.ProfilePicture.FileName,
+		&user.ProfilePicture.FileSize,
+		&user.ProfilePicture.BlurHash,
+		&user.ProfilePicture.DominantColor,
 	)
 
 	if err != nil {
 		return nil, err
 	}
 
+	setRoles(&user, roles, permissions)
+
 	return &user, nil
 }
 
@@ -137,20 +493,47 @@ func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
+	return updateUser(ctx, m.DB, u)
+}
+
+// updateUser updates one user, in the database or a transaction.
+func updateUser(ctx context.Context, db querier, u data.User) error {
 	stmt := `update users set
 		email = $1,
 		first_name = $2,
 		last_name = $3,
 		is_admin = $4,
-		updated_at = $5
-		where id = $6
+		external_id = nullif($5, ''),
+		deactivated_at = $6,
+		display_name = nullif($7, ''),
+		pronouns = nullif($8, ''),
+		job_title = nullif($9, ''),
+		bio = nullif($10, ''),
+		timezone = nullif($11, ''),
+		locale = nullif($12, ''),
+		handle = nullif($13, ''),
+		profile_visibility = coalesce(nullif($14, ''), profile_visibility),
+		avatar_visibility = coalesce(nullif($15, ''), avatar_visibility),
+		updated_at = $16
+		where id = $17
 	`
 
-	_, err := m.DB.ExecContext(ctx, stmt,
+	_, err := db.ExecContext(ctx, stmt,
 		u.Email,
 		u.FirstName,
 		u.LastName,
 		u.IsAdmin,
+		u.ExternalID,
+		u.DeactivatedAt,
+		u.DisplayName,
+		u.Pronouns,
+		u.JobTitle,
+		u.Bio,
+		u.Timezone,
+		u.Locale,
+		u.Handle,
+		u.ProfileVisibility,
+		u.AvatarVisibility,
 		time.Now(),
 		u.ID,
 	)
@@ -159,14 +542,101 @@ func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 		return err
 	}
 
-	return nil
+	return syncAdminRole(ctx, db, u.ID, u.IsAdmin)
 }
 
-// DeleteUser deletes one user from the database, by id
+// DeleteUser marks one user as deleted, by id. Deleted users are left out of everything else that looks users up,
+// and can be restored with RestoreUser until they are purged.
 func (m *PostgresDBRepo) DeleteUser(id int) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
+	stmt := `update users set deleted_at = $1 where id = $2 and deleted_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RestoreUser undoes DeleteUser for a user deleted after deletedAfter. It returns sql.ErrNoRows if there is no such
+// user. If someone else has taken their handle in the meantime, they lose it.
+func (m *PostgresDBRepo) RestoreUser(id int, deletedAfter time.Time) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users u set
+		deleted_at = null,
+		updated_at = $1,
+		handle = case
+			when exists (select 1 from users o where o.handle = u.handle and o.deleted_at is null) then null
+			else u.handle
+		end
+		where id = $2 and deleted_at > $3`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), id, deletedAfter)
+	if err != nil {
+		return err
+	}
+
+	restored, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if restored == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// GetDeletedUsers returns the users deleted before the given time, most recently deleted first. Pass the current
+// time to list every deleted user.
+func (m *PostgresDBRepo) GetDeletedUsers(before time.Time) ([]*data.User, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, email, first_name, last_name, is_admin, created_at, updated_at, deleted_at
+		from users where deleted_at < $1 order by deleted_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []*data.User
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.IsAdmin,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+			&user.DeletedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, &user)
+	}
+
+	return users, rows.Err()
+}
+
+// PurgeUser deletes one user from the database for good, by id, along with everything that belongs to them
+func (m *PostgresDBRepo) PurgeUser(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
 	stmt := `delete from users where id = $1`
 
 	_, err := m.DB.ExecContext(ctx, stmt, id)
@@ -182,21 +652,28 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
+	hashedPassword, err := m.Hasher.Hash(user.Password)
 	if err != nil {
 		return 0, err
 	}
 
+	return insertUser(ctx, m.DB, user, hashedPassword)
+}
+
+// insertUser inserts a new user, in the database or a transaction, with a password that has already been hashed.
+func insertUser(ctx context.Context, db querier, user data.User, hashedPassword string) (int, error) {
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, is_admin, external_id, deactivated_at,
+		created_at, updated_at) values ($1, $2, $3, $4, $5, nullif($6, ''), $7, $8, $9) returning id`
 
-	err = m.DB.QueryRowContext(ctx, stmt,
+	err := db.QueryRowContext(ctx, stmt,
 		user.Email,
 		user.FirstName,
 		user.LastName,
 		hashedPassword,
 		user.IsAdmin,
+		user.ExternalID,
+		user.DeactivatedAt,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -205,15 +682,45 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 		return 0, err
 	}
 
+	// everyone has the user role
+	stmt = `insert into user_roles (user_id, role_id) select $1, id from roles where name = $2`
+
+	_, err = db.ExecContext(ctx, stmt, newID, data.RoleUser)
+
+	if err != nil {
+		return 0, err
+	}
+
+	err = syncAdminRole(ctx, db, newID, user.IsAdmin)
+
+	if err != nil {
+		return 0, err
+	}
+
 	return newID, nil
 }
 
+// syncAdminRole gives the user the admin role if isAdmin is 1, and takes it away otherwise, so that code still
+// setting IsAdmin keeps working.
+func syncAdminRole(ctx context.Context, db querier, userID, isAdmin int) error {
+	stmt := `delete from user_roles where user_id = $1 and role_id = (select id from roles where name = $2)`
+
+	if isAdmin == 1 {
+		stmt = `insert into user_roles (user_id, role_id) select $1, id from roles where name = $2
+			on conflict do nothing`
+	}
+
+	_, err := db.ExecContext(ctx, stmt, userID, data.RoleAdmin)
+
+	return err
+}
+
 // ResetPassword is the method we will use to change a user's password.
 func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
 	defer cancel()
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hashedPassword, err := m.Hasher.Hash(password)
 	if err != nil {
 		return err
 	}
@@ -227,33 +734,1249 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 	return nil
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// importTimeout is how long an import may take; longer than dbTimeout, as it writes many users at once.
+const importTimeout = time.Minute
+
+// ImportUsers creates the users without an id and updates those with one, in one transaction, replacing their
+// password if it is set. Each user is written under a savepoint, so that one who cannot be written does not stop
+// the rest being tried, and every problem is reported; if there are any, or on a dry run, nothing is kept.
+func (m *PostgresDBRepo) ImportUsers(users []data.User, dryRun bool) ([]data.UserImportResult, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), importTimeout)
 	defer cancel()
 
-	stmt := `delete from user_images where id = $1`
+	// hashing is slow on purpose, so it is done before the transaction rather than holding it open
+	hashes := make([]string, len(users))
 
-	_, err := m.DB.ExecContext(ctx, stmt, i.UserID)
+	for i, user := range users {
+		if dryRun || user.Password == "" {
+			continue
+		}
+
+		hash, err := m.Hasher.Hash(user.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		hashes[i] = hash
+	}
 
+	tx, err := m.DB.BeginTx(ctx, nil)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
 
-	var newID int
-	stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
-		values ($1, $2, $3, $4) returning id`
+	results := make([]data.UserImportResult, len(users))
+	failed := false
 
-	err = m.DB.QueryRowContext(ctx, stmt,
-		i.UserID,
-		i.FileName,
-		time.Now(),
-		time.Now(),
-	).Scan(&newID)
+	for i, user := range users {
+		_, err := tx.ExecContext(ctx, `savepoint import_user`)
+		if err != nil {
+			return nil, err
+		}
 
-	if err != nil {
-		return 0, err
+		results[i].ID, err = importUser(ctx, tx, user, hashes[i])
+
+		if err != nil {
+			failed = true
+			results[i].Error = importError(err)
+
+			_, err = tx.ExecContext(ctx, `rollback to savepoint import_user`)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	return newID, nil
+	if dryRun || failed {
+		return results, nil
+	}
+
+	return results, tx.Commit()
+}
+
+// importUser writes one imported user in a transaction, returning their id.
+func importUser(ctx context.Context, tx querier, user data.User, hashedPassword string) (int, error) {
+	if user.ID == 0 {
+		id, err := insertUser(ctx, tx, user, hashedPassword)
+		if err != nil {
+			return 0, err
+		}
+
+		user.ID = id
+	} else if hashedPassword != "" {
+		_, err := tx.ExecContext(ctx, `update users set password = $1 where id = $2`, hashedPassword, user.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return user.ID, updateUser(ctx, tx, user)
+}
+
+// importError describes why a user could not be imported, in words an administrator can act on where possible.
+func importError(err error) string {
+	var pgErr *pgconn.PgError
+
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && pgErr.ConstraintName == "users_handle_idx" {
+		return "Someone else has that handle"
+	}
+
+	return err.Error()
+}
+
+// InsertUserImage inserts a user profile image into the database. Earlier images are kept as the user's history;
+// see DeleteUserImage.
+func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into user_images (user_id, file_name, file_size, blur_hash, dominant_color, created_at, updated_at,
+		original_file_name, animated) values ($1, $2, $3, $4, $5, $6, $7, nullif($8, ''), $9) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		i.UserID,
+		i.FileName,
+		i.FileSize,
+		i.BlurHash,
+		i.DominantColor,
+		time.Now(),
+		time.Now(),
+		i.OriginalFileName,
+		i.Animated,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetUserImages returns all of a user's profile images, newest first
+func (m *PostgresDBRepo) GetUserImages(userID int) ([]*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, file_name, coalesce(file_size, 0), coalesce(blur_hash, ''),
+		coalesce(dominant_color, ''), created_at, updated_at, coalesce(original_file_name, ''), animated
+		from user_images where user_id = $1 order by created_at desc, id desc`
+
+	return m.queryUserImages(ctx, query, userID)
+}
+
+// GetSharedUserImages returns the profile images, of any user, which are stored under the same file name as an older
+// image, oldest first.
+func (m *PostgresDBRepo) GetSharedUserImages() ([]*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select i.id, i.user_id, i.file_name, coalesce(i.file_size, 0), coalesce(i.blur_hash, ''),
+		coalesce(i.dominant_color, ''), i.created_at, i.updated_at, coalesce(i.original_file_name, ''), i.animated
+		from user_images i
+		where exists (select 1 from user_images o where o.file_name = i.file_name and o.id < i.id)
+		order by i.id`
+
+	return m.queryUserImages(ctx, query)
+}
+
+// queryUserImages runs a query selecting user images and scans the rows.
+func (m *PostgresDBRepo) queryUserImages(ctx context.Context, query string, args ...any) ([]*data.UserImage, error) {
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var images []*data.UserImage
+
+	for rows.Next() {
+		var image data.UserImage
+		err := rows.Scan(
+			&image.ID,
+			&image.UserID,
+			&image.FileName,
+			&image.FileSize,
+			&image.BlurHash,
+			&image.DominantColor,
+			&image.CreatedAt,
+			&image.UpdatedAt,
+			&image.OriginalFileName,
+			&image.Animated,
+		)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		images = append(images, &image)
+	}
+
+	return images, rows.Err()
+}
+
+// GetUserImageByFileName returns the user profile image stored under fileName, which may be any of the user's
+// images, not only their current one.
+func (m *PostgresDBRepo) GetUserImageByFileName(fileName string) (*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, file_name, coalesce(file_size, 0), coalesce(blur_hash, ''),
+		coalesce(dominant_color, ''), created_at, updated_at, coalesce(original_file_name, ''), animated
+		from user_images where file_name = $1`
+
+	var image data.UserImage
+
+	err := m.DB.QueryRowContext(ctx, query, fileName).Scan(
+		&image.ID,
+		&image.UserID,
+		&image.FileName,
+		&image.FileSize,
+		&image.BlurHash,
+		&image.DominantColor,
+		&image.CreatedAt,
+		&image.UpdatedAt,
+		&image.OriginalFileName,
+		&image.Animated,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &image, nil
+}
+
+// UserImageFileInUse reports whether any user's profile image, including those of deleted users, is stored under
+// fileName.
+func (m *PostgresDBRepo) UserImageFileInUse(fileName string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var inUse bool
+	err := m.DB.QueryRowContext(ctx, `select exists (select 1 from user_images where file_name = $1)`, fileName).Scan(&inUse)
+
+	return inUse, err
+}
+
+// RenameUserImage changes the file name a user profile image is stored under.
+func (m *PostgresDBRepo) RenameUserImage(id int, fileName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update user_images set file_name = $1, updated_at = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, fileName, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteUserImage deletes one user profile image from the database, by id
+func (m *PostgresDBRepo) DeleteUserImage(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from user_images where id = $1`
+
+	_, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RecordUpload records that a user is uploading fileSize bytes, for rate limiting, unless they have already made limit
+// uploads since the given time, in which case it returns false. Concurrent uploads by the same user are recorded one
+// at a time, so they cannot all slip under the limit. A limit of zero or less means no limit.
+func (m *PostgresDBRepo) RecordUpload(userID int, fileSize int64, since time.Time, limit int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// lock the user's row so their uploads are counted and recorded in turn
+	_, err = tx.ExecContext(ctx, `select id from users where id = $1 for update`, userID)
+	if err != nil {
+		return false, err
+	}
+
+	if limit > 0 {
+		var count int
+		err = tx.QueryRowContext(ctx, `select count(*) from upload_events where user_id = $1 and created_at >= $2`,
+			userID, since).Scan(&count)
+		if err != nil {
+			return false, err
+		}
+
+		if count >= limit {
+			return false, nil
+		}
+	}
+
+	stmt := `insert into upload_events (user_id, file_size, created_at) values ($1, $2, $3)`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, fileSize, time.Now())
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+// CountUploadsSince returns how many uploads a user has made since the given time.
+func (m *PostgresDBRepo) CountUploadsSince(userID int, since time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select count(*) from upload_events where user_id = $1 and created_at >= $2`
+
+	var count int
+	err := m.DB.QueryRowContext(ctx, query, userID, since).Scan(&count)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// UpdateUserQuota replaces a user's upload quota overrides.
+func (m *PostgresDBRepo) UpdateUserQuota(userID int, quota data.UploadQuota) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update users set
+		quota_bytes = $1,
+		quota_images = $2,
+		quota_uploads_per_hour = $3,
+		updated_at = $4
+		where id = $5
+	`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		quota.MaxBytes,
+		quota.MaxImages,
+		quota.MaxUploadsPerHour,
+		time.Now(),
+		userID,
+	)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertPersonalAccessToken stores a new personal access token, of which only the hash is kept, and returns its id.
+func (m *PostgresDBRepo) InsertPersonalAccessToken(t data.PersonalAccessToken, tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into personal_access_tokens (user_id, name, token_hash, scopes, expires_at, created_at)
+		values ($1, $2, $3, $4, $5, $6) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.Name,
+		tokenHash,
+		strings.Join(t.Scopes, " "),
+		t.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+const personalAccessTokenColumns = `id, user_id, name, scopes, expires_at, last_used_at, coalesce(last_used_ip, ''), created_at`
+
+func scanPersonalAccessToken(row interface{ Scan(...any) error }) (*data.PersonalAccessToken, error) {
+	var t data.PersonalAccessToken
+	var scopes string
+
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.Name,
+		&scopes,
+		&t.ExpiresAt,
+		&t.LastUsedAt,
+		&t.LastUsedIP,
+		&t.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.Scopes = strings.Fields(scopes)
+
+	return &t, nil
+}
+
+// GetPersonalAccessTokens returns a user's personal access tokens, newest first
+func (m *PostgresDBRepo) GetPersonalAccessTokens(userID int) ([]*data.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + personalAccessTokenColumns + `
+		from personal_access_tokens where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*data.PersonalAccessToken
+
+	for rows.Next() {
+		t, err := scanPersonalAccessToken(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		tokens = append(tokens, t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// GetPersonalAccessTokenByHash returns the personal access token with the given hash
+func (m *PostgresDBRepo) GetPersonalAccessTokenByHash(tokenHash string) (*data.PersonalAccessToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + personalAccessTokenColumns + ` from personal_access_tokens where token_hash = $1`
+
+	return scanPersonalAccessToken(m.DB.QueryRowContext(ctx, query, tokenHash))
+}
+
+// TouchPersonalAccessToken records when, and from where, a personal access token was last used.
+func (m *PostgresDBRepo) TouchPersonalAccessToken(id int, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update personal_access_tokens set last_used_at = $1, last_used_ip = $2 where id = $3`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), ip, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeletePersonalAccessToken revokes one of a user's personal access tokens. Tokens belonging to anyone else are left
+// alone, and sql.ErrNoRows is returned.
+func (m *PostgresDBRepo) DeletePersonalAccessToken(userID, id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from personal_access_tokens where id = $1 and user_id = $2`
+
+	result, err := m.DB.ExecContext(ctx, stmt, id, userID)
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// InsertRefreshToken stores a new refresh token, of which only the hash is kept, and returns its id.
+func (m *PostgresDBRepo) InsertRefreshToken(t data.RefreshToken, tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into refresh_tokens (user_id, family_id, token_hash, expires_at, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		t.UserID,
+		t.FamilyID,
+		tokenHash,
+		t.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetRefreshTokenByHash returns the refresh token with the given hash
+func (m *PostgresDBRepo) GetRefreshTokenByHash(tokenHash string) (*data.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, family_id, expires_at, used_at, revoked_at, created_at
+		from refresh_tokens where token_hash = $1`
+
+	var t data.RefreshToken
+	row := m.DB.QueryRowContext(ctx, query, tokenHash)
+
+	err := row.Scan(
+		&t.ID,
+		&t.UserID,
+		&t.FamilyID,
+		&t.ExpiresAt,
+		&t.UsedAt,
+		&t.RevokedAt,
+		&t.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// UseRefreshToken marks a refresh token as used. It returns false if the token had already been used, which means
+// it has been stolen or replayed.
+func (m *PostgresDBRepo) UseRefreshToken(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	// checking used_at in the same statement means two requests racing with one token cannot both succeed
+	stmt := `update refresh_tokens set used_at = $1 where id = $2 and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return updated == 1, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login.
+func (m *PostgresDBRepo) RevokeRefreshTokenFamily(familyID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where family_id = $2 and revoked_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), familyID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// InsertUserIdentity links a user to an account at an external identity provider, and returns the link's id.
+func (m *PostgresDBRepo) InsertUserIdentity(i data.UserIdentity) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into user_identities (user_id, issuer, subject, created_at)
+		values ($1, $2, $3, $4) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		i.UserID,
+		i.Issuer,
+		i.Subject,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetUserIdentity returns the link to the account with the given subject at the given identity provider
+func (m *PostgresDBRepo) GetUserIdentity(issuer, subject string) (*data.UserIdentity, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, issuer, subject, created_at
+		from user_identities where issuer = $1 and subject = $2`
+
+	var i data.UserIdentity
+	row := m.DB.QueryRowContext(ctx, query, issuer, subject)
+
+	err := row.Scan(
+		&i.ID,
+		&i.UserID,
+		&i.Issuer,
+		&i.Subject,
+		&i.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// InsertOAuthClient registers an application with our OpenID Connect provider, and returns its id.
+func (m *PostgresDBRepo) InsertOAuthClient(c data.OAuthClient, secretHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into oauth_clients (client_id, client_secret_hash, name, redirect_uris, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		c.ClientID,
+		secretHash,
+		c.Name,
+		strings.Join(c.RedirectURIs, " "),
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+const oauthClientColumns = `id, client_id, client_secret_hash, name, redirect_uris, created_at`
+
+func scanOAuthClient(row interface{ Scan(...any) error }) (*data.OAuthClient, error) {
+	var c data.OAuthClient
+	var redirectURIs string
+
+	err := row.Scan(
+		&c.ID,
+		&c.ClientID,
+		&c.SecretHash,
+		&c.Name,
+		&redirectURIs,
+		&c.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	c.RedirectURIs = strings.Fields(redirectURIs)
+
+	return &c, nil
+}
+
+// GetOAuthClients returns every registered OpenID Connect client, sorted by name
+func (m *PostgresDBRepo) GetOAuthClients() ([]*data.OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + oauthClientColumns + ` from oauth_clients order by name, id`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var clients []*data.OAuthClient
+
+	for rows.Next() {
+		c, err := scanOAuthClient(rows)
+		if err != nil {
+			log.Println("Error scanning", err)
+			return nil, err
+		}
+
+		clients = append(clients, c)
+	}
+
+	return clients, rows.Err()
+}
+
+// GetOAuthClientByClientID returns the OpenID Connect client with the given client id
+func (m *PostgresDBRepo) GetOAuthClientByClientID(clientID string) (*data.OAuthClient, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + oauthClientColumns + ` from oauth_clients where client_id = $1`
+
+	return scanOAuthClient(m.DB.QueryRowContext(ctx, query, clientID))
+}
+
+// DeleteOAuthClient removes an OpenID Connect client, along with its outstanding authorization codes. It returns
+// sql.ErrNoRows if there is no such client.
+func (m *PostgresDBRepo) DeleteOAuthClient(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `delete from oauth_clients where id = $1`
+
+	result, err := m.DB.ExecContext(ctx, stmt, id)
+	if err != nil {
+		return err
+	}
+
+	if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// InsertAuthorizationCode stores a new authorization code, of which only the hash is kept, and returns its id.
+func (m *PostgresDBRepo) InsertAuthorizationCode(c data.AuthorizationCode, codeHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into oauth_authorization_codes (client_id, user_id, code_hash, redirect_uri, scope, nonce,
+		code_challenge, expires_at, created_at) values ($1, $2, $3, $4, $5, $6, $7, $8, $9) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		c.ClientID,
+		c.UserID,
+		codeHash,
+		c.RedirectURI,
+		c.Scope,
+		c.Nonce,
+		c.CodeChallenge,
+		c.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+// GetAuthorizationCodeByHash returns the authorization code with the given hash
+func (m *PostgresDBRepo) GetAuthorizationCodeByHash(codeHash string) (*data.AuthorizationCode, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, client_id, user_id, redirect_uri, scope, nonce, code_challenge, expires_at, used_at,
+		created_at from oauth_authorization_codes where code_hash = $1`
+
+	var c data.AuthorizationCode
+	row := m.DB.QueryRowContext(ctx, query, codeHash)
+
+	err := row.Scan(
+		&c.ID,
+		&c.ClientID,
+		&c.UserID,
+		&c.RedirectURI,
+		&c.Scope,
+		&c.Nonce,
+		&c.CodeChallenge,
+		&c.ExpiresAt,
+		&c.UsedAt,
+		&c.CreatedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &c, nil
+}
+
+// UseAuthorizationCode marks an authorization code as used. It returns false if the code had already been used.
+func (m *PostgresDBRepo) UseAuthorizationCode(id int) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update oauth_authorization_codes set used_at = $1 where id = $2 and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return false, err
+	}
+
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return updated == 1, nil
+}
+
+// AllRoles returns every role, with the permissions it grants, in alphabetical order.
+func (m *PostgresDBRepo) AllRoles() ([]*data.Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			r.id, r.name, coalesce(r.description, ''), r.created_at,
+			coalesce(string_agg(p.name, ' ' order by p.name), '')
+		from
+			roles r
+			left join role_permissions rp on rp.role_id = r.id
+			left join permissions p on p.id = rp.permission_id
+		group by r.id
+		order by r.name`
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*data.Role
+
+	for rows.Next() {
+		var role data.Role
+		var permissions string
+
+		err := rows.Scan(&role.ID, &role.Name, &role.Description, &role.CreatedAt, &permissions)
+		if err != nil {
+			return nil, err
+		}
+
+		role.Permissions = strings.Fields(permissions)
+		roles = append(roles, &role)
+	}
+
+	return roles, rows.Err()
+}
+
+// SetUserRoles replaces a user's roles with the named ones, and keeps is_admin in step with the admin role.
+func (m *PostgresDBRepo) SetUserRoles(userID int, roles []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, `delete from user_roles where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into user_roles (user_id, role_id)
+		select $1, id from roles where name = any(string_to_array($2, ' '))`
+
+	_, err = tx.ExecContext(ctx, stmt, userID, strings.Join(roles, " "))
+	if err != nil {
+		return err
+	}
+
+	isAdmin := 0
+
+	if slices.Contains(roles, data.RoleAdmin) {
+		isAdmin = 1
+	}
+
+	_, err = tx.ExecContext(ctx, `update users set is_admin = $1, updated_at = $2 where id = $3`, isAdmin, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// auditChainLock is the advisory lock held while appending to the audit log, so that two events can never both
+// follow on from the same one.
+const auditChainLock = 7_415_001
+
+// InsertAuditEvent appends an event to the audit log, chaining it to the latest one, and returns its id.
+func (m *PostgresDBRepo) InsertAuditEvent(e data.AuditEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	details, err := data.CanonicalJSON(e.Details)
+	if err != nil {
+		return 0, err
+	}
+
+	e.Details = details
+
+	e.DetailsHash, err = e.HashDetails()
+	if err != nil {
+		return 0, err
+	}
+
+	e.HashVersion = data.AuditHashVersion
+	e.PersonalHash = e.HashPersonal()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	_, err = tx.ExecContext(ctx, `select pg_advisory_xact_lock($1)`, auditChainLock)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.QueryRowContext(ctx, `select hash from audit_events order by id desc limit 1`).Scan(&e.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	// timestamps are kept to the microsecond, so hash what will be read back
+	e.CreatedAt = time.Now().UTC().Truncate(time.Microsecond)
+	e.Hash = e.ComputeHash()
+
+	var newID int
+	stmt := `insert into audit_events (actor_id, target_user_id, action, ip, user_agent, details, created_at,
+			details_hash, personal_hash, hash_version, prev_hash, hash)
+		values (nullif($1, 0), nullif($2, 0), $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) returning id`
+
+	err = tx.QueryRowContext(ctx, stmt,
+		e.ActorID,
+		e.TargetUserID,
+		e.Action,
+		e.IP,
+		e.UserAgent,
+		string(e.Details),
+		e.CreatedAt,
+		e.DetailsHash,
+		e.PersonalHash,
+		e.HashVersion,
+		e.PrevHash,
+		e.Hash,
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, tx.Commit()
+}
+
+// GetAuditEvents returns a page of the audit log, narrowed down by the filter.
+func (m *PostgresDBRepo) GetAuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	order, cursor := "desc", "<"
+
+	if f.Ascending {
+		order, cursor = "asc", ">"
+	}
+
+	query := `
+		select
+			e.id, coalesce(e.actor_id, 0), coalesce(e.target_user_id, 0), e.action, coalesce(e.ip, ''),
+			coalesce(e.user_agent, ''), coalesce(e.details::text, ''), coalesce(e.created_at, 'epoch'),
+			e.details_hash, e.personal_hash, e.hash_version, e.prev_hash, e.hash, e.anonymized_at,
+			coalesce(a.email, ''), coalesce(t.email, '')
+		from
+			audit_events e
+			left join users a on a.id = e.actor_id
+			left join users t on t.id = e.target_user_id
+		where
+			($1 = 0 or e.actor_id = $1)
+			and ($2 = 0 or e.target_user_id = $2)
+			and ($3 = '' or e.action = $3)
+			and ($4::timestamp is null or e.created_at >= $4)
+			and ($5::timestamp is null or e.created_at < $5)
+			and ($6 = 0 or e.id ` + cursor + ` $6)
+		order by e.id ` + order + `
+		limit nullif($7, 0)`
+
+	from := sql.NullTime{Time: f.From, Valid: !f.From.IsZero()}
+	to := sql.NullTime{Time: f.To, Valid: !f.To.IsZero()}
+
+	rows, err := m.DB.QueryContext(ctx, query, f.ActorID, f.TargetUserID, f.Action, from, to, f.Cursor, f.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []*data.AuditEvent
+
+	for rows.Next() {
+		var e data.AuditEvent
+		var details string
+
+		err := rows.Scan(
+			&e.ID,
+			&e.ActorID,
+			&e.TargetUserID,
+			&e.Action,
+			&e.IP,
+			&e.UserAgent,
+			&details,
+			&e.CreatedAt,
+			&e.DetailsHash,
+			&e.PersonalHash,
+			&e.HashVersion,
+			&e.PrevHash,
+			&e.Hash,
+			&e.AnonymizedAt,
+			&e.ActorEmail,
+			&e.TargetEmail,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if details != "" {
+			e.Details = []byte(details)
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, rows.Err()
+}
+
+// AnonymizeAuditEvents removes a user from the audit log by removing all the personal data, whoever it is about, from
+// every event they took part in: who was involved, from where, and the details. Only the action and time are kept,
+// along with the hashes that chain the event to the others.
+func (m *PostgresDBRepo) AnonymizeAuditEvents(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update audit_events set
+			actor_id = null,
+			target_user_id = null,
+			ip = null,
+			user_agent = null,
+			details = null,
+			anonymized_at = $2
+		where (actor_id = $1 or target_user_id = $1) and anonymized_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, time.Now())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// GetRefreshTokens returns a user's refresh tokens, newest first
+func (m *PostgresDBRepo) GetRefreshTokens(userID int) ([]*data.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select id, user_id, family_id, expires_at, used_at, revoked_at, created_at
+		from refresh_tokens where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []*data.RefreshToken
+
+	for rows.Next() {
+		var t data.RefreshToken
+
+		err := rows.Scan(
+			&t.ID,
+			&t.UserID,
+			&t.FamilyID,
+			&t.ExpiresAt,
+			&t.UsedAt,
+			&t.RevokedAt,
+			&t.CreatedAt,
+		)
+
+		if err != nil {
+			return nil, err
+		}
+
+		tokens = append(tokens, &t)
+	}
+
+	return tokens, rows.Err()
+}
+
+// InsertDataExport records that a user has asked for their data, of which only the hash of the download token is
+// kept, and returns its id.
+func (m *PostgresDBRepo) InsertDataExport(e data.DataExport, tokenHash string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	var newID int
+	stmt := `insert into data_exports (user_id, token_hash, status, expires_at, created_at)
+		values ($1, $2, $3, $4, $5) returning id`
+
+	err := m.DB.QueryRowContext(ctx, stmt,
+		e.UserID,
+		tokenHash,
+		data.ExportPending,
+		e.ExpiresAt,
+		time.Now(),
+	).Scan(&newID)
+
+	if err != nil {
+		return 0, err
+	}
+
+	return newID, nil
+}
+
+const dataExportColumns = `id, user_id, file_name, status, expires_at, created_at, completed_at`
+
+func scanDataExport(row interface{ Scan(...any) error }) (*data.DataExport, error) {
+	var e data.DataExport
+
+	err := row.Scan(
+		&e.ID,
+		&e.UserID,
+		&e.FileName,
+		&e.Status,
+		&e.ExpiresAt,
+		&e.CreatedAt,
+		&e.CompletedAt,
+	)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &e, nil
+}
+
+// GetDataExportByHash returns the data export whose download token has the given hash
+func (m *PostgresDBRepo) GetDataExportByHash(tokenHash string) (*data.DataExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + dataExportColumns + ` from data_exports where token_hash = $1`
+
+	return scanDataExport(m.DB.QueryRowContext(ctx, query, tokenHash))
+}
+
+// GetDataExports returns a user's data exports, newest first
+func (m *PostgresDBRepo) GetDataExports(userID int) ([]*data.DataExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + dataExportColumns + ` from data_exports where user_id = $1 order by created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []*data.DataExport
+
+	for rows.Next() {
+		e, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		exports = append(exports, e)
+	}
+
+	return exports, rows.Err()
+}
+
+// GetExpiredDataExports returns every user's data exports which expired before the given time, oldest first.
+func (m *PostgresDBRepo) GetExpiredDataExports(before time.Time) ([]*data.DataExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	query := `select ` + dataExportColumns + ` from data_exports where expires_at < $1 order by expires_at, id`
+
+	rows, err := m.DB.QueryContext(ctx, query, before)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []*data.DataExport
+
+	for rows.Next() {
+		e, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		exports = append(exports, e)
+	}
+
+	return exports, rows.Err()
+}
+
+// FinishDataExport records that building an export has finished, successfully or not. It returns sql.ErrNoRows if
+// the export has been deleted since, so that its file can be removed.
+func (m *PostgresDBRepo) FinishDataExport(id int, status, fileName string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	stmt := `update data_exports set status = $1, file_name = $2, completed_at = $3 where id = $4`
+
+	result, err := m.DB.ExecContext(ctx, stmt, status, fileName, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteDataExports forgets all of a user's data exports; their files are the caller's to remove.
+func (m *PostgresDBRepo) DeleteDataExports(userID int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from data_exports where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// DeleteDataExport forgets one data export, by id.
+func (m *PostgresDBRepo) DeleteDataExport(id int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, `delete from data_exports where id = $1`, id)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
@@ -6,6 +6,7 @@ package dbrepo
 
 import (
 	"database/sql"
+	"errors"
 	"fmt"
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v5"
@@ -16,6 +17,8 @@ import (
 	"github.com/spartanhooah/profile-picture-web/db/repository"
 	"log"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -231,10 +234,62 @@ func Test_PostgresDBRepo_UpdateUser(t *testing.T) {
 	if user.Email != "jane@example.com" {
 		t.Errorf("Incorrect email returned; expected jane@example.com but got %s", user.Email)
 	}
+
+	user.DisplayName = "JJ"
+	user.Pronouns = "she/her"
+	user.Bio = "Likes long walks"
+	user.Timezone = "Europe/London"
+	user.Locale = "en-GB"
+
+	err = testRepo.UpdateUser(*user)
+
+	if err != nil {
+		t.Errorf("Error updating profile: %s", err)
+	}
+
+	updated, _ := testRepo.GetUser(2)
+
+	if updated.DisplayName != "JJ" || updated.Pronouns != "she/her" || updated.Bio != "Likes long walks" ||
+		updated.Timezone != "Europe/London" || updated.Locale != "en-GB" || updated.JobTitle != "" {
+		t.Errorf("Expected the profile to be saved, got %+v", updated)
+	}
+
+	if updated.ProfileVisibility != data.ProfileVisibilityMembers {
+		t.Errorf("Expected profiles to be for members by default, got %q", updated.ProfileVisibility)
+	}
+
+	updated.Handle = "jj"
+	updated.ProfileVisibility = data.ProfileVisibilityPublic
+
+	err = testRepo.UpdateUser(*updated)
+
+	if err != nil {
+		t.Errorf("Error setting handle: %s", err)
+	}
+
+	byHandle, err := testRepo.GetUserByHandle("jj")
+
+	if err != nil || byHandle.ID != 2 || byHandle.ProfileVisibility != data.ProfileVisibilityPublic {
+		t.Errorf("Expected user 2 by handle with a public profile, got %+v %v", byHandle, err)
+	}
+
+	// handles are unique
+	other, _ := testRepo.GetUser(1)
+	other.Handle = "jj"
+
+	if err := testRepo.UpdateUser(*other); err == nil {
+		t.Error("Expected a second user with the same handle to be refused")
+	}
 }
 
 func Test_PostgresDBRepo_DeleteUser(t *testing.T) {
-	err := testRepo.DeleteUser(2)
+	user, err := testRepo.GetUser(2)
+
+	if err != nil {
+		t.Fatalf("Error getting user 2: %s", err)
+	}
+
+	err = testRepo.DeleteUser(2)
 
 	if err != nil {
 		t.Errorf("Error deleting user: %s", err)
@@ -245,6 +300,50 @@ func Test_PostgresDBRepo_DeleteUser(t *testing.T) {
 	if err == nil {
 		t.Errorf("Found user 2 but that user should have been deleted")
 	}
+
+	if _, err := testRepo.GetUserByEmail(user.Email); err == nil {
+		t.Errorf("Found user 2 by email but that user should have been deleted")
+	}
+
+	users, _ := testRepo.AllUsers()
+
+	for _, u := range users {
+		if u.ID == 2 {
+			t.Errorf("Expected deleted users to be left out of all users")
+		}
+	}
+
+	deleted, err := testRepo.GetDeletedUsers(time.Now().Add(time.Second))
+
+	if err != nil || len(deleted) != 1 || deleted[0].ID != 2 || deleted[0].DeletedAt == nil {
+		t.Fatalf("Expected user 2 to be listed as deleted, got %+v %v", deleted, err)
+	}
+
+	// a user deleted before the retention window cannot be restored
+	if err := testRepo.RestoreUser(2, time.Now().Add(time.Minute)); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows restoring a user past the retention window, got %v", err)
+	}
+
+	err = testRepo.RestoreUser(2, time.Now().Add(-time.Hour))
+
+	if err != nil {
+		t.Fatalf("Error restoring user: %s", err)
+	}
+
+	if _, err := testRepo.GetUser(2); err != nil {
+		t.Errorf("Expected user 2 to be restored, got %s", err)
+	}
+
+	_ = testRepo.DeleteUser(2)
+	err = testRepo.PurgeUser(2)
+
+	if err != nil {
+		t.Errorf("Error purging user: %s", err)
+	}
+
+	if deleted, _ := testRepo.GetDeletedUsers(time.Now().Add(time.Second)); len(deleted) != 0 {
+		t.Errorf("Expected user 2 to be purged, got %+v", deleted)
+	}
 }
 
 func Test_PostgresDBRepo_ResetPassword(t *testing.T) {
@@ -265,14 +364,35 @@ func Test_PostgresDBRepo_ResetPassword(t *testing.T) {
 	if !matches {
 		t.Errorf("Password did not match")
 	}
+
+	if !strings.HasPrefix(user.Password, "$argon2id$") {
+		t.Errorf("Expected an argon2id hash by default, got %s", user.Password)
+	}
+
+	// hashes made with another algorithm can still be checked
+	bcryptRepo := &PostgresDBRepo{DB: testDB, Hasher: data.PasswordHasher{Algorithm: data.PasswordHashBcrypt, BcryptCost: 4}}
+
+	err = bcryptRepo.ResetPassword(1, "password")
+
+	if err != nil {
+		t.Errorf("Error resetting password: %s", err)
+	}
+
+	user, _ = testRepo.GetUser(1)
+
+	if matches, _ := user.PasswordMatches("password"); !matches || !strings.HasPrefix(user.Password, "$2a$04$") {
+		t.Errorf("Expected a matching bcrypt hash, got %s", user.Password)
+	}
 }
 
 func Test_PostgresDBRepo_InsertUserImage(t *testing.T) {
 	image := data.UserImage{
-		UserID:    1,
-		FileName:  "test.jpg",
-		CreatedAt: time.Now(),
-		UpdatedAt: time.Now(),
+		UserID:        1,
+		FileName:      "test.jpg",
+		BlurHash:      "LEHV6nWB2yk8pyo0adR*.7kCMdnj",
+		DominantColor: "#a0b0c0",
+		CreatedAt:     time.Now(),
+		UpdatedAt:     time.Now(),
 	}
 
 	imageId, err := testRepo.InsertUserImage(image)
@@ -285,6 +405,12 @@ func Test_PostgresDBRepo_InsertUserImage(t *testing.T) {
 		t.Errorf("Incorrect id returned; expected 1 but got %d", imageId)
 	}
 
+	user, _ := testRepo.GetUser(1)
+
+	if user.ProfilePicture.BlurHash != image.BlurHash || user.ProfilePicture.DominantColor != image.DominantColor {
+		t.Errorf("Placeholders not stored; got %q and %q", user.ProfilePicture.BlurHash, user.ProfilePicture.DominantColor)
+	}
+
 	image.UserID = 100
 
 	_, err = testRepo.InsertUserImage(image)
@@ -293,3 +419,1024 @@ func Test_PostgresDBRepo_InsertUserImage(t *testing.T) {
 		t.Errorf("Should not have been able attach image to nonexistent user")
 	}
 }
+
+func Test_PostgresDBRepo_UserImageHistory(t *testing.T) {
+	animated := true
+	image := data.UserImage{
+		UserID:           1,
+		FileName:         "newer.jpg",
+		OriginalFileName: "holiday.jpg",
+		FileSize:         2048,
+		Animated:         &animated,
+	}
+
+	newerID, err := testRepo.InsertUserImage(image)
+
+	if err != nil {
+		t.Fatalf("Error inserting image: %s", err)
+	}
+
+	// the earlier image is kept as history
+	images, err := testRepo.GetUserImages(1)
+
+	if err != nil {
+		t.Fatalf("Error getting images: %s", err)
+	}
+
+	if len(images) != 2 {
+		t.Fatalf("Expected 2 images in history, got %d", len(images))
+	}
+
+	if images[0].ID != newerID || images[0].FileSize != 2048 || images[0].OriginalFileName != "holiday.jpg" {
+		t.Errorf("Expected the newest image first, got %+v", images[0])
+	}
+
+	if images[0].Animated == nil || !*images[0].Animated || images[1].Animated != nil {
+		t.Errorf("Expected only the newest image to be recorded as animated, got %v and %v", images[0].Animated, images[1].Animated)
+	}
+
+	user, _ := testRepo.GetUser(1)
+
+	if user.ProfilePicture.FileName != "newer.jpg" {
+		t.Errorf("Expected the newest image to be the profile picture, got %s", user.ProfilePicture.FileName)
+	}
+
+	err = testRepo.DeleteUserImage(images[1].ID)
+
+	if err != nil {
+		t.Errorf("Error deleting image: %s", err)
+	}
+
+	images, _ = testRepo.GetUserImages(1)
+
+	if len(images) != 1 {
+		t.Errorf("Expected 1 image after deleting, got %d", len(images))
+	}
+
+	for fileName, expected := range map[string]bool{"newer.jpg": true, "test.jpg": false} {
+		if inUse, err := testRepo.UserImageFileInUse(fileName); err != nil || inUse != expected {
+			t.Errorf("Expected %s in use to be %t, got %t %v", fileName, expected, inUse, err)
+		}
+	}
+
+	// no two images may be stored under the same name
+	_, err = testRepo.InsertUserImage(data.UserImage{UserID: 1, FileName: "newer.jpg"})
+
+	if err == nil {
+		t.Errorf("Should not have been able to store two images under the same name")
+	}
+
+	shared, err := testRepo.GetSharedUserImages()
+
+	if err != nil || len(shared) != 0 {
+		t.Errorf("Expected no images sharing a file, got %d %v", len(shared), err)
+	}
+}
+
+func Test_PostgresDBRepo_RenameUserImage(t *testing.T) {
+	id, err := testRepo.InsertUserImage(data.UserImage{UserID: 1, FileName: "before-rename.png"})
+
+	if err != nil {
+		t.Fatalf("Error inserting image: %s", err)
+	}
+
+	err = testRepo.RenameUserImage(id, "after-rename.png")
+
+	if err != nil {
+		t.Fatalf("Error renaming image: %s", err)
+	}
+
+	image, err := testRepo.GetUserImageByFileName("after-rename.png")
+
+	if err != nil || image.ID != id {
+		t.Errorf("Expected to find the renamed image, got %+v %v", image, err)
+	}
+
+	_ = testRepo.DeleteUserImage(id)
+}
+
+func Test_PostgresDBRepo_GetUserImageByFileName(t *testing.T) {
+	image, err := testRepo.GetUserImageByFileName("newer.jpg")
+
+	if err != nil {
+		t.Fatalf("Error getting image: %s", err)
+	}
+
+	if image.UserID != 1 {
+		t.Errorf("Expected the image to belong to user 1, got %d", image.UserID)
+	}
+
+	_, err = testRepo.GetUserImageByFileName("nope.jpg")
+
+	if err == nil {
+		t.Errorf("Should not have found an image that was never uploaded")
+	}
+
+	user, _ := testRepo.GetUser(1)
+
+	if user.AvatarVisibility != data.AvatarVisibilityPublic {
+		t.Errorf("Expected avatars to be public by default, got %q", user.AvatarVisibility)
+	}
+
+	user.AvatarVisibility = data.AvatarVisibilityPrivate
+
+	err = testRepo.UpdateUser(*user)
+
+	if err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	user, _ = testRepo.GetUser(1)
+
+	if user.AvatarVisibility != data.AvatarVisibilityPrivate {
+		t.Errorf("Expected the avatar to be private, got %q", user.AvatarVisibility)
+	}
+
+	user.AvatarVisibility = data.AvatarVisibilityPublic
+	_ = testRepo.UpdateUser(*user)
+}
+
+func Test_PostgresDBRepo_Uploads(t *testing.T) {
+	before := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if recorded, err := testRepo.RecordUpload(1, 1024, before, 3); err != nil || !recorded {
+			t.Fatalf("Error recording upload: %t %v", recorded, err)
+		}
+	}
+
+	recorded, err := testRepo.RecordUpload(1, 1024, before, 3)
+
+	if err != nil || recorded {
+		t.Errorf("Expected an upload over the limit not to be recorded, got %t %v", recorded, err)
+	}
+
+	count, err := testRepo.CountUploadsSince(1, before)
+
+	if err != nil {
+		t.Errorf("Error counting uploads: %s", err)
+	}
+
+	if count != 3 {
+		t.Errorf("Expected 3 uploads, got %d", count)
+	}
+
+	count, _ = testRepo.CountUploadsSince(1, time.Now().Add(time.Minute))
+
+	if count != 0 {
+		t.Errorf("Expected no uploads in the future, got %d", count)
+	}
+}
+
+func Test_PostgresDBRepo_UpdateUserQuota(t *testing.T) {
+	maxBytes, maxImages := int64(1024*1024), 0
+
+	err := testRepo.UpdateUserQuota(1, data.UploadQuota{MaxBytes: &maxBytes, MaxImages: &maxImages})
+
+	if err != nil {
+		t.Errorf("Error updating quota: %s", err)
+	}
+
+	user, _ := testRepo.GetUser(1)
+
+	if user.Quota.MaxBytes == nil || *user.Quota.MaxBytes != maxBytes {
+		t.Errorf("Expected byte quota of %d, got %v", maxBytes, user.Quota.MaxBytes)
+	}
+
+	if user.Quota.MaxImages == nil || *user.Quota.MaxImages != 0 {
+		t.Errorf("Expected image quota of 0, got %v", user.Quota.MaxImages)
+	}
+
+	if user.Quota.MaxUploadsPerHour != nil {
+		t.Errorf("Expected no upload rate override, got %d", *user.Quota.MaxUploadsPerHour)
+	}
+
+	// clearing the overrides goes back to the defaults
+	_ = testRepo.UpdateUserQuota(1, data.UploadQuota{})
+	user, _ = testRepo.GetUser(1)
+
+	if user.Quota.MaxBytes != nil || user.Quota.MaxImages != nil {
+		t.Errorf("Expected overrides to be cleared, got %+v", user.Quota)
+	}
+}
+
+func Test_PostgresDBRepo_PersonalAccessTokens(t *testing.T) {
+	expires := time.Now().UTC().Add(time.Hour).Truncate(time.Microsecond)
+	token := data.PersonalAccessToken{
+		UserID:    1,
+		Name:      "backup script",
+		Scopes:    []string{"avatar:read", "avatar:write"},
+		ExpiresAt: &expires,
+	}
+
+	id, err := testRepo.InsertPersonalAccessToken(token, strings.Repeat("a", 64))
+
+	if err != nil {
+		t.Fatalf("Error inserting token: %s", err)
+	}
+
+	_, err = testRepo.InsertPersonalAccessToken(token, strings.Repeat("a", 64))
+
+	if err == nil {
+		t.Error("Should not have been able to insert a token with the same hash")
+	}
+
+	found, err := testRepo.GetPersonalAccessTokenByHash(strings.Repeat("a", 64))
+
+	if err != nil {
+		t.Fatalf("Error getting token by hash: %s", err)
+	}
+
+	if found.ID != id || len(found.Scopes) != 2 || found.Scopes[1] != "avatar:write" || found.LastUsedAt != nil {
+		t.Errorf("Unexpected token %+v", found)
+	}
+
+	if found.ExpiresAt == nil || !found.ExpiresAt.Equal(expires) {
+		t.Errorf("Expected expiry %s, got %v", expires, found.ExpiresAt)
+	}
+
+	err = testRepo.TouchPersonalAccessToken(id, "192.0.2.1")
+
+	if err != nil {
+		t.Errorf("Error touching token: %s", err)
+	}
+
+	tokens, err := testRepo.GetPersonalAccessTokens(1)
+
+	if err != nil || len(tokens) != 1 {
+		t.Fatalf("Expected 1 token, got %d (%v)", len(tokens), err)
+	}
+
+	if tokens[0].LastUsedAt == nil || tokens[0].LastUsedIP != "192.0.2.1" {
+		t.Errorf("Expected last use to be recorded, got %+v", tokens[0])
+	}
+
+	if err := testRepo.DeletePersonalAccessToken(2, id); err != sql.ErrNoRows {
+		t.Errorf("Expected another user's delete to find nothing, got %v", err)
+	}
+
+	if err := testRepo.DeletePersonalAccessToken(1, id); err != nil {
+		t.Errorf("Error deleting token: %s", err)
+	}
+
+	if _, err := testRepo.GetPersonalAccessTokenByHash(strings.Repeat("a", 64)); err == nil {
+		t.Error("Expected a revoked token not to be found")
+	}
+}
+
+func Test_PostgresDBRepo_RefreshTokens(t *testing.T) {
+	token := data.RefreshToken{
+		UserID:    1,
+		FamilyID:  "family-one",
+		ExpiresAt: time.Now().Add(time.Hour),
+	}
+
+	_, err := testRepo.InsertRefreshToken(token, strings.Repeat("b", 64))
+
+	if err != nil {
+		t.Fatalf("Error inserting refresh token: %s", err)
+	}
+
+	_, err = testRepo.InsertRefreshToken(token, strings.Repeat("c", 64))
+
+	if err != nil {
+		t.Fatalf("Error inserting refresh token: %s", err)
+	}
+
+	found, err := testRepo.GetRefreshTokenByHash(strings.Repeat("b", 64))
+
+	if err != nil {
+		t.Fatalf("Error getting refresh token: %s", err)
+	}
+
+	if found.FamilyID != "family-one" || found.UsedAt != nil || found.RevokedAt != nil {
+		t.Errorf("Unexpected refresh token %+v", found)
+	}
+
+	used, err := testRepo.UseRefreshToken(found.ID)
+
+	if err != nil || !used {
+		t.Errorf("Expected the first use to succeed, got %t (%v)", used, err)
+	}
+
+	used, _ = testRepo.UseRefreshToken(found.ID)
+
+	if used {
+		t.Error("Expected a second use to be refused")
+	}
+
+	err = testRepo.RevokeRefreshTokenFamily("family-one")
+
+	if err != nil {
+		t.Errorf("Error revoking family: %s", err)
+	}
+
+	sibling, _ := testRepo.GetRefreshTokenByHash(strings.Repeat("c", 64))
+
+	if sibling.RevokedAt == nil {
+		t.Error("Expected every token in the family to be revoked")
+	}
+}
+
+func Test_PostgresDBRepo_UserIdentities(t *testing.T) {
+	identity := data.UserIdentity{
+		UserID:  1,
+		Issuer:  "https://idp.example.com",
+		Subject: "subject-one",
+	}
+
+	_, err := testRepo.InsertUserIdentity(identity)
+
+	if err != nil {
+		t.Fatalf("Error inserting identity: %s", err)
+	}
+
+	// a subject can only be linked once per issuer
+	_, err = testRepo.InsertUserIdentity(identity)
+
+	if err == nil {
+		t.Error("Expected linking the same subject twice to fail")
+	}
+
+	found, err := testRepo.GetUserIdentity("https://idp.example.com", "subject-one")
+
+	if err != nil {
+		t.Fatalf("Error getting identity: %s", err)
+	}
+
+	if found.UserID != 1 {
+		t.Errorf("Expected user 1, got %d", found.UserID)
+	}
+
+	_, err = testRepo.GetUserIdentity("https://other.example.com", "subject-one")
+
+	if err == nil {
+		t.Error("Expected the subject to be unknown at another issuer")
+	}
+}
+
+func Test_PostgresDBRepo_OAuthClients(t *testing.T) {
+	client := data.OAuthClient{
+		ClientID:     "client-one",
+		Name:         "Client One",
+		RedirectURIs: []string{"https://one.example.com/callback", "http://localhost:3000/callback"},
+	}
+
+	clientID, err := testRepo.InsertOAuthClient(client, strings.Repeat("d", 64))
+
+	if err != nil {
+		t.Fatalf("Error inserting client: %s", err)
+	}
+
+	found, err := testRepo.GetOAuthClientByClientID("client-one")
+
+	if err != nil {
+		t.Fatalf("Error getting client: %s", err)
+	}
+
+	if found.SecretHash != strings.Repeat("d", 64) || len(found.RedirectURIs) != 2 || !found.AllowsRedirect("http://localhost:3000/callback") {
+		t.Errorf("Unexpected client %+v", found)
+	}
+
+	code := data.AuthorizationCode{
+		ClientID:      clientID,
+		UserID:        1,
+		RedirectURI:   "https://one.example.com/callback",
+		Scope:         "openid email",
+		Nonce:         "nonce",
+		CodeChallenge: "challenge",
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+
+	_, err = testRepo.InsertAuthorizationCode(code, strings.Repeat("e", 64))
+
+	if err != nil {
+		t.Fatalf("Error inserting authorization code: %s", err)
+	}
+
+	stored, err := testRepo.GetAuthorizationCodeByHash(strings.Repeat("e", 64))
+
+	if err != nil {
+		t.Fatalf("Error getting authorization code: %s", err)
+	}
+
+	if stored.Scope != "openid email" || stored.UsedAt != nil {
+		t.Errorf("Unexpected authorization code %+v", stored)
+	}
+
+	used, err := testRepo.UseAuthorizationCode(stored.ID)
+
+	if err != nil || !used {
+		t.Errorf("Expected the first use to succeed, got %t (%v)", used, err)
+	}
+
+	used, _ = testRepo.UseAuthorizationCode(stored.ID)
+
+	if used {
+		t.Error("Expected a second use to be refused")
+	}
+
+	err = testRepo.DeleteOAuthClient(clientID)
+
+	if err != nil {
+		t.Errorf("Error deleting client: %s", err)
+	}
+
+	// deleting a client deletes its codes
+	_, err = testRepo.GetAuthorizationCodeByHash(strings.Repeat("e", 64))
+
+	if err == nil {
+		t.Error("Expected the client's codes to be deleted")
+	}
+
+	err = testRepo.DeleteOAuthClient(clientID)
+
+	if err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows deleting a missing client, got %v", err)
+	}
+}
+
+func Test_PostgresDBRepo_ProvisionedUser(t *testing.T) {
+	id, err := testRepo.InsertUser(data.User{
+		FirstName:  "Hire",
+		LastName:   "New",
+		Email:      "new.hire@example.com",
+		Password:   "secret",
+		ExternalID: "hr-1001",
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting user: %s", err)
+	}
+
+	user, _ := testRepo.GetUser(id)
+
+	if user.ExternalID != "hr-1001" || !user.Active() {
+		t.Errorf("Expected an active user with external id hr-1001, got %+v", user)
+	}
+
+	now := time.Now()
+	user.DeactivatedAt = &now
+	user.ExternalID = ""
+
+	err = testRepo.UpdateUser(*user)
+
+	if err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	user, _ = testRepo.GetUserByEmail("new.hire@example.com")
+
+	if user.Active() || user.ExternalID != "" {
+		t.Errorf("Expected a deactivated user without an external id, got %+v", user)
+	}
+}
+
+func Test_PostgresDBRepo_Roles(t *testing.T) {
+	roles, err := testRepo.AllRoles()
+
+	if err != nil {
+		t.Fatalf("Error listing roles: %s", err)
+	}
+
+	if len(roles) != 4 || roles[0].Name != data.RoleAdmin || len(roles[0].Permissions) != 9 {
+		t.Fatalf("Expected the four seeded roles, admin first with every permission, got %+v", roles[0])
+	}
+
+	id, err := testRepo.InsertUser(data.User{
+		FirstName: "Mod",
+		LastName:  "Erator",
+		Email:     "moderator@example.com",
+		Password:  "secret",
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting user: %s", err)
+	}
+
+	user, _ := testRepo.GetUser(id)
+
+	if !user.HasRole(data.RoleUser) || len(user.Permissions) != 0 {
+		t.Errorf("Expected a new user to have only the user role, got %v %v", user.Roles, user.Permissions)
+	}
+
+	err = testRepo.SetUserRoles(id, []string{data.RoleUser, data.RoleModerator, data.RoleAdmin})
+
+	if err != nil {
+		t.Fatalf("Error setting roles: %s", err)
+	}
+
+	user, _ = testRepo.GetUserByEmail("moderator@example.com")
+
+	if user.IsAdmin != 1 || !user.Can(data.PermissionAssignRoles) || len(user.Roles) != 3 {
+		t.Errorf("Expected an administrator, got is_admin %d with %v %v", user.IsAdmin, user.Roles, user.Permissions)
+	}
+
+	// older code setting is_admin takes the admin role away
+	user.IsAdmin = 0
+
+	err = testRepo.UpdateUser(*user)
+
+	if err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	user, _ = testRepo.GetUser(id)
+
+	if user.HasRole(data.RoleAdmin) || user.Can(data.PermissionAssignRoles) || !user.Can(data.PermissionModerateImages) {
+		t.Errorf("Expected a moderator, got %v %v", user.Roles, user.Permissions)
+	}
+}
+
+func Test_PostgresDBRepo_AuditEvents(t *testing.T) {
+	targetID, err := testRepo.InsertUser(data.User{
+		FirstName: "Imp",
+		LastName:  "Ersonated",
+		Email:     "impersonated@example.com",
+		Password:  "secret",
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting user: %s", err)
+	}
+
+	firstID, err := testRepo.InsertAuditEvent(data.AuditEvent{
+		TargetUserID: targetID,
+		Action:       data.AuditImpersonationStarted,
+		IP:           "127.0.0.1",
+		UserAgent:    "Go-http-client/1.1",
+		Details:      []byte(`{"reason": "support", "ticket": 12}`),
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting audit event: %s", err)
+	}
+
+	// the actor may be unknown
+	_, err = testRepo.InsertAuditEvent(data.AuditEvent{TargetUserID: targetID, Action: data.AuditImpersonationStopped})
+
+	if err != nil {
+		t.Fatalf("Error inserting an event without an actor: %s", err)
+	}
+
+	events, err := testRepo.GetAuditEvents(data.AuditFilter{TargetUserID: targetID, Ascending: true})
+
+	if err != nil {
+		t.Fatalf("Error listing audit events: %s", err)
+	}
+
+	if len(events) != 2 || events[0].ID != firstID || events[0].TargetEmail != "impersonated@example.com" {
+		t.Fatalf("Expected both events about the user, oldest first, got %+v", events)
+	}
+
+	// what is read back must hash the same as what was written, or the chain could never be verified
+	for _, e := range events {
+		detailsHash, _ := e.HashDetails()
+
+		if detailsHash != e.DetailsHash || e.ComputeHash() != e.Hash {
+			t.Errorf("Expected event %d to hash the same after a round trip, got %+v", e.ID, e)
+		}
+	}
+
+	if events[1].PrevHash != events[0].Hash {
+		t.Errorf("Expected the second event to follow on from the first")
+	}
+
+	events, _ = testRepo.GetAuditEvents(data.AuditFilter{Action: data.AuditImpersonationStopped, Limit: 1})
+
+	if len(events) != 1 || events[0].Action != data.AuditImpersonationStopped {
+		t.Errorf("Expected to filter by action, got %+v", events)
+	}
+
+	_, err = testDB.Exec(`update audit_events set action = 'user.delete' where id = $1`, firstID)
+
+	if err == nil {
+		t.Errorf("Expected audit events to be append-only")
+	}
+
+	// purging a user leaves their events alone
+	err = testRepo.PurgeUser(targetID)
+
+	if err != nil {
+		t.Fatalf("Error deleting a user with audit events: %s", err)
+	}
+
+	events, _ = testRepo.GetAuditEvents(data.AuditFilter{TargetUserID: targetID})
+
+	if len(events) != 2 || events[0].TargetEmail != "" {
+		t.Errorf("Expected the events to outlive the user, got %+v", events)
+	}
+}
+
+func Test_PostgresDBRepo_AnonymizeAuditEvents(t *testing.T) {
+	userID, err := testRepo.InsertUser(data.User{
+		FirstName: "Era",
+		LastName:  "Sed",
+		Email:     "erased@example.com",
+		Password:  "secret",
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting user: %s", err)
+	}
+
+	_, err = testRepo.InsertAuditEvent(data.AuditEvent{
+		ActorID:      userID,
+		TargetUserID: userID,
+		Action:       data.AuditUserUpdated,
+		IP:           "127.0.0.1",
+		UserAgent:    "Go-http-client/1.1",
+		Details:      []byte(`{"email": "erased@example.com"}`),
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting audit event: %s", err)
+	}
+
+	err = testRepo.AnonymizeAuditEvents(userID)
+
+	if err != nil {
+		t.Fatalf("Error anonymizing audit events: %s", err)
+	}
+
+	events, _ := testRepo.GetAuditEvents(data.AuditFilter{Action: data.AuditUserUpdated, Limit: 1})
+
+	if len(events) != 1 {
+		t.Fatalf("Expected the event to be kept, got %+v", events)
+	}
+
+	e := events[0]
+
+	if e.ActorID != 0 || e.TargetUserID != 0 || e.IP != "" || e.UserAgent != "" || e.Details != nil || e.AnonymizedAt == nil {
+		t.Errorf("Expected the event to be anonymized, got %+v", e)
+	}
+
+	// the chain still holds, since the hashes are kept
+	if e.ComputeHash() != e.Hash {
+		t.Errorf("Expected the anonymized event to keep its hash")
+	}
+
+	_, err = testDB.Exec(`update audit_events set anonymized_at = null where id = $1`, e.ID)
+
+	if err == nil {
+		t.Errorf("Expected anonymized events to stay anonymized")
+	}
+
+	// anonymizing may only remove personal data, not change it
+	id, _ := testRepo.InsertAuditEvent(data.AuditEvent{ActorID: 1, Action: data.AuditUserUpdated, IP: "127.0.0.1"})
+
+	_, err = testDB.Exec(`update audit_events set anonymized_at = now(), ip = '10.0.0.1' where id = $1`, id)
+
+	if err == nil {
+		t.Errorf("Expected anonymizing not to be able to change the IP address")
+	}
+}
+
+func Test_PostgresDBRepo_DataExports(t *testing.T) {
+	userID, err := testRepo.InsertUser(data.User{
+		FirstName: "Ex",
+		LastName:  "Porter",
+		Email:     "exporter@example.com",
+		Password:  "secret",
+	})
+
+	if err != nil {
+		t.Fatalf("Error inserting user: %s", err)
+	}
+
+	id, err := testRepo.InsertDataExport(data.DataExport{UserID: userID, ExpiresAt: time.Now().Add(time.Hour)}, "export-hash")
+
+	if err != nil {
+		t.Fatalf("Error inserting data export: %s", err)
+	}
+
+	export, err := testRepo.GetDataExportByHash("export-hash")
+
+	if err != nil || export.ID != id || export.Status != data.ExportPending || export.CompletedAt != nil {
+		t.Fatalf("Expected a pending export, got %+v %v", export, err)
+	}
+
+	err = testRepo.FinishDataExport(id, data.ExportReady, "export.zip")
+
+	if err != nil {
+		t.Fatalf("Error finishing data export: %s", err)
+	}
+
+	exports, err := testRepo.GetDataExports(userID)
+
+	if err != nil || len(exports) != 1 || exports[0].Status != data.ExportReady || exports[0].FileName != "export.zip" || exports[0].CompletedAt == nil {
+		t.Fatalf("Expected a finished export, got %+v %v", exports, err)
+	}
+
+	expired, err := testRepo.GetExpiredDataExports(time.Now())
+
+	if err != nil || len(expired) != 0 {
+		t.Errorf("Expected no expired exports yet, got %+v %v", expired, err)
+	}
+
+	expired, _ = testRepo.GetExpiredDataExports(time.Now().Add(2 * time.Hour))
+
+	if len(expired) != 1 || expired[0].ID != id {
+		t.Errorf("Expected the export to have expired in two hours, got %+v", expired)
+	}
+
+	err = testRepo.DeleteDataExport(id)
+
+	if err != nil {
+		t.Fatalf("Error deleting data export: %s", err)
+	}
+
+	err = testRepo.FinishDataExport(id, data.ExportReady, "export.zip")
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected finishing a deleted export to be sql.ErrNoRows, got %v", err)
+	}
+
+	err = testRepo.DeleteDataExports(userID)
+
+	if err != nil {
+		t.Fatalf("Error deleting data exports: %s", err)
+	}
+
+	if _, err := testRepo.GetDataExportByHash("export-hash"); err == nil {
+		t.Errorf("Expected the export to be deleted")
+	}
+}
+
+func Test_PostgresDBRepo_SearchUsers(t *testing.T) {
+	var ids = map[string]int{}
+
+	for _, u := range []data.User{
+		{FirstName: "Bea", LastName: "Quillfeather", Email: "bea@search.test", Password: "secret"},
+		{FirstName: "Ada", LastName: "Quillfeather", Email: "ada@search.test", Password: "secret", IsAdmin: 1},
+		{FirstName: "Adam", LastName: "Quillfeather", Email: "adam@search.test", Password: "secret"},
+	} {
+		id, err := testRepo.InsertUser(u)
+
+		if err != nil {
+			t.Fatalf("Error inserting user: %s", err)
+		}
+
+		ids[u.FirstName] = id
+	}
+
+	_, err := testRepo.InsertUserImage(data.UserImage{UserID: ids["Bea"], FileName: "bea.png"})
+
+	if err != nil {
+		t.Fatalf("Error inserting image: %s", err)
+	}
+
+	yes, no := true, false
+	byName := func(search data.UserSearch) data.UserSearch {
+		search.Query = "quillfeather"
+		search.Sort = data.UserSortName
+
+		return search
+	}
+
+	var tests = []struct {
+		name          string
+		search        data.UserSearch
+		expectedNames []string
+	}{
+		{"full text", data.UserSearch{Query: "Quillfeather", Sort: data.UserSortName}, []string{"Ada", "Adam", "Bea"}},
+		{"typo", data.UserSearch{Query: "quilfeather", Sort: data.UserSortName}, []string{"Ada", "Adam", "Bea"}},
+		{"part of an email address", data.UserSearch{Query: "search.te", Sort: data.UserSortName}, []string{"Ada", "Adam", "Bea"}},
+		{"no match", data.UserSearch{Query: "zzyzx"}, nil},
+		{"by name descending", byName(data.UserSearch{Descending: true}), []string{"Bea", "Adam", "Ada"}},
+		{"by email", data.UserSearch{Query: "quillfeather", Sort: data.UserSortEmail}, []string{"Ada", "Adam", "Bea"}},
+		{"newest first", data.UserSearch{Query: "quillfeather", Sort: data.UserSortCreated, Descending: true}, []string{"Adam", "Ada", "Bea"}},
+		{"by id", data.UserSearch{Query: "quillfeather", Sort: data.UserSortID}, []string{"Bea", "Ada", "Adam"}},
+		{"has avatar", byName(data.UserSearch{HasAvatar: &yes}), []string{"Bea"}},
+		{"has no avatar", byName(data.UserSearch{HasAvatar: &no}), []string{"Ada", "Adam"}},
+		{"admin", byName(data.UserSearch{IsAdmin: &yes}), []string{"Ada"}},
+		{"created in the future", byName(data.UserSearch{CreatedFrom: time.Now().Add(time.Hour)}), nil},
+		{"created before now", byName(data.UserSearch{CreatedTo: time.Now().Add(time.Hour)}), []string{"Ada", "Adam", "Bea"}},
+	}
+
+	for _, test := range tests {
+		result, err := testRepo.SearchUsers(test.search)
+
+		if err != nil {
+			t.Errorf("%s: error searching users: %s", test.name, err)
+			continue
+		}
+
+		var names []string
+
+		for _, user := range result.Users {
+			names = append(names, user.FirstName)
+		}
+
+		if !slices.Equal(names, test.expectedNames) || result.Total != len(test.expectedNames) {
+			t.Errorf("%s: expected %v, got %v of %d", test.name, test.expectedNames, names, result.Total)
+		}
+	}
+
+	// how many are found depends on how similar the other users are, but the best match comes first
+	for query, expected := range map[string]string{"adam": "Adam", "bea@search.test": "Bea", "ada quillfeather": "Ada"} {
+		result, err := testRepo.SearchUsers(data.UserSearch{Query: query})
+
+		if err != nil || len(result.Users) == 0 || result.Users[0].FirstName != expected {
+			t.Errorf("Expected %s to be the best match for %q, got %+v %v", expected, query, result, err)
+		}
+	}
+
+	// page through by each sort, two at a time
+	for _, sort := range []string{data.UserSortRelevance, data.UserSortName, data.UserSortEmail, data.UserSortCreated, data.UserSortID} {
+		search := data.UserSearch{Query: "quillfeather", Sort: sort, Limit: 2}
+		seen := map[int]bool{}
+
+		for pages := 0; ; pages++ {
+			result, err := testRepo.SearchUsers(search)
+
+			if err != nil {
+				t.Fatalf("%s: error searching users: %s", sort, err)
+			}
+
+			for _, user := range result.Users {
+				if seen[user.ID] {
+					t.Errorf("%s: %s listed twice", sort, user.FirstName)
+				}
+
+				seen[user.ID] = true
+			}
+
+			if result.Next == "" {
+				if pages != 1 || len(seen) != 3 {
+					t.Errorf("%s: expected 3 users on 2 pages, got %d on %d", sort, len(seen), pages+1)
+				}
+
+				break
+			}
+
+			if pages > 1 {
+				t.Fatalf("%s: expected the pages to end", sort)
+			}
+
+			search.Cursor = result.Next
+		}
+	}
+
+	first, _ := testRepo.SearchUsers(data.UserSearch{Query: "quillfeather", Sort: data.UserSortName, Limit: 1})
+
+	for _, cursor := range []string{"nope", first.Next} {
+		_, err := testRepo.SearchUsers(data.UserSearch{Query: "quillfeather", Sort: data.UserSortEmail, Cursor: cursor})
+
+		if !errors.Is(err, data.ErrInvalidCursor) {
+			t.Errorf("Expected cursor %q to be invalid for another sort, got %v", cursor, err)
+		}
+	}
+}
+
+func Test_PostgresDBRepo_SearchUsers_Directory(t *testing.T) {
+	deactivated := time.Now()
+
+	for _, u := range []data.User{
+		{FirstName: "Dora", LastName: "Listwell", Email: "dora@directory.test", Handle: "dorothea",
+			ProfileVisibility: data.ProfileVisibilityPublic},
+		{FirstName: "Dan", LastName: "Listwell", Email: "dan@directory.test", ProfileVisibility: data.ProfileVisibilityMembers},
+		{FirstName: "Dee", LastName: "Listwell", Email: "dee@directory.test", ProfileVisibility: data.ProfileVisibilityHidden},
+		{FirstName: "Del", LastName: "Listwell", Email: "del@directory.test", ProfileVisibility: data.ProfileVisibilityPublic,
+			DeactivatedAt: &deactivated},
+	} {
+		id, err := testRepo.InsertUser(data.User{FirstName: u.FirstName, LastName: u.LastName, Email: u.Email, Password: "secret"})
+
+		if err != nil {
+			t.Fatalf("Error inserting user: %s", err)
+		}
+
+		u.ID = id
+
+		if err := testRepo.UpdateUser(u); err != nil {
+			t.Fatalf("Error updating user: %s", err)
+		}
+	}
+
+	listed := func(search data.UserSearch) data.UserSearch {
+		search.Sort = data.UserSortName
+		search.ActiveOnly = true
+
+		if search.ProfileVisibilities == nil {
+			search.ProfileVisibilities = []string{data.ProfileVisibilityPublic, data.ProfileVisibilityMembers}
+		}
+
+		return search
+	}
+
+	var tests = []struct {
+		name          string
+		search        data.UserSearch
+		expectedNames []string
+	}{
+		{"everyone", data.UserSearch{Query: "listwell", Sort: data.UserSortName}, []string{"Dan", "Dee", "Del", "Dora"}},
+		{"listed to members", listed(data.UserSearch{Query: "listwell"}), []string{"Dan", "Dora"}},
+		{"listed to everyone", listed(data.UserSearch{Query: "listwell", ProfileVisibilities: []string{data.ProfileVisibilityPublic}}), []string{"Dora"}},
+		{"by handle", listed(data.UserSearch{Query: "dorothea"}), []string{"Dora"}},
+		{"by email", listed(data.UserSearch{Query: "dan@directory"}), []string{"Dan"}},
+		{"email skipped", listed(data.UserSearch{Query: "dan@directory", SkipEmail: true}), nil},
+		{"name with email skipped", listed(data.UserSearch{Query: "dan list", SkipEmail: true}), []string{"Dan"}},
+		{"offset", listed(data.UserSearch{Query: "listwell", Offset: 1, Limit: 1}), []string{"Dora"}},
+		{"by exact email", data.UserSearch{Email: "DAN@directory.test"}, []string{"Dan"}},
+		{"by part of an email", data.UserSearch{Email: "dan@directory"}, nil},
+		{"by external id", data.UserSearch{Query: "listwell", ExternalID: "nobody"}, nil},
+	}
+
+	for _, test := range tests {
+		result, err := testRepo.SearchUsers(test.search)
+
+		if err != nil {
+			t.Errorf("%s: error searching users: %s", test.name, err)
+			continue
+		}
+
+		var names []string
+
+		for _, user := range result.Users {
+			names = append(names, user.FirstName)
+		}
+
+		if !slices.Equal(names, test.expectedNames) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectedNames, names)
+		}
+	}
+}
+
+func Test_PostgresDBRepo_ImportUsers(t *testing.T) {
+	graceID, err := testRepo.InsertUser(data.User{FirstName: "Grace", LastName: "Importer", Email: "grace@import.test", Password: "secret"})
+
+	if err != nil {
+		t.Fatalf("Error inserting user: %s", err)
+	}
+
+	grace, _ := testRepo.GetUser(graceID)
+	grace.Handle = "grace-import"
+
+	if err := testRepo.UpdateUser(*grace); err != nil {
+		t.Fatalf("Error updating user: %s", err)
+	}
+
+	ada := data.User{FirstName: "Ada", LastName: "Importer", Email: "ada@import.test", Password: "temporary",
+		Handle: "ada-import", ProfileVisibility: data.ProfileVisibilityMembers, AvatarVisibility: data.AvatarVisibilityPublic}
+	changed := *grace
+	changed.JobTitle = "Admiral"
+	changed.Password = "new password"
+
+	for _, dryRun := range []bool{true, false} {
+		results, err := testRepo.ImportUsers([]data.User{ada, changed}, dryRun)
+
+		if err != nil {
+			t.Fatalf("dry run %t: error importing users: %s", dryRun, err)
+		}
+
+		if results[0].ID == 0 || results[0].Error != "" || results[1].ID != graceID || results[1].Error != "" {
+			t.Fatalf("dry run %t: expected both users to be written, got %+v", dryRun, results)
+		}
+
+		imported, err := testRepo.GetUserByEmail(ada.Email)
+
+		if dryRun {
+			if !errors.Is(err, sql.ErrNoRows) {
+				t.Errorf("Expected a dry run not to keep the new user, got %v", err)
+			}
+
+			if after, _ := testRepo.GetUser(graceID); after.JobTitle != "" {
+				t.Errorf("Expected a dry run not to change the existing user, got %q", after.JobTitle)
+			}
+
+			continue
+		}
+
+		if err != nil || imported.ID != results[0].ID || imported.Handle != ada.Handle {
+			t.Fatalf("Expected the new user to be created, got %+v %v", imported, err)
+		}
+
+		if matches, _ := imported.PasswordMatches("temporary"); !matches {
+			t.Error("Expected the new user to have their password")
+		}
+
+		after, _ := testRepo.GetUserByEmail(grace.Email)
+
+		if matches, _ := after.PasswordMatches("new password"); after.JobTitle != "Admiral" || !matches {
+			t.Errorf("Expected the existing user to be updated with a new password, got %q", after.JobTitle)
+		}
+	}
+
+	// one user who cannot be written keeps every other one from being written too
+	bea := data.User{FirstName: "Bea", LastName: "Importer", Email: "bea@import.test", Password: "temporary"}
+	cy := data.User{FirstName: "Cy", LastName: "Importer", Email: "cy@import.test", Password: "temporary", Handle: "grace-import"}
+
+	results, err := testRepo.ImportUsers([]data.User{bea, cy}, false)
+
+	if err != nil {
+		t.Fatalf("Error importing users: %s", err)
+	}
+
+	if results[0].Error != "" || results[1].Error != "Someone else has that handle" {
+		t.Errorf("Expected only the second user to fail for their handle, got %+v", results)
+	}
+
+	if _, err := testRepo.GetUserByEmail(bea.Email); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected nothing to be imported, got %v", err)
+	}
+}
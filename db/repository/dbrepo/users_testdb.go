@@ -1,9 +1,10 @@
 package dbrepo
 
 import (
+	"cmp"
 	"database/sql"
-	"errors"
 	"github.com/spartanhooah/profile-picture-web/data"
+	"strings"
 	"time"
 )
 
@@ -20,10 +21,90 @@ func (m *TestDBRepo) AllUsers() ([]*data.User, error) {
 	return users, nil
 }
 
-// GetUser returns one user by id
+// SearchUsers finds two users when the search is for ada, a page at a time: Ada Lovelace, then, after the cursor
+// "after-ada", Grace Hopper. Listing everyone in order of id finds the same two, skipping Offset of them and paging
+// by Limit. A search for the email address ada@example.com finds Ada alone. Any other search finds no one, and any
+// other cursor is invalid.
+func (m *TestDBRepo) SearchUsers(search data.UserSearch) (*data.UserSearchResult, error) {
+	if search.Cursor != "" && search.Cursor != "after-ada" {
+		return nil, data.ErrInvalidCursor
+	}
+
+	result := data.UserSearchResult{Users: []*data.User{}}
+
+	if search.Sort == data.UserSortID && search.Query == "" && search.Email == "" && search.ExternalID == "" {
+		result.Total = 2
+		users := []*data.User{
+			{ID: 2, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"},
+			{ID: 3, FirstName: "Grace", LastName: "Hopper", Email: "grace@example.com"},
+		}
+
+		if search.Cursor != "" {
+			users = users[1:]
+		}
+
+		users = users[min(search.Offset, len(users)):]
+
+		if search.Limit > 0 && len(users) > search.Limit {
+			users = users[:search.Limit]
+			result.Next = "after-ada"
+		}
+
+		result.Users = append(result.Users, users...)
+
+		return &result, nil
+	}
+
+	if strings.EqualFold(search.Email, "ada@example.com") {
+		result.Total = 1
+		result.Users = append(result.Users, &data.User{ID: 2, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+
+		return &result, nil
+	}
+
+	if search.Query != "ada" {
+		return &result, nil
+	}
+
+	result.Total = 2
+
+	if search.Cursor == "" {
+		result.Users = append(result.Users, &data.User{ID: 2, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com"})
+		result.Next = "after-ada"
+	} else {
+		result.Users = append(result.Users, &data.User{ID: 3, FirstName: "Grace", LastName: "Hopper", Email: "grace@example.com"})
+	}
+
+	return &result, nil
+}
+
+// GetUser returns one user by id. Their password is "secret". User 8's avatar is for members only, and user 11's is
+// private. User 3 is an ordinary user, user 12 an administrator and user 13 a moderator. User 14 has been
+// deactivated, and user 15 deleted.
 func (m *TestDBRepo) GetUser(id int) (*data.User, error) {
+	switch id {
+	case 3:
+		return &data.User{ID: 3}, nil
+	case 14:
+		deactivatedAt := time.Now().Add(-time.Hour)
+		return &data.User{ID: 14, DeactivatedAt: &deactivatedAt}, nil
+	case 15:
+		return nil, sql.ErrNoRows
+	case 12:
+		return &data.User{ID: 12, IsAdmin: 1, Roles: []string{data.RoleAdmin}}, nil
+	case 13:
+		return &data.User{ID: 13, Roles: []string{data.RoleModerator, data.RoleUser},
+			Permissions: []string{data.PermissionModerateImages, data.PermissionReadUsers}}, nil
+	case 8:
+		return &data.User{ID: 8, AvatarVisibility: data.AvatarVisibilityMembers}, nil
+	case 11:
+		return &data.User{ID: 11, AvatarVisibility: data.AvatarVisibilityPrivate}, nil
+	}
+
 	var user = data.User{
 		ID: 1,
+		// a low cost keeps the tests quick
+		Password: "$2a$04$.yLE6nHt/8RW0Hl7knG1EusXG6YtnBTasLkCXEZLImhggv4baXu02",
 	}
 
 	return &user, nil
@@ -44,7 +125,26 @@ func (m *TestDBRepo) GetUserByEmail(email string) (*data.User, error) {
 		}, nil
 	}
 
-	return nil, errors.New("User not found")
+	return nil, sql.ErrNoRows
+}
+
+// GetUserByHandle returns one user by the handle of their public profile: ada, whose profile is public, colleague,
+// whose profile is for members, or hermit, whose profile is hidden.
+func (m *TestDBRepo) GetUserByHandle(handle string) (*data.User, error) {
+	users := map[string]*data.User{
+		"ada": {ID: 2, FirstName: "Ada", LastName: "Lovelace", Email: "ada@example.com", JobTitle: "Analyst",
+			Handle: "ada", ProfileVisibility: data.ProfileVisibilityPublic},
+		"colleague": {ID: 3, FirstName: "Grace", LastName: "Hopper", Email: "grace@example.com",
+			Handle: "colleague", ProfileVisibility: data.ProfileVisibilityMembers},
+		"hermit": {ID: 7, FirstName: "Henry", LastName: "Cavendish", Email: "henry@example.com",
+			Handle: "hermit", ProfileVisibility: data.ProfileVisibilityHidden},
+	}
+
+	if user, ok := users[handle]; ok {
+		return user, nil
+	}
+
+	return nil, sql.ErrNoRows
 }
 
 // UpdateUser updates one user in the database
@@ -52,16 +152,73 @@ func (m *TestDBRepo) UpdateUser(u data.User) error {
 	return nil
 }
 
-// DeleteUser deletes one user from the database, by id
+// DeleteUser marks one user as deleted, by id
 func (m *TestDBRepo) DeleteUser(id int) error {
 	return nil
 }
 
+// testDeletedUsers are the deleted users the test repository knows: user 4 was deleted an hour ago, user 5 sixty
+// days ago, and user 6, who has the same email address as the administrator, an hour ago.
+func testDeletedUsers() []*data.User {
+	recently := time.Now().Add(-time.Hour)
+	longAgo := time.Now().Add(-60 * 24 * time.Hour)
+
+	return []*data.User{
+		{ID: 4, FirstName: "Recently", LastName: "Deleted", Email: "recent@example.com", DeletedAt: &recently},
+		{ID: 6, FirstName: "Admin", LastName: "Again", Email: "admin@example.com", DeletedAt: &recently},
+		{ID: 5, FirstName: "Long", LastName: "Gone", Email: "gone@example.com", DeletedAt: &longAgo},
+	}
+}
+
+// RestoreUser undoes DeleteUser for a user deleted after deletedAfter
+func (m *TestDBRepo) RestoreUser(id int, deletedAfter time.Time) error {
+	for _, user := range testDeletedUsers() {
+		if user.ID == id && user.DeletedAt.After(deletedAfter) {
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+// GetDeletedUsers returns the users deleted before the given time, most recently deleted first
+func (m *TestDBRepo) GetDeletedUsers(before time.Time) ([]*data.User, error) {
+	var users []*data.User
+
+	for _, user := range testDeletedUsers() {
+		if user.DeletedAt.Before(before) {
+			users = append(users, user)
+		}
+	}
+
+	return users, nil
+}
+
+// PurgeUser deletes one user from the database for good, by id
+func (m *TestDBRepo) PurgeUser(id int) error {
+	return nil
+}
+
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
 func (m *TestDBRepo) InsertUser(user data.User) (int, error) {
 	return 2, nil
 }
 
+// ImportUsers gives new users ids from 100 up, and keeps nothing. The handle "taken" belongs to someone else.
+func (m *TestDBRepo) ImportUsers(users []data.User, dryRun bool) ([]data.UserImportResult, error) {
+	results := make([]data.UserImportResult, len(users))
+
+	for i, user := range users {
+		results[i].ID = cmp.Or(user.ID, 100+i)
+
+		if user.Handle == "taken" {
+			results[i].Error = "Someone else has that handle"
+		}
+	}
+
+	return results, nil
+}
+
 // ResetPassword is the method we will use to change a user's password.
 func (m *TestDBRepo) ResetPassword(id int, password string) error {
 	return nil
@@ -71,3 +228,365 @@ func (m *TestDBRepo) ResetPassword(id int, password string) error {
 func (m *TestDBRepo) InsertUserImage(i data.UserImage) (int, error) {
 	return 1, nil
 }
+
+// GetUserImages returns all of a user's profile images, newest first
+func (m *TestDBRepo) GetUserImages(userID int) ([]*data.UserImage, error) {
+	return []*data.UserImage{
+		{ID: 2, UserID: userID, FileName: "previous.png", FileSize: 1000},
+		{ID: 1, UserID: userID, FileName: "oldest.png", FileSize: 1000},
+	}, nil
+}
+
+// GetUserImageByFileName returns the user profile image stored under fileName: members.png is user 8's, private.png
+// user 11's, and anything else user 1's. animated.png is recorded as an animation, and other images have no record
+// either way.
+func (m *TestDBRepo) GetUserImageByFileName(fileName string) (*data.UserImage, error) {
+	owners := map[string]int{"members.png": 8, "private.png": 11}
+	image := &data.UserImage{ID: 1, UserID: cmp.Or(owners[fileName], 1), FileName: fileName}
+
+	if fileName == "animated.png" {
+		animated := true
+		image.Animated = &animated
+	}
+
+	return image, nil
+}
+
+// UserImageFileInUse reports whether any user's profile image is stored under fileName; only shared.png is.
+func (m *TestDBRepo) UserImageFileInUse(fileName string) (bool, error) {
+	return fileName == "shared.png", nil
+}
+
+// GetSharedUserImages returns the profile images stored under the same file name as an older image: one, under
+// shared.png.
+func (m *TestDBRepo) GetSharedUserImages() ([]*data.UserImage, error) {
+	return []*data.UserImage{{ID: 3, UserID: 2, FileName: "shared.png"}}, nil
+}
+
+// RenameUserImage changes the file name a user profile image is stored under.
+func (m *TestDBRepo) RenameUserImage(id int, fileName string) error {
+	return nil
+}
+
+// DeleteUserImage deletes one user profile image from the database, by id
+func (m *TestDBRepo) DeleteUserImage(id int) error {
+	return nil
+}
+
+// RecordUpload records that a user is uploading fileSize bytes, for rate limiting, unless they have already made limit
+// uploads since the given time.
+func (m *TestDBRepo) RecordUpload(userID int, fileSize int64, since time.Time, limit int) (bool, error) {
+	// agrees with CountUploadsSince
+	return limit <= 0 || 3 < limit, nil
+}
+
+// CountUploadsSince returns how many uploads a user has made since the given time.
+func (m *TestDBRepo) CountUploadsSince(userID int, since time.Time) (int, error) {
+	return 3, nil
+}
+
+// UpdateUserQuota replaces a user's upload quota overrides.
+func (m *TestDBRepo) UpdateUserQuota(userID int, quota data.UploadQuota) error {
+	return nil
+}
+
+// InsertPersonalAccessToken stores a new personal access token, of which only the hash is kept, and returns its id.
+func (m *TestDBRepo) InsertPersonalAccessToken(t data.PersonalAccessToken, tokenHash string) (int, error) {
+	return 1, nil
+}
+
+// GetPersonalAccessTokens returns a user's personal access tokens, newest first
+func (m *TestDBRepo) GetPersonalAccessTokens(userID int) ([]*data.PersonalAccessToken, error) {
+	return []*data.PersonalAccessToken{
+		{ID: 1, UserID: userID, Name: "backup script", Scopes: []string{"avatar:read"}, CreatedAt: time.Now()},
+	}, nil
+}
+
+// GetPersonalAccessTokenByHash returns the personal access token with the given hash. The test repository knows
+// the tokens "ppw_test-token", which may read avatars, and "ppw_expired-token".
+func (m *TestDBRepo) GetPersonalAccessTokenByHash(tokenHash string) (*data.PersonalAccessToken, error) {
+	switch tokenHash {
+	case "52e067483de6c133f6772eb9eb62bf1c1e0b70b6e82b629c556caa9a8143e0da":
+		return &data.PersonalAccessToken{ID: 1, UserID: 1, Name: "test", Scopes: []string{"avatar:read"}}, nil
+	case "40dcd418a8867c07dbe729fedd4a5eae0dfb99b52a1c6827d4e6d51c50153d62":
+		expired := time.Now().Add(-time.Hour)
+		return &data.PersonalAccessToken{ID: 2, UserID: 1, Name: "expired", Scopes: []string{"avatar:read"}, ExpiresAt: &expired}, nil
+	}
+
+	return nil, sql.ErrNoRows
+}
+
+// TouchPersonalAccessToken records when, and from where, a personal access token was last used.
+func (m *TestDBRepo) TouchPersonalAccessToken(id int, ip string) error {
+	return nil
+}
+
+// DeletePersonalAccessToken revokes one of a user's personal access tokens.
+func (m *TestDBRepo) DeletePersonalAccessToken(userID, id int) error {
+	if id != 1 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// InsertRefreshToken stores a new refresh token, of which only the hash is kept, and returns its id.
+func (m *TestDBRepo) InsertRefreshToken(t data.RefreshToken, tokenHash string) (int, error) {
+	return 1, nil
+}
+
+// GetRefreshTokenByHash returns the refresh token with the given hash. The test repository knows the tokens
+// "ppr_valid", "ppr_reused", which has already been used, "ppr_expired" and "ppr_revoked", all belonging to user 1.
+func (m *TestDBRepo) GetRefreshTokenByHash(tokenHash string) (*data.RefreshToken, error) {
+	token := data.RefreshToken{ID: 1, UserID: 1, FamilyID: "family", ExpiresAt: time.Now().Add(time.Hour)}
+	past := time.Now().Add(-time.Hour)
+
+	switch tokenHash {
+	case "bfaf17217dfdc386d962bb4b263189dc661aead2de5f7b4d0c873cb9305eb0dc":
+	case "a7ffa9b85352aa1860eb8cd750e3be0de9ed576f89e80418391cfc13f1d5b59b":
+		token.UsedAt = &past
+	case "f5270f844f006a5ade7e8cf1a634b552a73b366e000b1d0825af39d794070b44":
+		token.ExpiresAt = past
+	case "01a78b85b93def5c6a39c81c939e9ae96d371b1289d4964ee7f73c6ac23ed31e":
+		token.RevokedAt = &past
+	default:
+		return nil, sql.ErrNoRows
+	}
+
+	return &token, nil
+}
+
+// UseRefreshToken marks a refresh token as used, returning false if it had already been used.
+func (m *TestDBRepo) UseRefreshToken(id int) (bool, error) {
+	return true, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token descended from the same login.
+func (m *TestDBRepo) RevokeRefreshTokenFamily(familyID string) error {
+	return nil
+}
+
+// InsertUserIdentity links a user to an account at an external identity provider, and returns the link's id.
+func (m *TestDBRepo) InsertUserIdentity(i data.UserIdentity) (int, error) {
+	return 1, nil
+}
+
+// GetUserIdentity returns the link to an account at an identity provider. The test repository only knows the
+// subject "linked-subject", which belongs to user 1, "deactivated-subject", which belongs to the deactivated user 14,
+// and "deleted-subject", which belongs to the deleted user 15.
+func (m *TestDBRepo) GetUserIdentity(issuer, subject string) (*data.UserIdentity, error) {
+	userID, ok := map[string]int{"linked-subject": 1, "deactivated-subject": 14, "deleted-subject": 15}[subject]
+
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return &data.UserIdentity{ID: userID, UserID: userID, Issuer: issuer, Subject: subject, CreatedAt: time.Now()}, nil
+}
+
+// InsertOAuthClient registers an application with our OpenID Connect provider, and returns its id.
+func (m *TestDBRepo) InsertOAuthClient(c data.OAuthClient, secretHash string) (int, error) {
+	return 1, nil
+}
+
+// GetOAuthClients returns every registered OpenID Connect client
+func (m *TestDBRepo) GetOAuthClients() ([]*data.OAuthClient, error) {
+	client, _ := m.GetOAuthClientByClientID("test-client")
+
+	return []*data.OAuthClient{client}, nil
+}
+
+// GetOAuthClientByClientID returns an OpenID Connect client. The test repository only knows "test-client", whose
+// secret is "test-secret".
+func (m *TestDBRepo) GetOAuthClientByClientID(clientID string) (*data.OAuthClient, error) {
+	if clientID != "test-client" {
+		return nil, sql.ErrNoRows
+	}
+
+	return &data.OAuthClient{
+		ID:           1,
+		ClientID:     "test-client",
+		Name:         "Test Client",
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		SecretHash:   "9caf06bb4436cdbfa20af9121a626bc1093c4f54b31c0fa937957856135345b6",
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// DeleteOAuthClient removes an OpenID Connect client, returning sql.ErrNoRows for any but client 1.
+func (m *TestDBRepo) DeleteOAuthClient(id int) error {
+	if id != 1 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// InsertAuthorizationCode stores a new authorization code, of which only the hash is kept, and returns its id.
+func (m *TestDBRepo) InsertAuthorizationCode(c data.AuthorizationCode, codeHash string) (int, error) {
+	return 1, nil
+}
+
+// GetAuthorizationCodeByHash returns the authorization code with the given hash. The test repository knows the codes
+// "test-code", "used-code" and "expired-code", all issued to test-client for user 1 with the nonce "test-nonce" and
+// the PKCE verifier "test-verifier", and "deactivated-code" and "deleted-code", issued the same way to users 14 and
+// 15.
+func (m *TestDBRepo) GetAuthorizationCodeByHash(codeHash string) (*data.AuthorizationCode, error) {
+	code := data.AuthorizationCode{
+		ID:            1,
+		ClientID:      1,
+		UserID:        1,
+		RedirectURI:   "https://app.example.com/callback",
+		Scope:         "openid profile email",
+		Nonce:         "test-nonce",
+		CodeChallenge: "JBbiqONGWPaAmwXk_8bT6UnlPfrn65D32eZlJS-zGG0",
+		ExpiresAt:     time.Now().Add(time.Minute),
+	}
+	past := time.Now().Add(-time.Minute)
+
+	switch codeHash {
+	case "3a5f4b089cfd9588a00d4da744493979993cd87e5361d2720acc36a83eb8c04d":
+	case "234df9750e1efcaa1529914053aac982c8ff655bca6f48e48744ef2b0c8b61bb":
+		code.UsedAt = &past
+	case "b73627994df08e3832288605cee06158e47825576c8bdd4a9dc201e8f89934f3":
+		code.ExpiresAt = past
+	case "fded6ed657a168ee69ebe141803caa4beb811831b85707c5386c753d9cc17bd4":
+		code.UserID = 14
+	case "1160ecc1c830e274cf9e1b7c039be56bbff30ac75b806154f5772de9f8f0a72d":
+		code.UserID = 15
+	default:
+		return nil, sql.ErrNoRows
+	}
+
+	return &code, nil
+}
+
+// UseAuthorizationCode marks an authorization code as used, returning false if it had already been used.
+func (m *TestDBRepo) UseAuthorizationCode(id int) (bool, error) {
+	return true, nil
+}
+
+// AllRoles returns the roles every installation starts with.
+func (m *TestDBRepo) AllRoles() ([]*data.Role, error) {
+	return []*data.Role{
+		{ID: 1, Name: data.RoleAdmin, Permissions: []string{data.PermissionReadAudit, data.PermissionManageClients,
+			data.PermissionModerateImages, data.PermissionManageQuotas, data.PermissionAssignRoles,
+			data.PermissionDeleteUsers, data.PermissionImpersonate, data.PermissionReadUsers, data.PermissionWriteUsers}},
+		{ID: 4, Name: data.RoleAuditor, Permissions: []string{data.PermissionReadAudit, data.PermissionReadUsers}},
+		{ID: 2, Name: data.RoleModerator, Permissions: []string{data.PermissionModerateImages, data.PermissionReadUsers}},
+		{ID: 3, Name: data.RoleUser, Permissions: []string{}},
+	}, nil
+}
+
+// SetUserRoles replaces a user's roles.
+func (m *TestDBRepo) SetUserRoles(userID int, roles []string) error {
+	return nil
+}
+
+// InsertAuditEvent writes an entry to the audit log.
+func (m *TestDBRepo) InsertAuditEvent(e data.AuditEvent) (int, error) {
+	return 3, nil
+}
+
+// GetAuditEvents returns the two events in a correctly chained audit log: the admin updating user 2, then
+// resetting their password. Like the real thing it honours the order and cursor, but ignores other filters.
+func (m *TestDBRepo) GetAuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error) {
+	events := []*data.AuditEvent{
+		{ID: 1, ActorID: 1, TargetUserID: 2, Action: data.AuditUserUpdated, IP: "127.0.0.1", UserAgent: "test",
+			Details:   []byte(`{"changes":{"email":{"from":"jane@example.com","to":"jane.doe@example.com"}}}`),
+			CreatedAt: time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC), ActorEmail: "admin@example.com"},
+		{ID: 2, ActorID: 1, TargetUserID: 2, Action: data.AuditPasswordReset, IP: "127.0.0.1", UserAgent: "test",
+			Details: []byte(`{}`), CreatedAt: time.Date(2024, 1, 1, 9, 5, 0, 0, time.UTC), ActorEmail: "admin@example.com"},
+	}
+
+	for i, e := range events {
+		if i > 0 {
+			e.PrevHash = events[i-1].Hash
+		}
+
+		e.DetailsHash, _ = e.HashDetails()
+		e.HashVersion = data.AuditHashVersion
+		e.PersonalHash = e.HashPersonal()
+		e.Hash = e.ComputeHash()
+	}
+
+	var page []*data.AuditEvent
+
+	for _, e := range events {
+		if f.Ascending && e.ID > f.Cursor {
+			page = append(page, e)
+		} else if !f.Ascending && (f.Cursor == 0 || e.ID < f.Cursor) {
+			page = append([]*data.AuditEvent{e}, page...)
+		}
+	}
+
+	return page, nil
+}
+
+// AnonymizeAuditEvents removes a user from the audit log.
+func (m *TestDBRepo) AnonymizeAuditEvents(userID int) error {
+	return nil
+}
+
+// GetRefreshTokens returns a user's refresh tokens.
+func (m *TestDBRepo) GetRefreshTokens(userID int) ([]*data.RefreshToken, error) {
+	return []*data.RefreshToken{
+		{ID: 1, UserID: userID, FamilyID: "family", ExpiresAt: time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+	}, nil
+}
+
+// InsertDataExport records that a user has asked for their data.
+func (m *TestDBRepo) InsertDataExport(e data.DataExport, tokenHash string) (int, error) {
+	return 1, nil
+}
+
+// GetDataExportByHash returns the data export whose download token has the given hash. The test repository knows
+// the tokens "ready-export", whose file is export.zip, "pending-export" and "expired-export", all for user 1.
+func (m *TestDBRepo) GetDataExportByHash(tokenHash string) (*data.DataExport, error) {
+	export := data.DataExport{ID: 1, UserID: 1, FileName: "export.zip", Status: data.ExportReady,
+		ExpiresAt: time.Now().Add(time.Hour)}
+
+	switch tokenHash {
+	case "a84046ffc8f525ab1487e537be0328dc4f3244615bd5663845aca3b83d5f9dc9":
+	case "3a9753bc90e4a7be54448fb4d46814458ef511c390686a9e3a6acb751dc540f8":
+		export.FileName = ""
+		export.Status = data.ExportPending
+	case "3c9c308005d81e7e83804863c04cf483a375c373a1fdc79b84e6306952267ceb":
+		export.ExpiresAt = time.Now().Add(-time.Hour)
+	default:
+		return nil, sql.ErrNoRows
+	}
+
+	return &export, nil
+}
+
+// GetDataExports returns a user's data exports; the test repository has none.
+func (m *TestDBRepo) GetDataExports(userID int) ([]*data.DataExport, error) {
+	return nil, nil
+}
+
+// FinishDataExport records that building an export has finished. Export 3 has been deleted while it was being built.
+func (m *TestDBRepo) FinishDataExport(id int, status, fileName string) error {
+	if id == 3 {
+		return sql.ErrNoRows
+	}
+
+	return nil
+}
+
+// DeleteDataExports forgets all of a user's data exports.
+func (m *TestDBRepo) DeleteDataExports(userID int) error {
+	return nil
+}
+
+// GetExpiredDataExports returns the data exports which expired before the given time; the test repository has one,
+// whose file is expired.zip.
+func (m *TestDBRepo) GetExpiredDataExports(before time.Time) ([]*data.DataExport, error) {
+	return []*data.DataExport{{ID: 2, UserID: 1, FileName: "expired.zip", Status: data.ExportReady,
+		ExpiresAt: before.Add(-time.Hour)}}, nil
+}
+
+// DeleteDataExport forgets one data export.
+func (m *TestDBRepo) DeleteDataExport(id int) error {
+	return nil
+}
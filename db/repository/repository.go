@@ -3,16 +3,63 @@ package repository
 import (
 	"database/sql"
 	"github.com/spartanhooah/profile-picture-web/data"
+	"time"
 )
 
 type DatabaseRepo interface {
 	Connection() *sql.DB
 	AllUsers() ([]*data.User, error)
+	SearchUsers(search data.UserSearch) (*data.UserSearchResult, error)
 	GetUser(id int) (*data.User, error)
 	GetUserByEmail(email string) (*data.User, error)
+	GetUserByHandle(handle string) (*data.User, error)
 	UpdateUser(u data.User) error
 	DeleteUser(id int) error
+	RestoreUser(id int, deletedAfter time.Time) error
+	GetDeletedUsers(before time.Time) ([]*data.User, error)
+	PurgeUser(id int) error
 	InsertUser(user data.User) (int, error)
+	ImportUsers(users []data.User, dryRun bool) ([]data.UserImportResult, error)
 	ResetPassword(id int, password string) error
 	InsertUserImage(i data.UserImage) (int, error)
+	GetUserImages(userID int) ([]*data.UserImage, error)
+	GetUserImageByFileName(fileName string) (*data.UserImage, error)
+	UserImageFileInUse(fileName string) (bool, error)
+	GetSharedUserImages() ([]*data.UserImage, error)
+	RenameUserImage(id int, fileName string) error
+	DeleteUserImage(id int) error
+	RecordUpload(userID int, fileSize int64, since time.Time, limit int) (bool, error)
+	CountUploadsSince(userID int, since time.Time) (int, error)
+	UpdateUserQuota(userID int, quota data.UploadQuota) error
+	InsertPersonalAccessToken(t data.PersonalAccessToken, tokenHash string) (int, error)
+	GetPersonalAccessTokens(userID int) ([]*data.PersonalAccessToken, error)
+	GetPersonalAccessTokenByHash(tokenHash string) (*data.PersonalAccessToken, error)
+	TouchPersonalAccessToken(id int, ip string) error
+	DeletePersonalAccessToken(userID, id int) error
+	InsertRefreshToken(t data.RefreshToken, tokenHash string) (int, error)
+	GetRefreshTokenByHash(tokenHash string) (*data.RefreshToken, error)
+	UseRefreshToken(id int) (bool, error)
+	RevokeRefreshTokenFamily(familyID string) error
+	InsertUserIdentity(i data.UserIdentity) (int, error)
+	GetUserIdentity(issuer, subject string) (*data.UserIdentity, error)
+	InsertOAuthClient(c data.OAuthClient, secretHash string) (int, error)
+	GetOAuthClients() ([]*data.OAuthClient, error)
+	GetOAuthClientByClientID(clientID string) (*data.OAuthClient, error)
+	DeleteOAuthClient(id int) error
+	InsertAuthorizationCode(c data.AuthorizationCode, codeHash string) (int, error)
+	GetAuthorizationCodeByHash(codeHash string) (*data.AuthorizationCode, error)
+	UseAuthorizationCode(id int) (bool, error)
+	AllRoles() ([]*data.Role, error)
+	SetUserRoles(userID int, roles []string) error
+	InsertAuditEvent(e data.AuditEvent) (int, error)
+	GetAuditEvents(f data.AuditFilter) ([]*data.AuditEvent, error)
+	AnonymizeAuditEvents(userID int) error
+	GetRefreshTokens(userID int) ([]*data.RefreshToken, error)
+	InsertDataExport(e data.DataExport, tokenHash string) (int, error)
+	GetDataExportByHash(tokenHash string) (*data.DataExport, error)
+	GetDataExports(userID int) ([]*data.DataExport, error)
+	FinishDataExport(id int, status, fileName string) error
+	DeleteDataExports(userID int) error
+	GetExpiredDataExports(before time.Time) ([]*data.DataExport, error)
+	DeleteDataExport(id int) error
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"database/sql"
 	"encoding/gob"
 	"flag"
@@ -8,7 +10,11 @@ import (
 	"github.com/spartanhooah/profile-picture-web/data"
 	"github.com/spartanhooah/profile-picture-web/db/repository/dbrepo"
 	"log"
+	"math"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
 func main() {
@@ -16,9 +22,144 @@ func main() {
 	// set up an app config
 	app := web.Application{}
 
+	app.Images = web.DefaultImageConfig()
+	app.AvatarURLs = web.DefaultAvatarURLConfig()
+	app.Quotas = web.DefaultQuotaConfig()
+	app.JWT = web.DefaultJWTConfig()
+	app.Provider = web.DefaultProviderConfig()
+	app.Passwords = web.DefaultPasswordPolicy()
+	app.PasswordHasher = data.DefaultPasswordHasher()
+
 	flag.StringVar(&app.Datasource, "datasource", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Postgres connection")
+	animationPolicy := flag.String("animation-policy", string(app.Images.AnimationPolicy), "What to do with animated uploads: reject, first-frame or keep")
+	flag.IntVar(&app.Images.MaxAnimationFrames, "max-animation-frames", app.Images.MaxAnimationFrames, "Most frames an animated upload may have")
+	flag.DurationVar(&app.Images.MaxAnimationDuration, "max-animation-duration", app.Images.MaxAnimationDuration, "Longest an animated upload may last")
+	flag.IntVar(&app.Images.MaxDimension, "max-animation-dimension", app.Images.MaxDimension, "Largest width or height animated uploads are resized to")
+	flag.IntVar(&app.Images.MaxPixels, "max-image-pixels", app.Images.MaxPixels, "Most pixels decoded from one upload, counting every frame of an animation; 0 for no limit")
+	flag.IntVar(&app.Images.JPEGQuality, "jpeg-quality", app.Images.JPEGQuality, "Quality (1-100) of JPEG avatar variants")
+	flag.IntVar(&app.Images.WebPQuality, "webp-quality", app.Images.WebPQuality, "Quality (1-100) of WebP avatar variants, in builds with the webp tag")
+	avatarURLKey := flag.String("avatar-url-key", os.Getenv("AVATAR_URL_KEY"), "Secret to sign links to avatars that are not public with; defaults to $AVATAR_URL_KEY, and empty generates a temporary one")
+	flag.DurationVar(&app.AvatarURLs.TTL, "avatar-url-ttl", app.AvatarURLs.TTL, "How long signed links to avatars that are not public last")
+	flag.Int64Var(&app.Quotas.MaxBytes, "quota-bytes", app.Quotas.MaxBytes, "Most bytes of images each user may store; 0 for no limit")
+	flag.IntVar(&app.Quotas.MaxImages, "quota-images", app.Quotas.MaxImages, "How many images to keep in each user's history; 0 for no limit")
+	flag.IntVar(&app.Quotas.MaxUploadsPerHour, "quota-uploads-per-hour", app.Quotas.MaxUploadsPerHour, "Most uploads each user may make an hour; 0 for no limit")
+	jwtKeys := flag.String("jwt-keys", "", "JSON file of keys to sign API access tokens with; empty generates a temporary key")
+	flag.StringVar(&app.JWT.Issuer, "jwt-issuer", app.JWT.Issuer, "Issuer of API access tokens")
+	flag.DurationVar(&app.JWT.AccessTokenTTL, "access-token-ttl", app.JWT.AccessTokenTTL, "How long API access tokens last")
+	flag.DurationVar(&app.JWT.RefreshTokenTTL, "refresh-token-ttl", app.JWT.RefreshTokenTTL, "How long API refresh tokens last")
+	flag.StringVar(&app.Provider.Issuer, "issuer-url", app.Provider.Issuer, "Public base URL of this server, used as the issuer of ID tokens")
+	flag.DurationVar(&app.Provider.IDTokenTTL, "id-token-ttl", app.Provider.IDTokenTTL, "How long ID tokens issued to other applications last")
+	var oidc web.OIDCConfig
+	flag.StringVar(&oidc.Issuer, "oidc-issuer", "", "Issuer URL of an OpenID Connect provider to sign in with; empty disables SSO")
+	flag.StringVar(&oidc.ClientID, "oidc-client-id", "", "Client ID registered with the OpenID Connect provider")
+	flag.StringVar(&oidc.ClientSecret, "oidc-client-secret", os.Getenv("OIDC_CLIENT_SECRET"), "Client secret registered with the OpenID Connect provider; defaults to $OIDC_CLIENT_SECRET")
+	flag.StringVar(&oidc.RedirectURL, "oidc-redirect-url", "http://localhost:8080/auth/sso/callback", "Address the OpenID Connect provider sends users back to")
+	flag.StringVar(&oidc.Name, "oidc-name", "SSO", "Name of the OpenID Connect provider shown on the sign in button")
+	clamdAddress := flag.String("clamd", "", "Address of clamd (host:port, or a Unix socket path) used to scan uploads; empty disables scanning")
+	scanTimeout := flag.Duration("scan-timeout", 30*time.Second, "How long to wait for clamd to scan an upload")
+	flag.BoolVar(&app.ScanFailOpen, "scan-fail-open", false, "Accept uploads when clamd cannot be reached or times out")
+	flag.DurationVar(&app.DeletedUserRetention, "deleted-user-retention", web.DefaultDeletedUserRetention, "How long deleted users can be restored for before they are purged")
+	flag.IntVar(&app.Passwords.MinLength, "password-min-length", app.Passwords.MinLength, "Fewest characters a new password may have")
+	flag.StringVar(&app.PasswordHasher.Algorithm, "password-hash", app.PasswordHasher.Algorithm, "Algorithm to hash new passwords with: argon2id or bcrypt")
+	flag.IntVar(&app.PasswordHasher.BcryptCost, "bcrypt-cost", app.PasswordHasher.BcryptCost, "Cost of bcrypt password hashes")
+	argon2Memory := flag.Uint("argon2-memory", uint(app.PasswordHasher.Argon2.Memory), "KiB of memory Argon2id password hashes use")
+	argon2Iterations := flag.Uint("argon2-iterations", uint(app.PasswordHasher.Argon2.Iterations), "Passes over memory Argon2id password hashes make")
+	argon2Parallelism := flag.Uint("argon2-parallelism", uint(app.PasswordHasher.Argon2.Parallelism), "Threads Argon2id password hashes use")
+	passwordDenylist := flag.String("password-denylist", "", "File of common or breached passwords to refuse, one per line")
+	var smtpMailer web.SMTPMailer
+	flag.StringVar(&smtpMailer.Address, "smtp-address", "", "host:port of the SMTP server to send email through; empty logs email instead")
+	flag.StringVar(&smtpMailer.From, "smtp-from", "profile-pictures@localhost", "Address email is sent from")
+	flag.StringVar(&smtpMailer.Username, "smtp-username", "", "Username for the SMTP server, if it needs one")
+	flag.StringVar(&smtpMailer.Password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "Password for the SMTP server; defaults to $SMTP_PASSWORD")
+	flag.BoolVar(&app.PublicProfiles, "public-profiles", false, "Let people who are not signed in see the directory and public profiles")
+	purgeInterval := flag.Duration("purge-interval", time.Hour, "How often to purge deleted users once they can no longer be restored")
 	flag.Parse()
 
+	policy, err := web.ParseAnimationPolicy(*animationPolicy)
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Images.AnimationPolicy = policy
+	app.Provider.Issuer = strings.TrimSuffix(app.Provider.Issuer, "/")
+
+	if *clamdAddress == "" {
+		log.Println("No clamd address given; uploads will not be scanned for malware")
+		app.Scanner = web.NoopScanner{}
+	} else {
+		app.Scanner = web.NewClamdScanner(*clamdAddress, *scanTimeout)
+	}
+
+	if *argon2Memory > math.MaxUint32 || *argon2Iterations > math.MaxUint32 || *argon2Parallelism > math.MaxUint8 {
+		log.Fatal("argon2-memory, argon2-iterations or argon2-parallelism is too large")
+	}
+
+	app.PasswordHasher.Argon2.Memory = uint32(*argon2Memory)
+	app.PasswordHasher.Argon2.Iterations = uint32(*argon2Iterations)
+	app.PasswordHasher.Argon2.Parallelism = uint8(*argon2Parallelism)
+
+	err = app.PasswordHasher.Validate()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Passwords.MaxBytes = app.PasswordHasher.MaxPasswordBytes()
+
+	if *passwordDenylist != "" {
+		app.Passwords.Denylist, err = web.LoadPasswordDenylist(*passwordDenylist)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if smtpMailer.Address == "" {
+		log.Println("No SMTP server given; email will be written to the log instead of sent")
+		app.Mailer = web.LogMailer{}
+	} else {
+		app.Mailer = smtpMailer
+	}
+
+	if *avatarURLKey == "" {
+		log.Println("No avatar URL key given; signed links to avatars will stop working when the server restarts")
+		app.AvatarURLs.Key = make([]byte, 32)
+
+		if _, err := rand.Read(app.AvatarURLs.Key); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		app.AvatarURLs.Key = []byte(*avatarURLKey)
+	}
+
+	if *jwtKeys == "" {
+		log.Println("No JWT keys given; access tokens will stop working when the server restarts")
+		key, err := web.GenerateEdDSAKey("temporary")
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		app.JWT.Keys = []web.SigningKey{key}
+	} else {
+		app.JWT.Keys, err = web.LoadSigningKeys(*jwtKeys)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if oidc.Issuer != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		app.SSO, err = web.NewSSO(ctx, oidc)
+		cancel()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	conn, err := app.ConnectToDB()
 
 	if err != nil {
@@ -32,10 +173,101 @@ func main() {
 		}
 	}(conn)
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	app.DB = &dbrepo.PostgresDBRepo{DB: conn, Hasher: app.PasswordHasher}
+
+	// commands run against the database and exit, rather than starting the server
+	switch flag.Arg(0) {
+	case "":
+	case "verify-audit-log":
+		err = app.VerifyAuditLog(os.Stdout)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	case "purge-deleted-users":
+		purged, err := app.PurgeDeletedUsers()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Purged %d deleted users", purged)
+		return
+	case "rename-uploads":
+		renamed, err := app.RenameSharedUploads()
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Printf("Renamed %d images which shared a file", renamed)
+		return
+	case "import-users":
+		commandFlags := flag.NewFlagSet("import-users", flag.ExitOnError)
+		var opts web.UserImportOptions
+		commandFlags.BoolVar(&opts.DryRun, "dry-run", false, "Check the file and report what would be imported, without importing it")
+		commandFlags.BoolVar(&opts.Welcome, "welcome", false, "Email new users a temporary password")
+		commandFlags.BoolVar(&opts.Reset, "reset", false, "Reset the passwords of existing users and email them the new ones")
+		format := commandFlags.String("format", "", "csv or jsonl; defaults to the file's extension")
+		_ = commandFlags.Parse(flag.Args()[1:])
+
+		if commandFlags.NArg() != 1 {
+			log.Fatal("Usage: import-users [-dry-run] [-welcome] [-reset] [-format csv|jsonl] file")
+		}
+
+		report, err := app.ImportUsersFromFile(os.Stderr, commandFlags.Arg(0), *format, opts)
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		switch {
+		case report.Failed > 0:
+			log.Fatalf("Nothing was imported: %d users have problems", report.Failed)
+		case !report.Imported:
+			log.Printf("Dry run: %d users would be created and %d updated", report.Created, report.Updated)
+		default:
+			log.Printf("Created %d users and updated %d", report.Created, report.Updated)
+		}
+
+		return
+	case "export-users":
+		commandFlags := flag.NewFlagSet("export-users", flag.ExitOnError)
+		format := commandFlags.String("format", "csv", "csv or jsonl")
+		_ = commandFlags.Parse(flag.Args()[1:])
+
+		out := os.Stdout
+
+		if commandFlags.NArg() > 0 {
+			out, err = os.Create(commandFlags.Arg(0))
+
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		err = app.ExportUsers(out, *format)
+
+		if closeErr := out.Close(); err == nil {
+			err = closeErr
+		}
+
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	default:
+		log.Fatalf("Unknown command %q; the commands are verify-audit-log, purge-deleted-users, rename-uploads, "+
+			"import-users and export-users", flag.Arg(0))
+	}
 
 	app.Session = web.GetSession()
 
+	go app.PurgeDeletedUsersEvery(context.Background(), *purgeInterval)
+
 	// print out a message
 	log.Println("Starting server on port 8080")
 
@@ -0,0 +1,6 @@
+-- Brings a database created from an earlier sql/users.sql up to date; fresh databases get these changes from
+-- sql/users.sql itself.
+
+ALTER TABLE public.user_images
+    ADD COLUMN blur_hash character varying(64),
+    ADD COLUMN dominant_color character varying(7);
@@ -0,0 +1,20 @@
+-- Existing images predate size tracking and count as empty until they are replaced.
+
+ALTER TABLE public.user_images
+    ADD COLUMN file_size bigint;
+
+ALTER TABLE public.users
+    ADD COLUMN quota_bytes bigint,
+    ADD COLUMN quota_images integer,
+    ADD COLUMN quota_uploads_per_hour integer;
+
+CREATE TABLE public.upload_events (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    file_size bigint,
+    created_at timestamp without time zone
+);
+
+CREATE INDEX upload_events_user_id_created_at_idx ON public.upload_events USING btree (user_id, created_at);
+
+CREATE INDEX user_images_user_id_created_at_idx ON public.user_images USING btree (user_id, created_at);
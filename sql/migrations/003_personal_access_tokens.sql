@@ -0,0 +1,15 @@
+-- Only a SHA-256 hash of each token is stored; scopes are separated by spaces.
+
+CREATE TABLE public.personal_access_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    name character varying(255),
+    token_hash character(64) UNIQUE,
+    scopes character varying(255),
+    expires_at timestamp without time zone,
+    last_used_at timestamp without time zone,
+    last_used_ip character varying(45),
+    created_at timestamp without time zone
+);
+
+CREATE INDEX personal_access_tokens_user_id_idx ON public.personal_access_tokens USING btree (user_id);
@@ -0,0 +1,15 @@
+-- Refresh tokens are stored hashed. Every token issued by rotating another shares its family_id, so the whole family
+-- can be revoked when a used token is presented again.
+
+CREATE TABLE public.refresh_tokens (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    family_id character varying(64),
+    token_hash character(64) UNIQUE,
+    expires_at timestamp without time zone,
+    used_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+CREATE INDEX refresh_tokens_family_id_idx ON public.refresh_tokens USING btree (family_id);
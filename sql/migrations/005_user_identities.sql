@@ -0,0 +1,11 @@
+-- Links users to accounts at external OpenID Connect providers. A provider identifies a person by its issuer and
+-- their subject, which unlike their email address never changes.
+
+CREATE TABLE public.user_identities (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    issuer character varying(255),
+    subject character varying(255),
+    created_at timestamp without time zone,
+    UNIQUE (issuer, subject)
+);
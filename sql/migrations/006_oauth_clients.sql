@@ -0,0 +1,25 @@
+-- Applications allowed to sign users in through our OpenID Connect provider, and the short lived authorization codes
+-- issued to them. Client secrets and codes are stored hashed; redirect_uris is space separated.
+
+CREATE TABLE public.oauth_clients (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    client_id character varying(64) UNIQUE,
+    client_secret_hash character(64),
+    name character varying(255),
+    redirect_uris text,
+    created_at timestamp without time zone
+);
+
+CREATE TABLE public.oauth_authorization_codes (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    client_id integer REFERENCES public.oauth_clients(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    code_hash character(64) UNIQUE,
+    redirect_uri text,
+    scope character varying(255),
+    nonce character varying(255),
+    code_challenge character varying(128),
+    expires_at timestamp without time zone,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
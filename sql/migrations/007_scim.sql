@@ -0,0 +1,5 @@
+-- Provisioning through SCIM: external_id is the identifier the provisioning system knows a user by, and deactivated
+-- users are kept but can no longer sign in.
+
+ALTER TABLE public.users ADD COLUMN external_id character varying(255);
+ALTER TABLE public.users ADD COLUMN deactivated_at timestamp without time zone;
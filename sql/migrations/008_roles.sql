@@ -0,0 +1,59 @@
+-- Role based access control. Permissions are granted to roles, and users are given any number of roles. Everyone
+-- gets the user role, and users with is_admin = 1 the admin role; is_admin is kept in step with the admin role so
+-- older clients which read it keep working.
+
+CREATE TABLE public.permissions (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(64) NOT NULL UNIQUE,
+    description character varying(255)
+);
+
+CREATE TABLE public.roles (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(64) NOT NULL UNIQUE,
+    description character varying(255),
+    created_at timestamp without time zone
+);
+
+CREATE TABLE public.role_permissions (
+    role_id integer NOT NULL REFERENCES public.roles(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES public.permissions(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE public.user_roles (
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES public.roles(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+CREATE INDEX user_roles_role_id_idx ON public.user_roles USING btree (role_id);
+
+INSERT INTO public.permissions (name, description) VALUES
+    ('users:read', 'View every user''s account'),
+    ('users:write', 'Create, change and deactivate users'),
+    ('users:delete', 'Delete users'),
+    ('roles:assign', 'Assign roles to users'),
+    ('quotas:manage', 'Change users'' upload quotas'),
+    ('clients:manage', 'Register applications that sign users in'),
+    ('images:moderate', 'Remove other users'' profile pictures'),
+    ('audit:read', 'Read the audit log');
+
+INSERT INTO public.roles (name, description, created_at) VALUES
+    ('admin', 'Can do everything', now()),
+    ('moderator', 'Looks after the profile pictures people upload', now()),
+    ('user', 'Manages their own account', now()),
+    ('auditor', 'Reviews accounts and the audit log', now());
+
+INSERT INTO public.role_permissions (role_id, permission_id)
+    SELECT r.id, p.id
+    FROM public.roles r, public.permissions p
+    WHERE r.name = 'admin'
+       OR (r.name = 'moderator' AND p.name IN ('users:read', 'images:moderate'))
+       OR (r.name = 'auditor' AND p.name IN ('users:read', 'audit:read'));
+
+INSERT INTO public.user_roles (user_id, role_id)
+    SELECT u.id, r.id FROM public.users u, public.roles r WHERE r.name = 'user';
+
+INSERT INTO public.user_roles (user_id, role_id)
+    SELECT u.id, r.id FROM public.users u, public.roles r WHERE r.name = 'admin' AND u.is_admin = 1;
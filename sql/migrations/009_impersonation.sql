@@ -0,0 +1,23 @@
+-- Administrators may sign in as another user. Every time they start or stop doing so is written to audit_events,
+-- which records who did what to whom; actor and target are kept as null if either user is later deleted.
+
+CREATE TABLE public.audit_events (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    actor_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    target_user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE SET NULL,
+    action character varying(64) NOT NULL,
+    ip character varying(64),
+    user_agent text,
+    details jsonb,
+    created_at timestamp without time zone
+);
+
+CREATE INDEX audit_events_target_user_id_idx ON public.audit_events USING btree (target_user_id);
+
+INSERT INTO public.permissions (name, description) VALUES
+    ('users:impersonate', 'Sign in as another user to see what they see');
+
+INSERT INTO public.role_permissions (role_id, permission_id)
+    SELECT r.id, p.id
+    FROM public.roles r, public.permissions p
+    WHERE r.name = 'admin' AND p.name = 'users:impersonate';
@@ -0,0 +1,27 @@
+-- Make the audit log tamper-evident. Each event stores the hash of the event before it, and its own hash covers
+-- that along with everything recorded about the event, so changing or removing one breaks the chain; a trigger
+-- refuses updates and deletes outright. The foreign keys are dropped so that deleting a user does not rewrite
+-- their events. Events written before this migration have no hash, and the chain starts after them.
+
+ALTER TABLE public.audit_events DROP CONSTRAINT audit_events_actor_id_fkey;
+ALTER TABLE public.audit_events DROP CONSTRAINT audit_events_target_user_id_fkey;
+
+ALTER TABLE public.audit_events ADD COLUMN details_hash character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE public.audit_events ADD COLUMN prev_hash character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE public.audit_events ADD COLUMN hash character varying(64) NOT NULL DEFAULT '';
+
+CREATE INDEX audit_events_actor_id_idx ON public.audit_events USING btree (actor_id);
+
+CREATE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
+
+CREATE TRIGGER audit_events_append_only BEFORE DELETE OR UPDATE ON public.audit_events
+    FOR EACH ROW EXECUTE FUNCTION public.audit_events_append_only();
+
+CREATE TRIGGER audit_events_no_truncate BEFORE TRUNCATE ON public.audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION public.audit_events_append_only();
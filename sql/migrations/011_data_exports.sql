@@ -0,0 +1,37 @@
+-- Subject access and erasure requests. Users can download a ZIP of their data, built in the background and kept
+-- until expires_at, and can erase their account. Erasing anonymizes the audit events about them: events are now
+-- hashed in version 2, which hashes the personal data separately so it can be removed without breaking the chain.
+-- Older events can only have their details removed.
+
+CREATE TABLE public.data_exports (
+    id integer NOT NULL GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    token_hash character varying(64) NOT NULL UNIQUE,
+    file_name character varying(255) NOT NULL DEFAULT '',
+    status character varying(16) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    created_at timestamp without time zone,
+    completed_at timestamp without time zone
+);
+
+CREATE INDEX data_exports_user_id_idx ON public.data_exports USING btree (user_id);
+
+ALTER TABLE public.audit_events ADD COLUMN anonymized_at timestamp without time zone;
+ALTER TABLE public.audit_events ADD COLUMN personal_hash character varying(64) NOT NULL DEFAULT '';
+ALTER TABLE public.audit_events ADD COLUMN hash_version smallint NOT NULL DEFAULT 1;
+
+CREATE OR REPLACE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    -- the only change allowed is anonymizing an event, which leaves everything the chain covers alone
+    IF TG_OP = 'UPDATE' AND OLD.anonymized_at IS NULL AND NEW.anonymized_at IS NOT NULL
+        AND NEW.id = OLD.id AND NEW.action = OLD.action AND NEW.created_at IS NOT DISTINCT FROM OLD.created_at
+        AND NEW.details_hash = OLD.details_hash AND NEW.personal_hash = OLD.personal_hash
+        AND NEW.hash_version = OLD.hash_version AND NEW.prev_hash = OLD.prev_hash AND NEW.hash = OLD.hash THEN
+        RETURN NEW;
+    END IF;
+
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
@@ -0,0 +1,6 @@
+-- Deleting a user marks them deleted rather than removing them, so an administrator can restore them until the
+-- retention window has passed and they are purged for good.
+
+ALTER TABLE public.users ADD COLUMN deleted_at timestamp without time zone;
+
+CREATE INDEX users_deleted_at_idx ON public.users USING btree (deleted_at) WHERE (deleted_at IS NOT NULL);
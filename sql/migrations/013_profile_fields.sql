@@ -0,0 +1,9 @@
+-- Users can now edit their own profile, which gains a display name, pronouns, job title, bio, timezone and locale.
+-- All are optional.
+
+ALTER TABLE public.users ADD COLUMN display_name character varying(255);
+ALTER TABLE public.users ADD COLUMN pronouns character varying(64);
+ALTER TABLE public.users ADD COLUMN job_title character varying(255);
+ALTER TABLE public.users ADD COLUMN bio text;
+ALTER TABLE public.users ADD COLUMN timezone character varying(64);
+ALTER TABLE public.users ADD COLUMN locale character varying(35);
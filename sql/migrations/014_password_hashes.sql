@@ -0,0 +1,4 @@
+-- Passwords can now be hashed with Argon2id, whose hashes are longer than bcrypt's 60 characters. Existing bcrypt
+-- hashes are replaced as their users sign in.
+
+ALTER TABLE public.users ALTER COLUMN password TYPE character varying(255);
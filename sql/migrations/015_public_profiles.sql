@@ -0,0 +1,8 @@
+-- Users get a handle, so their public profile can be found at /u/{handle}, and choose who can see that profile:
+-- anyone (public), signed in users (members), or no one but themselves and administrators (hidden). Handles are
+-- unique among users who have not been deleted.
+
+ALTER TABLE public.users ADD COLUMN handle character varying(32);
+ALTER TABLE public.users ADD COLUMN profile_visibility character varying(16) DEFAULT 'members'::character varying NOT NULL;
+
+CREATE UNIQUE INDEX users_handle_idx ON public.users USING btree (handle) WHERE (deleted_at IS NULL);
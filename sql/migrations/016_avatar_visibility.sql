@@ -0,0 +1,7 @@
+-- Users choose who can see their avatar: anyone (public), signed in users (members), or only themselves and
+-- administrators (private). Avatars that are not public are linked to with signed URLs that expire.
+
+ALTER TABLE public.users ADD COLUMN avatar_visibility character varying(16) DEFAULT 'public'::character varying NOT NULL;
+
+-- avatars are looked up by file name on every request, to find whose they are
+CREATE INDEX user_images_file_name_idx ON public.user_images USING btree (file_name);
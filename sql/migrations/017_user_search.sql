@@ -0,0 +1,17 @@
+-- Users are searched by name and email address, with full-text search over search_vector, where names count for
+-- more than email addresses, and trigram similarity over search_text, which catches typos and partial words. Email
+-- addresses are split into words at @ and dots, so that searching for either half finds them.
+
+CREATE EXTENSION IF NOT EXISTS pg_trgm WITH SCHEMA public;
+
+ALTER TABLE public.users ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('simple', coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(display_name, '')), 'A') ||
+    setweight(to_tsvector('simple', translate(coalesce(email, ''), '@.', '  ')), 'B')
+) STORED;
+
+ALTER TABLE public.users ADD COLUMN search_text text GENERATED ALWAYS AS (
+    lower(coalesce(first_name, '') || ' ' || coalesce(last_name, '') || ' ' || coalesce(display_name, '') || ' ' || coalesce(email, ''))
+) STORED;
+
+CREATE INDEX users_search_text_idx ON public.users USING gin (search_text public.gin_trgm_ops);
+CREATE INDEX users_search_vector_idx ON public.users USING gin (search_vector);
@@ -0,0 +1,4 @@
+-- Uploads are stored under random names, so that two users' files can never collide. The name a file was uploaded
+-- under is kept for reference only; images stored before this have none.
+
+ALTER TABLE public.user_images ADD COLUMN original_file_name character varying(255);
@@ -0,0 +1,10 @@
+-- Avatars are looked up by file name alone, so no two images may share one. Images stored before uploads were given
+-- random names can: run the rename-uploads command first, which gives each of them a copy of its file under a name of
+-- its own. This finds any that are left:
+--
+--   SELECT file_name, count(*) FROM public.user_images GROUP BY file_name HAVING count(*) > 1;
+
+DROP INDEX public.user_images_file_name_idx;
+
+ALTER TABLE ONLY public.user_images
+    ADD CONSTRAINT user_images_file_name_key UNIQUE (file_name);
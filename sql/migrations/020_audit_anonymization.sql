@@ -0,0 +1,33 @@
+-- Anonymizing an audit event removes all of its personal data, whichever version it was hashed with, and the trigger
+-- now only lets that data be removed, rather than changed, when an event is anonymized.
+
+CREATE OR REPLACE FUNCTION public.audit_events_append_only() RETURNS trigger
+    LANGUAGE plpgsql
+    AS $$
+BEGIN
+    -- the only change allowed is anonymizing an event: personal data may be removed, but not changed, and everything
+    -- else is left alone
+    IF TG_OP = 'UPDATE' AND OLD.anonymized_at IS NULL AND NEW.anonymized_at IS NOT NULL
+        AND NEW.id = OLD.id AND NEW.action = OLD.action AND NEW.created_at IS NOT DISTINCT FROM OLD.created_at
+        AND NEW.details_hash = OLD.details_hash AND NEW.personal_hash = OLD.personal_hash
+        AND NEW.hash_version = OLD.hash_version AND NEW.prev_hash = OLD.prev_hash AND NEW.hash = OLD.hash
+        AND (NEW.actor_id IS NULL OR NEW.actor_id = OLD.actor_id)
+        AND (NEW.target_user_id IS NULL OR NEW.target_user_id = OLD.target_user_id)
+        AND (NEW.ip IS NULL OR NEW.ip = OLD.ip)
+        AND (NEW.user_agent IS NULL OR NEW.user_agent = OLD.user_agent)
+        AND (NEW.details IS NULL OR NEW.details = OLD.details) THEN
+        RETURN NEW;
+    END IF;
+
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
+
+-- events anonymized before this kept some personal data, such as the other party's id, which the audit log verifier
+-- no longer accepts
+ALTER TABLE public.audit_events DISABLE TRIGGER audit_events_append_only;
+
+UPDATE public.audit_events SET actor_id = NULL, target_user_id = NULL, ip = NULL, user_agent = NULL, details = NULL
+    WHERE anonymized_at IS NOT NULL;
+
+ALTER TABLE public.audit_events ENABLE TRIGGER audit_events_append_only;
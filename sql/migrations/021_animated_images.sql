@@ -0,0 +1,4 @@
+-- Whether an image is animated is recorded when it is uploaded, so that avatars can be served without decoding every
+-- frame to find out. Images stored before this have none, and are checked when they are served.
+
+ALTER TABLE public.user_images ADD COLUMN animated boolean;